@@ -0,0 +1,44 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import "fmt"
+
+const (
+	LVMTypeThin  = "Thin"
+	LVMTypeThick = "Thick"
+)
+
+// ValidateLVMType checks the LVM spec does not mix the thin and thick settings: a thin volume cannot be contiguous,
+// and a thick volume cannot use thin pools. It is shared by the LocalStorageClass webhook and the CSI driver,
+// so both reject the same storage classes.
+func (s *LocalStorageClassLVMSpec) ValidateLVMType() error {
+	switch s.Type {
+	case LVMTypeThin:
+		if s.Thick != nil && s.Thick.Contiguous {
+			return fmt.Errorf("contiguous allocation (thick.contiguous) is only supported for %s volumes, but the LVM type is %s", LVMTypeThick, s.Type)
+		}
+	case LVMTypeThick:
+		for _, lvg := range s.LVMVolumeGroups {
+			if lvg.Thin != nil && lvg.Thin.PoolName != "" {
+				return fmt.Errorf("thin pool %s of LVMVolumeGroup %s is only supported for %s volumes, but the LVM type is %s", lvg.Thin.PoolName, lvg.Name, LVMTypeThin, s.Type)
+			}
+		}
+	}
+
+	return nil
+}
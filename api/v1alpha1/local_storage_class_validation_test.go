@@ -0,0 +1,70 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateLVMType(t *testing.T) {
+	thickLVGs := []LocalStorageClassLVG{{Name: "lvg-1"}}
+	thinLVGs := []LocalStorageClassLVG{{Name: "lvg-1", Thin: &LocalStorageClassLVMThinPoolSpec{PoolName: "pool-1"}}}
+
+	for _, tc := range []struct {
+		name string
+		spec LocalStorageClassLVMSpec
+		err  string
+	}{
+		{
+			name: "thick",
+			spec: LocalStorageClassLVMSpec{Type: LVMTypeThick, LVMVolumeGroups: thickLVGs},
+		},
+		{
+			name: "thick_contiguous",
+			spec: LocalStorageClassLVMSpec{Type: LVMTypeThick, LVMVolumeGroups: thickLVGs, Thick: &LocalStorageClassLVMThickSpec{Contiguous: true}},
+		},
+		{
+			name: "thin",
+			spec: LocalStorageClassLVMSpec{Type: LVMTypeThin, LVMVolumeGroups: thinLVGs},
+		},
+		{
+			name: "thin_not_contiguous",
+			spec: LocalStorageClassLVMSpec{Type: LVMTypeThin, LVMVolumeGroups: thinLVGs, Thick: &LocalStorageClassLVMThickSpec{}},
+		},
+		{
+			name: "thin_contiguous_is_contradictory",
+			spec: LocalStorageClassLVMSpec{Type: LVMTypeThin, LVMVolumeGroups: thinLVGs, Thick: &LocalStorageClassLVMThickSpec{Contiguous: true}},
+			err:  "contiguous allocation (thick.contiguous) is only supported for Thick volumes",
+		},
+		{
+			name: "thick_with_thin_pool_is_contradictory",
+			spec: LocalStorageClassLVMSpec{Type: LVMTypeThick, LVMVolumeGroups: thinLVGs},
+			err:  "thin pool pool-1 of LVMVolumeGroup lvg-1 is only supported for Thin volumes",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.spec.ValidateLVMType()
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Fatalf("expected error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
@@ -19,6 +19,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
@@ -39,6 +40,9 @@ import (
 	"sds-local-volume-csi/driver"
 	"sds-local-volume-csi/pkg/kubutils"
 	"sds-local-volume-csi/pkg/logger"
+	"sds-local-volume-csi/pkg/lvgcache"
+	"sds-local-volume-csi/pkg/tracing"
+	"sds-local-volume-csi/pkg/utils"
 )
 
 var (
@@ -76,6 +80,12 @@ func main() {
 	}
 
 	log.Info("version = ", cfgParams.Version)
+	log.Info("[main] effective configuration", cfgParams.KeysAndValues()...)
+
+	utils.KubernetesAPIRequestLimit = cfgParams.APIRequestLimit
+	utils.KubernetesAPIRequestTimeout = cfgParams.APIRequestTimeout
+	utils.LVGListPageSize = cfgParams.LVGListPageSize
+	log.Info(fmt.Sprintf("[main] Kubernetes API request limit: %d, timeout: %s", utils.KubernetesAPIRequestLimit, utils.KubernetesAPIRequestTimeout))
 
 	kConfig, err := kubutils.KubernetesDefaultConfigCreate()
 	if err != nil {
@@ -107,7 +117,113 @@ func main() {
 		}
 	}()
 
-	drv, err := driver.NewDriver(cfgParams.CsiAddress, cfgParams.DriverName, cfgParams.Address, &cfgParams.NodeName, log, cl)
+	tp, shutdownTracing, err := tracing.NewTracerProvider(ctx, cfgParams.OTelExporterEndpoint, cfgParams.DriverName)
+	if err != nil {
+		log.Error(err, "[main] unable to create the tracer provider")
+		os.Exit(1)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Error(err, "[main] unable to shutdown the tracer provider")
+		}
+	}()
+
+	var lvgLister utils.LVGLister = utils.ClientLVGLister{Client: cl}
+	if cfgParams.LVGCacheResyncPeriod > 0 {
+		lvgCache, err := lvgcache.Start(ctx, kConfig, scheme, cfgParams.LVGCacheResyncPeriod, log)
+		if err != nil {
+			log.Error(err, "[main] unable to start the LVMVolumeGroup cache")
+			os.Exit(1)
+		}
+		lvgLister = lvgCache
+		log.Info("[main] LVMVolumeGroup cache has been started")
+	}
+
+	nodeSelector, err := utils.NewNodeSelector(cfgParams.NodeSelectionStrategy)
+	if err != nil {
+		log.Error(err, "[main] invalid node selection strategy")
+		os.Exit(1)
+	}
+	log.Info(fmt.Sprintf("[main] node selection strategy: %s", nodeSelector.Name()))
+
+	var deviceProber utils.DeviceProber
+	if cfgParams.DeviceReadinessCommand != "" {
+		deviceProber = utils.NewCommandDeviceProber(cfgParams.DeviceReadinessCommand)
+	}
+
+	var blockFSProber utils.BlockFSProber
+	if cfgParams.BlockFSUsageProbe {
+		blockFSProber = utils.NewSuperblockFSProber()
+	}
+
+	var auditLog io.Writer
+	switch cfgParams.AuditLog {
+	case "":
+	case "-":
+		auditLog = os.Stdout
+	default:
+		auditFile, err := os.OpenFile(cfgParams.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			log.Error(err, "[main] unable to open the audit log")
+			os.Exit(1)
+		}
+		defer auditFile.Close()
+		auditLog = auditFile
+		log.Info(fmt.Sprintf("[main] audit log: %s", cfgParams.AuditLog))
+	}
+
+	drv, err := driver.NewDriver(
+		cfgParams.CsiAddress,
+		cfgParams.DriverName,
+		cfgParams.Address,
+		&cfgParams.NodeName,
+		log,
+		cl,
+		driver.WithAsyncCreateVolume(cfgParams.AsyncCreateVolume),
+		driver.WithStrictThinSizeCheck(cfgParams.StrictThinSizeCheck),
+		driver.WithIOThrottler(utils.NewCgroupIOThrottler(cfgParams.IOCgroupPath)),
+		driver.WithExcludeNodeTaint(cfgParams.ExcludeNodeTaint),
+		driver.WithTracerProvider(tp),
+		driver.WithDevPathBase(cfgParams.DevPathBase),
+		driver.WithMaxConcurrentFormats(cfgParams.MaxConcurrentFormats),
+		driver.WithMaxConcurrentVGOperations(cfgParams.MaxConcurrentVGOps),
+		driver.WithListVolumesLayout(cfgParams.ListVolumesLayout),
+		driver.WithLLVFinalizer(cfgParams.LLVFinalizer),
+		driver.WithMountTimeout(cfgParams.MountTimeout),
+		driver.WithUnmountTimeout(cfgParams.UnmountTimeout, cfgParams.LazyUnmount),
+		driver.WithEphemeralDeleteGracePeriod(cfgParams.EphemeralDeleteGrace),
+		driver.WithRegistrationTimeout(cfgParams.RegistrationTimeout),
+		driver.WithShutdownTimeout(cfgParams.ShutdownTimeout),
+		driver.WithTopologyKey(cfgParams.TopologyKey),
+		driver.WithLVGLister(lvgLister),
+		driver.WithNodeSelector(nodeSelector),
+		driver.WithMinVolumeSize(cfgParams.MinVolumeSize.Value(), cfgParams.MinVolumeSizePolicy),
+		driver.WithMaxVolumesPerNode(cfgParams.MaxVolumesPerNode),
+		driver.WithInodeFreeThreshold(cfgParams.InodeFreeThreshold),
+		driver.WithDynamicMaxVolumesPerNode(cfgParams.MaxVolumesAverageSize.Value()),
+		driver.WithStaleMountsAction(cfgParams.StaleMountsAction),
+		driver.WithGRPCReflection(cfgParams.GRPCReflection),
+		driver.WithProvisionFailureCooldown(cfgParams.ProvisionCooldown),
+		driver.WithLVGStatusTimeout(cfgParams.LVGStatusTimeout),
+		driver.WithLVNameTemplate(cfgParams.LVNameTemplate),
+		driver.WithForeignMountAction(cfgParams.ForeignMountAction),
+		driver.WithFreezeAgent(cfgParams.FreezeAgent),
+		driver.WithNodeStorageClassLabels(cfgParams.StorageClassLabels),
+		driver.WithAuditLog(auditLog),
+		driver.WithDeviceReadinessProbe(deviceProber, cfgParams.DeviceReadinessAttempts, cfgParams.DeviceReadinessInterval),
+		driver.WithBlockFSUsageProbe(blockFSProber),
+		driver.WithResizeToolPaths(utils.ResizeToolPaths{
+			utils.Resize2fsTool: cfgParams.Resize2fsPath,
+			utils.XFSGrowfsTool: cfgParams.XFSGrowfsPath,
+			utils.BtrfsTool:     cfgParams.BtrfsPath,
+		}),
+		driver.WithRequiredProvisionerSecrets(utils.SplitCommaSeparated(cfgParams.RequiredSecrets)),
+		driver.WithMountRetryPolicy(utils.MountRetryPolicy{
+			Attempts:        cfgParams.MountRetryAttempts,
+			Interval:        utils.DefaultMountRetryInterval,
+			RetryableErrors: utils.ParseRetryableMountErrors(cfgParams.MountRetryErrors),
+		}),
+	)
 	if err != nil {
 		log.Error(err, "[main] create NewDriver")
 	}
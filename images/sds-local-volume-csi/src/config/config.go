@@ -17,12 +17,22 @@ limitations under the License.
 package config
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
 
 	"sds-local-volume-csi/driver"
+	"sds-local-volume-csi/internal"
 	"sds-local-volume-csi/pkg/logger"
+	"sds-local-volume-csi/pkg/utils"
 )
 
 const (
@@ -30,49 +40,294 @@ const (
 	LogLevel                             = "LOG_LEVEL"
 	DefaultHealthProbeBindAddressEnvName = "HEALTH_PROBE_BIND_ADDRESS"
 	DefaultHealthProbeBindAddress        = ":8081"
+	KubernetesAPIRequestLimit            = "KUBERNETES_API_REQUEST_LIMIT"
+	KubernetesAPIRequestTimeout          = "KUBERNETES_API_REQUEST_TIMEOUT"
 )
 
 type Options struct {
-	NodeName               string
-	Version                string
-	Loglevel               logger.Verbosity
-	HealthProbeBindAddress string
-	CsiAddress             string
-	DriverName             string
-	Address                string
+	NodeName                string
+	Version                 string
+	Loglevel                logger.Verbosity
+	HealthProbeBindAddress  string
+	CsiAddress              string
+	DriverName              string
+	Address                 string
+	AsyncCreateVolume       bool
+	IOCgroupPath            string
+	ExcludeNodeTaint        string
+	OTelExporterEndpoint    string
+	DevPathBase             string
+	MaxConcurrentFormats    int
+	MaxConcurrentVGOps      int
+	BlockFSUsageProbe       bool
+	MountRetryAttempts      int
+	MountRetryErrors        string
+	ListVolumesLayout       bool
+	LLVFinalizer            string
+	MountTimeout            time.Duration
+	RequiredSecrets         string
+	TopologyKey             string
+	LVGCacheResyncPeriod    time.Duration
+	MinVolumeSize           resource.Quantity
+	MinVolumeSizePolicy     string
+	MaxVolumesPerNode       int64
+	InodeFreeThreshold      int64
+	MaxVolumesAverageSize   resource.Quantity
+	StaleMountsAction       string
+	NodeSelectionStrategy   string
+	GRPCReflection          bool
+	ProvisionCooldown       time.Duration
+	Resize2fsPath           string
+	XFSGrowfsPath           string
+	BtrfsPath               string
+	UnmountTimeout          time.Duration
+	EphemeralDeleteGrace    time.Duration
+	LazyUnmount             bool
+	RegistrationTimeout     time.Duration
+	APIRequestLimit         int
+	LVGStatusTimeout        time.Duration
+	LVNameTemplate          string
+	ForeignMountAction      string
+	DeviceReadinessCommand  string
+	DeviceReadinessAttempts int
+	DeviceReadinessInterval time.Duration
+	FreezeAgent             bool
+	APIRequestTimeout       time.Duration
+	ShutdownTimeout         time.Duration
+	StrictThinSizeCheck     bool
+	LVGListPageSize         int64
+	StorageClassLabels      time.Duration
+	AuditLog                string
 }
 
+// NewConfig reads the options from the command line flags and the env variables and validates them.
 func NewConfig() (*Options, error) {
+	return parseConfig(flag.NewFlagSet(os.Args[0], flag.ExitOnError), os.Args[1:], os.Getenv)
+}
+
+func parseConfig(fl *flag.FlagSet, args []string, getenv func(string) string) (*Options, error) {
 	var opts Options
 
-	opts.NodeName = os.Getenv(NodeName)
+	opts.NodeName = getenv(NodeName)
 	if opts.NodeName == "" {
 		return nil, fmt.Errorf("[NewConfig] required %s env variable is not specified", NodeName)
 	}
 
-	opts.HealthProbeBindAddress = os.Getenv(DefaultHealthProbeBindAddressEnvName)
+	opts.HealthProbeBindAddress = getenv(DefaultHealthProbeBindAddressEnvName)
 	if opts.HealthProbeBindAddress == "" {
 		opts.HealthProbeBindAddress = DefaultHealthProbeBindAddress
 	}
 
-	loglevel := os.Getenv(LogLevel)
+	loglevel := getenv(LogLevel)
 	if loglevel == "" {
 		opts.Loglevel = logger.DebugLevel
 	} else {
 		opts.Loglevel = logger.Verbosity(loglevel)
 	}
 
+	var err error
+	opts.APIRequestLimit, opts.APIRequestTimeout, err = utils.ParseKubernetesAPIRetries(getenv(KubernetesAPIRequestLimit), getenv(KubernetesAPIRequestTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("[NewConfig] invalid %s or %s env variable: %w", KubernetesAPIRequestLimit, KubernetesAPIRequestTimeout, err)
+	}
+
 	opts.Version = "dev"
 
-	fl := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	fl.StringVar(&opts.CsiAddress, "csi-address", "unix:///var/lib/kubelet/plugins/"+driver.DefaultDriverName+"/csi.sock", "CSI address")
 	fl.StringVar(&opts.DriverName, "driver-name", driver.DefaultDriverName, "Name for the driver")
 	fl.StringVar(&opts.Address, "address", driver.DefaultAddress, "Address to serve on")
+	fl.StringVar(&opts.TopologyKey, "topology-key", internal.TopologyKey, "Key of the node topology segment. Must be the same for the controller and the node plugins")
+	fl.StringVar(&opts.DevPathBase, "dev-path-base", driver.DefaultDevPathBase, "Directory containing the LVM device nodes")
+	fl.StringVar(&opts.IOCgroupPath, "io-cgroup-path", utils.DefaultIOCgroupPath, "cgroup v2 directory used to apply per-volume IO limits")
+	fl.StringVar(&opts.ExcludeNodeTaint, "exclude-node-taint", "", "Taint key of the nodes excluded from the volume placement")
+	fl.StringVar(&opts.OTelExporterEndpoint, "otel-exporter-endpoint", "", "OTLP gRPC endpoint to export the CSI operation spans to (e.g. http://otel-collector:4317). Tracing is disabled if empty")
+	fl.IntVar(&opts.MaxConcurrentFormats, "max-concurrent-formats", 0, "Maximum number of devices formatted concurrently on the node. Zero means no limit")
+	fl.IntVar(&opts.MaxConcurrentVGOps, "max-concurrent-vg-operations", utils.DefaultVGConcurrency, fmt.Sprintf("Maximum number of LV creations and deletions run concurrently on the same LVMVolumeGroup. Zero means no limit. "+
+		"A creation holds its slot until the node agent picks the LVMLogicalVolume up, for at most %s, so an LVMLogicalVolume stuck in Pending "+
+		"delays the other creations and deletions on the LVMVolumeGroup by as much", utils.DefaultVGSlotHoldTimeout))
+	fl.IntVar(&opts.MountRetryAttempts, "mount-retry-attempts", utils.DefaultMountRetryAttempts, "Number of attempts to mount a volume failing with a retryable error")
+	fl.StringVar(&opts.MountRetryErrors, "mount-retry-errors", strings.Join(utils.DefaultRetryableMountErrors, ","), "Comma-separated errno names and case-insensitive substrings of the mount errors considered transient")
+	fl.BoolVar(&opts.BlockFSUsageProbe, "block-fs-usage-probe", false, "Report the usage of the filesystem found inside the block volumes in the NodeGetVolumeStats volume condition")
+	fl.BoolVar(&opts.ListVolumesLayout, "list-volumes-layout", false, "Report the LV segment layout in the ListVolumes entries")
+	fl.StringVar(&opts.LLVFinalizer, "llv-finalizer", utils.SDSLocalVolumeCSIFinalizer, "Finalizer protecting the LVMLogicalVolumes created by the driver")
+	fl.DurationVar(&opts.MountTimeout, "mount-timeout", 0, "Timeout of the mount step of NodePublishVolume. Zero means the mount is bounded by the request deadline only")
+	fl.StringVar(&opts.RequiredSecrets, "required-provisioner-secrets", "", "Comma-separated keys CreateVolume requires in the provisioner secrets. Secrets are ignored if empty")
+	fl.Int64Var(&opts.LVGListPageSize, "lvg-list-page-size", utils.DefaultLVGListPageSize, "Number of the LVMVolumeGroups read from the API server per list request. Zero reads them in a single request")
+	fl.DurationVar(&opts.LVGCacheResyncPeriod, "lvg-cache-resync-period", 0, "Resync period of the LVMVolumeGroup cache the volume placement reads from. Zero disables the cache, so the LVMVolumeGroups are read from the API server on every CreateVolume")
+	minVolumeSize := fl.String("min-volume-size", utils.DefaultMinVolumeSize.String(), "Minimum size of the created volumes. Zero disables the floor")
+	fl.StringVar(&opts.MinVolumeSizePolicy, "min-volume-size-policy", utils.MinVolumeSizePolicyRoundUp, "Policy applied to the requests below the minimum volume size: round-up or reject")
+	fl.Int64Var(&opts.MaxVolumesPerNode, "max-volumes-per-node", 0, "Maximum number of volumes on the node reported to the kubelet, also the ceiling of the dynamic limit. Zero means no limit")
+	maxVolumesAverageSize := fl.String("max-volumes-average-volume-size", "0", "Assumed average volume size the node LVG capacity is divided by to compute the maximum number of volumes on the node. Zero disables the dynamic limit")
+	fl.StringVar(&opts.StaleMountsAction, "stale-mounts", "", "Action on the mounts of the volumes whose LVMLogicalVolumes no longer exist found by the node plugin on the startup: report or unmount. The scan is disabled if empty")
+	fl.StringVar(&opts.NodeSelectionStrategy, "node-selection-strategy", utils.NodeSelectorMostFree, "Strategy choosing the node to place a new volume on: most-free to spread the volumes or bin-pack to consolidate them")
+	fl.BoolVar(&opts.GRPCReflection, "grpc-reflection", false, "Register the gRPC server reflection service on the CSI socket for debugging with grpcurl")
+	fl.DurationVar(&opts.ProvisionCooldown, "provision-failure-cooldown", 0, "Time CreateVolume holds back the placements of a storage class on a node after a provision there failed. Zero disables the cooldown")
+	fl.StringVar(&opts.Resize2fsPath, "resize2fs-path", "", "Path of resize2fs growing the ext filesystems. It is looked up in PATH if empty")
+	fl.StringVar(&opts.XFSGrowfsPath, "xfs-growfs-path", "", "Path of xfs_growfs growing the xfs filesystems. It is looked up in PATH if empty")
+	fl.StringVar(&opts.BtrfsPath, "btrfs-path", "", "Path of btrfs growing the btrfs filesystems. It is looked up in PATH if empty")
+	fl.DurationVar(&opts.UnmountTimeout, "unmount-timeout", 0, "Timeout of the unmount step of NodeUnpublishVolume. Zero means the unmount is not bounded")
+	fl.DurationVar(&opts.EphemeralDeleteGrace, "ephemeral-delete-grace-period", 0, "Delay of the LVMLogicalVolume deletion of an ephemeral inline volume after its NodeUnpublishVolume. Zero deletes it at once")
+	fl.BoolVar(&opts.LazyUnmount, "lazy-unmount-on-timeout", false, "Detach the target with a lazy unmount (umount -l) when the unmount of NodeUnpublishVolume times out")
+	fl.DurationVar(&opts.RegistrationTimeout, "registration-timeout", 0, "Time the node plugin waits for the kubelet to register it, logging the progress. The registration is retried by the node-driver-registrar. Zero disables the wait")
+	fl.DurationVar(&opts.LVGStatusTimeout, "lvg-status-timeout", 0, "Time CreateVolume waits for the status of the storage class LVMVolumeGroups to be populated. Zero fails CreateVolume at once")
+	fl.StringVar(&opts.LVNameTemplate, "lv-name-template", "", "Template of the LV names on the nodes, e.g. ${pvc.namespace}-${pv.name}. It must contain ${pv.name}. Empty names the LVs after the volume IDs")
+	fl.Int64Var(&opts.InodeFreeThreshold, "inode-free-threshold-percent", 5, "Free inodes percent of a filesystem volume below which NodeGetVolumeStats reports it abnormal. Zero disables the check")
+	fl.StringVar(&opts.ForeignMountAction, "foreign-mount-action", driver.ForeignMountFail, "Action of NodePublishVolume on the target already mounted from a foreign device: fail with AlreadyExists or force to unmount it and mount the volume")
+	fl.StringVar(&opts.DeviceReadinessCommand, "device-readiness-command", "", "Shell command probing the device gets as $1 before NodePublishVolume mounts it, failing while the device is not ready, e.g. test \"$(blockdev --getsize64 \"$1\")\" -gt 0. The probe is disabled if empty")
+	fl.IntVar(&opts.DeviceReadinessAttempts, "device-readiness-attempts", utils.DefaultDeviceProbeAttempts, "Number of attempts of the device readiness probe")
+	fl.DurationVar(&opts.DeviceReadinessInterval, "device-readiness-interval", utils.DefaultDeviceProbeInterval, "Interval between the attempts of the device readiness probe")
+	fl.BoolVar(&opts.FreezeAgent, "fs-freeze-agent", false, "Serve the filesystem freeze requests of CreateSnapshot for the volumes mounted on the node. Enable on the node plugins only")
+	fl.DurationVar(&opts.StorageClassLabels, "node-storage-class-labels-interval", 0, "Interval the node plugin labels the Node with the storage classes listing an LVMVolumeGroup of the node at. Zero disables the labels. Enable on the node plugins only")
+	fl.StringVar(&opts.AuditLog, "audit-log", "", "Path of the file the audit records of the volume lifecycle calls are appended to as JSON lines, or - for stdout. The audit log is disabled if empty")
+	fl.DurationVar(&opts.ShutdownTimeout, "shutdown-timeout", driver.DefaultShutdownTimeout, "Time the plugin waits on shutdown for the in-flight node operations to finish, refusing the new publish requests. Zero means no limit")
+	fl.BoolVar(&opts.StrictThinSizeCheck, "strict-thin-size-check", false, "Wait for the actual size of the thin volumes to match the requested size on CreateVolume instead of their Created phase only")
+	fl.BoolVar(&opts.AsyncCreateVolume, "async-create-volume", false, "Return from CreateVolume without waiting for the LVMLogicalVolume to be created")
 
-	err := fl.Parse(os.Args[1:])
+	err = fl.Parse(args)
 	if err != nil {
 		return &opts, err
 	}
 
+	opts.MinVolumeSize, err = resource.ParseQuantity(*minVolumeSize)
+	if err != nil {
+		return &opts, fmt.Errorf("[NewConfig] invalid min-volume-size: %w", err)
+	}
+
+	opts.MaxVolumesAverageSize, err = resource.ParseQuantity(*maxVolumesAverageSize)
+	if err != nil {
+		return &opts, fmt.Errorf("[NewConfig] invalid max-volumes-average-volume-size: %w", err)
+	}
+
+	if err := opts.Validate(); err != nil {
+		return &opts, fmt.Errorf("[NewConfig] %w", err)
+	}
+
 	return &opts, nil
 }
+
+// Validate checks the values of the options and their combinations.
+func (o *Options) Validate() error {
+	if level, err := strconv.Atoi(string(o.Loglevel)); err != nil || level < 0 || level > 4 {
+		return fmt.Errorf("invalid %s %q: must be an integer from %s to %s", LogLevel, o.Loglevel, logger.ErrorLevel, logger.TraceLevel)
+	}
+
+	if o.DriverName == "" {
+		return errors.New("invalid driver-name: must not be empty")
+	}
+
+	if o.TopologyKey == "" {
+		return errors.New("invalid topology-key: must not be empty")
+	}
+
+	if o.MountRetryAttempts < 1 {
+		return fmt.Errorf("invalid mount-retry-attempts %d: must be at least 1", o.MountRetryAttempts)
+	}
+
+	if o.DeviceReadinessAttempts < 1 {
+		return fmt.Errorf("invalid device-readiness-attempts %d: must be at least 1", o.DeviceReadinessAttempts)
+	}
+
+	if o.MaxConcurrentFormats < 0 {
+		return fmt.Errorf("invalid max-concurrent-formats %d: must not be negative", o.MaxConcurrentFormats)
+	}
+
+	if o.MaxConcurrentVGOps < 0 {
+		return fmt.Errorf("invalid max-concurrent-vg-operations %d: must not be negative", o.MaxConcurrentVGOps)
+	}
+
+	if o.LVGListPageSize < 0 {
+		return fmt.Errorf("invalid lvg-list-page-size %d: must not be negative", o.LVGListPageSize)
+	}
+
+	if o.MaxVolumesPerNode < 0 {
+		return fmt.Errorf("invalid max-volumes-per-node %d: must not be negative", o.MaxVolumesPerNode)
+	}
+
+	if o.InodeFreeThreshold < 0 || o.InodeFreeThreshold > 100 {
+		return fmt.Errorf("invalid inode-free-threshold-percent %d: must be from 0 to 100", o.InodeFreeThreshold)
+	}
+
+	if o.MinVolumeSize.Sign() < 0 {
+		return fmt.Errorf("invalid min-volume-size %s: must not be negative", o.MinVolumeSize.String())
+	}
+
+	if o.MaxVolumesAverageSize.Sign() < 0 {
+		return fmt.Errorf("invalid max-volumes-average-volume-size %s: must not be negative", o.MaxVolumesAverageSize.String())
+	}
+
+	for name, d := range map[string]time.Duration{
+		"mount-timeout":                      o.MountTimeout,
+		"unmount-timeout":                    o.UnmountTimeout,
+		"ephemeral-delete-grace-period":      o.EphemeralDeleteGrace,
+		"registration-timeout":               o.RegistrationTimeout,
+		"lvg-cache-resync-period":            o.LVGCacheResyncPeriod,
+		"provision-failure-cooldown":         o.ProvisionCooldown,
+		"lvg-status-timeout":                 o.LVGStatusTimeout,
+		"device-readiness-interval":          o.DeviceReadinessInterval,
+		"shutdown-timeout":                   o.ShutdownTimeout,
+		"node-storage-class-labels-interval": o.StorageClassLabels,
+	} {
+		if d < 0 {
+			return fmt.Errorf("invalid %s %s: must not be negative", name, d)
+		}
+	}
+
+	if o.LazyUnmount && o.UnmountTimeout == 0 {
+		return errors.New("invalid lazy-unmount-on-timeout: requires a non-zero unmount-timeout")
+	}
+
+	if err := driver.ValidateStaleMountsAction(o.StaleMountsAction); err != nil {
+		return fmt.Errorf("invalid stale-mounts: %w", err)
+	}
+
+	if err := driver.ValidateForeignMountAction(o.ForeignMountAction); err != nil {
+		return fmt.Errorf("invalid foreign-mount-action: %w", err)
+	}
+
+	if _, err := utils.NewNodeSelector(o.NodeSelectionStrategy); err != nil {
+		return fmt.Errorf("invalid node-selection-strategy: %w", err)
+	}
+
+	if err := utils.ValidateMinVolumeSizePolicy(o.MinVolumeSizePolicy); err != nil {
+		return fmt.Errorf("invalid min-volume-size-policy: %w", err)
+	}
+
+	if err := utils.ValidateLVNameTemplate(o.LVNameTemplate); err != nil {
+		return fmt.Errorf("invalid lv-name-template: %w", err)
+	}
+
+	return nil
+}
+
+// redactedURLOptions are the options holding the URLs whose credentials are not logged.
+var redactedURLOptions = map[string]struct{}{
+	"OTelExporterEndpoint": {},
+}
+
+// KeysAndValues returns the options as the key-value pairs of a structured log line, the option
+// names being the keys. The credentials of the URLs are redacted.
+func (o *Options) KeysAndValues() []interface{} {
+	v := reflect.ValueOf(o).Elem()
+	keysAndValues := make([]interface{}, 0, 2*v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		var value interface{} = v.Field(i).Interface()
+		if stringer, ok := v.Field(i).Addr().Interface().(fmt.Stringer); ok {
+			value = stringer.String()
+		}
+		if _, ok := redactedURLOptions[name]; ok {
+			value = redactURL(v.Field(i).String())
+		}
+		keysAndValues = append(keysAndValues, name, value)
+	}
+	return keysAndValues
+}
+
+// redactURL replaces the password of the URL with xxxxx. The values that are not URLs are returned as is.
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	return u.Redacted()
+}
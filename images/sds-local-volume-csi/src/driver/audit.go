@@ -0,0 +1,156 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"sds-local-volume-csi/internal"
+)
+
+// auditedOperations are the volume lifecycle methods recorded in the audit log by auditInterceptor.
+var auditedOperations = map[string]string{
+	"/csi.v1.Controller/CreateVolume":           "create",
+	"/csi.v1.Controller/DeleteVolume":           "delete",
+	"/csi.v1.Controller/ControllerExpandVolume": "expand",
+	"/csi.v1.Node/NodeExpandVolume":             "node-expand",
+	"/csi.v1.Node/NodeStageVolume":              "stage",
+	"/csi.v1.Node/NodeUnstageVolume":            "unstage",
+	"/csi.v1.Node/NodePublishVolume":            "publish",
+	"/csi.v1.Node/NodeUnpublishVolume":          "unpublish",
+}
+
+// auditRecord is a line of the audit log. The requesting identity is the PVC and PV of the external-provisioner
+// run with --extra-create-metadata and the pod of the CSIDriver with podInfoOnMount, whichever the request carries.
+// The record is built from the listed fields only, so the secrets of the requests never get into it.
+type auditRecord struct {
+	Time           time.Time `json:"time"`
+	Operation      string    `json:"operation"`
+	Node           string    `json:"node"`
+	VolumeID       string    `json:"volumeID"`
+	SizeBytes      int64     `json:"sizeBytes,omitempty"`
+	TargetPath     string    `json:"targetPath,omitempty"`
+	PVC            string    `json:"pvc,omitempty"`
+	PV             string    `json:"pv,omitempty"`
+	Pod            string    `json:"pod,omitempty"`
+	ServiceAccount string    `json:"serviceAccount,omitempty"`
+	Result         string    `json:"result"`
+	Error          string    `json:"error,omitempty"`
+	DurationMs     int64     `json:"durationMs"`
+}
+
+// auditInterceptor writes a JSON line per volume lifecycle call to the audit log once the call returns,
+// including the calls refused on shutdown.
+func (d *Driver) auditInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	operation, ok := auditedOperations[info.FullMethod]
+	if d.auditLog == nil || !ok {
+		return handler(ctx, req)
+	}
+
+	start := time.Now()
+	resp, err := handler(ctx, req)
+
+	record := newAuditRecord(operation, req, resp)
+	record.Time = start.UTC()
+	record.Node = d.hostID
+	record.Result = status.Code(err).String()
+	if err != nil {
+		record.Error = status.Convert(err).Message()
+	}
+	record.DurationMs = time.Since(start).Milliseconds()
+	d.writeAuditRecord(record)
+
+	return resp, err
+}
+
+// newAuditRecord returns the record of the request with the what and who fields filled in.
+func newAuditRecord(operation string, req, resp interface{}) auditRecord {
+	record := auditRecord{Operation: operation}
+
+	switch r := req.(type) {
+	case *csi.CreateVolumeRequest:
+		record.VolumeID = r.GetName()
+		record.SizeBytes = r.GetCapacityRange().GetRequiredBytes()
+		if created, ok := resp.(*csi.CreateVolumeResponse); ok && created.GetVolume().GetCapacityBytes() > 0 {
+			record.SizeBytes = created.GetVolume().GetCapacityBytes()
+		}
+		record.setIdentity(r.GetParameters())
+	case *csi.DeleteVolumeRequest:
+		record.VolumeID = r.GetVolumeId()
+	case *csi.ControllerExpandVolumeRequest:
+		record.VolumeID = r.GetVolumeId()
+		record.SizeBytes = r.GetCapacityRange().GetRequiredBytes()
+		if expanded, ok := resp.(*csi.ControllerExpandVolumeResponse); ok && expanded.GetCapacityBytes() > 0 {
+			record.SizeBytes = expanded.GetCapacityBytes()
+		}
+	case *csi.NodeExpandVolumeRequest:
+		record.VolumeID = r.GetVolumeId()
+		record.SizeBytes = r.GetCapacityRange().GetRequiredBytes()
+		record.TargetPath = r.GetVolumePath()
+	case *csi.NodeStageVolumeRequest:
+		record.VolumeID = r.GetVolumeId()
+		record.TargetPath = r.GetStagingTargetPath()
+		record.setIdentity(r.GetVolumeContext())
+	case *csi.NodeUnstageVolumeRequest:
+		record.VolumeID = r.GetVolumeId()
+		record.TargetPath = r.GetStagingTargetPath()
+	case *csi.NodePublishVolumeRequest:
+		record.VolumeID = r.GetVolumeId()
+		record.TargetPath = r.GetTargetPath()
+		record.setIdentity(r.GetVolumeContext())
+	case *csi.NodeUnpublishVolumeRequest:
+		record.VolumeID = r.GetVolumeId()
+		record.TargetPath = r.GetTargetPath()
+	}
+
+	return record
+}
+
+// setIdentity fills in the requesting PVC, PV and pod found in the parameters or the volume context.
+func (r *auditRecord) setIdentity(values map[string]string) {
+	if name := values[internal.PVCNameKey]; name != "" {
+		r.PVC = values[internal.PVCNamespaceKey] + "/" + name
+	}
+	r.PV = values[internal.PVNameKey]
+	if name := values[internal.PodNameKey]; name != "" {
+		r.Pod = values[internal.PodNamespaceKey] + "/" + name
+	}
+	r.ServiceAccount = values[internal.PodServiceAccountKey]
+}
+
+// writeAuditRecord appends the record to the audit log. A failing write is only logged, so the audit log
+// never fails the volume operations.
+func (d *Driver) writeAuditRecord(record auditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		d.log.Error(err, fmt.Sprintf("[Audit] unable to marshal the audit record of %s of volume %s", record.Operation, record.VolumeID))
+		return
+	}
+
+	d.auditMu.Lock()
+	defer d.auditMu.Unlock()
+	if _, err := d.auditLog.Write(append(line, '\n')); err != nil {
+		d.log.Error(err, fmt.Sprintf("[Audit] unable to write the audit record of %s of volume %s", record.Operation, record.VolumeID))
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"sds-local-volume-csi/internal"
+	"sds-local-volume-csi/pkg/utils"
+)
+
+// auditRecords returns the records of the audit log.
+func auditRecords(t *testing.T, log *bytes.Buffer) []map[string]interface{} {
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(log.Bytes()))
+	for scanner.Scan() {
+		record := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record), scanner.Text())
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	ctx := context.Background()
+
+	var audit bytes.Buffer
+	cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+	d := newTestDriver(cl, WithLVEnumerator(fakeLVEnumerator{}), WithVGChecker(fakeVGChecker{}), WithAsyncCreateVolume(true), WithAuditLog(&audit))
+	st := newFakeStoreManager()
+	st.volumeStats = map[string]utils.VolumeStats{"/target/pvc-1": {TotalBytes: 2 << 30}}
+	d.storeManager = st
+	conn := serveTestDriver(t, d)
+	cc, nc := csi.NewControllerClient(conn), csi.NewNodeClient(conn)
+
+	createRequest := newTestCreateVolumeRequest("pvc-1", 1<<30, "- name: lvg-1\n")
+	createRequest.Parameters[internal.PVCNameKey] = "data"
+	createRequest.Parameters[internal.PVCNamespaceKey] = "tenant-a"
+	createRequest.Parameters[internal.PVNameKey] = "pvc-1"
+	createRequest.Secrets = map[string]string{"token": "s3cr3t"}
+
+	// the async CreateVolume returns once the LVMLogicalVolume is created by the node agent
+	_, err := cc.CreateVolume(ctx, createRequest)
+	require.Error(t, err)
+	llv := &snc.LVMLogicalVolume{}
+	require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, llv))
+	llv.Status = &snc.LVMLogicalVolumeStatus{Phase: internal.LLVStatusCreated, ActualSize: resource.MustParse("1Gi")}
+	require.NoError(t, cl.Update(ctx, llv))
+	created, err := cc.CreateVolume(ctx, createRequest)
+	require.NoError(t, err)
+
+	// the node agent has grown the LV already, so the expansion does not wait for it
+	require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, llv))
+	llv.Status.ActualSize = resource.MustParse("2Gi")
+	require.NoError(t, cl.Update(ctx, llv))
+
+	_, err = cc.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{VolumeId: "pvc-1", CapacityRange: &csi.CapacityRange{RequiredBytes: 2 << 30}})
+	require.NoError(t, err)
+
+	volumeContext := created.GetVolume().GetVolumeContext()
+	stageRequest := newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeExt4)
+	stageRequest.VolumeContext = volumeContext
+	stageRequest.Secrets = map[string]string{"token": "s3cr3t"}
+	_, err = nc.NodeStageVolume(ctx, stageRequest)
+	require.NoError(t, err)
+
+	publishRequest := newTestNodePublishVolumeRequest("pvc-1", volumeContext)
+	publishRequest.VolumeContext[internal.PodNameKey] = "app-0"
+	publishRequest.VolumeContext[internal.PodNamespaceKey] = "tenant-a"
+	publishRequest.VolumeContext[internal.PodServiceAccountKey] = "app"
+	_, err = nc.NodePublishVolume(ctx, publishRequest)
+	require.NoError(t, err)
+
+	_, err = nc.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{VolumeId: "pvc-1", VolumePath: "/target/pvc-1", CapacityRange: &csi.CapacityRange{RequiredBytes: 2 << 30}})
+	require.NoError(t, err)
+	_, err = nc.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc-1", TargetPath: "/target/pvc-1"})
+	require.NoError(t, err)
+	_, err = nc.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: "pvc-1", StagingTargetPath: "/staging/pvc-1"})
+	require.NoError(t, err)
+	_, err = cc.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "pvc-1", Secrets: map[string]string{"token": "s3cr3t"}})
+	require.NoError(t, err)
+
+	// the calls not changing the volumes are not audited
+	_, err = nc.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+	require.NoError(t, err)
+
+	assert.NotContains(t, audit.String(), "s3cr3t")
+
+	records := auditRecords(t, &audit)
+	var operations []string
+	for _, record := range records {
+		operations = append(operations, record["operation"].(string))
+		assert.Equal(t, "pvc-1", record["volumeID"])
+		assert.Equal(t, "test-node", record["node"])
+		assert.NotEmpty(t, record["time"])
+		assert.Contains(t, record, "durationMs")
+	}
+	require.Equal(t, []string{"create", "create", "expand", "stage", "publish", "node-expand", "unpublish", "unstage", "delete"}, operations)
+
+	t.Run("create_records_requesting_pvc_and_size", func(t *testing.T) {
+		assert.Equal(t, "DeadlineExceeded", records[0]["result"])
+		assert.NotEmpty(t, records[0]["error"])
+
+		assert.Equal(t, "OK", records[1]["result"])
+		assert.NotContains(t, records[1], "error")
+		assert.Equal(t, "tenant-a/data", records[1]["pvc"])
+		assert.Equal(t, "pvc-1", records[1]["pv"])
+		assert.EqualValues(t, 1<<30, records[1]["sizeBytes"])
+	})
+
+	t.Run("expand_records_size", func(t *testing.T) {
+		assert.Equal(t, "OK", records[2]["result"])
+		assert.EqualValues(t, 2<<30, records[2]["sizeBytes"])
+		assert.EqualValues(t, 2<<30, records[5]["sizeBytes"])
+	})
+
+	t.Run("node_operations_record_targets_and_pod", func(t *testing.T) {
+		assert.Equal(t, "/staging/pvc-1", records[3]["targetPath"])
+		assert.Equal(t, "/target/pvc-1", records[4]["targetPath"])
+		assert.Equal(t, "tenant-a/app-0", records[4]["pod"])
+		assert.Equal(t, "app", records[4]["serviceAccount"])
+		assert.Equal(t, "/target/pvc-1", records[6]["targetPath"])
+		assert.Equal(t, "/staging/pvc-1", records[7]["targetPath"])
+		for _, record := range records[3:] {
+			assert.Equal(t, "OK", record["result"])
+		}
+	})
+
+	t.Run("failed_operation_is_recorded", func(t *testing.T) {
+		audit.Reset()
+		_, err := nc.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{VolumeId: "pvc-2"})
+		require.Error(t, err)
+
+		records := auditRecords(t, &audit)
+		require.Len(t, records, 1)
+		assert.Equal(t, "publish", records[0]["operation"])
+		assert.Equal(t, "pvc-2", records[0]["volumeID"])
+		assert.Equal(t, "InvalidArgument", records[0]["result"])
+		assert.NotEmpty(t, records[0]["error"])
+	})
+}
@@ -20,31 +20,50 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/deckhouse/sds-node-configurator/api/v1alpha1"
 	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"sds-local-volume-csi/internal"
+	"sds-local-volume-csi/pkg/tracing"
 	"sds-local-volume-csi/pkg/utils"
 )
 
 const (
 	sourceVolumeKindSnapshot = "LVMLogicalVolumeSnapshot"
 	sourceVolumeKindVolume   = "LVMLogicalVolume"
+
+	lvgStatusPollInterval = 200 * time.Millisecond
+	// llvCleanupTimeout bounds the deletion of the LVMLogicalVolume of a cancelled CreateVolume
+	llvCleanupTimeout = 10 * time.Second
+	// maxNodeReselections bounds the retries of CreateVolume on another node after the LV creation ran out of space
+	maxNodeReselections = 1
 )
 
 func (d *Driver) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	return d.createVolume(ctx, request, nil)
+}
+
+// createVolume provisions the volume on the storage class LVMVolumeGroups not located on the excluded nodes.
+func (d *Driver) createVolume(ctx context.Context, request *csi.CreateVolumeRequest, excludedNodes []string) (*csi.CreateVolumeResponse, error) {
 	traceID := uuid.New().String()
+	trace.SpanFromContext(ctx).SetAttributes(tracing.TraceIDKey.String(traceID))
 
 	d.log.Trace(fmt.Sprintf("[CreateVolume][traceID:%s] ========== CreateVolume ============", traceID))
-	d.log.Trace(request.String())
+	d.log.Trace(sanitizeCreateVolumeRequest(request).String())
 	d.log.Trace(fmt.Sprintf("[CreateVolume][traceID:%s] ========== CreateVolume ============", traceID))
 
 	if request.Parameters[internal.TypeKey] != internal.Lvm {
@@ -67,35 +86,201 @@ func (d *Driver) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequ
 
 	if len(request.Parameters[internal.LVMVolumeGroupKey]) == 0 {
 		err := errors.New("no LVMVolumeGroups specified in a storage class's parameters")
-		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] no LVMVolumeGroups were found for the request: %+v", traceID, volumeID, request))
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] no LVMVolumeGroups were found for the request: %+v", traceID, volumeID, sanitizeCreateVolumeRequest(request)))
 		return nil, status.Errorf(codes.InvalidArgument, "no LVMVolumeGroups specified in a storage class's parameters")
 	}
 
-	storageClassLVGs, storageClassLVGParametersMap, err := utils.GetStorageClassLVGsAndParameters(ctx, d.cl, d.log, request.Parameters[internal.LVMVolumeGroupKey])
+	if err := utils.ValidateProvisionerSecrets(request.GetSecrets(), d.requiredSecrets); err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] invalid provisioner secrets", traceID, volumeID))
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if _, err := utils.ParseLVMVolumeGroups(request.Parameters[internal.LVMVolumeGroupKey]); err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] invalid LVMVolumeGroups in a storage class's parameters", traceID, volumeID))
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := utils.ValidateLVMTypeParameters(request.Parameters); err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] contradictory thin and thick parameters", traceID, volumeID))
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	switch request.Parameters[internal.ThinPoolSelectionStrategyKey] {
+	case "", internal.ThinPoolSelectionMostFree, internal.ThinPoolSelectionLowestOvercommit:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported %s: %s", internal.ThinPoolSelectionStrategyKey, request.Parameters[internal.ThinPoolSelectionStrategyKey])
+	}
+
+	provisionTimeout, err := utils.GetProvisionTimeout(request.Parameters, d.waitActionTimeout, maxWaitActionTimeout)
+	if err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] invalid provision timeout", traceID, volumeID))
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	d.log.Debug(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] provision timeout: %s", traceID, volumeID, provisionTimeout))
+
+	if _, err := utils.GetActivationMode(request.Parameters); err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] invalid activation mode", traceID, volumeID))
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if _, _, err := utils.GetEncryptionExpected(request.Parameters); err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] invalid encryption expectation", traceID, volumeID))
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if _, err := utils.GetFormatOverBlock(request.Parameters); err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] invalid format over block", traceID, volumeID))
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	mountSync, err := utils.GetMountSync(request.Parameters)
+	if err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] invalid mount sync", traceID, volumeID))
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if mountSync && slices.ContainsFunc(request.GetVolumeCapabilities(), func(c *csi.VolumeCapability) bool { return c.GetBlock() != nil }) {
+		return nil, status.Errorf(codes.InvalidArgument, "%s is not supported for block volumes", internal.MountSyncKey)
+	}
+
+	for _, c := range request.GetVolumeCapabilities() {
+		if c.GetMount() == nil {
+			continue
+		}
+		if err := checkFSTypeAllowed(request.Parameters, c.GetMount().GetFsType()); err != nil {
+			d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] invalid filesystem type", traceID, volumeID))
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	freeSpaceThreshold, err := utils.GetFreeSpaceSoftThreshold(request.Parameters)
+	if err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] invalid free space soft threshold", traceID, volumeID))
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if _, err := utils.GetIOLimits(request.Parameters); err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] invalid IO limits", traceID, volumeID))
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if _, err := utils.GetFormatPriority(request.Parameters); err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] invalid format priority", traceID, volumeID))
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	maxVolumeSize, err := utils.GetMaxVolumeSize(request.Parameters, internal.MaxVolumeSizeKey)
+	if err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] invalid maximum volume size", traceID, volumeID))
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	preallocate, err := utils.GetThinPreallocate(request.Parameters)
+	if err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] invalid thin preallocation", traceID, volumeID))
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	nodeSelector, err := d.volumeNodeSelector(request.Parameters)
+	if err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] invalid node selection metric", traceID, volumeID))
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	storageClassLVGs, storageClassLVGParametersMap, err := utils.GetStorageClassLVGsAndParameters(ctx, d.lvgLister, d.log, request.Parameters[internal.LVMVolumeGroupKey])
 	if err != nil {
 		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] error GetStorageClassLVGs", traceID, volumeID))
 		return nil, status.Errorf(codes.Internal, "error during GetStorageClassLVGs")
 	}
 
+	if d.lvgStatusTimeout > 0 && !slices.ContainsFunc(storageClassLVGs, utils.IsLVGStatusPopulated) {
+		storageClassLVGs, storageClassLVGParametersMap, err = d.waitForLVGStatus(ctx, traceID, volumeID, request.Parameters[internal.LVMVolumeGroupKey])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	lvgPolicy, err := utils.GetSameNodeLVGPolicy(request.Parameters, storageClassLVGParametersMap)
+	if err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] invalid same-node LVMVolumeGroup policy", traceID, volumeID))
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if len(excludedNodes) > 0 {
+		d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] exclude the LVMVolumeGroups on nodes %v", traceID, volumeID, excludedNodes))
+		storageClassLVGs = slices.DeleteFunc(storageClassLVGs, func(lvg v1alpha1.LVMVolumeGroup) bool {
+			return slices.Contains(excludedNodes, lvg.Spec.Local.NodeName)
+		})
+	}
+
 	contiguous := utils.IsContiguous(request, LvmType)
 	d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] contiguous: %t", traceID, volumeID, contiguous))
 
-	// TODO: Consider refactoring the naming strategy for llvName and lvName.
-	// Currently, we use the same name for llvName (the name of the LVMLogicalVolume resource in Kubernetes)
-	// and lvName (the name of the LV in LVM on the node) because the PV name is unique within the cluster,
-	// preventing name collisions. This approach simplifies matching between nodes and Kubernetes by maintaining
-	// the same name in both contexts. Future consideration should be given to optimizing this logic to enhance
-	// code readability and maintainability.
+	// The LVMLogicalVolume resource is always named after the PV, which is unique within the cluster. The LV on
+	// the node is named after it too, unless an LV name template adds e.g. the PVC namespace to ease auditing.
+	// The template always contains the PV name, so the LV names stay unique.
 	llvName := volumeID
-	lvName := volumeID
-	d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] llv name: %s", traceID, volumeID, llvName))
+	lvName := utils.ExpandLVName(d.lvNameTemplate, volumeID, request.Parameters)
+	d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] llv name: %s, lv name: %s", traceID, volumeID, llvName, lvName))
+
+	// The VG of the volume is not selected yet, so the LV name must fit the device-mapper names in any of them.
+	for _, lvg := range storageClassLVGs {
+		if err := utils.ValidateDMNameLength(lvg.Spec.ActualVGNameOnTheNode, lvName); err != nil {
+			d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] LV name is too long for LVMVolumeGroup %s", traceID, volumeID, lvg.Name))
+			return nil, status.Errorf(codes.InvalidArgument, "LV name is too long for LVMVolumeGroup %s: %v", lvg.Name, err)
+		}
+	}
+
+	requiredBytes, err := utils.ApplyMinVolumeSize(request.CapacityRange.GetRequiredBytes(), request.CapacityRange.GetLimitBytes(), d.minVolumeSize, d.minVolumeSizePolicy)
+	if err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] invalid requested size", traceID, volumeID))
+		return nil, status.Error(codes.OutOfRange, err.Error())
+	}
+	if requiredBytes != request.CapacityRange.GetRequiredBytes() {
+		d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] requested size %d is below the minimum volume size. Round it up to %d", traceID, volumeID, request.CapacityRange.GetRequiredBytes(), requiredBytes))
+	}
+
+	// LVM allocates whole extents, so the size is aligned to report the capacity actually provisioned
+	if alignedBytes := utils.AlignVolumeSize(requiredBytes, utils.DefaultExtentSize.Value()); alignedBytes != requiredBytes {
+		d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] requested size %d is aligned to the %s extent size: %d", traceID, volumeID, requiredBytes, utils.DefaultExtentSize.String(), alignedBytes))
+		requiredBytes = alignedBytes
+	}
 
-	llvSize := resource.NewQuantity(request.CapacityRange.GetRequiredBytes(), resource.BinarySI)
+	if err := utils.CheckMaxVolumeSize(requiredBytes, maxVolumeSize); err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] requested size is above the maximum volume size", traceID, volumeID))
+		return nil, status.Error(codes.OutOfRange, err.Error())
+	}
+
+	llvSize := utils.CapacityBytesToQuantity(requiredBytes)
 	d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] llv size: %s", traceID, volumeID, llvSize.String()))
 
+	if d.asyncCreateVolume {
+		existingLLV, err := utils.GetLVMLogicalVolume(ctx, d.cl, llvName, "")
+		if err == nil {
+			d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] LVMLogicalVolume %s already exists. Check its spec and status", traceID, volumeID, llvName))
+			if err := d.checkExistingLLVSpec(request, existingLLV, lvName, LvmType, *llvSize, contiguous, storageClassLVGs, storageClassLVGParametersMap); err != nil {
+				d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] existing LVMLogicalVolume %s does not match the request", traceID, volumeID, llvName))
+				if errors.Is(err, utils.ErrLLVSpecConflict) {
+					return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists with different parameters: %v", volumeID, err)
+				}
+				if errors.Is(err, utils.ErrThinPoolNotResolved) || errors.Is(err, utils.ErrThinPoolNotFound) {
+					return nil, status.Errorf(codes.InvalidArgument, "error getting LVMLogicalVolume spec: %v", err)
+				}
+				return nil, status.Errorf(codes.Internal, "error getting LVMLogicalVolume spec: %v", err)
+			}
+			return d.getAsyncCreateVolumeResult(ctx, traceID, request, existingLLV, storageClassLVGs)
+		}
+		if !kerrors.IsNotFound(err) {
+			d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] error getting LVMLogicalVolume %s", traceID, volumeID, llvName))
+			return nil, status.Errorf(codes.Internal, "error getting LVMLogicalVolume %s: %s", llvName, err.Error())
+		}
+	}
+
 	var selectedLVG *v1alpha1.LVMVolumeGroup
 	var preferredNode string
+	var placementStrategy string
 	var sourceVolume *v1alpha1.LVMLogicalVolumeSource
+	var sourceActualSize resource.Quantity
+	var sourceVolumeID, sourceSnapshotID string
 
 	if request.VolumeContentSource != nil {
 		sourceVolume = &v1alpha1.LVMLogicalVolumeSource{}
@@ -144,6 +329,9 @@ func (d *Driver) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequ
 
 			// prefer the same node as the source
 			preferredNode = sourceVol.Status.NodeName
+			sourceActualSize = sourceVol.Status.Size
+			sourceVolumeID = sourceVol.Spec.LVMLogicalVolumeName
+			sourceSnapshotID = sourceVol.Name
 		case *csi.VolumeContentSource_Volume:
 			sourceVolume.Kind = sourceVolumeKindVolume
 			sourceVolume.Name = s.Volume.VolumeId
@@ -186,41 +374,105 @@ func (d *Driver) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequ
 
 			// prefer the same node as the source
 			preferredNode = selectedLVG.Spec.Local.NodeName
+			sourceVolumeID = sourceVol.Name
+			if sourceVol.Status != nil {
+				sourceActualSize = sourceVol.Status.ActualSize
+			}
+		}
+
+		placementStrategy = internal.PlacementStrategySource
+
+		// a thick clone is a full copy allocated at once, so the lack of space is reported before it is started
+		if LvmType == internal.LVMTypeThick && selectedLVG != nil {
+			requiredSpace := *llvSize
+			if sourceActualSize.Cmp(requiredSpace) > 0 {
+				requiredSpace = sourceActualSize
+			}
+			freeSpace := utils.GetLVMVolumeGroupFreeSpace(*selectedLVG)
+			if requiredSpace.Cmp(freeSpace) > 0 {
+				d.log.Error(nil, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] LVMVolumeGroup %s has %s free, the thick clone of %s needs %s", traceID, volumeID, selectedLVG.Name, freeSpace.String(), sourceVolume.Name, requiredSpace.String()))
+				return nil, status.Errorf(codes.ResourceExhausted, "LVMVolumeGroup %s has %s free, the thick clone of %s needs %s", selectedLVG.Name, freeSpace.String(), sourceVolume.Name, requiredSpace.String())
+			}
 		}
 	} else {
 		switch BindingMode {
 		case internal.BindingModeI:
 			d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] BindingMode is %s. Start selecting node", traceID, volumeID, internal.BindingModeI))
-			selectedNodeName, freeSpace, err := utils.GetNodeWithMaxFreeSpace(storageClassLVGs, storageClassLVGParametersMap, LvmType)
+			candidateLVGs, err := utils.FilterSchedulableLVGs(ctx, d.cl, d.log, storageClassLVGs, d.excludeNodeTaint)
+			if err != nil {
+				d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] error FilterSchedulableLVGs", traceID, volumeID))
+				return nil, status.Errorf(codes.Internal, "error filtering schedulable nodes: %v", err)
+			}
+			if len(candidateLVGs) == 0 {
+				return nil, status.Errorf(codes.ResourceExhausted, "all nodes of the storage class LVMVolumeGroups are unschedulable")
+			}
+
+			var selectedNodeName string
+			var freeSpace resource.Quantity
+			if LvmType == internal.LVMTypeThin && request.Parameters[internal.ThinPoolSelectionStrategyKey] == internal.ThinPoolSelectionLowestOvercommit {
+				var thinPoolName string
+				var overcommitRatio float64
+				placementStrategy = internal.ThinPoolSelectionLowestOvercommit
+				selectedNodeName, thinPoolName, freeSpace, overcommitRatio, err = utils.GetNodeWithLowestThinPoolOvercommit(candidateLVGs, storageClassLVGParametersMap)
+				if err == nil {
+					d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] Selected thin pool %s on node %s with overcommit ratio %.2f", traceID, volumeID, thinPoolName, selectedNodeName, overcommitRatio))
+				}
+			} else {
+				placementStrategy = nodeSelector.Name()
+				selectedNodeName, freeSpace, err = nodeSelector.SelectNode(candidateLVGs, storageClassLVGParametersMap, LvmType, *llvSize)
+			}
 			if err != nil {
 				d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] error GetNodeMaxVGSize", traceID, volumeID))
+				if errors.Is(err, utils.ErrLVGNotReady) {
+					return nil, status.Errorf(codes.Unavailable, "no ready LVMVolumeGroups: %v", err)
+				}
+				if errors.Is(err, utils.ErrThinPoolNotResolved) || errors.Is(err, utils.ErrThinPoolNotFound) {
+					return nil, status.Errorf(codes.InvalidArgument, "unable to resolve the thin pool: %v", err)
+				}
 			}
 
 			preferredNode = selectedNodeName
 			d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] Selected node: %s, free space %s", traceID, volumeID, selectedNodeName, freeSpace.String()))
 			if LvmType == internal.LVMTypeThick {
 				if llvSize.Value() > freeSpace.Value() {
-					return nil, status.Errorf(codes.Internal, "requested size: %s is greater than free space: %s", llvSize.String(), freeSpace.String())
+					candidates := append(
+						utils.EvaluateLVGCandidates(candidateLVGs, storageClassLVGParametersMap, LvmType, *llvSize),
+						excludedLVGCandidates(storageClassLVGs, candidateLVGs, "node is unschedulable")...,
+					)
+					return nil, capacityExhaustedError(fmt.Sprintf("requested size: %s is greater than free space: %s", llvSize.String(), freeSpace.String()), candidates)
 				}
 			}
 		case internal.BindingModeWFFC:
 			d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] BindingMode is %s. Get preferredNode", traceID, volumeID, internal.BindingModeWFFC))
-			if len(request.AccessibilityRequirements.Preferred) != 0 {
-				t := request.AccessibilityRequirements.Preferred[0].Segments
-				preferredNode = t[internal.TopologyKey]
+			placementStrategy = internal.PlacementStrategyWFFC
+			preferredNode, err = d.selectWFFCNode(traceID, request, nodeSelector, storageClassLVGs, storageClassLVGParametersMap, LvmType, *llvSize)
+			if err != nil {
+				d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] error selecting node", traceID, volumeID))
+				return nil, err
 			}
 		}
 
 		d.log.Trace(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] preferredNode: %s. Select LVG", traceID, volumeID, preferredNode))
-		selectedLVG, err = utils.SelectLVG(storageClassLVGs, preferredNode)
-		d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] selectedLVG: %+v", traceID, volumeID, selectedLVG))
+		var appliedPolicy string
+		selectedLVG, appliedPolicy, err = d.lvgSelector.Select(storageClassLVGs, preferredNode, lvgPolicy, storageClassLVGParametersMap, LvmType, *llvSize)
 		if err != nil {
 			d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] error SelectLVG", traceID, volumeID))
+			if errors.Is(err, utils.ErrLVGNotReady) {
+				return nil, status.Errorf(codes.Unavailable, "error during SelectLVG: %v", err)
+			}
+			if errors.Is(err, utils.ErrThinPoolNotResolved) || errors.Is(err, utils.ErrThinPoolNotFound) {
+				return nil, status.Errorf(codes.InvalidArgument, "error during SelectLVG: %v", err)
+			}
 			return nil, status.Errorf(codes.Internal, "error during SelectLVG")
 		}
+		if appliedPolicy != lvgPolicy.Name {
+			d.log.Warning(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] none of the pinned LVMVolumeGroups %v is located on node %s", traceID, volumeID, lvgPolicy.Pinned, preferredNode))
+		}
+		d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] selected LVMVolumeGroup %s on node %s by the %s policy", traceID, volumeID, selectedLVG.Name, preferredNode, appliedPolicy))
+		d.log.Trace(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] selectedLVG: %+v", traceID, volumeID, selectedLVG))
 	}
 
-	llvSpec := utils.GetLLVSpec(
+	llvSpec, err := utils.GetLLVSpec(
 		d.log,
 		lvName,
 		*selectedLVG,
@@ -230,41 +482,425 @@ func (d *Driver) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequ
 		contiguous,
 		sourceVolume,
 	)
+	if err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] error GetLLVSpec", traceID, volumeID))
+		if errors.Is(err, utils.ErrThinPoolNotResolved) || errors.Is(err, utils.ErrThinPoolNotFound) {
+			return nil, status.Errorf(codes.InvalidArgument, "error getting LVMLogicalVolume spec: %v", err)
+		}
+		return nil, status.Errorf(codes.Internal, "error getting LVMLogicalVolume spec: %v", err)
+	}
 	d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] LVMLogicalVolumeSpec: %+v", traceID, volumeID, llvSpec))
+	decision := utils.NewPlacementDecision(*selectedLVG, llvSpec, placementStrategy).String()
+	d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] placement decision: %s", traceID, volumeID, decision))
+	annotations := utils.RequestedAllocationPolicyAnnotations(contiguous)
+	annotations[internal.PlacementDecisionAnnotation] = decision
+	if maxVolumeSize > 0 {
+		annotations[internal.MaxVolumeSizeAnnotation] = request.Parameters[internal.MaxVolumeSizeKey]
+	}
+	if llvSpec.Type == internal.LVMTypeThin {
+		annotations[internal.ThinAllocationAnnotation] = d.thinAllocationMode(traceID, volumeID, request, preallocate, *selectedLVG, llvSpec, *llvSize)
+	}
 	resizeDelta, err := resource.ParseQuantity(internal.ResizeDelta)
 	if err != nil {
 		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] error ParseQuantity for ResizeDelta", traceID, volumeID))
 		return nil, err
 	}
 
-	d.log.Trace(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] ------------ CreateLVMLogicalVolume start ------------", traceID, volumeID))
-	_, err = utils.CreateLVMLogicalVolume(ctx, d.cl, d.log, traceID, llvName, llvSpec)
+	cooldownKey := utils.ProvisionCooldownKey(request.Parameters[internal.LVMVolumeGroupKey], selectedLVG.Spec.Local.NodeName)
+	if remaining := d.provisionCooldown.Remaining(cooldownKey); remaining > 0 {
+		d.log.Warning(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] a recent provision failed on node %s. Back off for %s", traceID, volumeID, selectedLVG.Spec.Local.NodeName, remaining))
+		return nil, provisionCooldownError(selectedLVG.Spec.Local.NodeName, remaining)
+	}
+
+	// the LVMVolumeGroup may have been deleted since it was listed for the selection
+	if err := utils.CheckLVGExists(ctx, d.cl, selectedLVG.Name); err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] selected LVMVolumeGroup %s is not available", traceID, volumeID, selectedLVG.Name))
+		if errors.Is(err, utils.ErrLVGGone) {
+			return nil, llvFailureError(err)
+		}
+		return nil, status.Errorf(codes.Internal, "error checking LVMVolumeGroup %s: %v", selectedLVG.Name, err)
+	}
+
+	// the slot is held until the node agent runs lvcreate, as that is when the VG metadata is locked
+	release, err := d.acquireVGSlot(ctx, "CreateVolume", traceID, volumeID, selectedLVG.Name)
 	if err != nil {
-		if kerrors.IsAlreadyExists(err) {
-			d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] LVMLogicalVolume %s already exists. Skip creating", traceID, volumeID, llvName))
-		} else {
-			d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] error CreateLVMLogicalVolume", traceID, volumeID))
-			return nil, err
+		return nil, err
+	}
+	defer release()
+
+	d.log.Trace(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] ------------ CreateLVMLogicalVolume start ------------", traceID, volumeID))
+	trace.SpanFromContext(ctx).SetAttributes(tracing.LVGKey.String(selectedLVG.Name), tracing.NodeKey.String(selectedLVG.Spec.Local.NodeName))
+	createCtx, createSpan := d.tracer.Start(ctx, "CreateLVMLogicalVolume", trace.WithAttributes(tracing.LVGKey.String(selectedLVG.Name)))
+	llv, llvCreated, err := utils.CreateLVMLogicalVolume(createCtx, d.cl, d.log, traceID, llvName, d.llvFinalizer, utils.LineageLabels(sourceVolumeID, sourceSnapshotID), annotations, llvSpec, resizeDelta)
+	if err == nil {
+		d.setProvisioningConditions(ctx, traceID, llv,
+			utils.NewProvisioningCondition(internal.ProvisioningConditionNodeSelected, fmt.Sprintf("selected LVMVolumeGroup %s on node %s", selectedLVG.Name, selectedLVG.Spec.Local.NodeName)),
+			utils.NewProvisioningCondition(internal.ProvisioningConditionLVCreationRequested, fmt.Sprintf("requested %s LV %s of size %s", llvSpec.Type, llvSpec.ActualLVNameOnTheNode, llvSpec.Size)),
+		)
+		if !freeSpaceThreshold.IsZero() {
+			d.checkFreeSpaceThreshold(traceID, volumeID, *selectedLVG, llvSpec, *llvSize, freeSpaceThreshold)
 		}
+	} else {
+		endSpan(createSpan, err)
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] error CreateLVMLogicalVolume", traceID, volumeID))
+		if errors.Is(err, utils.ErrLLVSpecConflict) {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists with different parameters: %v", volumeID, err)
+		}
+		return nil, err
 	}
+	createSpan.End()
 	d.log.Trace(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] ------------ CreateLVMLogicalVolume end ------------", traceID, volumeID))
 
+	if llv != nil {
+		d.setProvisioningConditions(ctx, traceID, llv,
+			utils.NewProvisioningCondition(internal.ProvisioningConditionWaitingForActivation, "waiting for the LV to be created on the node"))
+	}
+
+	if d.asyncCreateVolume {
+		d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] async mode is on. Skip waiting for LVMLogicalVolume %s", traceID, volumeID, llvName))
+		return nil, status.Errorf(codes.DeadlineExceeded, "LVMLogicalVolume %s is still being provisioned", llvName)
+	}
+
+	// the agent has run lvcreate once it picks the LVMLogicalVolume up, so the slot is not held while the volume
+	// becomes ready. It is released after vgSlotHoldTimeout at the latest, so a stuck LVMLogicalVolume does not block the VG.
+	pickupCtx, cancelPickup := context.WithTimeout(ctx, d.vgSlotHoldTimeout)
+	defer cancelPickup()
+	go func() {
+		defer release()
+		if err := utils.WaitForLLVPickup(pickupCtx, d.cl, llvName); errors.Is(err, context.DeadlineExceeded) {
+			d.log.Warning(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] LVMLogicalVolume %s is not picked up by the node agent in %s. Release the slot of LVMVolumeGroup %s", traceID, volumeID, llvName, d.vgSlotHoldTimeout, selectedLVG.Name))
+		}
+	}()
+
 	d.log.Trace(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] start wait CreateLVMLogicalVolume", traceID, volumeID))
 
-	attemptCounter, err := utils.WaitForStatusUpdate(ctx, d.cl, d.log, traceID, request.Name, "", *llvSize, resizeDelta)
-	if err != nil {
-		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] error WaitForStatusUpdate. Delete LVMLogicalVolume %s", traceID, volumeID, request.Name))
+	waitCtx, cancel := context.WithTimeout(ctx, d.subTimeout(ctx, "CreateVolume", "provision", provisionTimeout))
+	defer cancel()
 
-		deleteErr := utils.DeleteLVMLogicalVolume(ctx, d.cl, d.log, traceID, request.Name)
-		if deleteErr != nil {
-			d.log.Error(deleteErr, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] error DeleteLVMLogicalVolume", traceID, volumeID))
+	waitCtx, waitSpan := d.tracer.Start(waitCtx, "WaitForStatusUpdate")
+	attemptCounter, err := utils.WaitForStatusUpdate(waitCtx, d.cl, d.log, traceID, request.Name, "", *llvSize, resizeDelta, d.strictThinSize)
+	endSpan(waitSpan, err)
+	if err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] error WaitForStatusUpdate", traceID, volumeID))
+		if ctx.Err() != nil {
+			d.reclaimCancelledLLV(ctx, traceID, volumeID, llvName, llvCreated)
+			return nil, status.FromContextError(ctx.Err()).Err()
 		}
+		d.reclaimFailedLLV(ctx, traceID, volumeID, request.Name, err)
 
 		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] error creating LVMLogicalVolume", traceID, volumeID))
+		err = llvFailureError(err)
+		if isRetryableProvisionFailure(err) {
+			d.provisionCooldown.RecordFailure(cooldownKey)
+		}
+		if d.canReselectNode(err, request, sourceVolume, storageClassLVGs, selectedLVG.Spec.Local.NodeName, excludedNodes) {
+			// the free space the node was selected by was stale, so the selection is repeated without the node
+			d.log.Warning(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] LVMVolumeGroup %s on node %s ran out of space. Refresh it and reselect the node", traceID, volumeID, selectedLVG.Name, selectedLVG.Spec.Local.NodeName))
+			d.refreshLVG(ctx, traceID, volumeID, selectedLVG.Name)
+			if waitErr := utils.WaitForLLVDeletion(waitCtx, d.cl, llvName); waitErr != nil {
+				d.log.Error(waitErr, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] LVMLogicalVolume %s is not deleted. Skip the reselection", traceID, volumeID, llvName))
+				return nil, err
+			}
+			release()
+			return d.createVolume(ctx, request, append(excludedNodes, selectedLVG.Spec.Local.NodeName))
+		}
 		return nil, err
 	}
 	d.log.Trace(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] finish wait CreateLVMLogicalVolume, attempt counter = %d", traceID, volumeID, attemptCounter))
 
+	if llv != nil {
+		d.setProvisioningConditions(ctx, traceID, llv,
+			utils.NewProvisioningCondition(internal.ProvisioningConditionProvisioned, fmt.Sprintf("LV is created on the node %s", selectedLVG.Spec.Local.NodeName)))
+	}
+	if created, err := utils.GetLVMLogicalVolume(ctx, d.cl, llvName, ""); err == nil {
+		d.recordAchievedAllocationPolicy(ctx, traceID, created)
+	} else {
+		d.log.Warning(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] unable to get LVMLogicalVolume %s to record the achieved allocation policy: %v", traceID, volumeID, llvName, err))
+	}
+	d.provisionCooldown.Reset(cooldownKey)
+
+	return d.createVolumeResponse(traceID, request, selectedLVG, llvSpec, preferredNode, annotations), nil
+}
+
+// canReselectNode reports whether the volume failed for the lack of space on its node can be retried on another
+// node. Only the volumes placed by the free space are reselected: the clones and restores stay on the node of their
+// source and the WaitForFirstConsumer volumes on the node chosen by the scheduler.
+func (d *Driver) canReselectNode(err error, request *csi.CreateVolumeRequest, sourceVolume *v1alpha1.LVMLogicalVolumeSource, storageClassLVGs []v1alpha1.LVMVolumeGroup, failedNode string, excludedNodes []string) bool {
+	if status.Code(err) != codes.ResourceExhausted || len(excludedNodes) >= maxNodeReselections {
+		return false
+	}
+	if sourceVolume != nil || request.Parameters[internal.BindingModeKey] != internal.BindingModeI {
+		return false
+	}
+
+	return slices.ContainsFunc(storageClassLVGs, func(lvg v1alpha1.LVMVolumeGroup) bool {
+		return lvg.Spec.Local.NodeName != failedNode
+	})
+}
+
+// getReadyError converts the error of the utils.GetReady getters to the gRPC status: NotFound for the missing object,
+// Unavailable for the object whose status is not populated yet, so the caller retries, and Internal otherwise.
+func getReadyError(err error, kind, name string) error {
+	switch {
+	case kerrors.IsNotFound(err):
+		return status.Errorf(codes.NotFound, "%s %s not found", kind, name)
+	case errors.Is(err, utils.ErrNotReady):
+		return status.Errorf(codes.Unavailable, "%s %s is not ready: %v", kind, name, err)
+	default:
+		return status.Errorf(codes.Internal, "error getting %s %s: %v", kind, name, err)
+	}
+}
+
+// refreshLVG replaces the possibly stale LVMVolumeGroup served by the LVMVolumeGroup lister with its current state,
+// so the next selections do not pick it by the free space it no longer has.
+func (d *Driver) refreshLVG(ctx context.Context, traceID, volumeID, lvgName string) {
+	refresher, ok := d.lvgLister.(utils.LVGRefresher)
+	if !ok {
+		return
+	}
+
+	lvg, err := utils.GetLVMVolumeGroup(ctx, d.cl, lvgName)
+	if err != nil {
+		d.log.Warning(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] unable to refresh LVMVolumeGroup %s: %v", traceID, volumeID, lvgName, err))
+		return
+	}
+	refresher.RefreshLVG(lvg)
+}
+
+// setProvisioningConditions reports the provisioning progress on the LVMLogicalVolume.
+// The progress is informational, so the errors are only logged.
+func (d *Driver) setProvisioningConditions(ctx context.Context, traceID string, llv *v1alpha1.LVMLogicalVolume, conditions ...metav1.Condition) {
+	if err := utils.SetLLVProvisioningConditions(ctx, d.cl, llv, conditions...); err != nil {
+		d.log.Warning(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] unable to set the provisioning conditions: %v", traceID, llv.Name, err))
+	}
+}
+
+// reclaimFailedLLV deletes the LVMLogicalVolume that failed to be provisioned, so the retry of CreateVolume
+// starts clean instead of finding it already existing. The LVMLogicalVolume is kept if the failure is transient
+// and the node agent recovers from it on its own.
+func (d *Driver) reclaimFailedLLV(ctx context.Context, traceID, volumeID, llvName string, err error) {
+	if isTransientLLVFailure(err) {
+		d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] LVMLogicalVolume %s failed transiently. Keep it for the retry", traceID, volumeID, llvName))
+		return
+	}
+
+	d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] delete LVMLogicalVolume %s", traceID, volumeID, llvName))
+	if deleteErr := utils.DeleteLVMLogicalVolume(ctx, d.cl, d.log, traceID, llvName, d.llvFinalizer); deleteErr != nil && !kerrors.IsNotFound(deleteErr) {
+		d.log.Error(deleteErr, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] error DeleteLVMLogicalVolume", traceID, volumeID))
+	}
+}
+
+// reclaimCancelledLLV deletes the LVMLogicalVolume created by the CreateVolume call cancelled while waiting for
+// it to be provisioned, so it is not left behind if the caller gives up on the volume. An LVMLogicalVolume adopted
+// from a previous call is kept, as the cancelled call does not own it. The deletion outlives the cancelled request
+// context, but is bounded by llvCleanupTimeout.
+func (d *Driver) reclaimCancelledLLV(ctx context.Context, traceID, volumeID, llvName string, created bool) {
+	if !created {
+		d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] request is cancelled. Keep the adopted LVMLogicalVolume %s", traceID, volumeID, llvName))
+		return
+	}
+
+	cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), llvCleanupTimeout)
+	defer cancel()
+
+	d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] request is cancelled. Delete the created LVMLogicalVolume %s", traceID, volumeID, llvName))
+	if err := utils.DeleteLVMLogicalVolume(cleanupCtx, d.cl, d.log, traceID, llvName, d.llvFinalizer); err != nil && !kerrors.IsNotFound(err) {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] unable to delete the LVMLogicalVolume %s of the cancelled request", traceID, volumeID, llvName))
+	}
+}
+
+// acquireVGSlot waits for a free slot of the LVMVolumeGroup for an LV creation or deletion.
+// The returned release func must be called once the operation is done.
+func (d *Driver) acquireVGSlot(ctx context.Context, method, traceID, volumeID, lvgName string) (func(), error) {
+	d.log.Trace(fmt.Sprintf("[%s][traceID:%s][volumeID:%s] waiting for a free slot of LVMVolumeGroup %s", method, traceID, volumeID, lvgName))
+	release, err := d.vgLimiter.Acquire(ctx, lvgName)
+	if err != nil {
+		d.log.Error(err, fmt.Sprintf("[%s][traceID:%s][volumeID:%s] gave up waiting for a free slot of LVMVolumeGroup %s", method, traceID, volumeID, lvgName))
+		return nil, status.FromContextError(err).Err()
+	}
+	return release, nil
+}
+
+// waitForLVGStatus re-reads the storage class LVMVolumeGroups until the status of any of them is populated
+// by the node agent. A codes.Unavailable error is returned if no status is populated within the timeout.
+func (d *Driver) waitForLVGStatus(ctx context.Context, traceID, volumeID, lvgsParam string) ([]v1alpha1.LVMVolumeGroup, map[string]string, error) {
+	timeout := d.subTimeout(ctx, "CreateVolume", "LVMVolumeGroup status wait", d.lvgStatusTimeout)
+	d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] no storage class LVMVolumeGroup has its status populated. Wait up to %s", traceID, volumeID, timeout))
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		select {
+		case <-waitCtx.Done():
+			return nil, nil, status.Errorf(codes.Unavailable, "no storage class LVMVolumeGroup has its status populated in %s", timeout)
+		case <-time.After(lvgStatusPollInterval):
+		}
+
+		lvgs, params, err := utils.GetStorageClassLVGsAndParameters(waitCtx, d.lvgLister, d.log, lvgsParam)
+		if err != nil {
+			d.log.Warning(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] unable to get the storage class LVMVolumeGroups: %v", traceID, volumeID, err))
+			continue
+		}
+
+		if slices.ContainsFunc(lvgs, utils.IsLVGStatusPopulated) {
+			d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] storage class LVMVolumeGroup status is populated", traceID, volumeID))
+			return lvgs, params, nil
+		}
+	}
+}
+
+// recordAchievedAllocationPolicy annotates the provisioned LVMLogicalVolume with the allocation policy
+// the node agent achieved and warns if it diverges from the requested one.
+func (d *Driver) recordAchievedAllocationPolicy(ctx context.Context, traceID string, llv *v1alpha1.LVMLogicalVolume) {
+	if err := utils.SetLLVAchievedAllocationPolicy(ctx, d.cl, llv); err != nil {
+		d.log.Warning(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] unable to record the achieved allocation policy: %v", traceID, llv.Name, err))
+	}
+
+	if utils.IsAllocationPolicyDiverged(llv) {
+		d.log.Warning(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] requested %s allocation, but LVMVolumeGroup %s provisioned a %s LV", traceID, llv.Name, internal.AllocationPolicyContiguous, llv.Spec.LVMVolumeGroupName, internal.AllocationPolicyFragmented))
+		d.metrics.IncAllocationPolicyDivergences(llv.Spec.LVMVolumeGroupName)
+	}
+}
+
+// thinAllocationMode returns the allocation mode of a new thin volume. The requested preallocation falls back
+// to the lazy allocation with a warning if it cannot be honored: the node plugin preallocates the volume by
+// zero-filling it before formatting, which is not possible for the block volumes, and the thin pool must have
+// the physical free space to back the whole volume.
+func (d *Driver) thinAllocationMode(traceID, volumeID string, request *csi.CreateVolumeRequest, preallocate bool, lvg v1alpha1.LVMVolumeGroup, llvSpec v1alpha1.LVMLogicalVolumeSpec, size resource.Quantity) string {
+	if !preallocate {
+		return internal.ThinAllocationLazy
+	}
+
+	if slices.ContainsFunc(request.GetVolumeCapabilities(), func(c *csi.VolumeCapability) bool { return c.GetBlock() != nil }) {
+		d.log.Warning(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] preallocation is not supported for block volumes. Fall back to %s allocation", traceID, volumeID, internal.ThinAllocationLazy))
+		return internal.ThinAllocationLazy
+	}
+
+	mode, reason := utils.ThinAllocationMode(preallocate, lvg, llvSpec.Thin.PoolName, size)
+	if mode != internal.ThinAllocationPreallocated {
+		d.log.Warning(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] unable to preallocate the volume: %s. Fall back to %s allocation", traceID, volumeID, reason, mode))
+	}
+	return mode
+}
+
+// checkExistingLLVSpec compares the spec of the LVMLogicalVolume created by a previous CreateVolume call with
+// the requested one the way CreateLVMLogicalVolume does in the sync mode, returning ErrLLVSpecConflict on a mismatch.
+// The requested spec is built for the LVMVolumeGroup of the existing LVMLogicalVolume, which must be listed in
+// the storage class, so the volume is not compared with a new selection.
+func (d *Driver) checkExistingLLVSpec(
+	request *csi.CreateVolumeRequest,
+	llv *v1alpha1.LVMLogicalVolume,
+	lvName, lvmType string,
+	llvSize resource.Quantity,
+	contiguous bool,
+	storageClassLVGs []v1alpha1.LVMVolumeGroup,
+	storageClassLVGParametersMap map[string]string,
+) error {
+	lvg, err := utils.SelectLVGByName(storageClassLVGs, llv.Spec.LVMVolumeGroupName)
+	if err != nil {
+		return fmt.Errorf("%w: LVMVolumeGroup %s is not listed in the storage class", utils.ErrLLVSpecConflict, llv.Spec.LVMVolumeGroupName)
+	}
+
+	var source *v1alpha1.LVMLogicalVolumeSource
+	switch s := request.GetVolumeContentSource().GetType().(type) {
+	case *csi.VolumeContentSource_Snapshot:
+		source = &v1alpha1.LVMLogicalVolumeSource{Kind: sourceVolumeKindSnapshot, Name: s.Snapshot.GetSnapshotId()}
+	case *csi.VolumeContentSource_Volume:
+		source = &v1alpha1.LVMLogicalVolumeSource{Kind: sourceVolumeKindVolume, Name: s.Volume.GetVolumeId()}
+	}
+	// the volume restored without a requested size takes the size of its source
+	if source != nil && llvSize.IsZero() {
+		if llvSize, err = resource.ParseQuantity(llv.Spec.Size); err != nil {
+			return fmt.Errorf("%w: invalid size %q", utils.ErrLLVSpecConflict, llv.Spec.Size)
+		}
+	}
+
+	requested, err := utils.GetLLVSpec(d.log, lvName, *lvg, storageClassLVGParametersMap, lvmType, llvSize, contiguous, source)
+	if err != nil {
+		return err
+	}
+
+	resizeDelta, err := resource.ParseQuantity(internal.ResizeDelta)
+	if err != nil {
+		return err
+	}
+	if mismatch := utils.LLVSpecMismatch(llv.Spec, requested, resizeDelta); mismatch != "" {
+		return fmt.Errorf("%w: %s", utils.ErrLLVSpecConflict, mismatch)
+	}
+
+	return nil
+}
+
+// getAsyncCreateVolumeResult checks the state of an LVMLogicalVolume created by a previous CreateVolume call.
+// A still provisioning volume is reported with codes.DeadlineExceeded, so the external-provisioner retries the call.
+func (d *Driver) getAsyncCreateVolumeResult(
+	ctx context.Context,
+	traceID string,
+	request *csi.CreateVolumeRequest,
+	llv *v1alpha1.LVMLogicalVolume,
+	storageClassLVGs []v1alpha1.LVMVolumeGroup,
+) (*csi.CreateVolumeResponse, error) {
+	volumeID := request.Name
+
+	llvSize, err := resource.ParseQuantity(llv.Spec.Size)
+	if err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] error parsing quantity %s", traceID, volumeID, llv.Spec.Size))
+		return nil, status.Errorf(codes.Internal, "error parsing quantity: %v", err)
+	}
+
+	resizeDelta, err := resource.ParseQuantity(internal.ResizeDelta)
+	if err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] error ParseQuantity for ResizeDelta", traceID, volumeID))
+		return nil, err
+	}
+
+	created, err := utils.CheckLLVStatus(llv, llvSize, resizeDelta, d.strictThinSize)
+	if err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] LVMLogicalVolume %s is not created", traceID, volumeID, llv.Name))
+		d.reclaimFailedLLV(ctx, traceID, volumeID, llv.Name, err)
+
+		var failed *utils.LLVFailedError
+		if errors.As(err, &failed) {
+			err = llvFailedStatusError(failed)
+		} else {
+			err = status.Errorf(codes.Internal, "error creating LVMLogicalVolume: %v", err)
+		}
+		if lvg, lvgErr := utils.SelectLVGByName(storageClassLVGs, llv.Spec.LVMVolumeGroupName); lvgErr == nil && isRetryableProvisionFailure(err) {
+			d.provisionCooldown.RecordFailure(utils.ProvisionCooldownKey(request.Parameters[internal.LVMVolumeGroupKey], lvg.Spec.Local.NodeName))
+		}
+		return nil, err
+	}
+
+	if !created {
+		d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] LVMLogicalVolume %s is still being provisioned", traceID, volumeID, llv.Name))
+		return nil, status.Errorf(codes.DeadlineExceeded, "LVMLogicalVolume %s is still being provisioned", llv.Name)
+	}
+
+	selectedLVG, err := utils.SelectLVGByName(storageClassLVGs, llv.Spec.LVMVolumeGroupName)
+	if err != nil {
+		d.log.Error(err, fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] error getting LVMVolumeGroup %s", traceID, volumeID, llv.Spec.LVMVolumeGroupName))
+		return nil, status.Errorf(codes.Internal, "error getting LVMVolumeGroup %s: %s", llv.Spec.LVMVolumeGroupName, err.Error())
+	}
+
+	d.setProvisioningConditions(ctx, traceID, llv,
+		utils.NewProvisioningCondition(internal.ProvisioningConditionProvisioned, fmt.Sprintf("LV is created on the node %s", selectedLVG.Spec.Local.NodeName)))
+	d.recordAchievedAllocationPolicy(ctx, traceID, llv)
+	d.provisionCooldown.Reset(utils.ProvisionCooldownKey(request.Parameters[internal.LVMVolumeGroupKey], selectedLVG.Spec.Local.NodeName))
+
+	return d.createVolumeResponse(traceID, request, selectedLVG, llv.Spec, selectedLVG.Spec.Local.NodeName, llv.Annotations), nil
+}
+
+func (d *Driver) createVolumeResponse(
+	traceID string,
+	request *csi.CreateVolumeRequest,
+	selectedLVG *v1alpha1.LVMVolumeGroup,
+	llvSpec v1alpha1.LVMLogicalVolumeSpec,
+	preferredNode string,
+	annotations map[string]string,
+) *csi.CreateVolumeResponse {
+	volumeID := request.Name
+
 	volumeCtx := make(map[string]string, len(request.Parameters))
 	for k, v := range request.Parameters {
 		volumeCtx[k] = v
@@ -272,40 +908,171 @@ func (d *Driver) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequ
 
 	volumeCtx[internal.SubPath] = request.Name
 	volumeCtx[internal.VGNameKey] = selectedLVG.Spec.ActualVGNameOnTheNode
+	if metric, _ := utils.GetSelectionMetric(request.Parameters); metric == internal.SelectionMetricInodes {
+		// the filesystem is formatted with the ratio the node was selected by
+		if ratios, err := utils.GetLVGBytesPerInode(request.Parameters); err == nil {
+			volumeCtx[internal.FormatBytesPerInodeKey] = strconv.FormatInt(ratios[selectedLVG.Name], 10)
+		}
+	}
+	if llvSpec.ActualLVNameOnTheNode != volumeID {
+		volumeCtx[internal.LVNameKey] = llvSpec.ActualLVNameOnTheNode
+	}
 	if llvSpec.Type == internal.LVMTypeThin {
 		volumeCtx[internal.ThinPoolNameKey] = llvSpec.Thin.PoolName
 	} else {
 		volumeCtx[internal.ThinPoolNameKey] = ""
 	}
+	if decision := annotations[internal.PlacementDecisionAnnotation]; decision != "" {
+		volumeCtx[internal.PlacementDecisionKey] = decision
+	}
+	if allocation := annotations[internal.ThinAllocationAnnotation]; allocation != "" {
+		volumeCtx[internal.ThinAllocationKey] = allocation
+	}
+
+	// The provisioned size may be larger than the requested one, e.g. rounded up to the minimum volume size.
+	capacityBytes := request.CapacityRange.GetRequiredBytes()
+	if size, err := resource.ParseQuantity(llvSpec.Size); err == nil && size.Value() > capacityBytes {
+		capacityBytes = size.Value()
+	}
+	volumeCtx[internal.VolumeSizeKey] = strconv.FormatInt(capacityBytes, 10)
 
 	d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] Volume created successfully. volumeCtx: %+v", traceID, volumeID, volumeCtx))
 
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			CapacityBytes: request.CapacityRange.GetRequiredBytes(),
+			CapacityBytes: capacityBytes,
 			VolumeId:      request.Name,
 			VolumeContext: volumeCtx,
 			ContentSource: request.VolumeContentSource,
 			AccessibleTopology: []*csi.Topology{
 				{Segments: map[string]string{
-					internal.TopologyKey: preferredNode,
+					d.topologyKey: preferredNode,
 				}},
 			},
 		},
-	}, nil
+	}
+}
+
+// volumeNodeSelector returns the node selector of the storage class: the inode-based one if the storage class
+// selects the nodes by inodes, the configured one otherwise.
+func (d *Driver) volumeNodeSelector(params map[string]string) (utils.NodeSelector, error) {
+	metric, err := utils.GetSelectionMetric(params)
+	if err != nil {
+		return nil, err
+	}
+	if metric != internal.SelectionMetricInodes {
+		return d.nodeSelector, nil
+	}
+
+	ratios, err := utils.GetLVGBytesPerInode(params)
+	if err != nil {
+		return nil, err
+	}
+	return utils.MostFreeInodesNodeSelector{BytesPerInode: ratios}, nil
+}
+
+// selectWFFCNode returns the consumer's node if its LVMVolumeGroup has enough space for the volume.
+// Otherwise, the node with the most free space among the requisite topology nodes is returned.
+// The returned errors are gRPC status errors.
+func (d *Driver) selectWFFCNode(
+	traceID string,
+	request *csi.CreateVolumeRequest,
+	nodeSelector utils.NodeSelector,
+	storageClassLVGs []v1alpha1.LVMVolumeGroup,
+	storageClassLVGParametersMap map[string]string,
+	lvmType string,
+	llvSize resource.Quantity,
+) (string, error) {
+	volumeID := request.Name
+	accessibility := request.GetAccessibilityRequirements()
+
+	var consumerNode string
+	if len(accessibility.GetPreferred()) != 0 {
+		consumerNode = accessibility.GetPreferred()[0].GetSegments()[d.topologyKey]
+	}
+
+	if consumerNode != "" {
+		// the volume fits the consumer node if it fits the LVMVolumeGroup with the most free space on it
+		consumerLVG, _, err := d.lvgSelector.Select(storageClassLVGs, consumerNode, utils.SameNodeLVGPolicy{Name: internal.SameNodeLVGPolicyMostFree}, storageClassLVGParametersMap, lvmType, llvSize)
+		if errors.Is(err, utils.ErrThinPoolNotResolved) || errors.Is(err, utils.ErrThinPoolNotFound) {
+			return "", status.Errorf(codes.InvalidArgument, "error getting free space on the consumer node %s: %v", consumerNode, err)
+		}
+		if err != nil {
+			d.log.Warning(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] unable to select LVMVolumeGroup on the consumer node %s: %v", traceID, volumeID, consumerNode, err))
+		} else {
+			freeSpace, err := utils.GetLVGFreeSpace(*consumerLVG, storageClassLVGParametersMap, lvmType)
+			if err != nil {
+				if errors.Is(err, utils.ErrThinPoolNotResolved) || errors.Is(err, utils.ErrThinPoolNotFound) {
+					return "", status.Errorf(codes.InvalidArgument, "error getting free space on the consumer node %s: %v", consumerNode, err)
+				}
+				return "", status.Errorf(codes.Internal, "error getting free space on the consumer node %s: %v", consumerNode, err)
+			}
+
+			if freeSpace.Cmp(llvSize) >= 0 {
+				d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] consumer node %s has enough free space %s", traceID, volumeID, consumerNode, freeSpace.String()))
+				return consumerNode, nil
+			}
+			d.log.Warning(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] consumer node %s has not enough free space %s for the requested size %s", traceID, volumeID, consumerNode, freeSpace.String(), llvSize.String()))
+		}
+	}
+
+	requisiteNodes := make(map[string]struct{}, len(accessibility.GetRequisite()))
+	for _, topology := range accessibility.GetRequisite() {
+		if nodeName := topology.GetSegments()[d.topologyKey]; nodeName != "" {
+			requisiteNodes[nodeName] = struct{}{}
+		}
+	}
+
+	candidateLVGs := make([]v1alpha1.LVMVolumeGroup, 0, len(storageClassLVGs))
+	for _, lvg := range storageClassLVGs {
+		if _, ok := requisiteNodes[lvg.Spec.Local.NodeName]; ok || len(requisiteNodes) == 0 {
+			candidateLVGs = append(candidateLVGs, lvg)
+		}
+	}
+
+	nodeName, freeSpace, err := nodeSelector.SelectNode(candidateLVGs, storageClassLVGParametersMap, lvmType, llvSize)
+	if err != nil {
+		if errors.Is(err, utils.ErrLVGNotReady) {
+			return "", status.Errorf(codes.Unavailable, "no ready LVMVolumeGroups: %v", err)
+		}
+		if errors.Is(err, utils.ErrThinPoolNotResolved) || errors.Is(err, utils.ErrThinPoolNotFound) {
+			return "", status.Errorf(codes.InvalidArgument, "error selecting node: %v", err)
+		}
+		return "", status.Errorf(codes.Internal, "error selecting node: %v", err)
+	}
+	if nodeName == "" || freeSpace.Cmp(llvSize) < 0 {
+		candidates := append(
+			utils.EvaluateLVGCandidates(candidateLVGs, storageClassLVGParametersMap, lvmType, llvSize),
+			excludedLVGCandidates(storageClassLVGs, candidateLVGs, "node is not in the requisite topology")...,
+		)
+		return "", capacityExhaustedError(fmt.Sprintf("requested size: %s is greater than the max free space: %s", llvSize.String(), freeSpace.String()), candidates)
+	}
+
+	d.log.Info(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] falling back to node %s with free space %s", traceID, volumeID, nodeName, freeSpace.String()))
+	return nodeName, nil
 }
 
 func (d *Driver) DeleteVolume(ctx context.Context, request *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	traceID := uuid.New().String()
+	trace.SpanFromContext(ctx).SetAttributes(tracing.TraceIDKey.String(traceID))
 	d.log.Info("[DeleteVolume][traceID:%s] ========== Start DeleteVolume ============", traceID)
 	if len(request.VolumeId) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID cannot be empty")
 	}
 
-	err := utils.DeleteLVMLogicalVolume(ctx, d.cl, d.log, traceID, request.VolumeId)
+	if llv, err := utils.GetLVMLogicalVolume(ctx, d.cl, request.VolumeId, ""); err == nil {
+		release, err := d.acquireVGSlot(ctx, "DeleteVolume", traceID, request.VolumeId, llv.Spec.LVMVolumeGroupName)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	err := utils.DeleteLVMLogicalVolume(ctx, d.cl, d.log, traceID, request.VolumeId, d.llvFinalizer)
 	if err != nil {
 		d.log.Error(err, "error DeleteLVMLogicalVolume")
 	}
+	d.metrics.SetLLVErrored(request.VolumeId, false)
 	d.log.Info(fmt.Sprintf("[DeleteVolume][traceID:%s][volumeID:%s] Volume deleted successfully", traceID, request.VolumeId))
 	d.log.Info("[DeleteVolume][traceID:%s] ========== END DeleteVolume ============", traceID)
 	return &csi.DeleteVolumeResponse{}, nil
@@ -331,9 +1098,76 @@ func (d *Driver) ValidateVolumeCapabilities(_ context.Context, _ *csi.ValidateVo
 	return nil, nil
 }
 
-func (d *Driver) ListVolumes(_ context.Context, _ *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+func (d *Driver) ListVolumes(ctx context.Context, request *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
 	d.log.Info("call method ListVolumes")
-	return nil, nil
+
+	llvs := &v1alpha1.LVMLogicalVolumeList{}
+	if err := d.cl.List(ctx, llvs); err != nil {
+		d.log.Error(err, "[ListVolumes] error listing LVMLogicalVolumes")
+		return nil, status.Errorf(codes.Internal, "error listing LVMLogicalVolumes: %v", err)
+	}
+
+	volumes := make([]v1alpha1.LVMLogicalVolume, 0, len(llvs.Items))
+	for _, llv := range llvs.Items {
+		if slices.Contains(llv.Finalizers, d.llvFinalizer) {
+			volumes = append(volumes, llv)
+		}
+	}
+	slices.SortFunc(volumes, func(a, b v1alpha1.LVMLogicalVolume) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	start, end, err := pageBounds(len(volumes), request.GetStartingToken(), request.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+
+	response := &csi.ListVolumesResponse{Entries: make([]*csi.ListVolumesResponse_Entry, 0, end-start)}
+	for _, llv := range volumes[start:end] {
+		volume := &csi.Volume{VolumeId: llv.Name}
+		if size, err := resource.ParseQuantity(llv.Spec.Size); err == nil {
+			volume.CapacityBytes = size.Value()
+		}
+		if llv.Status != nil && !llv.Status.ActualSize.IsZero() {
+			volume.CapacityBytes = llv.Status.ActualSize.Value()
+		}
+		if d.listVolumesLayout {
+			volume.VolumeContext = utils.GetLLVSegmentLayout(&llv)
+		}
+		if allocation := utils.GetThinAllocation(&llv); allocation != "" {
+			if volume.VolumeContext == nil {
+				volume.VolumeContext = make(map[string]string, 1)
+			}
+			volume.VolumeContext[internal.ThinAllocationKey] = allocation
+		}
+
+		response.Entries = append(response.Entries, &csi.ListVolumesResponse_Entry{Volume: volume})
+	}
+
+	if end < len(volumes) {
+		response.NextToken = strconv.Itoa(end)
+	}
+
+	return response, nil
+}
+
+// pageBounds returns the bounds of the page of a sorted list starting at the token, which is the index of its first entry.
+func pageBounds(total int, startingToken string, maxEntries int32) (int, int, error) {
+	start := 0
+	if startingToken != "" {
+		var err error
+		start, err = strconv.Atoi(startingToken)
+		if err != nil || start < 0 || start > total {
+			return 0, 0, status.Errorf(codes.Aborted, "invalid starting token %q", startingToken)
+		}
+	}
+
+	end := total
+	if maxEntries > 0 && start+int(maxEntries) < end {
+		end = start + int(maxEntries)
+	}
+
+	return start, end, nil
 }
 
 func (d *Driver) GetCapacity(_ context.Context, _ *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
@@ -358,6 +1192,8 @@ func (d *Driver) ControllerGetCapabilities(_ context.Context, _ *csi.ControllerG
 		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
 	}
 
 	csiCaps := make([]*csi.ControllerServiceCapability, len(capabilities))
@@ -378,6 +1214,7 @@ func (d *Driver) ControllerGetCapabilities(_ context.Context, _ *csi.ControllerG
 
 func (d *Driver) CreateSnapshot(ctx context.Context, request *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
 	traceID := uuid.New().String()
+	trace.SpanFromContext(ctx).SetAttributes(tracing.TraceIDKey.String(traceID))
 
 	d.log.Trace(fmt.Sprintf("[CreateSnapshot][traceID:%s] ========== CreateSnapshot ============", traceID))
 	d.log.Trace(request.String())
@@ -426,6 +1263,21 @@ func (d *Driver) CreateSnapshot(ctx context.Context, request *csi.CreateSnapshot
 		)
 	}
 
+	freeze, err := utils.GetSnapshotFreeze(request.Parameters)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if freeze {
+		// the filesystem is thawed once the snapshot is taken or failed
+		thaw, err := d.freezeSourceVolume(ctx, traceID, llv, lvg.Spec.Local.NodeName, request.Name)
+		if err != nil {
+			return nil, err
+		}
+		if thaw != nil {
+			defer thaw()
+		}
+	}
+
 	// the snapshots are required to be created in the same node and device class as the source volume.
 
 	// suggested name is in form "{prefix}-{uuid}", where {prefix} is specified as external-snapshotter argument
@@ -497,11 +1349,32 @@ func (d *Driver) DeleteSnapshot(ctx context.Context, request *csi.DeleteSnapshot
 	}
 
 	traceID := uuid.New().String()
+	trace.SpanFromContext(ctx).SetAttributes(tracing.TraceIDKey.String(traceID))
 	d.log.Trace(fmt.Sprintf("[DeleteSnapshot][traceID:%s] ========== DeleteSnapshot ============", traceID))
 	d.log.Trace(request.String())
 
-	if err := utils.DeleteLVMLogicalVolumeSnapshot(ctx, d.cl, d.log, traceID, request.SnapshotId); err != nil {
-		d.log.Error(err, "error DeleteLVMLogicalVolume")
+	if _, err := utils.GetLVMLogicalVolumeSnapshot(ctx, d.cl, request.SnapshotId, ""); err != nil {
+		if kerrors.IsNotFound(err) {
+			d.log.Info(fmt.Sprintf("[DeleteSnapshot][traceID:%s][SnapshotId:%s] LVMLogicalVolumeSnapshot is already deleted", traceID, request.SnapshotId))
+			return &csi.DeleteSnapshotResponse{}, nil
+		}
+		d.log.Error(err, fmt.Sprintf("[DeleteSnapshot][traceID:%s][SnapshotId:%s] error getting LVMLogicalVolumeSnapshot", traceID, request.SnapshotId))
+		return nil, status.Errorf(codes.Internal, "error getting LVMLogicalVolumeSnapshot %s: %v", request.SnapshotId, err)
+	}
+
+	restoring, err := d.getRestoringLLVNames(ctx, request.SnapshotId)
+	if err != nil {
+		d.log.Error(err, fmt.Sprintf("[DeleteSnapshot][traceID:%s][SnapshotId:%s] error listing LVMLogicalVolumes", traceID, request.SnapshotId))
+		return nil, status.Errorf(codes.Internal, "error listing LVMLogicalVolumes: %v", err)
+	}
+	if len(restoring) > 0 {
+		d.log.Warning(fmt.Sprintf("[DeleteSnapshot][traceID:%s][SnapshotId:%s] snapshot is being restored to the LVMLogicalVolumes %v", traceID, request.SnapshotId, restoring))
+		return nil, status.Errorf(codes.FailedPrecondition, "snapshot %s is being restored to the volumes %v", request.SnapshotId, restoring)
+	}
+
+	if err := utils.DeleteLVMLogicalVolumeSnapshot(ctx, d.cl, d.log, traceID, request.SnapshotId); err != nil && !kerrors.IsNotFound(err) {
+		d.log.Error(err, fmt.Sprintf("[DeleteSnapshot][traceID:%s][SnapshotId:%s] error DeleteLVMLogicalVolumeSnapshot", traceID, request.SnapshotId))
+		return nil, status.Errorf(codes.Internal, "error deleting LVMLogicalVolumeSnapshot %s: %v", request.SnapshotId, err)
 	}
 
 	d.log.Info(fmt.Sprintf("[Snapshot][traceID:%s][SnapshotId:%s] Snapshot deleted successfully", traceID, request.SnapshotId))
@@ -509,13 +1382,84 @@ func (d *Driver) DeleteSnapshot(ctx context.Context, request *csi.DeleteSnapshot
 	return &csi.DeleteSnapshotResponse{}, nil
 }
 
-func (d *Driver) ListSnapshots(_ context.Context, _ *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+// getRestoringLLVNames returns the names of the LVMLogicalVolumes still being restored from the snapshot.
+func (d *Driver) getRestoringLLVNames(ctx context.Context, snapshotID string) ([]string, error) {
+	llvs := &v1alpha1.LVMLogicalVolumeList{}
+	if err := d.cl.List(ctx, llvs); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, llv := range llvs.Items {
+		source := llv.Spec.Source
+		if source == nil || source.Kind != sourceVolumeKindSnapshot || source.Name != snapshotID || llv.DeletionTimestamp != nil {
+			continue
+		}
+		if llv.Status != nil && (llv.Status.Phase == internal.LLVStatusCreated || llv.Status.Phase == utils.LLVStatusFailed) {
+			continue
+		}
+		names = append(names, llv.Name)
+	}
+
+	return names, nil
+}
+
+func (d *Driver) ListSnapshots(ctx context.Context, request *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
 	d.log.Info("call method ListSnapshots")
-	return nil, nil
+
+	llvsList := &v1alpha1.LVMLogicalVolumeSnapshotList{}
+	if err := d.cl.List(ctx, llvsList); err != nil {
+		d.log.Error(err, "[ListSnapshots] error listing LVMLogicalVolumeSnapshots")
+		return nil, status.Errorf(codes.Internal, "error listing LVMLogicalVolumeSnapshots: %v", err)
+	}
+
+	snapshots := make([]v1alpha1.LVMLogicalVolumeSnapshot, 0, len(llvsList.Items))
+	for _, llvs := range llvsList.Items {
+		if request.GetSnapshotId() != "" && llvs.Name != request.GetSnapshotId() {
+			continue
+		}
+		if request.GetSourceVolumeId() != "" && llvs.Spec.LVMLogicalVolumeName != request.GetSourceVolumeId() {
+			continue
+		}
+		snapshots = append(snapshots, llvs)
+	}
+	slices.SortFunc(snapshots, func(a, b v1alpha1.LVMLogicalVolumeSnapshot) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	start, end, err := pageBounds(len(snapshots), request.GetStartingToken(), request.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+
+	response := &csi.ListSnapshotsResponse{Entries: make([]*csi.ListSnapshotsResponse_Entry, 0, end-start)}
+	for _, llvs := range snapshots[start:end] {
+		snapshot := &csi.Snapshot{
+			SnapshotId:     llvs.Name,
+			SourceVolumeId: llvs.Spec.LVMLogicalVolumeName,
+			CreationTime: &timestamp.Timestamp{
+				Seconds: llvs.CreationTimestamp.Unix(),
+				Nanos:   0,
+			},
+			ReadyToUse: utils.IsLLVSReady(&llvs),
+		}
+		if llvs.Status != nil {
+			snapshot.SizeBytes = llvs.Status.Size.Value()
+		}
+
+		response.Entries = append(response.Entries, &csi.ListSnapshotsResponse_Entry{Snapshot: snapshot})
+	}
+
+	if end < len(snapshots) {
+		response.NextToken = strconv.Itoa(end)
+	}
+
+	return response, nil
 }
 
 func (d *Driver) ControllerExpandVolume(ctx context.Context, request *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
 	traceID := uuid.New().String()
+	trace.SpanFromContext(ctx).SetAttributes(tracing.TraceIDKey.String(traceID))
 
 	d.log.Info(fmt.Sprintf("[ControllerExpandVolume][traceID:%s] method ControllerExpandVolume", traceID))
 	d.log.Trace(fmt.Sprintf("[ControllerExpandVolume][traceID:%s] ========== ControllerExpandVolume ============", traceID))
@@ -527,10 +1471,10 @@ func (d *Driver) ControllerExpandVolume(ctx context.Context, request *csi.Contro
 		return nil, status.Error(codes.InvalidArgument, "Volume id cannot be empty")
 	}
 
-	llv, err := utils.GetLVMLogicalVolume(ctx, d.cl, volumeID, "")
+	llv, err := utils.GetReadyLVMLogicalVolume(ctx, d.cl, volumeID, "")
 	if err != nil {
 		d.log.Error(err, fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] error getting LVMLogicalVolume", traceID, volumeID))
-		return nil, status.Errorf(codes.Internal, "error getting LVMLogicalVolume: %s", err.Error())
+		return nil, getReadyError(err, "LVMLogicalVolume", volumeID)
 	}
 
 	resizeDelta, err := resource.ParseQuantity(internal.ResizeDelta)
@@ -539,57 +1483,89 @@ func (d *Driver) ControllerExpandVolume(ctx context.Context, request *csi.Contro
 		return nil, err
 	}
 	d.log.Trace(fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] resizeDelta: %s", traceID, volumeID, resizeDelta.String()))
-	requestCapacity := resource.NewQuantity(request.CapacityRange.GetRequiredBytes(), resource.BinarySI)
+	// LVM allocates whole extents, so the volume is expanded to the aligned size as it is created with it
+	requiredBytes := request.CapacityRange.GetRequiredBytes()
+	if alignedBytes := utils.AlignVolumeSize(requiredBytes, utils.DefaultExtentSize.Value()); alignedBytes != requiredBytes {
+		d.log.Info(fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] requested size %d is aligned to the %s extent size: %d", traceID, volumeID, requiredBytes, utils.DefaultExtentSize.String(), alignedBytes))
+		requiredBytes = alignedBytes
+	}
+	requestCapacity := utils.CapacityBytesToQuantity(requiredBytes)
 	d.log.Trace(fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] requestCapacity: %s", traceID, volumeID, requestCapacity.String()))
 
+	maxVolumeSize, err := utils.GetMaxVolumeSize(llv.Annotations, internal.MaxVolumeSizeAnnotation)
+	if err != nil {
+		d.log.Warning(fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] ignore the invalid maximum volume size: %v", traceID, volumeID, err))
+	}
+	if err := utils.CheckMaxVolumeSize(requiredBytes, maxVolumeSize); err != nil {
+		d.log.Error(err, fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] requested size is above the maximum volume size", traceID, volumeID))
+		return nil, status.Error(codes.OutOfRange, err.Error())
+	}
+
 	nodeExpansionRequired := true
 	if request.GetVolumeCapability().GetBlock() != nil {
 		nodeExpansionRequired = false
 	}
 	d.log.Info(fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] NodeExpansionRequired: %t", traceID, volumeID, nodeExpansionRequired))
 
-	if llv.Status.ActualSize.Value() > requestCapacity.Value()+resizeDelta.Value() || utils.AreSizesEqualWithinDelta(*requestCapacity, llv.Status.ActualSize, resizeDelta) {
+	requestCapacityWithDelta := requestCapacity.DeepCopy()
+	requestCapacityWithDelta.Add(resizeDelta)
+	if llv.Status.ActualSize.Cmp(requestCapacityWithDelta) > 0 || utils.AreSizesEqualWithinDelta(*requestCapacity, llv.Status.ActualSize, resizeDelta) {
 		d.log.Warning(fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] requested size is less than or equal to the actual size of the volume include delta %s , no need to resize LVMLogicalVolume %s, requested size: %s, actual size: %s, return NodeExpansionRequired: %t and CapacityBytes: %d", traceID, volumeID, resizeDelta.String(), volumeID, requestCapacity.String(), llv.Status.ActualSize.String(), nodeExpansionRequired, llv.Status.ActualSize.Value()))
+		d.clearLLVLastError(ctx, traceID, llv)
 		return &csi.ControllerExpandVolumeResponse{
 			CapacityBytes:         llv.Status.ActualSize.Value(),
 			NodeExpansionRequired: nodeExpansionRequired,
 		}, nil
 	}
 
-	lvg, err := utils.GetLVMVolumeGroup(ctx, d.cl, llv.Spec.LVMVolumeGroupName)
-	if err != nil {
-		d.log.Error(err, fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] error getting LVMVolumeGroup", traceID, volumeID))
-		return nil, status.Errorf(codes.Internal, "error getting LVMVolumeGroup: %v", err)
-	}
+	// the spec is already updated by a previous call that did not wait for the resize to complete
+	if specSize, err := resource.ParseQuantity(llv.Spec.Size); err == nil && specSize.Cmp(*requestCapacity) == 0 {
+		d.log.Info(fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] LVMLogicalVolume spec size is already %s, skip updating it", traceID, volumeID, llv.Spec.Size))
+	} else {
+		lvg, err := utils.GetReadyLVMVolumeGroup(ctx, d.cl, llv.Spec.LVMVolumeGroupName)
+		if err != nil {
+			d.log.Error(err, fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] error getting LVMVolumeGroup", traceID, volumeID))
+			return nil, getReadyError(err, "LVMVolumeGroup", llv.Spec.LVMVolumeGroupName)
+		}
 
-	if llv.Spec.Type == internal.LVMTypeThick {
-		lvgFreeSpace := utils.GetLVMVolumeGroupFreeSpace(*lvg)
+		if llv.Spec.Type == internal.LVMTypeThick {
+			lvgFreeSpace := utils.GetLVMVolumeGroupFreeSpace(*lvg)
 
-		if lvgFreeSpace.Value() < (requestCapacity.Value() - llv.Status.ActualSize.Value()) {
-			d.log.Error(err, fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] requested size: %s is greater than the capacity of the LVMVolumeGroup: %s", traceID, volumeID, requestCapacity.String(), lvgFreeSpace.String()))
-			return nil, status.Errorf(codes.Internal, "requested size: %s is greater than the capacity of the LVMVolumeGroup: %s", requestCapacity.String(), lvgFreeSpace.String())
+			if lvgFreeSpace.Value() < (requestCapacity.Value() - llv.Status.ActualSize.Value()) {
+				err = fmt.Errorf("requested size: %s is greater than the capacity of the LVMVolumeGroup: %s", requestCapacity.String(), lvgFreeSpace.String())
+				d.log.Error(err, fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] not enough space in the LVMVolumeGroup", traceID, volumeID))
+				d.setLLVLastError(ctx, traceID, llv, err)
+				return nil, status.Error(codes.Internal, err.Error())
+			}
 		}
-	}
 
-	d.log.Info(fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] start resize LVMLogicalVolume", traceID, volumeID))
-	d.log.Info(fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] requested size: %s, actual size: %s", traceID, volumeID, requestCapacity.String(), llv.Status.ActualSize.String()))
-	err = utils.ExpandLVMLogicalVolume(ctx, d.cl, llv, requestCapacity.String())
-	if err != nil {
-		d.log.Error(err, fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] error updating LVMLogicalVolume", traceID, volumeID))
-		return nil, status.Errorf(codes.Internal, "error updating LVMLogicalVolume: %v", err)
+		d.log.Info(fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] start resize LVMLogicalVolume", traceID, volumeID))
+		d.log.Info(fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] requested size: %s, actual size: %s", traceID, volumeID, requestCapacity.String(), llv.Status.ActualSize.String()))
+		err = utils.ExpandLVMLogicalVolume(ctx, d.cl, llv, requestCapacity.String())
+		if err != nil {
+			d.log.Error(err, fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] error updating LVMLogicalVolume", traceID, volumeID))
+			d.setLLVLastError(ctx, traceID, llv, err)
+			if errors.Is(err, utils.ErrInvalidExpandSize) {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			return nil, status.Errorf(codes.Internal, "error updating LVMLogicalVolume: %v", err)
+		}
 	}
 
-	attemptCounter, err := utils.WaitForStatusUpdate(ctx, d.cl, d.log, traceID, llv.Name, llv.Namespace, *requestCapacity, resizeDelta)
+	// the phase of a resized volume stays Created, so the expansion always waits for the new size
+	attemptCounter, err := utils.WaitForStatusUpdate(ctx, d.cl, d.log, traceID, llv.Name, llv.Namespace, *requestCapacity, resizeDelta, true)
 	if err != nil {
 		d.log.Error(err, fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] error WaitForStatusUpdate", traceID, volumeID))
-		return nil, err
+		d.setLLVLastError(ctx, traceID, llv, err)
+		return nil, llvFailureError(err)
 	}
 	d.log.Info(fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] finish resize LVMLogicalVolume, attempt counter = %d ", traceID, volumeID, attemptCounter))
+	d.clearLLVLastError(ctx, traceID, llv)
 
 	d.log.Info(fmt.Sprintf("[ControllerExpandVolume][traceID:%s][volumeID:%s] Volume expanded successfully", traceID, volumeID))
 
 	return &csi.ControllerExpandVolumeResponse{
-		CapacityBytes:         request.CapacityRange.RequiredBytes,
+		CapacityBytes:         requiredBytes,
 		NodeExpansionRequired: nodeExpansionRequired,
 	}, nil
 }
@@ -603,3 +1579,58 @@ func (d *Driver) ControllerModifyVolume(_ context.Context, _ *csi.ControllerModi
 	d.log.Info(" call method ControllerModifyVolume")
 	return &csi.ControllerModifyVolumeResponse{}, nil
 }
+
+// setLLVLastError records the failed operation on the LVMLogicalVolume. The failure to record it is only logged.
+func (d *Driver) setLLVLastError(ctx context.Context, traceID string, llv *v1alpha1.LVMLogicalVolume, opErr error) {
+	d.metrics.SetLLVErrored(llv.Name, true)
+	if err := utils.SetLLVLastError(ctx, d.cl, llv, opErr, time.Now()); err != nil {
+		d.log.Warning(fmt.Sprintf("[setLLVLastError][traceID:%s][volumeID:%s] unable to record the last error: %v", traceID, llv.Name, err))
+	}
+}
+
+// clearLLVLastError removes the recorded failure from the LVMLogicalVolume. The failure to remove it is only logged.
+func (d *Driver) clearLLVLastError(ctx context.Context, traceID string, llv *v1alpha1.LVMLogicalVolume) {
+	d.metrics.SetLLVErrored(llv.Name, false)
+	if err := utils.ClearLLVLastError(ctx, d.cl, llv); err != nil {
+		d.log.Warning(fmt.Sprintf("[clearLLVLastError][traceID:%s][volumeID:%s] unable to clear the last error: %v", traceID, llv.Name, err))
+	}
+}
+
+// sanitizeCreateVolumeRequest returns a copy of the request with the secret values masked, so it can be logged.
+func sanitizeCreateVolumeRequest(request *csi.CreateVolumeRequest) *csi.CreateVolumeRequest {
+	if len(request.GetSecrets()) == 0 {
+		return request
+	}
+
+	sanitized := proto.Clone(request).(*csi.CreateVolumeRequest)
+	for k := range sanitized.Secrets {
+		sanitized.Secrets[k] = "***stripped***"
+	}
+	return sanitized
+}
+
+// checkFreeSpaceThreshold warns if the free space of the LVMVolumeGroup or thin pool the volume is provisioned in
+// drops below the soft threshold. Thin volumes do not reserve space, so the current thin pool free space is checked.
+func (d *Driver) checkFreeSpaceThreshold(traceID, volumeID string, lvg v1alpha1.LVMVolumeGroup, llvSpec v1alpha1.LVMLogicalVolumeSpec, llvSize resource.Quantity, threshold utils.FreeSpaceThreshold) {
+	var free, total resource.Quantity
+	var thinPool string
+	switch llvSpec.Type {
+	case internal.LVMTypeThick:
+		free = lvg.Status.VGFree.DeepCopy()
+		free.Sub(llvSize)
+		total = lvg.Status.VGSize
+	case internal.LVMTypeThin:
+		thinPool = llvSpec.Thin.PoolName
+		for _, tp := range lvg.Status.ThinPools {
+			if tp.Name == thinPool {
+				free, total = tp.AvailableSpace, tp.ActualSize
+			}
+		}
+	}
+
+	below := threshold.IsBelow(free, total)
+	d.metrics.SetFreeSpaceBelowThreshold(lvg.Spec.Local.NodeName, lvg.Name, thinPool, below)
+	if below {
+		d.log.Warning(fmt.Sprintf("[CreateVolume][traceID:%s][volumeID:%s] free space %s of LVMVolumeGroup %s (thin pool %q) is below the soft threshold %s", traceID, volumeID, free.String(), lvg.Name, thinPool, threshold.String()))
+	}
+}
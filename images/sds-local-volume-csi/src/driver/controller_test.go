@@ -0,0 +1,2327 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	"sds-local-volume-csi/internal"
+	"sds-local-volume-csi/pkg/logger"
+	"sds-local-volume-csi/pkg/lvgcache"
+	"sds-local-volume-csi/pkg/utils"
+)
+
+func newTestScheme() *runtime.Scheme {
+	s := runtime.NewScheme()
+	_ = snc.AddToScheme(s)
+	_ = clientgoscheme.AddToScheme(s)
+	return s
+}
+
+func newFakeClient(objs ...client.Object) client.WithWatch {
+	return fake.NewClientBuilder().WithScheme(newTestScheme()).WithObjects(objs...).Build()
+}
+
+func newTestDriver(cl client.Client, opts ...Option) *Driver {
+	nodeName := "test-node"
+	d, _ := NewDriver("unix:///tmp/csi.sock", "", DefaultAddress, &nodeName, &logger.Logger{}, cl, opts...)
+	return d
+}
+
+func newTestLVG(name, nodeName, vgFree string) *snc.LVMVolumeGroup {
+	return &snc.LVMVolumeGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: snc.LVMVolumeGroupSpec{
+			ActualVGNameOnTheNode: "vg-" + name,
+			Local:                 snc.LVMVolumeGroupLocalSpec{NodeName: nodeName},
+		},
+		Status: snc.LVMVolumeGroupStatus{
+			Nodes:  []snc.LVMVolumeGroupNode{{Name: nodeName}},
+			VGFree: resource.MustParse(vgFree),
+			VGSize: resource.MustParse(vgFree),
+		},
+	}
+}
+
+func newTestNode(name string) *corev1.Node {
+	return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+}
+
+func newTestCreateVolumeRequest(name string, size int64, lvgs string) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name:          name,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: size},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}},
+		},
+		Parameters: map[string]string{
+			internal.TypeKey:           internal.Lvm,
+			internal.LvmTypeKey:        internal.LVMTypeThick,
+			internal.BindingModeKey:    internal.BindingModeI,
+			internal.LVMVolumeGroupKey: lvgs,
+		},
+	}
+}
+
+func TestCreateVolume(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("async_create_polls_until_created", func(t *testing.T) {
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+		d := newTestDriver(cl, WithAsyncCreateVolume(true))
+		request := newTestCreateVolumeRequest("pvc-async", 1<<30, "- name: lvg-1\n")
+
+		_, err := d.CreateVolume(ctx, request)
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-async"}, llv))
+		assert.Equal(t, "lvg-1", llv.Spec.LVMVolumeGroupName)
+
+		_, err = d.CreateVolume(ctx, request)
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+		llv.Status = &snc.LVMLogicalVolumeStatus{
+			Phase:      internal.LLVStatusCreated,
+			ActualSize: resource.MustParse("1Gi"),
+		}
+		require.NoError(t, cl.Update(ctx, llv))
+
+		resp, err := d.CreateVolume(ctx, request)
+		require.NoError(t, err)
+		assert.Equal(t, "pvc-async", resp.Volume.VolumeId)
+		assert.Equal(t, "vg-lvg-1", resp.Volume.VolumeContext[internal.VGNameKey])
+		assert.Equal(t, "1073741824", resp.Volume.VolumeContext[internal.VolumeSizeKey])
+		assert.Equal(t, "node-1", resp.Volume.AccessibleTopology[0].Segments[internal.TopologyKey])
+	})
+
+	t.Run("async_create_reports_failed_llv", func(t *testing.T) {
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+		d := newTestDriver(cl, WithAsyncCreateVolume(true))
+		request := newTestCreateVolumeRequest("pvc-failed", 1<<30, "- name: lvg-1\n")
+
+		_, err := d.CreateVolume(ctx, request)
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-failed"}, llv))
+		llv.Status = &snc.LVMLogicalVolumeStatus{Phase: "Failed", Reason: "no space"}
+		require.NoError(t, cl.Update(ctx, llv))
+
+		_, err = d.CreateVolume(ctx, request)
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+		assert.ErrorContains(t, err, "no space")
+	})
+
+	t.Run("lvg_without_nodes_returns_unavailable", func(t *testing.T) {
+		lvg := newTestLVG("lvg-1", "node-1", "10Gi")
+		lvg.Status.Nodes = nil
+		d := newTestDriver(newFakeClient(lvg))
+
+		_, err := d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-not-ready", 1<<30, "- name: lvg-1\n"))
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	})
+
+	t.Run("cordoned_node_is_skipped", func(t *testing.T) {
+		cordoned := newTestNode("node-1")
+		cordoned.Spec.Unschedulable = true
+		cl := newFakeClient(
+			newTestLVG("lvg-1", "node-1", "100Gi"), cordoned,
+			newTestLVG("lvg-2", "node-2", "10Gi"), newTestNode("node-2"),
+		)
+		d := newTestDriver(cl, WithAsyncCreateVolume(true))
+
+		_, err := d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-cordon", 1<<30, "- name: lvg-1\n- name: lvg-2\n"))
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-cordon"}, llv))
+		assert.Equal(t, "lvg-2", llv.Spec.LVMVolumeGroupName)
+	})
+
+	t.Run("all_nodes_excluded_returns_resource_exhausted", func(t *testing.T) {
+		tainted := newTestNode("node-1")
+		tainted.Spec.Taints = []corev1.Taint{{Key: "example.com/draining", Effect: corev1.TaintEffectNoSchedule}}
+		d := newTestDriver(newFakeClient(newTestLVG("lvg-1", "node-1", "100Gi"), tainted), WithExcludeNodeTaint("example.com/draining"))
+
+		_, err := d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-tainted", 1<<30, "- name: lvg-1\n"))
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	})
+
+	t.Run("class_provision_timeout_is_honored", func(t *testing.T) {
+		d := newTestDriver(newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1")))
+		request := newTestCreateVolumeRequest("pvc-timeout", 1<<30, "- name: lvg-1\n")
+		request.Parameters[internal.ProvisionTimeoutKey] = "1s"
+
+		start := time.Now()
+		_, err := d.CreateVolume(ctx, request)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), 5*time.Second)
+	})
+
+	t.Run("unparseable_provision_timeout_is_rejected", func(t *testing.T) {
+		d := newTestDriver(newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1")))
+		request := newTestCreateVolumeRequest("pvc-timeout", 1<<30, "- name: lvg-1\n")
+		request.Parameters[internal.ProvisionTimeoutKey] = "soon"
+
+		_, err := d.CreateVolume(ctx, request)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+func TestCreateVolumeWaitForFirstConsumer(t *testing.T) {
+	ctx := context.Background()
+
+	newRequest := func(name string, size int64) *csi.CreateVolumeRequest {
+		request := newTestCreateVolumeRequest(name, size, "- name: lvg-1\n- name: lvg-2\n")
+		request.Parameters[internal.BindingModeKey] = internal.BindingModeWFFC
+		request.AccessibilityRequirements = &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{
+				{Segments: map[string]string{internal.TopologyKey: "node-1"}},
+				{Segments: map[string]string{internal.TopologyKey: "node-2"}},
+			},
+			Preferred: []*csi.Topology{
+				{Segments: map[string]string{internal.TopologyKey: "node-1"}},
+			},
+		}
+		return request
+	}
+
+	t.Run("consumer_node_has_space", func(t *testing.T) {
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "2Gi"), newTestLVG("lvg-2", "node-2", "100Gi"))
+		d := newTestDriver(cl, WithAsyncCreateVolume(true))
+
+		_, err := d.CreateVolume(ctx, newRequest("pvc-consumer", 1<<30))
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-consumer"}, llv))
+		assert.Equal(t, "lvg-1", llv.Spec.LVMVolumeGroupName)
+	})
+
+	t.Run("consumer_node_full_falls_back_to_free_space", func(t *testing.T) {
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "1Gi"), newTestLVG("lvg-2", "node-2", "100Gi"))
+		d := newTestDriver(cl, WithAsyncCreateVolume(true))
+
+		_, err := d.CreateVolume(ctx, newRequest("pvc-fallback", 2<<30))
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-fallback"}, llv))
+		assert.Equal(t, "lvg-2", llv.Spec.LVMVolumeGroupName)
+	})
+
+	t.Run("no_node_has_space", func(t *testing.T) {
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "1Gi"), newTestLVG("lvg-2", "node-2", "1Gi"))
+		d := newTestDriver(cl, WithAsyncCreateVolume(true))
+
+		_, err := d.CreateVolume(ctx, newRequest("pvc-full", 2<<30))
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	})
+}
+
+func TestCreateVolumeProvisioningConditions(t *testing.T) {
+	ctx := context.Background()
+
+	var written [][]string
+	cl := fake.NewClientBuilder().
+		WithScheme(newTestScheme()).
+		WithObjects(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1")).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+				if llv, ok := obj.(*snc.LVMLogicalVolume); ok {
+					conditions, err := utils.GetLLVProvisioningConditions(llv)
+					require.NoError(t, err)
+					types := make([]string, 0, len(conditions))
+					for _, c := range conditions {
+						types = append(types, c.Type)
+					}
+					written = append(written, types)
+				}
+				return c.Patch(ctx, obj, patch, opts...)
+			},
+		}).
+		Build()
+	d := newTestDriver(cl, WithAsyncCreateVolume(true))
+	request := newTestCreateVolumeRequest("pvc-progress", 1<<30, "- name: lvg-1\n")
+
+	_, err := d.CreateVolume(ctx, request)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	llv := &snc.LVMLogicalVolume{}
+	require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-progress"}, llv))
+	llv.Status = &snc.LVMLogicalVolumeStatus{Phase: internal.LLVStatusCreated, ActualSize: resource.MustParse("1Gi")}
+	require.NoError(t, cl.Update(ctx, llv))
+
+	_, err = d.CreateVolume(ctx, request)
+	require.NoError(t, err)
+
+	assert.Equal(t, [][]string{
+		{internal.ProvisioningConditionNodeSelected, internal.ProvisioningConditionLVCreationRequested},
+		{internal.ProvisioningConditionNodeSelected, internal.ProvisioningConditionLVCreationRequested, internal.ProvisioningConditionWaitingForActivation},
+		{internal.ProvisioningConditionNodeSelected, internal.ProvisioningConditionLVCreationRequested, internal.ProvisioningConditionWaitingForActivation, internal.ProvisioningConditionProvisioned},
+	}, written)
+
+	require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-progress"}, llv))
+	conditions, err := utils.GetLLVProvisioningConditions(llv)
+	require.NoError(t, err)
+	for _, c := range conditions {
+		assert.Equal(t, metav1.ConditionTrue, c.Status)
+		assert.False(t, c.LastTransitionTime.IsZero())
+		assert.NotEmpty(t, c.Message)
+	}
+	assert.Equal(t, "selected LVMVolumeGroup lvg-1 on node node-1", conditions[0].Message)
+}
+
+func TestListVolumes(t *testing.T) {
+	ctx := context.Background()
+
+	newLLV := func(name string, contiguous *bool) *snc.LVMLogicalVolume {
+		return &snc.LVMLogicalVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Finalizers: []string{utils.SDSLocalVolumeCSIFinalizer}},
+			Spec:       snc.LVMLogicalVolumeSpec{Type: internal.LVMTypeThick, Size: "1Gi", LVMVolumeGroupName: "lvg-1"},
+			Status:     &snc.LVMLogicalVolumeStatus{Phase: internal.LLVStatusCreated, ActualSize: resource.MustParse("1Gi"), Contiguous: contiguous},
+		}
+	}
+	contiguous := true
+	foreign := newLLV("pvc-foreign", nil)
+	foreign.Finalizers = nil
+	cl := newFakeClient(newLLV("pvc-contiguous", &contiguous), newLLV("pvc-unknown", nil), foreign)
+
+	t.Run("layout_is_reported_when_known", func(t *testing.T) {
+		d := newTestDriver(cl, WithListVolumesLayout(true))
+
+		resp, err := d.ListVolumes(ctx, &csi.ListVolumesRequest{})
+		require.NoError(t, err)
+		require.Len(t, resp.Entries, 2)
+
+		assert.Equal(t, "pvc-contiguous", resp.Entries[0].Volume.VolumeId)
+		assert.Equal(t, int64(1<<30), resp.Entries[0].Volume.CapacityBytes)
+		assert.Equal(t, map[string]string{internal.LayoutContiguousKey: "true", internal.LayoutSegmentsKey: "1"}, resp.Entries[0].Volume.VolumeContext)
+
+		assert.Equal(t, "pvc-unknown", resp.Entries[1].Volume.VolumeId)
+		assert.Empty(t, resp.Entries[1].Volume.VolumeContext)
+	})
+
+	t.Run("layout_is_omitted_when_disabled", func(t *testing.T) {
+		d := newTestDriver(cl)
+
+		resp, err := d.ListVolumes(ctx, &csi.ListVolumesRequest{})
+		require.NoError(t, err)
+		require.Len(t, resp.Entries, 2)
+		assert.Empty(t, resp.Entries[0].Volume.VolumeContext)
+	})
+
+	t.Run("pagination", func(t *testing.T) {
+		d := newTestDriver(cl)
+
+		resp, err := d.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 1})
+		require.NoError(t, err)
+		require.Len(t, resp.Entries, 1)
+		assert.Equal(t, "1", resp.NextToken)
+
+		resp, err = d.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 1, StartingToken: resp.NextToken})
+		require.NoError(t, err)
+		require.Len(t, resp.Entries, 1)
+		assert.Equal(t, "pvc-unknown", resp.Entries[0].Volume.VolumeId)
+		assert.Empty(t, resp.NextToken)
+
+		_, err = d.ListVolumes(ctx, &csi.ListVolumesRequest{StartingToken: "bogus"})
+		assert.Equal(t, codes.Aborted, status.Code(err))
+	})
+}
+
+func TestListSnapshots(t *testing.T) {
+	ctx := context.Background()
+
+	newLLVS := func(name, source string, backing string) *snc.LVMLogicalVolumeSnapshot {
+		return &snc.LVMLogicalVolumeSnapshot{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       snc.LVMLogicalVolumeSnapshotSpec{LVMLogicalVolumeName: source, ActualSnapshotNameOnTheNode: name},
+			Status: &snc.LVMLogicalVolumeSnapshotStatus{
+				Phase:                 utils.LLVSStatusCreated,
+				ActualLVNameOnTheNode: backing,
+				Size:                  resource.MustParse("1Gi"),
+			},
+		}
+	}
+	cl := newFakeClient(
+		newLLVS("snap-1", "pvc-1", "snap-1"),
+		newLLVS("snap-2", "pvc-2", "snap-2"),
+		newLLVS("snap-3", "pvc-1", ""),
+	)
+	d := newTestDriver(cl)
+
+	t.Run("pagination", func(t *testing.T) {
+		resp, err := d.ListSnapshots(ctx, &csi.ListSnapshotsRequest{MaxEntries: 2})
+		require.NoError(t, err)
+		require.Len(t, resp.Entries, 2)
+		assert.Equal(t, "snap-1", resp.Entries[0].Snapshot.SnapshotId)
+		assert.Equal(t, "pvc-1", resp.Entries[0].Snapshot.SourceVolumeId)
+		assert.Equal(t, int64(1<<30), resp.Entries[0].Snapshot.SizeBytes)
+		assert.True(t, resp.Entries[0].Snapshot.ReadyToUse)
+		assert.Equal(t, "snap-2", resp.Entries[1].Snapshot.SnapshotId)
+		assert.Equal(t, "2", resp.NextToken)
+
+		resp, err = d.ListSnapshots(ctx, &csi.ListSnapshotsRequest{MaxEntries: 2, StartingToken: resp.NextToken})
+		require.NoError(t, err)
+		require.Len(t, resp.Entries, 1)
+		assert.Equal(t, "snap-3", resp.Entries[0].Snapshot.SnapshotId)
+		assert.Empty(t, resp.NextToken)
+
+		_, err = d.ListSnapshots(ctx, &csi.ListSnapshotsRequest{StartingToken: "4"})
+		assert.Equal(t, codes.Aborted, status.Code(err))
+	})
+
+	t.Run("source_volume_filter", func(t *testing.T) {
+		resp, err := d.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SourceVolumeId: "pvc-1"})
+		require.NoError(t, err)
+		require.Len(t, resp.Entries, 2)
+		assert.Equal(t, "snap-1", resp.Entries[0].Snapshot.SnapshotId)
+		assert.Equal(t, "snap-3", resp.Entries[1].Snapshot.SnapshotId)
+
+		resp, err = d.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SourceVolumeId: "pvc-missing"})
+		require.NoError(t, err)
+		assert.Empty(t, resp.Entries)
+	})
+
+	t.Run("missing_backing_snapshot_is_not_ready", func(t *testing.T) {
+		resp, err := d.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SnapshotId: "snap-3"})
+		require.NoError(t, err)
+		require.Len(t, resp.Entries, 1)
+		assert.False(t, resp.Entries[0].Snapshot.ReadyToUse)
+	})
+}
+
+func TestDeleteSnapshot(t *testing.T) {
+	ctx := context.Background()
+
+	newLLVS := func() *snc.LVMLogicalVolumeSnapshot {
+		return &snc.LVMLogicalVolumeSnapshot{
+			ObjectMeta: metav1.ObjectMeta{Name: "snap-1", Finalizers: []string{utils.SDSLocalVolumeCSIFinalizer}},
+			Spec:       snc.LVMLogicalVolumeSnapshotSpec{LVMLogicalVolumeName: "pvc-1", ActualSnapshotNameOnTheNode: "snap-1"},
+		}
+	}
+	newRestoredLLV := func(status *snc.LVMLogicalVolumeStatus) *snc.LVMLogicalVolume {
+		return &snc.LVMLogicalVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-restored"},
+			Spec: snc.LVMLogicalVolumeSpec{
+				LVMVolumeGroupName: "lvg-1",
+				Source:             &snc.LVMLogicalVolumeSource{Kind: sourceVolumeKindSnapshot, Name: "snap-1"},
+			},
+			Status: status,
+		}
+	}
+
+	t.Run("already_deleted_snapshot_succeeds", func(t *testing.T) {
+		d := newTestDriver(newFakeClient())
+
+		_, err := d.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: "snap-1"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("snapshot_is_deleted_with_its_finalizer", func(t *testing.T) {
+		cl := newFakeClient(newLLVS())
+		d := newTestDriver(cl)
+
+		_, err := d.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: "snap-1"})
+		require.NoError(t, err)
+
+		err = cl.Get(ctx, client.ObjectKey{Name: "snap-1"}, &snc.LVMLogicalVolumeSnapshot{})
+		assert.True(t, kerrors.IsNotFound(err), "expected the snapshot to be deleted, got %v", err)
+
+		_, err = d.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: "snap-1"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("snapshot_referenced_by_restore_is_rejected", func(t *testing.T) {
+		cl := newFakeClient(newLLVS(), newRestoredLLV(nil))
+		d := newTestDriver(cl)
+
+		_, err := d.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: "snap-1"})
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+		assert.ErrorContains(t, err, "pvc-restored")
+		assert.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "snap-1"}, &snc.LVMLogicalVolumeSnapshot{}))
+	})
+
+	t.Run("snapshot_of_completed_restore_is_deleted", func(t *testing.T) {
+		cl := newFakeClient(newLLVS(), newRestoredLLV(&snc.LVMLogicalVolumeStatus{Phase: internal.LLVStatusCreated}))
+		d := newTestDriver(cl)
+
+		_, err := d.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: "snap-1"})
+		require.NoError(t, err)
+
+		err = cl.Get(ctx, client.ObjectKey{Name: "snap-1"}, &snc.LVMLogicalVolumeSnapshot{})
+		assert.True(t, kerrors.IsNotFound(err), "expected the snapshot to be deleted, got %v", err)
+	})
+}
+
+func TestLLVFinalizer(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name      string
+		opts      []Option
+		finalizer string
+	}{
+		{name: "default_finalizer", finalizer: utils.SDSLocalVolumeCSIFinalizer},
+		{name: "configured_finalizer", opts: []Option{WithLLVFinalizer("example.com/custom")}, finalizer: "example.com/custom"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+			d := newTestDriver(cl, append(tc.opts, WithAsyncCreateVolume(true))...)
+
+			_, err := d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-finalizer", 1<<30, "- name: lvg-1\n"))
+			assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+			llv := &snc.LVMLogicalVolume{}
+			require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-finalizer"}, llv))
+			assert.Equal(t, []string{tc.finalizer}, llv.Finalizers)
+
+			_, err = d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "pvc-finalizer"})
+			require.NoError(t, err)
+
+			err = cl.Get(ctx, client.ObjectKey{Name: "pvc-finalizer"}, llv)
+			assert.True(t, kerrors.IsNotFound(err))
+		})
+	}
+}
+
+func TestControllerExpandVolumeLastError(t *testing.T) {
+	ctx := context.Background()
+
+	llv := &snc.LVMLogicalVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-expand"},
+		Spec: snc.LVMLogicalVolumeSpec{
+			Type:                  internal.LVMTypeThick,
+			LVMVolumeGroupName:    "lvg-1",
+			ActualLVNameOnTheNode: "pvc-expand",
+			Size:                  "1Gi",
+		},
+		Status: &snc.LVMLogicalVolumeStatus{ActualSize: resource.MustParse("1Gi")},
+	}
+	cl := newFakeClient(newTestLVG("lvg-1", "node-1", "1Gi"), llv)
+	d := newTestDriver(cl)
+
+	erroredLLVs := func(n int) string {
+		return fmt.Sprintf(`
+# HELP sds_local_volume_csi_errored_llvs Number of LVMLogicalVolumes whose last operation failed.
+# TYPE sds_local_volume_csi_errored_llvs gauge
+sds_local_volume_csi_errored_llvs %d
+`, n)
+	}
+	request := &csi.ControllerExpandVolumeRequest{
+		VolumeId:      "pvc-expand",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 4 << 30},
+	}
+
+	_, err := d.ControllerExpandVolume(ctx, request)
+	assert.Equal(t, codes.Internal, status.Code(err))
+
+	got := &snc.LVMLogicalVolume{}
+	require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-expand"}, got))
+	assert.Contains(t, got.Annotations[internal.LastErrorAnnotation], "is greater than the capacity of the LVMVolumeGroup")
+	assert.NotEmpty(t, got.Annotations[internal.LastErrorTimeAnnotation])
+	assert.NoError(t, testutil.GatherAndCompare(d.metrics.Registry(), strings.NewReader(erroredLLVs(1)), "sds_local_volume_csi_errored_llvs"))
+
+	got.Status.ActualSize = resource.MustParse("4Gi")
+	require.NoError(t, cl.Update(ctx, got))
+
+	_, err = d.ControllerExpandVolume(ctx, request)
+	require.NoError(t, err)
+
+	require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-expand"}, got))
+	assert.NotContains(t, got.Annotations, internal.LastErrorAnnotation)
+	assert.NotContains(t, got.Annotations, internal.LastErrorTimeAnnotation)
+	assert.NoError(t, testutil.GatherAndCompare(d.metrics.Registry(), strings.NewReader(erroredLLVs(0)), "sds_local_volume_csi_errored_llvs"))
+}
+
+func TestControllerExpandVolumeNotReady(t *testing.T) {
+	ctx := context.Background()
+	request := func(volumeID string) *csi.ControllerExpandVolumeRequest {
+		return &csi.ControllerExpandVolumeRequest{VolumeId: volumeID, CapacityRange: &csi.CapacityRange{RequiredBytes: 2 << 30}}
+	}
+
+	t.Run("missing_volume_is_not_found", func(t *testing.T) {
+		d := newTestDriver(newFakeClient())
+
+		_, err := d.ControllerExpandVolume(ctx, request("pvc-missing"))
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("volume_without_status_is_unavailable", func(t *testing.T) {
+		llv := &snc.LVMLogicalVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-1"},
+			Spec:       snc.LVMLogicalVolumeSpec{Type: internal.LVMTypeThick, LVMVolumeGroupName: "lvg-1", Size: "1Gi"},
+		}
+		d := newTestDriver(newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), llv))
+
+		_, err := d.ControllerExpandVolume(ctx, request("pvc-1"))
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	})
+
+	t.Run("lvg_without_status_is_unavailable", func(t *testing.T) {
+		llv := &snc.LVMLogicalVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-1"},
+			Spec:       snc.LVMLogicalVolumeSpec{Type: internal.LVMTypeThick, LVMVolumeGroupName: "lvg-1", Size: "1Gi"},
+			Status:     &snc.LVMLogicalVolumeStatus{Phase: internal.LLVStatusCreated, ActualSize: resource.MustParse("1Gi")},
+		}
+		d := newTestDriver(newFakeClient(&snc.LVMVolumeGroup{ObjectMeta: metav1.ObjectMeta{Name: "lvg-1"}}, llv))
+
+		_, err := d.ControllerExpandVolume(ctx, request("pvc-1"))
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	})
+}
+
+func TestCreateVolumeThinPoolNotSpecified(t *testing.T) {
+	ctx := context.Background()
+
+	lvg := newTestLVG("lvg-1", "node-1", "10Gi")
+	lvg.Status.ThinPools = []snc.LVMVolumeGroupThinPoolStatus{
+		{Name: "pool-1", AvailableSpace: resource.MustParse("10Gi")},
+		{Name: "pool-2", AvailableSpace: resource.MustParse("10Gi")},
+	}
+	d := newTestDriver(newFakeClient(lvg, newTestNode("node-1")))
+
+	request := newTestCreateVolumeRequest("pvc-thin", 1<<30, "- name: lvg-1\n")
+	request.Parameters[internal.LvmTypeKey] = internal.LVMTypeThin
+
+	_, err := d.CreateVolume(ctx, request)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.ErrorContains(t, err, "specify thin.poolName")
+}
+
+func TestCreateVolumeThinPoolNotFound(t *testing.T) {
+	ctx := context.Background()
+
+	lvg := newTestLVG("lvg-1", "node-1", "10Gi")
+	lvg.Status.ThinPools = []snc.LVMVolumeGroupThinPoolStatus{
+		{Name: "pool-1", AvailableSpace: resource.MustParse("10Gi")},
+		{Name: "pool-2", AvailableSpace: resource.MustParse("10Gi")},
+	}
+	d := newTestDriver(newFakeClient(lvg, newTestNode("node-1")))
+
+	request := newTestCreateVolumeRequest("pvc-thin", 1<<30, "- name: lvg-1\n  thin:\n    poolName: pool-3\n")
+	request.Parameters[internal.LvmTypeKey] = internal.LVMTypeThin
+	request.Parameters[internal.BindingModeKey] = internal.BindingModeWFFC
+	request.AccessibilityRequirements = &csi.TopologyRequirement{
+		Preferred: []*csi.Topology{{Segments: map[string]string{internal.TopologyKey: "node-1"}}},
+	}
+
+	_, err := d.CreateVolume(ctx, request)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.ErrorContains(t, err, "available thin pools: [pool-1 pool-2]")
+}
+
+func TestCreateVolumeContradictoryLVMTypeParameters(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDriver(newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1")))
+
+	request := newTestCreateVolumeRequest("pvc-thin", 1<<30, "- name: lvg-1\n  thin:\n    poolName: pool-1\n")
+	request.Parameters[internal.LvmTypeKey] = internal.LVMTypeThin
+	request.Parameters[internal.LVMVThickContiguousParamKey] = "true"
+
+	_, err := d.CreateVolume(ctx, request)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.ErrorContains(t, err, "is only supported for Thick volumes")
+}
+
+func TestCreateVolumeThinAllocation(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name        string
+		preallocate string
+		used        string
+		block       bool
+		allocation  string
+	}{
+		{name: "lazy_by_default", used: "1Gi", allocation: internal.ThinAllocationLazy},
+		{name: "preallocated_when_requested", preallocate: "true", used: "1Gi", allocation: internal.ThinAllocationPreallocated},
+		{name: "pool_without_physical_space_falls_back_to_lazy", preallocate: "true", used: "9500Mi", allocation: internal.ThinAllocationLazy},
+		{name: "block_volume_falls_back_to_lazy", preallocate: "true", used: "1Gi", block: true, allocation: internal.ThinAllocationLazy},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lvg := newTestLVG("lvg-1", "node-1", "10Gi")
+			lvg.Status.ThinPools = []snc.LVMVolumeGroupThinPoolStatus{
+				{Name: "pool-1", ActualSize: resource.MustParse("10Gi"), UsedSize: resource.MustParse(tc.used), AvailableSpace: resource.MustParse("10Gi")},
+			}
+			cl := newFakeClient(lvg, newTestNode("node-1"))
+			d := newTestDriver(cl, WithAsyncCreateVolume(true))
+
+			request := newTestCreateVolumeRequest("pvc-thin", 1<<30, "- name: lvg-1\n  thin:\n    poolName: pool-1\n")
+			request.Parameters[internal.LvmTypeKey] = internal.LVMTypeThin
+			if tc.preallocate != "" {
+				request.Parameters[internal.ThinPreallocateKey] = tc.preallocate
+			}
+			if tc.block {
+				request.VolumeCapabilities = []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}}
+			}
+
+			_, err := d.CreateVolume(ctx, request)
+			assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+			llv := &snc.LVMLogicalVolume{}
+			require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-thin"}, llv))
+			assert.Equal(t, tc.allocation, llv.Annotations[internal.ThinAllocationAnnotation])
+
+			llv.Status = &snc.LVMLogicalVolumeStatus{Phase: internal.LLVStatusCreated, ActualSize: resource.MustParse("1Gi")}
+			require.NoError(t, cl.Update(ctx, llv))
+
+			resp, err := d.CreateVolume(ctx, request)
+			require.NoError(t, err)
+			assert.Equal(t, tc.allocation, resp.Volume.VolumeContext[internal.ThinAllocationKey])
+
+			list, err := d.ListVolumes(ctx, &csi.ListVolumesRequest{})
+			require.NoError(t, err)
+			require.Len(t, list.Entries, 1)
+			assert.Equal(t, tc.allocation, list.Entries[0].Volume.VolumeContext[internal.ThinAllocationKey])
+		})
+	}
+
+	t.Run("invalid_preallocate_is_rejected", func(t *testing.T) {
+		d := newTestDriver(newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1")))
+		request := newTestCreateVolumeRequest("pvc-thin", 1<<30, "- name: lvg-1\n  thin:\n    poolName: pool-1\n")
+		request.Parameters[internal.LvmTypeKey] = internal.LVMTypeThin
+		request.Parameters[internal.ThinPreallocateKey] = "always"
+
+		_, err := d.CreateVolume(ctx, request)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("thick_preallocate_is_rejected", func(t *testing.T) {
+		d := newTestDriver(newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1")))
+		request := newTestCreateVolumeRequest("pvc-thick", 1<<30, "- name: lvg-1\n")
+		request.Parameters[internal.ThinPreallocateKey] = "true"
+
+		_, err := d.CreateVolume(ctx, request)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.ErrorContains(t, err, "is only supported for Thin volumes")
+	})
+}
+
+func TestCreateVolumeThinActualSize(t *testing.T) {
+	ctx := context.Background()
+
+	newThinClient := func() client.WithWatch {
+		lvg := newTestLVG("lvg-1", "node-1", "10Gi")
+		lvg.Status.ThinPools = []snc.LVMVolumeGroupThinPoolStatus{{Name: "pool-1", AvailableSpace: resource.MustParse("10Gi")}}
+		return newFakeClient(lvg, newTestNode("node-1"))
+	}
+	newThinRequest := func() *csi.CreateVolumeRequest {
+		request := newTestCreateVolumeRequest("pvc-thin", 1<<30, "- name: lvg-1\n  thin:\n    poolName: pool-1\n")
+		request.Parameters[internal.LvmTypeKey] = internal.LVMTypeThin
+		return request
+	}
+	// markCreatedLazily plays the node agent reporting the space allocated in the thin pool as the actual size
+	markCreatedLazily := func(t *testing.T, cl client.Client) {
+		llv := &snc.LVMLogicalVolume{}
+		require.Eventually(t, func() bool { return cl.Get(ctx, client.ObjectKey{Name: "pvc-thin"}, llv) == nil }, 5*time.Second, 10*time.Millisecond)
+		llv.Status = &snc.LVMLogicalVolumeStatus{Phase: internal.LLVStatusCreated, ActualSize: resource.MustParse("4Mi")}
+		require.NoError(t, cl.Update(ctx, llv))
+	}
+
+	t.Run("created_phase_is_enough_by_default", func(t *testing.T) {
+		cl := newThinClient()
+		d := newTestDriver(cl)
+
+		errs := make(chan error, 1)
+		go func() {
+			_, err := d.CreateVolume(ctx, newThinRequest())
+			errs <- err
+		}()
+		markCreatedLazily(t, cl)
+
+		select {
+		case err := <-errs:
+			require.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("CreateVolume did not return for the created thin volume")
+		}
+	})
+
+	t.Run("created_phase_is_enough_in_async_mode", func(t *testing.T) {
+		cl := newThinClient()
+		d := newTestDriver(cl, WithAsyncCreateVolume(true))
+
+		_, err := d.CreateVolume(ctx, newThinRequest())
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+		markCreatedLazily(t, cl)
+
+		resp, err := d.CreateVolume(ctx, newThinRequest())
+		require.NoError(t, err)
+		assert.Equal(t, int64(1<<30), resp.Volume.CapacityBytes)
+	})
+
+	t.Run("strict_check_waits_for_size", func(t *testing.T) {
+		cl := newThinClient()
+		d := newTestDriver(cl, WithStrictThinSizeCheck(true))
+
+		waitCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		errs := make(chan error, 1)
+		go func() {
+			_, err := d.CreateVolume(waitCtx, newThinRequest())
+			errs <- err
+		}()
+		markCreatedLazily(t, cl)
+
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(<-errs))
+	})
+}
+
+func TestCreateVolumeAllowedFSTypes(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name    string
+		allowed string
+		fsType  string
+		code    codes.Code
+	}{
+		{name: "allowed_type_passes", allowed: "xfs", fsType: internal.FSTypeXfs, code: codes.DeadlineExceeded},
+		{name: "allowed_type_is_case_insensitive", allowed: "XFS, ext4", fsType: internal.FSTypeXfs, code: codes.DeadlineExceeded},
+		{name: "class_disallowed_type_is_rejected", allowed: "xfs", fsType: internal.FSTypeExt4, code: codes.InvalidArgument},
+		{name: "default_type_is_checked", allowed: "xfs", code: codes.InvalidArgument},
+		{name: "unset_allows_supported_types", fsType: internal.FSTypeExt4, code: codes.DeadlineExceeded},
+		{name: "unset_rejects_unsupported_types", fsType: "btrfs", code: codes.InvalidArgument},
+		{name: "unsupported_allowed_type_is_rejected", allowed: "xfs,btrfs", fsType: internal.FSTypeXfs, code: codes.InvalidArgument},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newTestDriver(newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1")), WithAsyncCreateVolume(true))
+			request := newTestCreateVolumeRequest("pvc-1", 1<<30, "- name: lvg-1\n")
+			request.VolumeCapabilities[0].GetMount().FsType = tc.fsType
+			if tc.allowed != "" {
+				request.Parameters[internal.AllowedFSTypesKey] = tc.allowed
+			}
+
+			_, err := d.CreateVolume(ctx, request)
+			assert.Equal(t, tc.code, status.Code(err))
+		})
+	}
+
+	t.Run("block_volume_is_not_checked", func(t *testing.T) {
+		d := newTestDriver(newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1")), WithAsyncCreateVolume(true))
+		request := newTestCreateVolumeRequest("pvc-1", 1<<30, "- name: lvg-1\n")
+		request.VolumeCapabilities = []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}}
+		request.Parameters[internal.AllowedFSTypesKey] = internal.FSTypeXfs
+
+		_, err := d.CreateVolume(ctx, request)
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	})
+}
+
+func TestCreateVolumeDMNameLength(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name      string
+		namespace string
+		code      codes.Code
+	}{
+		{name: "short_name_passes", namespace: "team-a", code: codes.DeadlineExceeded},
+		// the expanded LV name fits the LV name limit, but not the device-mapper name limit once the dashes are doubled
+		{name: "long_name_is_rejected", namespace: strings.Repeat("a-", 50), code: codes.InvalidArgument},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+			d := newTestDriver(cl, WithAsyncCreateVolume(true), WithLVNameTemplate("${pvc.namespace}-${pv.name}"))
+			request := newTestCreateVolumeRequest("pvc-1", 1<<30, "- name: lvg-1\n")
+			request.Parameters[internal.PVCNamespaceKey] = tc.namespace
+
+			_, err := d.CreateVolume(ctx, request)
+			assert.Equal(t, tc.code, status.Code(err))
+			if tc.code == codes.InvalidArgument {
+				assert.ErrorContains(t, err, "device-mapper name")
+				// nothing is created for the rejected request
+				err = cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, &snc.LVMLogicalVolume{})
+				assert.True(t, kerrors.IsNotFound(err))
+			}
+		})
+	}
+}
+
+func TestCreateVolumeProvisionerSecrets(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name     string
+		required []string
+		secrets  map[string]string
+		code     codes.Code
+	}{
+		{name: "required_secret_present", required: []string{"token"}, secrets: map[string]string{"token": "s3cr3t"}, code: codes.DeadlineExceeded},
+		{name: "required_secret_missing", required: []string{"token"}, secrets: map[string]string{"other": "value"}, code: codes.InvalidArgument},
+		{name: "secrets_not_required", secrets: map[string]string{"token": "s3cr3t"}, code: codes.DeadlineExceeded},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+			d := newTestDriver(cl, WithAsyncCreateVolume(true), WithRequiredProvisionerSecrets(tc.required))
+
+			request := newTestCreateVolumeRequest("pvc-secrets", 1<<30, "- name: lvg-1\n")
+			request.Secrets = tc.secrets
+
+			_, err := d.CreateVolume(ctx, request)
+			assert.Equal(t, tc.code, status.Code(err))
+			if tc.code == codes.InvalidArgument {
+				assert.ErrorContains(t, err, "token")
+				assert.NotContains(t, err.Error(), "value")
+			}
+		})
+	}
+}
+
+func TestControllerExpandVolumeIdempotent(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		specSize string
+		updates  []string
+	}{
+		{name: "already_updated_spec_is_not_updated_again", specSize: "2Gi"},
+		{name: "fresh_expand_updates_spec", specSize: "1Gi", updates: []string{"2Gi"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			llv := &snc.LVMLogicalVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "pvc-expand"},
+				Spec: snc.LVMLogicalVolumeSpec{
+					Type:                  internal.LVMTypeThick,
+					LVMVolumeGroupName:    "lvg-1",
+					ActualLVNameOnTheNode: "pvc-expand",
+					Size:                  tc.specSize,
+				},
+				Status: &snc.LVMLogicalVolumeStatus{Phase: utils.LLVStatusCreated, ActualSize: resource.MustParse("1Gi")},
+			}
+
+			var mu sync.Mutex
+			var updates []string
+			base := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), llv)
+			cl := interceptor.NewClient(base, interceptor.Funcs{
+				Update: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+					if llv, ok := obj.(*snc.LVMLogicalVolume); ok {
+						mu.Lock()
+						updates = append(updates, llv.Spec.Size)
+						mu.Unlock()
+					}
+					return c.Update(ctx, obj, opts...)
+				},
+			})
+			d := newTestDriver(cl)
+
+			// the node agent resizes the LV
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				resized := &snc.LVMLogicalVolume{}
+				if err := base.Get(ctx, client.ObjectKey{Name: "pvc-expand"}, resized); err != nil {
+					return
+				}
+				resized.Status.ActualSize = resource.MustParse("2Gi")
+				_ = base.Update(ctx, resized)
+			}()
+
+			resp, err := d.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+				VolumeId:      "pvc-expand",
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 2 << 30},
+			})
+			require.NoError(t, err)
+			assert.Equal(t, int64(2<<30), resp.CapacityBytes)
+
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, tc.updates, updates)
+		})
+	}
+}
+
+func TestCreateVolumeFreeSpaceSoftThreshold(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name      string
+		threshold string
+		code      codes.Code
+		expected  string
+	}{
+		{name: "below_quantity_threshold", threshold: "10Gi", code: codes.DeadlineExceeded, expected: "1"},
+		{name: "above_quantity_threshold", threshold: "5Gi", code: codes.DeadlineExceeded, expected: "0"},
+		{name: "below_percent_threshold", threshold: "95%", code: codes.DeadlineExceeded, expected: "1"},
+		{name: "invalid_threshold", threshold: "150%", code: codes.InvalidArgument},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+			d := newTestDriver(cl, WithAsyncCreateVolume(true))
+
+			request := newTestCreateVolumeRequest("pvc-threshold", 1<<30, "- name: lvg-1\n")
+			request.Parameters[internal.FreeSpaceSoftThresholdKey] = tc.threshold
+
+			_, err := d.CreateVolume(ctx, request)
+			assert.Equal(t, tc.code, status.Code(err))
+
+			if tc.expected == "" {
+				count, err := testutil.GatherAndCount(d.metrics.Registry(), "sds_local_volume_csi_free_space_below_soft_threshold")
+				require.NoError(t, err)
+				assert.Zero(t, count)
+				return
+			}
+			expected := `
+# HELP sds_local_volume_csi_free_space_below_soft_threshold Whether the free space of the LVMVolumeGroup or thin pool was below the storage class soft threshold after the last provision.
+# TYPE sds_local_volume_csi_free_space_below_soft_threshold gauge
+sds_local_volume_csi_free_space_below_soft_threshold{lvg="lvg-1",node="node-1",thin_pool=""} ` + tc.expected + "\n"
+			assert.NoError(t, testutil.GatherAndCompare(d.metrics.Registry(), strings.NewReader(expected), "sds_local_volume_csi_free_space_below_soft_threshold"))
+		})
+	}
+}
+
+func TestCreateVolumeAllocationPolicy(t *testing.T) {
+	ctx := context.Background()
+	contiguous, fragmented := true, false
+
+	for _, tc := range []struct {
+		name       string
+		contiguous string
+		achieved   *bool
+		requested  string
+		expected   string
+		diverged   int
+	}{
+		{name: "contiguous_achieved", contiguous: "true", achieved: &contiguous, requested: internal.AllocationPolicyContiguous, expected: internal.AllocationPolicyContiguous},
+		{name: "contiguous_diverged", contiguous: "true", achieved: &fragmented, requested: internal.AllocationPolicyContiguous, expected: internal.AllocationPolicyFragmented, diverged: 1},
+		{name: "normal_fragmented", contiguous: "false", achieved: &fragmented, requested: internal.AllocationPolicyNormal, expected: internal.AllocationPolicyFragmented},
+		{name: "achieved_not_reported", contiguous: "true", requested: internal.AllocationPolicyContiguous},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+			d := newTestDriver(cl, WithAsyncCreateVolume(true))
+			request := newTestCreateVolumeRequest("pvc-alloc", 1<<30, "- name: lvg-1\n")
+			request.Parameters[internal.LVMVThickContiguousParamKey] = tc.contiguous
+
+			_, err := d.CreateVolume(ctx, request)
+			assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+			llv := &snc.LVMLogicalVolume{}
+			require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-alloc"}, llv))
+			assert.Equal(t, tc.requested, llv.Annotations[internal.RequestedAllocationPolicyAnnotation])
+
+			llv.Status = &snc.LVMLogicalVolumeStatus{
+				Phase:      internal.LLVStatusCreated,
+				ActualSize: resource.MustParse("1Gi"),
+				Contiguous: tc.achieved,
+			}
+			require.NoError(t, cl.Update(ctx, llv))
+
+			_, err = d.CreateVolume(ctx, request)
+			require.NoError(t, err)
+
+			require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-alloc"}, llv))
+			if tc.expected == "" {
+				assert.NotContains(t, llv.Annotations, internal.AchievedAllocationPolicyAnnotation)
+			} else {
+				assert.Equal(t, tc.expected, llv.Annotations[internal.AchievedAllocationPolicyAnnotation])
+			}
+
+			count, err := testutil.GatherAndCount(d.metrics.Registry(), "sds_local_volume_csi_allocation_policy_divergences_total")
+			require.NoError(t, err)
+			assert.Equal(t, tc.diverged, count)
+		})
+	}
+}
+
+func TestCreateVolumePlacementDecision(t *testing.T) {
+	ctx := context.Background()
+	cl := newFakeClient(
+		newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"),
+		newTestLVG("lvg-2", "node-2", "20Gi"), newTestNode("node-2"),
+	)
+	d := newTestDriver(cl, WithAsyncCreateVolume(true))
+	request := newTestCreateVolumeRequest("pvc-decision", 1<<30, "- name: lvg-1\n- name: lvg-2\n")
+	const expected = "node=node-2,lvg=lvg-2,free=20Gi,strategy=most-free"
+
+	_, err := d.CreateVolume(ctx, request)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	llv := &snc.LVMLogicalVolume{}
+	require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-decision"}, llv))
+	assert.Equal(t, expected, llv.Annotations[internal.PlacementDecisionAnnotation])
+
+	llv.Status = &snc.LVMLogicalVolumeStatus{Phase: internal.LLVStatusCreated, ActualSize: resource.MustParse("1Gi")}
+	require.NoError(t, cl.Update(ctx, llv))
+
+	resp, err := d.CreateVolume(ctx, request)
+	require.NoError(t, err)
+	assert.Equal(t, expected, resp.Volume.VolumeContext[internal.PlacementDecisionKey])
+}
+
+func TestCreateVolumeInodeSelection(t *testing.T) {
+	ctx := context.Background()
+	// lvg-1 has more free bytes, lvg-2 fits more inodes with its smaller inode ratio
+	const lvgs = "- name: lvg-1\n  bytesPerInode: 64Ki\n- name: lvg-2\n"
+
+	newDriver := func() (*Driver, client.Client) {
+		cl := newFakeClient(
+			newTestLVG("lvg-1", "node-1", "20Gi"), newTestNode("node-1"),
+			newTestLVG("lvg-2", "node-2", "10Gi"), newTestNode("node-2"),
+		)
+		return newTestDriver(cl, WithAsyncCreateVolume(true)), cl
+	}
+
+	for _, tc := range []struct {
+		metric        string
+		lvg           string
+		bytesPerInode string
+	}{
+		{metric: "", lvg: "lvg-1"},
+		{metric: internal.SelectionMetricBytes, lvg: "lvg-1"},
+		{metric: internal.SelectionMetricInodes, lvg: "lvg-2", bytesPerInode: "16384"},
+	} {
+		t.Run("metric_"+tc.metric, func(t *testing.T) {
+			d, cl := newDriver()
+			request := newTestCreateVolumeRequest("pvc-inodes", 1<<30, lvgs)
+			if tc.metric != "" {
+				request.Parameters[internal.SelectionMetricKey] = tc.metric
+			}
+
+			_, err := d.CreateVolume(ctx, request)
+			assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+			llv := &snc.LVMLogicalVolume{}
+			require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-inodes"}, llv))
+			assert.Equal(t, tc.lvg, llv.Spec.LVMVolumeGroupName)
+
+			llv.Status = &snc.LVMLogicalVolumeStatus{Phase: internal.LLVStatusCreated, ActualSize: resource.MustParse("1Gi")}
+			require.NoError(t, cl.Update(ctx, llv))
+
+			resp, err := d.CreateVolume(ctx, request)
+			require.NoError(t, err)
+			assert.Equal(t, tc.bytesPerInode, resp.Volume.VolumeContext[internal.FormatBytesPerInodeKey])
+		})
+	}
+
+	t.Run("invalid_metric", func(t *testing.T) {
+		d, _ := newDriver()
+		request := newTestCreateVolumeRequest("pvc-inodes", 1<<30, lvgs)
+		request.Parameters[internal.SelectionMetricKey] = "files"
+
+		_, err := d.CreateVolume(ctx, request)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+func TestCreateVolumeMountSync(t *testing.T) {
+	ctx := context.Background()
+	cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+	d := newTestDriver(cl, WithAsyncCreateVolume(true))
+
+	request := newTestCreateVolumeRequest("pvc-sync", 1<<30, "- name: lvg-1\n")
+	request.Parameters[internal.MountSyncKey] = "true"
+	request.VolumeCapabilities = []*csi.VolumeCapability{
+		{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}},
+	}
+
+	_, err := d.CreateVolume(ctx, request)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.ErrorContains(t, err, "not supported for block volumes")
+}
+
+func TestCreateVolumeLVNameTemplate(t *testing.T) {
+	ctx := context.Background()
+	cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+	d := newTestDriver(cl, WithAsyncCreateVolume(true), WithLVNameTemplate("${pvc.namespace}-${pv.name}"))
+	request := newTestCreateVolumeRequest("pvc-tenant", 1<<30, "- name: lvg-1\n")
+	request.Parameters[internal.PVCNamespaceKey] = "tenant-a"
+
+	_, err := d.CreateVolume(ctx, request)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	llv := &snc.LVMLogicalVolume{}
+	require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-tenant"}, llv))
+	assert.Equal(t, "tenant-a-pvc-tenant", llv.Spec.ActualLVNameOnTheNode)
+
+	llv.Status = &snc.LVMLogicalVolumeStatus{Phase: internal.LLVStatusCreated, ActualSize: resource.MustParse("1Gi")}
+	require.NoError(t, cl.Update(ctx, llv))
+
+	resp, err := d.CreateVolume(ctx, request)
+	require.NoError(t, err)
+	assert.Equal(t, "pvc-tenant", resp.Volume.VolumeId)
+	assert.Equal(t, "tenant-a-pvc-tenant", resp.Volume.VolumeContext[internal.LVNameKey])
+}
+
+func TestCreateVolumeLVGStatusWait(t *testing.T) {
+	ctx := context.Background()
+
+	newUnpopulatedLVG := func() *snc.LVMVolumeGroup {
+		lvg := newTestLVG("lvg-1", "node-1", "10Gi")
+		lvg.Status = snc.LVMVolumeGroupStatus{}
+		return lvg
+	}
+
+	t.Run("status_populated_after_delay", func(t *testing.T) {
+		cl := newFakeClient(newUnpopulatedLVG(), newTestNode("node-1"))
+		d := newTestDriver(cl, WithAsyncCreateVolume(true), WithLVGStatusTimeout(5*time.Second))
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			lvg := &snc.LVMVolumeGroup{}
+			if err := cl.Get(ctx, client.ObjectKey{Name: "lvg-1"}, lvg); err != nil {
+				return
+			}
+			lvg.Status = newTestLVG("lvg-1", "node-1", "10Gi").Status
+			_ = cl.Update(ctx, lvg)
+		}()
+
+		_, err := d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-wait", 1<<30, "- name: lvg-1\n"))
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-wait"}, llv))
+		assert.Equal(t, "lvg-1", llv.Spec.LVMVolumeGroupName)
+	})
+
+	t.Run("status_never_populated", func(t *testing.T) {
+		cl := newFakeClient(newUnpopulatedLVG(), newTestNode("node-1"))
+		d := newTestDriver(cl, WithAsyncCreateVolume(true), WithLVGStatusTimeout(300*time.Millisecond))
+
+		start := time.Now()
+		_, err := d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-wait", 1<<30, "- name: lvg-1\n"))
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+		assert.ErrorContains(t, err, "no storage class LVMVolumeGroup has its status populated")
+		assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+	})
+}
+
+func TestCreateVolumeFailureReason(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name   string
+		reason string
+		code   codes.Code
+	}{
+		{name: "insufficient_free_space", reason: `unable to create Thick LV, err: Volume group "vg-1" has insufficient free space (10 extents): 256 required.`, code: codes.ResourceExhausted},
+		{name: "no_space_left", reason: "mkfs: No space left on device", code: codes.ResourceExhausted},
+		{name: "invalid_parameter", reason: "Invalid argument for --stripes", code: codes.InvalidArgument},
+		{name: "unsupported_parameter", reason: "unsupported thin pool chunk size", code: codes.InvalidArgument},
+		{name: "activation_failure", reason: "unable to activate LV vg-1/pvc-failed", code: codes.Unavailable},
+		{name: "unknown_reason", reason: "lvcreate exited with code 5", code: codes.Internal},
+		{name: "empty_reason", reason: "", code: codes.Internal},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+			d := newTestDriver(cl, WithAsyncCreateVolume(true))
+			request := newTestCreateVolumeRequest("pvc-failed", 1<<30, "- name: lvg-1\n")
+
+			_, err := d.CreateVolume(ctx, request)
+			require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+			llv := &snc.LVMLogicalVolume{}
+			require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-failed"}, llv))
+			llv.Status = &snc.LVMLogicalVolumeStatus{Phase: utils.LLVStatusFailed, Reason: tc.reason}
+			require.NoError(t, cl.Update(ctx, llv))
+
+			_, err = d.CreateVolume(ctx, request)
+			assert.Equal(t, tc.code, status.Code(err))
+			assert.ErrorContains(t, err, tc.reason)
+		})
+	}
+}
+
+func TestCreateVolumeFailureReasonVerbatim(t *testing.T) {
+	ctx := context.Background()
+
+	failWith := func(t *testing.T, reason string) *status.Status {
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+		d := newTestDriver(cl, WithAsyncCreateVolume(true))
+		request := newTestCreateVolumeRequest("pvc-failed", 1<<30, "- name: lvg-1\n")
+
+		_, err := d.CreateVolume(ctx, request)
+		require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-failed"}, llv))
+		llv.Status = &snc.LVMLogicalVolumeStatus{Phase: utils.LLVStatusFailed, Reason: reason}
+		require.NoError(t, cl.Update(ctx, llv))
+
+		_, err = d.CreateVolume(ctx, request)
+		st, ok := status.FromError(err)
+		require.True(t, ok)
+		return st
+	}
+
+	t.Run("detailed_reason_propagates_intact", func(t *testing.T) {
+		reason := "unable to create Thick LV, err: device-mapper: reload ioctl on (253:4) failed: Invalid argument\n" +
+			"  Failed to suspend logical volume vg-1/pvc-failed.\n  Releasing activation in critical section."
+
+		st := failWith(t, reason)
+		assert.Contains(t, st.Message(), reason)
+
+		require.Len(t, st.Details(), 1)
+		info, ok := st.Details()[0].(*errdetails.ErrorInfo)
+		require.True(t, ok)
+		assert.Equal(t, reason, info.Metadata["reason"])
+		assert.Equal(t, "pvc-failed", info.Metadata["lvmLogicalVolume"])
+		assert.Contains(t, info.Metadata["condition."+internal.ProvisioningConditionNodeSelected], "selected LVMVolumeGroup lvg-1 on node node-1")
+	})
+
+	t.Run("long_reason_is_truncated", func(t *testing.T) {
+		reason := strings.Repeat("x", maxLLVFailureReasonLength+100)
+
+		st := failWith(t, reason)
+		assert.Contains(t, st.Message(), strings.Repeat("x", maxLLVFailureReasonLength)+"... (100 bytes truncated)")
+		assert.NotContains(t, st.Message(), strings.Repeat("x", maxLLVFailureReasonLength+1))
+	})
+}
+
+func TestCreateVolumeReclaimFailedLLV(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name    string
+		reason  string
+		code    codes.Code
+		deleted bool
+	}{
+		{name: "failed_llv_is_deleted", reason: "lvcreate exited with code 5", code: codes.Internal, deleted: true},
+		{name: "exhausted_llv_is_deleted", reason: "insufficient free space", code: codes.ResourceExhausted, deleted: true},
+		{name: "transient_failure_is_kept", reason: "unable to activate LV vg-1/pvc-failed", code: codes.Unavailable, deleted: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+			d := newTestDriver(cl, WithAsyncCreateVolume(true))
+			request := newTestCreateVolumeRequest("pvc-failed", 1<<30, "- name: lvg-1\n")
+
+			_, err := d.CreateVolume(ctx, request)
+			require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+			llv := &snc.LVMLogicalVolume{}
+			require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-failed"}, llv))
+			llv.Status = &snc.LVMLogicalVolumeStatus{Phase: utils.LLVStatusFailed, Reason: tc.reason}
+			require.NoError(t, cl.Update(ctx, llv))
+
+			_, err = d.CreateVolume(ctx, request)
+			assert.Equal(t, tc.code, status.Code(err))
+
+			err = cl.Get(ctx, client.ObjectKey{Name: "pvc-failed"}, &snc.LVMLogicalVolume{})
+			if !tc.deleted {
+				assert.NoError(t, err)
+				return
+			}
+			assert.True(t, kerrors.IsNotFound(err), "expected the failed LLV to be deleted, got %v", err)
+
+			// the next attempt starts clean and creates the LLV again
+			_, err = d.CreateVolume(ctx, request)
+			assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+			assert.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-failed"}, &snc.LVMLogicalVolume{}))
+		})
+	}
+
+	t.Run("sync_failed_llv_is_deleted", func(t *testing.T) {
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+		d := newTestDriver(cl)
+
+		go func() {
+			for {
+				llv := &snc.LVMLogicalVolume{}
+				if err := cl.Get(ctx, client.ObjectKey{Name: "pvc-failed"}, llv); err != nil {
+					time.Sleep(50 * time.Millisecond)
+					continue
+				}
+				llv.Status = &snc.LVMLogicalVolumeStatus{Phase: utils.LLVStatusFailed, Reason: "lvcreate exited with code 5"}
+				_ = cl.Update(ctx, llv)
+				return
+			}
+		}()
+
+		_, err := d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-failed", 1<<30, "- name: lvg-1\n"))
+		assert.Equal(t, codes.Internal, status.Code(err))
+
+		err = cl.Get(ctx, client.ObjectKey{Name: "pvc-failed"}, &snc.LVMLogicalVolume{})
+		assert.True(t, kerrors.IsNotFound(err), "expected the failed LLV to be deleted, got %v", err)
+	})
+}
+
+func TestCreateVolumeExistingLLV(t *testing.T) {
+	ctx := context.Background()
+
+	newExistingLLV := func(lvg, size string) *snc.LVMLogicalVolume {
+		return &snc.LVMLogicalVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-1", Finalizers: []string{utils.SDSLocalVolumeCSIFinalizer}},
+			Spec: snc.LVMLogicalVolumeSpec{
+				ActualLVNameOnTheNode: "pvc-1",
+				Type:                  internal.LVMTypeThick,
+				Size:                  size,
+				LVMVolumeGroupName:    lvg,
+				Thick:                 &snc.LVMLogicalVolumeThickSpec{},
+			},
+			Status: &snc.LVMLogicalVolumeStatus{Phase: utils.LLVStatusCreated, ActualSize: resource.MustParse(size)},
+		}
+	}
+
+	// the async mode adopts the existing LLV before the selection, so it is checked separately
+	for _, mode := range []struct {
+		name  string
+		async bool
+	}{{name: "sync"}, {name: "async", async: true}} {
+		t.Run(mode.name, func(t *testing.T) {
+			t.Run("matching_llv_is_reused", func(t *testing.T) {
+				cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"), newExistingLLV("lvg-1", "1Gi"))
+				d := newTestDriver(cl, WithAsyncCreateVolume(mode.async))
+
+				response, err := d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-1", 1<<30, "- name: lvg-1\n"))
+				require.NoError(t, err)
+				assert.Equal(t, "pvc-1", response.Volume.VolumeId)
+				assert.Equal(t, int64(1<<30), response.Volume.CapacityBytes)
+			})
+
+			for _, tc := range []struct {
+				name string
+				llv  *snc.LVMLogicalVolume
+			}{
+				{name: "llv_of_other_lvg_conflicts", llv: newExistingLLV("lvg-2", "1Gi")},
+				{name: "llv_of_other_size_conflicts", llv: newExistingLLV("lvg-1", "5Gi")},
+				{name: "llv_of_other_type_conflicts", llv: func() *snc.LVMLogicalVolume {
+					llv := newExistingLLV("lvg-1", "1Gi")
+					llv.Spec.Type, llv.Spec.Thick, llv.Spec.Thin = internal.LVMTypeThin, nil, &snc.LVMLogicalVolumeThinSpec{PoolName: "pool-1"}
+					return llv
+				}()},
+			} {
+				t.Run(tc.name, func(t *testing.T) {
+					cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"), tc.llv)
+					d := newTestDriver(cl, WithAsyncCreateVolume(mode.async))
+
+					_, err := d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-1", 1<<30, "- name: lvg-1\n"))
+					assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+					// the conflicting LLV is left as is
+					llv := &snc.LVMLogicalVolume{}
+					require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, llv))
+					assert.Equal(t, tc.llv.Spec, llv.Spec)
+				})
+			}
+		})
+	}
+}
+
+func TestCreateVolumeCancelled(t *testing.T) {
+	// cancelWhenLLVExists cancels the request once the LVMLogicalVolume is waited for.
+	cancelWhenLLVExists := func(t *testing.T, cl client.Client, name string) context.Context {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go func() {
+			defer cancel()
+			for ctx.Err() == nil {
+				llv := &snc.LVMLogicalVolume{}
+				if err := cl.Get(ctx, client.ObjectKey{Name: name}, llv); err == nil && llv.Annotations[internal.ProvisioningConditionsAnnotation] != "" {
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+		return ctx
+	}
+
+	t.Run("created_llv_is_deleted", func(t *testing.T) {
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+		d := newTestDriver(cl)
+
+		_, err := d.CreateVolume(cancelWhenLLVExists(t, cl, "pvc-1"), newTestCreateVolumeRequest("pvc-1", 1<<30, "- name: lvg-1\n"))
+		assert.Equal(t, codes.Canceled, status.Code(err))
+
+		err = cl.Get(context.Background(), client.ObjectKey{Name: "pvc-1"}, &snc.LVMLogicalVolume{})
+		assert.True(t, kerrors.IsNotFound(err), "expected the LVMLogicalVolume to be deleted, got %v", err)
+	})
+
+	t.Run("adopted_llv_is_kept", func(t *testing.T) {
+		existing := &snc.LVMLogicalVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-1", Finalizers: []string{utils.SDSLocalVolumeCSIFinalizer}},
+			Spec: snc.LVMLogicalVolumeSpec{
+				ActualLVNameOnTheNode: "pvc-1",
+				Type:                  internal.LVMTypeThick,
+				Size:                  "1Gi",
+				LVMVolumeGroupName:    "lvg-1",
+				Thick:                 &snc.LVMLogicalVolumeThickSpec{},
+			},
+		}
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"), existing)
+		d := newTestDriver(cl)
+
+		_, err := d.CreateVolume(cancelWhenLLVExists(t, cl, "pvc-1"), newTestCreateVolumeRequest("pvc-1", 1<<30, "- name: lvg-1\n"))
+		assert.Equal(t, codes.Canceled, status.Code(err))
+
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(context.Background(), client.ObjectKey{Name: "pvc-1"}, llv))
+		assert.Nil(t, llv.DeletionTimestamp)
+		assert.Contains(t, llv.Finalizers, utils.SDSLocalVolumeCSIFinalizer)
+	})
+}
+
+func TestCreateVolumeProvisionCooldown(t *testing.T) {
+	ctx := context.Background()
+
+	failVolume := func(t *testing.T, cl client.Client, d *Driver, name, reason string) {
+		request := newTestCreateVolumeRequest(name, 1<<30, "- name: lvg-1\n")
+		_, err := d.CreateVolume(ctx, request)
+		require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: name}, llv))
+		llv.Status = &snc.LVMLogicalVolumeStatus{Phase: utils.LLVStatusFailed, Reason: reason}
+		require.NoError(t, cl.Update(ctx, llv))
+
+		_, err = d.CreateVolume(ctx, request)
+		require.Error(t, err)
+	}
+
+	t.Run("cooldown_is_enforced_and_lifts", func(t *testing.T) {
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+		d := newTestDriver(cl, WithAsyncCreateVolume(true), WithProvisionFailureCooldown(200*time.Millisecond))
+		failVolume(t, cl, d, "pvc-failed", "unable to activate LV vg-1/pvc-failed")
+
+		_, err := d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-next", 1<<30, "- name: lvg-1\n"))
+		require.Equal(t, codes.Unavailable, status.Code(err))
+		assert.ErrorContains(t, err, "node-1")
+		st, _ := status.FromError(err)
+		require.Len(t, st.Details(), 1)
+		retryInfo, ok := st.Details()[0].(*errdetails.RetryInfo)
+		require.True(t, ok)
+		assert.LessOrEqual(t, retryInfo.RetryDelay.AsDuration(), 200*time.Millisecond)
+		assert.Positive(t, retryInfo.RetryDelay.AsDuration())
+
+		err = cl.Get(ctx, client.ObjectKey{Name: "pvc-next"}, &snc.LVMLogicalVolume{})
+		assert.True(t, kerrors.IsNotFound(err))
+
+		time.Sleep(250 * time.Millisecond)
+
+		_, err = d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-next", 1<<30, "- name: lvg-1\n"))
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	})
+
+	t.Run("invalid_request_does_not_start_cooldown", func(t *testing.T) {
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+		d := newTestDriver(cl, WithAsyncCreateVolume(true), WithProvisionFailureCooldown(time.Minute))
+		failVolume(t, cl, d, "pvc-failed", "unsupported thin pool chunk size")
+
+		_, err := d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-next", 1<<30, "- name: lvg-1\n"))
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	})
+
+	t.Run("cooldown_is_disabled_by_default", func(t *testing.T) {
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+		d := newTestDriver(cl, WithAsyncCreateVolume(true))
+		failVolume(t, cl, d, "pvc-failed", "unable to activate LV vg-1/pvc-failed")
+
+		_, err := d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-next", 1<<30, "- name: lvg-1\n"))
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	})
+}
+
+func TestCreateVolumeClone(t *testing.T) {
+	ctx := context.Background()
+
+	newSourceLLV := func() *snc.LVMLogicalVolume {
+		return &snc.LVMLogicalVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-source"},
+			Spec: snc.LVMLogicalVolumeSpec{
+				Type:               internal.LVMTypeThin,
+				Size:               "2Gi",
+				LVMVolumeGroupName: "lvg-1",
+				Thin:               &snc.LVMLogicalVolumeThinSpec{PoolName: "tp-1"},
+			},
+			Status: &snc.LVMLogicalVolumeStatus{Phase: internal.LLVStatusCreated, ActualSize: resource.MustParse("2Gi")},
+		}
+	}
+	newCloneRequest := func(lvmType string) *csi.CreateVolumeRequest {
+		lvgs := "- name: lvg-1\n"
+		if lvmType == internal.LVMTypeThin {
+			lvgs = "- name: lvg-1\n  thin:\n    poolName: tp-1\n"
+		}
+		request := newTestCreateVolumeRequest("pvc-clone", 2<<30, lvgs)
+		request.Parameters[internal.LvmTypeKey] = lvmType
+		request.VolumeContentSource = &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "pvc-source"}},
+		}
+		return request
+	}
+	// the VG has 1Gi left, while the thin pool has room for the clone
+	newLVG := func() *snc.LVMVolumeGroup {
+		lvg := newTestLVG("lvg-1", "node-1", "1Gi")
+		lvg.Status.ThinPools = []snc.LVMVolumeGroupThinPoolStatus{
+			{Name: "tp-1", ActualSize: resource.MustParse("10Gi"), AvailableSpace: resource.MustParse("8Gi")},
+		}
+		return lvg
+	}
+
+	t.Run("thick_clone_insufficient_space", func(t *testing.T) {
+		cl := newFakeClient(newLVG(), newTestNode("node-1"), newSourceLLV())
+		d := newTestDriver(cl, WithAsyncCreateVolume(true))
+
+		_, err := d.CreateVolume(ctx, newCloneRequest(internal.LVMTypeThick))
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+		assert.ErrorContains(t, err, "LVMVolumeGroup lvg-1 has 1Gi free, the thick clone of pvc-source needs 2Gi")
+
+		err = cl.Get(ctx, client.ObjectKey{Name: "pvc-clone"}, &snc.LVMLogicalVolume{})
+		assert.True(t, kerrors.IsNotFound(err))
+	})
+
+	t.Run("thin_clone_allowed", func(t *testing.T) {
+		cl := newFakeClient(newLVG(), newTestNode("node-1"), newSourceLLV())
+		d := newTestDriver(cl, WithAsyncCreateVolume(true))
+
+		_, err := d.CreateVolume(ctx, newCloneRequest(internal.LVMTypeThin))
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-clone"}, llv))
+		require.NotNil(t, llv.Spec.Source)
+		assert.Equal(t, "pvc-source", llv.Spec.Source.Name)
+		assert.Equal(t, map[string]string{internal.SourceVolumeLabel: "pvc-source"}, llv.Labels)
+	})
+
+	t.Run("snapshot_restore_lineage", func(t *testing.T) {
+		snapshot := &snc.LVMLogicalVolumeSnapshot{
+			ObjectMeta: metav1.ObjectMeta{Name: "snap-1"},
+			Spec:       snc.LVMLogicalVolumeSnapshotSpec{LVMLogicalVolumeName: "pvc-source", ActualSnapshotNameOnTheNode: "snap-1"},
+			Status: &snc.LVMLogicalVolumeSnapshotStatus{
+				Phase:                 utils.LLVSStatusCreated,
+				NodeName:              "node-1",
+				ActualVGNameOnTheNode: "vg-lvg-1",
+				Size:                  resource.MustParse("2Gi"),
+			},
+		}
+		cl := newFakeClient(newLVG(), newTestNode("node-1"), newSourceLLV(), snapshot)
+		d := newTestDriver(cl, WithAsyncCreateVolume(true))
+		request := newCloneRequest(internal.LVMTypeThin)
+		request.VolumeContentSource = &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "snap-1"}},
+		}
+
+		_, err := d.CreateVolume(ctx, request)
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-clone"}, llv))
+		assert.Equal(t, map[string]string{internal.SourceVolumeLabel: "pvc-source", internal.SourceSnapshotLabel: "snap-1"}, llv.Labels)
+
+		lineage := &snc.LVMLogicalVolumeList{}
+		require.NoError(t, cl.List(ctx, lineage, client.MatchingLabels{internal.SourceVolumeLabel: "pvc-source"}))
+		require.Len(t, lineage.Items, 1)
+		assert.Equal(t, "pvc-clone", lineage.Items[0].Name)
+	})
+
+	t.Run("volume_has_no_lineage", func(t *testing.T) {
+		cl := newFakeClient(newLVG(), newTestNode("node-1"))
+		d := newTestDriver(cl, WithAsyncCreateVolume(true))
+
+		_, err := d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-new", 1<<20, "- name: lvg-1\n"))
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-new"}, llv))
+		assert.Empty(t, llv.Labels)
+	})
+}
+
+// staleLVGLister returns the LVMVolumeGroups listed before some of them were deleted.
+type staleLVGLister []snc.LVMVolumeGroup
+
+func (l staleLVGLister) ListLVGs(context.Context) ([]snc.LVMVolumeGroup, error) {
+	return l, nil
+}
+
+func TestCreateVolumeLVGDisappears(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("deleted_after_selection", func(t *testing.T) {
+		cl := newFakeClient(newTestNode("node-1"))
+		d := newTestDriver(cl, WithLVGLister(staleLVGLister{*newTestLVG("lvg-1", "node-1", "10Gi")}))
+
+		_, err := d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-gone", 1<<30, "- name: lvg-1\n"))
+		assert.Equal(t, codes.Aborted, status.Code(err))
+		assert.ErrorContains(t, err, "lvg-1")
+
+		err = cl.Get(ctx, client.ObjectKey{Name: "pvc-gone"}, &snc.LVMLogicalVolume{})
+		assert.True(t, kerrors.IsNotFound(err))
+	})
+
+	t.Run("deleted_while_waiting", func(t *testing.T) {
+		lvg := newTestLVG("lvg-1", "node-1", "10Gi")
+		cl := newFakeClient(lvg, newTestNode("node-1"))
+		d := newTestDriver(cl)
+
+		// the LVMVolumeGroup is deleted before the node agent creates the LV
+		go func() {
+			for {
+				if err := cl.Get(ctx, client.ObjectKey{Name: "pvc-gone"}, &snc.LVMLogicalVolume{}); err == nil {
+					_ = cl.Delete(ctx, lvg)
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+
+		_, err := d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-gone", 1<<30, "- name: lvg-1\n"))
+		assert.Equal(t, codes.Aborted, status.Code(err))
+		assert.ErrorContains(t, err, "lvg-1")
+
+		err = cl.Get(ctx, client.ObjectKey{Name: "pvc-gone"}, &snc.LVMLogicalVolume{})
+		assert.True(t, kerrors.IsNotFound(err))
+	})
+}
+
+func TestCreateVolumeMinVolumeSize(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name     string
+		policy   string
+		size     int64
+		limit    int64
+		code     codes.Code
+		expected string
+	}{
+		{name: "round_up", policy: utils.MinVolumeSizePolicyRoundUp, size: 1 << 20, code: codes.DeadlineExceeded, expected: "32Mi"},
+		{name: "round_up_above_limit", policy: utils.MinVolumeSizePolicyRoundUp, size: 1 << 20, limit: 16 << 20, code: codes.OutOfRange},
+		{name: "reject", policy: utils.MinVolumeSizePolicyReject, size: 1 << 20, code: codes.OutOfRange},
+		{name: "reject_above_floor", policy: utils.MinVolumeSizePolicyReject, size: 64 << 20, code: codes.DeadlineExceeded, expected: "64Mi"},
+		{name: "unaligned_size_is_rounded_to_extent", policy: utils.MinVolumeSizePolicyReject, size: 1<<30 + 1, code: codes.DeadlineExceeded, expected: "1028Mi"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+			d := newTestDriver(cl, WithAsyncCreateVolume(true), WithMinVolumeSize(32<<20, tc.policy))
+
+			request := newTestCreateVolumeRequest("pvc-tiny", tc.size, "- name: lvg-1\n")
+			request.CapacityRange.LimitBytes = tc.limit
+
+			_, err := d.CreateVolume(ctx, request)
+			assert.Equal(t, tc.code, status.Code(err))
+
+			llv := &snc.LVMLogicalVolume{}
+			err = cl.Get(ctx, client.ObjectKey{Name: "pvc-tiny"}, llv)
+			if tc.expected == "" {
+				assert.True(t, kerrors.IsNotFound(err))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, llv.Spec.Size)
+		})
+	}
+}
+
+func TestTopologyKey(t *testing.T) {
+	ctx := context.Background()
+	const key = "example.com/node"
+
+	t.Run("node_uses_configured_key", func(t *testing.T) {
+		d, _ := newTestNodeDriver(WithTopologyKey(key))
+
+		resp, err := d.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{key: "test-node"}, resp.AccessibleTopology.Segments)
+	})
+
+	t.Run("controller_uses_configured_key", func(t *testing.T) {
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+		d := newTestDriver(cl, WithAsyncCreateVolume(true), WithTopologyKey(key))
+		request := newTestCreateVolumeRequest("pvc-topology", 1<<30, "- name: lvg-1\n")
+
+		_, err := d.CreateVolume(ctx, request)
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-topology"}, llv))
+		llv.Status = &snc.LVMLogicalVolumeStatus{Phase: internal.LLVStatusCreated, ActualSize: resource.MustParse("1Gi")}
+		require.NoError(t, cl.Update(ctx, llv))
+
+		resp, err := d.CreateVolume(ctx, request)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{key: "node-1"}, resp.Volume.AccessibleTopology[0].Segments)
+	})
+
+	t.Run("wffc_reads_configured_key", func(t *testing.T) {
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestLVG("lvg-2", "node-2", "10Gi"), newTestNode("node-1"), newTestNode("node-2"))
+		d := newTestDriver(cl, WithAsyncCreateVolume(true), WithTopologyKey(key))
+		request := newTestCreateVolumeRequest("pvc-wffc", 1<<30, "- name: lvg-1\n- name: lvg-2\n")
+		request.Parameters[internal.BindingModeKey] = internal.BindingModeWFFC
+		request.AccessibilityRequirements = &csi.TopologyRequirement{
+			Preferred: []*csi.Topology{{Segments: map[string]string{key: "node-2"}}},
+		}
+
+		_, err := d.CreateVolume(ctx, request)
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-wffc"}, llv))
+		assert.Equal(t, "lvg-2", llv.Spec.LVMVolumeGroupName)
+	})
+}
+
+func TestCreateVolumeCapacityDiagnostics(t *testing.T) {
+	ctx := context.Background()
+
+	quotaViolations := func(t *testing.T, err error) map[string]string {
+		st, ok := status.FromError(err)
+		require.True(t, ok)
+		require.Equal(t, codes.ResourceExhausted, st.Code())
+		require.Len(t, st.Details(), 1)
+		failure, ok := st.Details()[0].(*errdetails.QuotaFailure)
+		require.True(t, ok)
+
+		violations := make(map[string]string, len(failure.Violations))
+		for _, v := range failure.Violations {
+			violations[v.Subject] = v.Description
+		}
+		return violations
+	}
+
+	t.Run("immediate_lists_each_candidate", func(t *testing.T) {
+		tainted := newTestNode("node-3")
+		tainted.Spec.Taints = []corev1.Taint{{Key: "example.com/draining", Effect: corev1.TaintEffectNoSchedule}}
+		cl := newFakeClient(
+			newTestLVG("lvg-1", "node-1", "1Gi"), newTestLVG("lvg-2", "node-2", "2Gi"), newTestLVG("lvg-3", "node-3", "100Gi"),
+			newTestNode("node-1"), newTestNode("node-2"), tainted,
+		)
+		d := newTestDriver(cl, WithExcludeNodeTaint("example.com/draining"))
+
+		_, err := d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-full", 4<<30, "- name: lvg-1\n- name: lvg-2\n- name: lvg-3\n"))
+		assert.Equal(t, map[string]string{
+			"LVMVolumeGroup/lvg-1": "node node-1: free space 1Gi is less than the requested 4Gi",
+			"LVMVolumeGroup/lvg-2": "node node-2: free space 2Gi is less than the requested 4Gi",
+			"LVMVolumeGroup/lvg-3": "node node-3: node is unschedulable",
+		}, quotaViolations(t, err))
+	})
+
+	t.Run("wffc_lists_each_candidate", func(t *testing.T) {
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "1Gi"), newTestLVG("lvg-2", "node-2", "100Gi"))
+		d := newTestDriver(cl)
+		request := newTestCreateVolumeRequest("pvc-full", 4<<30, "- name: lvg-1\n- name: lvg-2\n")
+		request.Parameters[internal.BindingModeKey] = internal.BindingModeWFFC
+		request.AccessibilityRequirements = &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{{Segments: map[string]string{internal.TopologyKey: "node-1"}}},
+		}
+
+		_, err := d.CreateVolume(ctx, request)
+		assert.Equal(t, map[string]string{
+			"LVMVolumeGroup/lvg-1": "node node-1: free space 1Gi is less than the requested 4Gi",
+			"LVMVolumeGroup/lvg-2": "node node-2: node is not in the requisite topology",
+		}, quotaViolations(t, err))
+	})
+
+	t.Run("details_are_bounded", func(t *testing.T) {
+		candidates := make([]utils.LVGCandidate, 100)
+		for i := range candidates {
+			candidates[i] = utils.LVGCandidate{LVG: fmt.Sprintf("lvg-%d", i), Node: "node", Rejection: strings.Repeat("x", 1000)}
+		}
+
+		st, _ := status.FromError(capacityExhaustedError("full", candidates))
+		failure := st.Details()[0].(*errdetails.QuotaFailure)
+		require.Len(t, failure.Violations, maxDiagnosticsCandidates+1)
+		assert.Len(t, failure.Violations[0].Description, maxDiagnosticsDescriptionLength)
+		assert.Equal(t, "68 more candidates are omitted", failure.Violations[maxDiagnosticsCandidates].Description)
+	})
+}
+
+func TestCreateVolumeVGConcurrency(t *testing.T) {
+	ctx := context.Background()
+
+	llvExists := func(cl client.Client, name string) bool {
+		return cl.Get(ctx, client.ObjectKey{Name: name}, &snc.LVMLogicalVolume{}) == nil
+	}
+	markCreated := func(t *testing.T, cl client.Client, name string) {
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: name}, llv))
+		llv.Status = &snc.LVMLogicalVolumeStatus{Phase: internal.LLVStatusCreated, ActualSize: resource.MustParse("1Gi")}
+		require.NoError(t, cl.Update(ctx, llv))
+	}
+	createVolume := func(d *Driver, name, lvgs string) <-chan error {
+		errs := make(chan error, 1)
+		go func() {
+			_, err := d.CreateVolume(ctx, newTestCreateVolumeRequest(name, 1<<30, lvgs))
+			errs <- err
+		}()
+		return errs
+	}
+
+	t.Run("same_vg_creations_are_serialized", func(t *testing.T) {
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+		d := newTestDriver(cl)
+
+		first := createVolume(d, "pvc-1", "- name: lvg-1\n")
+		require.Eventually(t, func() bool { return llvExists(cl, "pvc-1") }, 5*time.Second, 10*time.Millisecond)
+		second := createVolume(d, "pvc-2", "- name: lvg-1\n")
+
+		assert.Never(t, func() bool { return llvExists(cl, "pvc-2") }, 300*time.Millisecond, 10*time.Millisecond)
+
+		markCreated(t, cl, "pvc-1")
+		require.NoError(t, <-first)
+		require.Eventually(t, func() bool { return llvExists(cl, "pvc-2") }, 5*time.Second, 10*time.Millisecond)
+
+		markCreated(t, cl, "pvc-2")
+		require.NoError(t, <-second)
+	})
+
+	t.Run("different_vg_creations_run_concurrently", func(t *testing.T) {
+		cl := newFakeClient(
+			newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"),
+			newTestLVG("lvg-2", "node-2", "10Gi"), newTestNode("node-2"),
+		)
+		d := newTestDriver(cl)
+
+		first := createVolume(d, "pvc-1", "- name: lvg-1\n")
+		second := createVolume(d, "pvc-2", "- name: lvg-2\n")
+		require.Eventually(t, func() bool { return llvExists(cl, "pvc-1") && llvExists(cl, "pvc-2") }, 5*time.Second, 10*time.Millisecond)
+
+		markCreated(t, cl, "pvc-1")
+		markCreated(t, cl, "pvc-2")
+		require.NoError(t, <-first)
+		require.NoError(t, <-second)
+	})
+
+	t.Run("zero_limit_does_not_serialize", func(t *testing.T) {
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+		d := newTestDriver(cl, WithMaxConcurrentVGOperations(0))
+
+		first := createVolume(d, "pvc-1", "- name: lvg-1\n")
+		second := createVolume(d, "pvc-2", "- name: lvg-1\n")
+		require.Eventually(t, func() bool { return llvExists(cl, "pvc-1") && llvExists(cl, "pvc-2") }, 5*time.Second, 10*time.Millisecond)
+
+		markCreated(t, cl, "pvc-1")
+		markCreated(t, cl, "pvc-2")
+		require.NoError(t, <-first)
+		require.NoError(t, <-second)
+	})
+
+	t.Run("deletion_waits_for_same_vg_creation", func(t *testing.T) {
+		existing := &snc.LVMLogicalVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-0"},
+			Spec:       snc.LVMLogicalVolumeSpec{ActualLVNameOnTheNode: "pvc-0", Type: internal.LVMTypeThick, Size: "1Gi", LVMVolumeGroupName: "lvg-1"},
+		}
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"), existing)
+		d := newTestDriver(cl)
+
+		created := createVolume(d, "pvc-1", "- name: lvg-1\n")
+		require.Eventually(t, func() bool { return llvExists(cl, "pvc-1") }, 5*time.Second, 10*time.Millisecond)
+
+		deleted := make(chan error, 1)
+		go func() {
+			_, err := d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "pvc-0"})
+			deleted <- err
+		}()
+		assert.Never(t, func() bool { return !llvExists(cl, "pvc-0") }, 300*time.Millisecond, 10*time.Millisecond)
+
+		markCreated(t, cl, "pvc-1")
+		require.NoError(t, <-created)
+		require.NoError(t, <-deleted)
+		assert.False(t, llvExists(cl, "pvc-0"))
+	})
+
+	t.Run("slot_is_released_once_llv_is_picked_up", func(t *testing.T) {
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+		d := newTestDriver(cl)
+
+		first := createVolume(d, "pvc-1", "- name: lvg-1\n")
+		require.Eventually(t, func() bool { return llvExists(cl, "pvc-1") }, 5*time.Second, 10*time.Millisecond)
+
+		// the agent has run lvcreate, but the LV does not have the requested size yet
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, llv))
+		llv.Status = &snc.LVMLogicalVolumeStatus{Phase: internal.LLVStatusCreated, ActualSize: resource.MustParse("512Mi")}
+		require.NoError(t, cl.Update(ctx, llv))
+
+		second := createVolume(d, "pvc-2", "- name: lvg-1\n")
+		require.Eventually(t, func() bool { return llvExists(cl, "pvc-2") }, 5*time.Second, 10*time.Millisecond)
+
+		markCreated(t, cl, "pvc-1")
+		markCreated(t, cl, "pvc-2")
+		require.NoError(t, <-first)
+		require.NoError(t, <-second)
+	})
+
+	t.Run("stuck_llv_does_not_starve_same_vg_deletion", func(t *testing.T) {
+		existing := &snc.LVMLogicalVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-0"},
+			Spec:       snc.LVMLogicalVolumeSpec{ActualLVNameOnTheNode: "pvc-0", Type: internal.LVMTypeThick, Size: "1Gi", LVMVolumeGroupName: "lvg-1"},
+		}
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"), existing)
+		d := newTestDriver(cl, WithVGSlotHoldTimeout(200*time.Millisecond))
+
+		createCtx, cancel := context.WithCancel(ctx)
+		created := make(chan error, 1)
+		go func() {
+			_, err := d.CreateVolume(createCtx, newTestCreateVolumeRequest("pvc-1", 1<<30, "- name: lvg-1\n"))
+			created <- err
+		}()
+		require.Eventually(t, func() bool { return llvExists(cl, "pvc-1") }, 5*time.Second, 10*time.Millisecond)
+
+		// the LVMLogicalVolume stays Pending, yet the deletion gets the slot once the hold timeout expires
+		_, err := d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "pvc-0"})
+		require.NoError(t, err)
+		assert.False(t, llvExists(cl, "pvc-0"))
+
+		select {
+		case err := <-created:
+			t.Fatalf("the creation of the stuck LVMLogicalVolume returned: %v", err)
+		default:
+		}
+		cancel()
+		assert.Equal(t, codes.Canceled, status.Code(<-created))
+	})
+
+	t.Run("slot_is_released_when_creation_fails", func(t *testing.T) {
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+		d := newTestDriver(cl)
+
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := d.CreateVolume(cancelled, newTestCreateVolumeRequest("pvc-1", 1<<30, "- name: lvg-1\n"))
+		require.Error(t, err)
+
+		acquireCtx, cancelAcquire := context.WithTimeout(ctx, time.Second)
+		defer cancelAcquire()
+		release, err := d.vgLimiter.Acquire(acquireCtx, "lvg-1")
+		require.NoError(t, err)
+		release()
+	})
+}
+
+func TestCreateVolumeStaleFreeSpace(t *testing.T) {
+	ctx := context.Background()
+
+	// provisionOnNodes plays the node agents failing the LV creation on the LVMVolumeGroups out of space.
+	// It returns the LVMVolumeGroups the LV creation was attempted on.
+	provisionOnNodes := func(t *testing.T, cl client.Client, name string, outOfSpace map[string]bool) func() []string {
+		agentCtx, cancel := context.WithCancel(ctx)
+		t.Cleanup(cancel)
+		var mu sync.Mutex
+		var attempts []string
+		go func() {
+			for agentCtx.Err() == nil {
+				llv := &snc.LVMLogicalVolume{}
+				if err := cl.Get(agentCtx, client.ObjectKey{Name: name}, llv); err == nil && llv.Status == nil {
+					mu.Lock()
+					attempts = append(attempts, llv.Spec.LVMVolumeGroupName)
+					mu.Unlock()
+					if outOfSpace[llv.Spec.LVMVolumeGroupName] {
+						llv.Status = &snc.LVMLogicalVolumeStatus{Phase: utils.LLVStatusFailed, Reason: "insufficient free space in VG vg-" + llv.Spec.LVMVolumeGroupName}
+					} else {
+						llv.Status = &snc.LVMLogicalVolumeStatus{Phase: internal.LLVStatusCreated, ActualSize: resource.MustParse("1Gi")}
+					}
+					_ = cl.Update(agentCtx, llv)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+		return func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]string(nil), attempts...)
+		}
+	}
+
+	// newStaleCache returns the LVMVolumeGroup cache still showing lvg-1 with the space it no longer has
+	newStaleCache := func() *lvgcache.Cache {
+		cache := lvgcache.New(&logger.Logger{})
+		cache.OnAdd(newTestLVG("lvg-1", "node-1", "20Gi"), false)
+		cache.OnAdd(newTestLVG("lvg-2", "node-2", "10Gi"), false)
+		return cache
+	}
+
+	t.Run("stale_node_is_reselected", func(t *testing.T) {
+		cl := newFakeClient(
+			newTestLVG("lvg-1", "node-1", "512Mi"), newTestNode("node-1"),
+			newTestLVG("lvg-2", "node-2", "10Gi"), newTestNode("node-2"),
+		)
+		cache := newStaleCache()
+		d := newTestDriver(cl, WithLVGLister(cache))
+		attempts := provisionOnNodes(t, cl, "pvc-1", map[string]bool{"lvg-1": true})
+
+		resp, err := d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-1", 1<<30, "- name: lvg-1\n- name: lvg-2\n"))
+		require.NoError(t, err)
+		assert.Equal(t, "node-2", resp.Volume.AccessibleTopology[0].Segments[internal.TopologyKey])
+		assert.Equal(t, []string{"lvg-1", "lvg-2"}, attempts())
+
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, llv))
+		assert.Equal(t, "lvg-2", llv.Spec.LVMVolumeGroupName)
+
+		// the next selections see the refreshed free space
+		lvgs, err := cache.ListLVGs(ctx)
+		require.NoError(t, err)
+		require.Len(t, lvgs, 2)
+		assert.Equal(t, "512Mi", lvgs[0].Status.VGFree.String())
+	})
+
+	t.Run("reselection_is_bounded", func(t *testing.T) {
+		cl := newFakeClient(
+			newTestLVG("lvg-1", "node-1", "20Gi"), newTestNode("node-1"),
+			newTestLVG("lvg-2", "node-2", "10Gi"), newTestNode("node-2"),
+			newTestLVG("lvg-3", "node-3", "5Gi"), newTestNode("node-3"),
+		)
+		d := newTestDriver(cl)
+		attempts := provisionOnNodes(t, cl, "pvc-1", map[string]bool{"lvg-1": true, "lvg-2": true, "lvg-3": true})
+
+		_, err := d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-1", 1<<30, "- name: lvg-1\n- name: lvg-2\n- name: lvg-3\n"))
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+		assert.Equal(t, []string{"lvg-1", "lvg-2"}, attempts())
+	})
+
+	t.Run("single_node_is_not_reselected", func(t *testing.T) {
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "20Gi"), newTestNode("node-1"))
+		d := newTestDriver(cl)
+		attempts := provisionOnNodes(t, cl, "pvc-1", map[string]bool{"lvg-1": true})
+
+		_, err := d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-1", 1<<30, "- name: lvg-1\n"))
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+		assert.Equal(t, []string{"lvg-1"}, attempts())
+	})
+
+	t.Run("other_failures_are_not_reselected", func(t *testing.T) {
+		cl := newFakeClient(
+			newTestLVG("lvg-1", "node-1", "20Gi"), newTestNode("node-1"),
+			newTestLVG("lvg-2", "node-2", "10Gi"), newTestNode("node-2"),
+		)
+		d := newTestDriver(cl)
+		go func() {
+			for ctx.Err() == nil {
+				llv := &snc.LVMLogicalVolume{}
+				if err := cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, llv); err == nil {
+					llv.Status = &snc.LVMLogicalVolumeStatus{Phase: utils.LLVStatusFailed, Reason: "unsupported thin pool chunk size"}
+					_ = cl.Update(ctx, llv)
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+
+		_, err := d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-1", 1<<30, "- name: lvg-1\n- name: lvg-2\n"))
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+func TestVolumeMaxSize(t *testing.T) {
+	ctx := context.Background()
+	newRequest := func(size int64, maxSize string) *csi.CreateVolumeRequest {
+		request := newTestCreateVolumeRequest("pvc-1", size, "- name: lvg-1\n")
+		request.Parameters[internal.MaxVolumeSizeKey] = maxSize
+		return request
+	}
+
+	t.Run("under_cap_create_is_provisioned", func(t *testing.T) {
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+		d := newTestDriver(cl, WithAsyncCreateVolume(true))
+
+		_, err := d.CreateVolume(ctx, newRequest(1<<30, "1Gi"))
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, llv))
+		assert.Equal(t, "1Gi", llv.Spec.Size)
+		assert.Equal(t, "1Gi", llv.Annotations[internal.MaxVolumeSizeAnnotation])
+	})
+
+	t.Run("over_cap_create_is_rejected", func(t *testing.T) {
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+		d := newTestDriver(cl, WithAsyncCreateVolume(true))
+
+		_, err := d.CreateVolume(ctx, newRequest(2<<30, "1Gi"))
+		assert.Equal(t, codes.OutOfRange, status.Code(err))
+		assert.True(t, kerrors.IsNotFound(cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, &snc.LVMLogicalVolume{})))
+	})
+
+	t.Run("cap_is_checked_after_extent_rounding", func(t *testing.T) {
+		d := newTestDriver(newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1")), WithAsyncCreateVolume(true))
+
+		// 1Gi and a byte is rounded up to 1Gi and a 4Mi extent
+		_, err := d.CreateVolume(ctx, newRequest(1<<30+1, "1Gi"))
+		assert.Equal(t, codes.OutOfRange, status.Code(err))
+	})
+
+	t.Run("invalid_cap_is_rejected", func(t *testing.T) {
+		d := newTestDriver(newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1")), WithAsyncCreateVolume(true))
+
+		_, err := d.CreateVolume(ctx, newRequest(1<<30, "0"))
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("over_cap_expansion_is_rejected", func(t *testing.T) {
+		llv := &snc.LVMLogicalVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-1", Annotations: map[string]string{internal.MaxVolumeSizeAnnotation: "2Gi"}},
+			Spec: snc.LVMLogicalVolumeSpec{
+				Type:                  internal.LVMTypeThick,
+				LVMVolumeGroupName:    "lvg-1",
+				ActualLVNameOnTheNode: "pvc-1",
+				Size:                  "1Gi",
+			},
+			Status: &snc.LVMLogicalVolumeStatus{Phase: internal.LLVStatusCreated, ActualSize: resource.MustParse("1Gi")},
+		}
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), llv)
+		d := newTestDriver(cl)
+
+		_, err := d.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{VolumeId: "pvc-1", CapacityRange: &csi.CapacityRange{RequiredBytes: 3 << 30}})
+		assert.Equal(t, codes.OutOfRange, status.Code(err))
+
+		got := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, got))
+		assert.Equal(t, "1Gi", got.Spec.Size)
+	})
+
+	t.Run("expansion_cap_is_checked_after_extent_rounding", func(t *testing.T) {
+		llv := &snc.LVMLogicalVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-1", Annotations: map[string]string{internal.MaxVolumeSizeAnnotation: "2Gi"}},
+			Spec: snc.LVMLogicalVolumeSpec{
+				Type:                  internal.LVMTypeThick,
+				LVMVolumeGroupName:    "lvg-1",
+				ActualLVNameOnTheNode: "pvc-1",
+				Size:                  "1Gi",
+			},
+			Status: &snc.LVMLogicalVolumeStatus{Phase: internal.LLVStatusCreated, ActualSize: resource.MustParse("1Gi")},
+		}
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), llv)
+		d := newTestDriver(cl)
+
+		// 2Gi and a byte is rounded up to 2Gi and a 4Mi extent
+		_, err := d.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{VolumeId: "pvc-1", CapacityRange: &csi.CapacityRange{RequiredBytes: 2<<30 + 1}})
+		assert.Equal(t, codes.OutOfRange, status.Code(err))
+
+		got := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, got))
+		assert.Equal(t, "1Gi", got.Spec.Size)
+	})
+
+	t.Run("unaligned_expansion_uses_aligned_size", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+
+		llv := &snc.LVMLogicalVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-1", Annotations: map[string]string{internal.MaxVolumeSizeAnnotation: "3Gi"}},
+			Spec: snc.LVMLogicalVolumeSpec{
+				Type:                  internal.LVMTypeThick,
+				LVMVolumeGroupName:    "lvg-1",
+				ActualLVNameOnTheNode: "pvc-1",
+				Size:                  "1Gi",
+			},
+			Status: &snc.LVMLogicalVolumeStatus{Phase: internal.LLVStatusCreated, ActualSize: resource.MustParse("1Gi")},
+		}
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), llv)
+		d := newTestDriver(cl)
+		aligned := resource.MustParse("2052Mi")
+
+		// the node agent resizes the LV to the whole extents
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			resized := &snc.LVMLogicalVolume{}
+			if err := cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, resized); err != nil {
+				return
+			}
+			resized.Status.ActualSize = aligned
+			_ = cl.Update(ctx, resized)
+		}()
+
+		resp, err := d.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{VolumeId: "pvc-1", CapacityRange: &csi.CapacityRange{RequiredBytes: 2<<30 + 1}})
+		require.NoError(t, err)
+		assert.Equal(t, aligned.Value(), resp.CapacityBytes)
+
+		got := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, got))
+		specSize := resource.MustParse(got.Spec.Size)
+		assert.Equal(t, aligned.Value(), specSize.Value())
+	})
+}
+
+func TestCreateVolumeSameNodeLVGPolicy(t *testing.T) {
+	ctx := context.Background()
+	const lvgs = "- name: lvg-small\n- name: lvg-large\n- name: lvg-other-node\n"
+
+	newClient := func() client.WithWatch {
+		return newFakeClient(
+			newTestLVG("lvg-small", "node-1", "10Gi"),
+			newTestLVG("lvg-large", "node-1", "40Gi"),
+			newTestLVG("lvg-other-node", "node-2", "20Gi"),
+			newTestNode("node-1"),
+			newTestNode("node-2"),
+		)
+	}
+	// createdLVG returns the LVMVolumeGroup of the LVMLogicalVolume created by the async CreateVolume
+	createdLVG := func(t *testing.T, d *Driver, cl client.Client, request *csi.CreateVolumeRequest) string {
+		_, err := d.CreateVolume(ctx, request)
+		require.Equal(t, codes.DeadlineExceeded, status.Code(err), err)
+
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: request.Name}, llv))
+		return llv.Spec.LVMVolumeGroupName
+	}
+
+	t.Run("most_free_lvg_is_selected_by_default", func(t *testing.T) {
+		cl := newClient()
+		d := newTestDriver(cl, WithAsyncCreateVolume(true))
+
+		assert.Equal(t, "lvg-large", createdLVG(t, d, cl, newTestCreateVolumeRequest("pvc-1", 1<<30, lvgs)))
+	})
+
+	t.Run("pinned_lvg_is_selected", func(t *testing.T) {
+		cl := newClient()
+		d := newTestDriver(cl, WithAsyncCreateVolume(true))
+		request := newTestCreateVolumeRequest("pvc-1", 1<<30, lvgs)
+		request.Parameters[internal.SameNodeLVGPolicyKey] = internal.SameNodeLVGPolicyNamed
+		request.Parameters[internal.PinnedLVGsKey] = "lvg-small"
+
+		assert.Equal(t, "lvg-small", createdLVG(t, d, cl, request))
+	})
+
+	t.Run("invalid_policy_is_rejected", func(t *testing.T) {
+		for name, params := range map[string]map[string]string{
+			"unknown_policy":       {internal.SameNodeLVGPolicyKey: "random"},
+			"named_without_pinned": {internal.SameNodeLVGPolicyKey: internal.SameNodeLVGPolicyNamed},
+			"pinned_not_listed":    {internal.SameNodeLVGPolicyKey: internal.SameNodeLVGPolicyNamed, internal.PinnedLVGsKey: "lvg-missing"},
+		} {
+			t.Run(name, func(t *testing.T) {
+				cl := newClient()
+				d := newTestDriver(cl)
+				request := newTestCreateVolumeRequest("pvc-1", 1<<30, lvgs)
+				for key, value := range params {
+					request.Parameters[key] = value
+				}
+
+				_, err := d.CreateVolume(ctx, request)
+				assert.Equal(t, codes.InvalidArgument, status.Code(err))
+				assert.True(t, kerrors.IsNotFound(cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, &snc.LVMLogicalVolume{})))
+			})
+		}
+	})
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// deadlineHeadroomDivisor sets the part of the time left to the request deadline, 1/10, kept for the work
+	// following a bounded sub-operation, e.g. the lazy unmount or the cleanup, and for returning the response.
+	deadlineHeadroomDivisor = 10
+	// minSubTimeout is the shortest timeout of a sub-operation of a request whose deadline is about to expire.
+	minSubTimeout = time.Millisecond
+)
+
+// subTimeout returns the timeout of a sub-operation of the request fitting into the deadline of the request,
+// as the caller gives up on the call once it expires. The configured timeout is returned as is if the request
+// has no deadline or the deadline leaves enough time for it. The zero configured timeout means the sub-operation
+// is bounded by the request deadline only, so it is still zero without the deadline.
+func (d *Driver) subTimeout(ctx context.Context, method, operation string, timeout time.Duration) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return timeout
+	}
+
+	left := time.Until(deadline)
+	available := max(left-left/deadlineHeadroomDivisor, minSubTimeout)
+	if timeout > 0 && timeout <= available {
+		return timeout
+	}
+
+	if timeout > 0 {
+		d.log.Info(fmt.Sprintf("[%s] the request deadline in %s limits the %s timeout of %s to %s", method, left.Round(time.Millisecond), operation, timeout, available.Round(time.Millisecond)))
+	}
+	return available
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSubTimeout(t *testing.T) {
+	d := newTestDriver(newFakeClient())
+
+	t.Run("no_deadline_keeps_configured_timeout", func(t *testing.T) {
+		assert.Equal(t, time.Minute, d.subTimeout(context.Background(), "Test", "test", time.Minute))
+		assert.Zero(t, d.subTimeout(context.Background(), "Test", "test", 0))
+	})
+
+	t.Run("distant_deadline_keeps_configured_timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+		defer cancel()
+
+		assert.Equal(t, time.Minute, d.subTimeout(ctx, "Test", "test", time.Minute))
+	})
+
+	t.Run("close_deadline_limits_timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		timeout := d.subTimeout(ctx, "Test", "test", time.Minute)
+		assert.LessOrEqual(t, timeout, 9*time.Second)
+		assert.Greater(t, timeout, 8*time.Second)
+	})
+
+	t.Run("deadline_bounds_unbounded_timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		assert.LessOrEqual(t, d.subTimeout(ctx, "Test", "test", 0), 9*time.Second)
+	})
+
+	t.Run("expired_deadline_leaves_min_timeout", func(t *testing.T) {
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		defer cancel()
+
+		assert.Equal(t, minSubTimeout, d.subTimeout(ctx, "Test", "test", time.Minute))
+	})
+}
+
+func TestRequestDeadlineBoundsSubOperations(t *testing.T) {
+	const deadline = time.Second
+
+	t.Run("mount", func(t *testing.T) {
+		release := make(chan struct{})
+		defer close(release)
+
+		d, st := newTestNodeDriver(WithMountTimeout(time.Minute))
+		st.publishHook = func(string) { <-release }
+
+		ctx, cancel := context.WithTimeout(context.Background(), deadline)
+		defer cancel()
+
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+		// the error is returned before the caller gives up
+		assert.NoError(t, ctx.Err())
+	})
+
+	t.Run("unbounded_mount", func(t *testing.T) {
+		release := make(chan struct{})
+		defer close(release)
+
+		d, st := newTestNodeDriver()
+		st.publishHook = func(string) { <-release }
+
+		ctx, cancel := context.WithTimeout(context.Background(), deadline)
+		defer cancel()
+
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+		assert.NoError(t, ctx.Err())
+	})
+
+	t.Run("unmount_leaves_time_for_lazy_unmount", func(t *testing.T) {
+		release := make(chan struct{})
+		defer close(release)
+
+		d, st := newTestNodeDriver(WithUnmountTimeout(time.Minute, true))
+		st.unpublishHook = func(string) { <-release }
+
+		ctx, cancel := context.WithTimeout(context.Background(), deadline)
+		defer cancel()
+
+		_, err := d.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc-1", TargetPath: "/target/pvc-1"})
+		require.NoError(t, err)
+		assert.NoError(t, ctx.Err())
+
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		assert.Equal(t, []string{"lazy unmount /target/pvc-1"}, st.calls)
+	})
+
+	t.Run("lvg_status_wait", func(t *testing.T) {
+		lvg := newTestLVG("lvg-1", "node-1", "10Gi")
+		lvg.Status = snc.LVMVolumeGroupStatus{}
+		d := newTestDriver(newFakeClient(lvg, newTestNode("node-1")), WithLVGStatusTimeout(time.Minute))
+
+		ctx, cancel := context.WithTimeout(context.Background(), deadline)
+		defer cancel()
+
+		_, err := d.CreateVolume(ctx, newTestCreateVolumeRequest("pvc-1", 1<<30, "- name: lvg-1\n"))
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+		assert.NoError(t, ctx.Err())
+	})
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"sds-local-volume-csi/internal"
+	"sds-local-volume-csi/pkg/utils"
+)
+
+// deviceSizeTolerance is the shortage of the device size against the provisioned volume size still considered plausible.
+var deviceSizeTolerance = resource.MustParse(internal.ResizeDelta)
+
+// checkDeviceSize returns a codes.Internal status error if the device reports zero size or a size implausibly
+// smaller than the provisioned one of the volume context, e.g. because the LV is not activated properly or
+// its device mapper entry is stale, so it is reported clearly instead of failing in mkfs or mount.
+func (d *Driver) checkDeviceSize(method, volumeID, devPath string, volumeContext map[string]string) error {
+	expectedSize, err := utils.GetExpectedDeviceSize(volumeContext)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "[%s] %v", method, err)
+	}
+
+	size, err := d.storeManager.GetDeviceSize(devPath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "[%s] Error getting the size of device %q: %v", method, devPath, err)
+	}
+
+	if err := utils.CheckDeviceSize(size, expectedSize, deviceSizeTolerance.Value()); err != nil {
+		d.log.Error(err, fmt.Sprintf("[%s] Device %s of volume %s is not usable", method, devPath, volumeID))
+		return status.Errorf(codes.Internal, "[%s] Device %q of volume %s is not usable, check the LV is activated: %v", method, devPath, volumeID, err)
+	}
+
+	return nil
+}
+
+// waitForDeviceReady runs the configured readiness probe against the device until it succeeds. The device is
+// reported with codes.FailedPrecondition if it is not ready after all the attempts or the request is cancelled.
+func (d *Driver) waitForDeviceReady(ctx context.Context, volumeID, devPath string) error {
+	if d.deviceProber == nil {
+		return nil
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = d.deviceProber.ProbeDevice(devPath); err == nil {
+			d.log.Debug(fmt.Sprintf("[NodePublishVolume] Device %s of volume %s is ready after %d attempt(s)", devPath, volumeID, attempt))
+			return nil
+		}
+
+		if attempt >= d.deviceProbeAttempts {
+			break
+		}
+
+		d.log.Info(fmt.Sprintf("[NodePublishVolume] Device %s of volume %s is not ready (attempt %d of %d): %v. Retry in %s", devPath, volumeID, attempt, d.deviceProbeAttempts, err, d.deviceProbeInterval))
+		select {
+		case <-ctx.Done():
+			return status.Errorf(codes.FailedPrecondition, "[NodePublishVolume] Device %q is not ready: %v", devPath, ctx.Err())
+		case <-time.After(d.deviceProbeInterval):
+		}
+	}
+
+	d.log.Error(err, fmt.Sprintf("[NodePublishVolume] Device %s of volume %s is not ready after %d attempt(s)", devPath, volumeID, d.deviceProbeAttempts))
+	return status.Errorf(codes.FailedPrecondition, "[NodePublishVolume] Device %q is not ready after %d attempt(s): %v", devPath, d.deviceProbeAttempts, err)
+}
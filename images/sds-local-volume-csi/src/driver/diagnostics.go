@@ -0,0 +1,201 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"sds-local-volume-csi/pkg/utils"
+)
+
+const (
+	// the diagnostics are bounded to keep the gRPC trailers small
+	maxDiagnosticsCandidates        = 32
+	maxDiagnosticsDescriptionLength = 256
+	// the node agent failure reason is kept verbatim up to the length
+	maxLLVFailureReasonLength = 4096
+)
+
+// excludedLVGCandidates returns the rejected candidates for the LVMVolumeGroups not present in eligible.
+func excludedLVGCandidates(all, eligible []v1alpha1.LVMVolumeGroup, reason string) []utils.LVGCandidate {
+	names := make(map[string]struct{}, len(eligible))
+	for _, lvg := range eligible {
+		names[lvg.Name] = struct{}{}
+	}
+
+	var candidates []utils.LVGCandidate
+	for _, lvg := range all {
+		if _, ok := names[lvg.Name]; !ok {
+			candidates = append(candidates, utils.LVGCandidate{LVG: lvg.Name, Node: lvg.Spec.Local.NodeName, Rejection: reason})
+		}
+	}
+
+	return candidates
+}
+
+// capacityExhaustedError returns a ResourceExhausted status error with a QuotaFailure detail
+// listing each candidate LVMVolumeGroup and the reason it was rejected.
+func capacityExhaustedError(msg string, candidates []utils.LVGCandidate) error {
+	st := status.New(codes.ResourceExhausted, msg)
+
+	violations := make([]*errdetails.QuotaFailure_Violation, 0, min(len(candidates), maxDiagnosticsCandidates+1))
+	for i, c := range candidates {
+		if i == maxDiagnosticsCandidates {
+			violations = append(violations, &errdetails.QuotaFailure_Violation{
+				Description: fmt.Sprintf("%d more candidates are omitted", len(candidates)-i),
+			})
+			break
+		}
+
+		reason := c.Rejection
+		if reason == "" {
+			reason = fmt.Sprintf("free space %s", c.FreeSpace.String())
+		}
+		description := fmt.Sprintf("node %s: %s", c.Node, reason)
+		if len(description) > maxDiagnosticsDescriptionLength {
+			description = description[:maxDiagnosticsDescriptionLength-3] + "..."
+		}
+
+		violations = append(violations, &errdetails.QuotaFailure_Violation{
+			Subject:     "LVMVolumeGroup/" + c.LVG,
+			Description: description,
+		})
+	}
+
+	withDetails, err := st.WithDetails(&errdetails.QuotaFailure{Violations: violations})
+	if err != nil {
+		return st.Err()
+	}
+	return withDetails.Err()
+}
+
+// llvFailureCodes maps the substrings of the LVMLogicalVolume failure reasons to the gRPC codes.
+// The external-provisioner retries ResourceExhausted and Unavailable with a backoff,
+// while InvalidArgument tells it the request cannot succeed as is.
+var llvFailureCodes = []struct {
+	substr string
+	code   codes.Code
+}{
+	{substr: "insufficient free space", code: codes.ResourceExhausted},
+	{substr: "not enough space", code: codes.ResourceExhausted},
+	{substr: "no space", code: codes.ResourceExhausted},
+	{substr: "invalid", code: codes.InvalidArgument},
+	{substr: "unsupported", code: codes.InvalidArgument},
+	{substr: "activat", code: codes.Unavailable},
+}
+
+// llvFailureCode returns the gRPC code of the LVMLogicalVolume failure reason. Unknown reasons are Internal.
+func llvFailureCode(reason string) codes.Code {
+	reason = strings.ToLower(reason)
+	for _, c := range llvFailureCodes {
+		if strings.Contains(reason, c.substr) {
+			return c.code
+		}
+	}
+
+	return codes.Internal
+}
+
+// llvFailureError converts an LVMLogicalVolume failure into a status error with the code of its reason.
+// The deletion of the LVMVolumeGroup is Aborted, so the external-provisioner retries and reselects it.
+// Other errors are returned as is.
+func llvFailureError(err error) error {
+	var failed *utils.LLVFailedError
+	if errors.As(err, &failed) {
+		return llvFailedStatusError(failed)
+	}
+
+	if errors.Is(err, utils.ErrLVGGone) {
+		return status.Error(codes.Aborted, err.Error())
+	}
+
+	return err
+}
+
+// isTransientLLVFailure reports whether the LVMLogicalVolume failed for a reason the node agent recovers from
+// on its own, e.g. an activation failure, so the LVMLogicalVolume is kept for the next attempt.
+func isTransientLLVFailure(err error) bool {
+	var failed *utils.LLVFailedError
+	return errors.As(err, &failed) && llvFailureCode(failed.Reason) == codes.Unavailable
+}
+
+// llvFailedStatusError returns the status error of the failed LVMLogicalVolume with the node agent reason
+// verbatim, unless it is too long, and an ErrorInfo detail carrying the reason and the provisioning conditions.
+func llvFailedStatusError(failed *utils.LLVFailedError) error {
+	reason := truncateLLVFailureReason(failed.Reason)
+	st := status.New(llvFailureCode(failed.Reason), (&utils.LLVFailedError{Name: failed.Name, Reason: reason}).Error())
+
+	info := &errdetails.ErrorInfo{
+		Reason: "LVMLogicalVolumeFailed",
+		Domain: DefaultDriverName,
+		Metadata: map[string]string{
+			"lvmLogicalVolume": failed.Name,
+			"reason":           reason,
+		},
+	}
+	for _, c := range failed.Conditions {
+		info.Metadata["condition."+c.Type] = fmt.Sprintf("%s: %s", c.Status, c.Message)
+	}
+
+	withDetails, err := st.WithDetails(info)
+	if err != nil {
+		return st.Err()
+	}
+	return withDetails.Err()
+}
+
+// truncateLLVFailureReason cuts the reason longer than maxLLVFailureReasonLength at a rune boundary
+// and notes how much was cut.
+func truncateLLVFailureReason(reason string) string {
+	if len(reason) <= maxLLVFailureReasonLength {
+		return reason
+	}
+
+	cut := maxLLVFailureReasonLength
+	for cut > 0 && !utf8.RuneStart(reason[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s... (%d bytes truncated)", reason[:cut], len(reason)-cut)
+}
+
+// provisionCooldownError returns an Unavailable status error with a RetryInfo detail
+// hinting the external-provisioner to back off until the cooldown lifts.
+func provisionCooldownError(nodeName string, remaining time.Duration) error {
+	st := status.Newf(codes.Unavailable, "a recent provision failed on node %s, retry in %s", nodeName, remaining.Round(time.Second))
+
+	withDetails, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(remaining)})
+	if err != nil {
+		return st.Err()
+	}
+	return withDetails.Err()
+}
+
+// isRetryableProvisionFailure reports whether the provision failure may succeed on a retry of the same placement,
+// so it starts the cooldown. Invalid requests fail regardless of the placement.
+func isRetryableProvisionFailure(err error) bool {
+	return status.Code(err) != codes.InvalidArgument
+}
@@ -20,6 +20,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
@@ -30,12 +31,18 @@ import (
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"sds-local-volume-csi/internal"
 	"sds-local-volume-csi/pkg/logger"
+	"sds-local-volume-csi/pkg/metrics"
+	"sds-local-volume-csi/pkg/tracing"
 	"sds-local-volume-csi/pkg/utils"
 )
 
@@ -47,6 +54,9 @@ const (
 	// http handler on.
 	DefaultAddress           = "127.0.0.1:12302"
 	defaultWaitActionTimeout = 5 * time.Minute
+	maxWaitActionTimeout     = 30 * time.Minute
+	// DefaultDevPathBase is the directory containing the LVM device nodes.
+	DefaultDevPathBase = "/dev"
 )
 
 var (
@@ -72,22 +82,464 @@ type Driver struct {
 	storeManager utils.NodeStoreManager
 	inFlight     *internal.InFlight
 
+	trimTargetsMu sync.Mutex // protects trimTargets
+	// trimTargets holds the publish targets to be trimmed on unpublish.
+	// It is populated on publish, so the targets published before the restart are not trimmed.
+	trimTargets map[string]struct{}
+
+	ephemeralTargetsMu sync.Mutex // protects ephemeralTargets
+	// ephemeralTargets holds the publish targets of the ephemeral inline volumes, whose LVMLogicalVolumes
+	// are deleted on unpublish. It is populated on publish, as trimTargets.
+	ephemeralTargets map[string]struct{}
+	// ephemeralDeleteGracePeriod delays the deletion of the LVMLogicalVolume of an unpublished ephemeral volume.
+	ephemeralDeleteGracePeriod time.Duration
+
+	asyncCreateVolume bool
+	ioThrottler       utils.IOThrottler
+	lvEnumerator      utils.LVEnumerator
+	lvActivator       utils.LVActivator
+	vgChecker         utils.VGChecker
+	lvgLister         utils.LVGLister
+	nodeSelector      utils.NodeSelector
+	llvFinalizer      string
+	excludeNodeTaint  string
+	tracer            trace.Tracer
+	devPathBase       string
+	// formatSemaphore limits the concurrent filesystem formatting. Nil means unlimited.
+	formatSemaphore *semaphore.Weighted
+	// listVolumesLayout adds the LV segment layout to the ListVolumes entries.
+	listVolumesLayout bool
+	metrics           *metrics.Metrics
+	// topologyKey is the key of the node topology segment reported by NodeGetInfo and CreateVolume.
+	topologyKey string
+	// requiredSecrets are the keys CreateVolume requires in the provisioner secrets.
+	requiredSecrets []string
+	// mountTimeout bounds the mount step of NodePublishVolume. Zero means no limit.
+	mountTimeout time.Duration
+	// unmountTimeout bounds the unmount step of NodeUnpublishVolume. Zero means no limit.
+	unmountTimeout time.Duration
+	// registrationTimeout is how long the node plugin waits for the kubelet to register it. Zero disables the wait.
+	registrationTimeout time.Duration
+	// lazyUnmount makes NodeUnpublishVolume detach the target lazily when the unmount times out.
+	lazyUnmount bool
+	// minVolumeSize is the floor of the CreateVolume sizes applied according to minVolumeSizePolicy.
+	minVolumeSize       int64
+	minVolumeSizePolicy string
+	// maxVolumesPerNode is reported by NodeGetInfo. Zero means no limit.
+	maxVolumesPerNode int64
+	// inodeFreeThresholdPercent is the free inodes percent below which NodeGetVolumeStats reports
+	// the filesystem volume abnormal. Zero disables the check.
+	inodeFreeThresholdPercent int64
+	// conditionCache keeps the API objects read by NodeGetVolumeStats for the volume condition.
+	conditionCache *volumeConditionCache
+	// maxVolumesAverageSize enables the limit computed from the node LVG capacity. Zero disables it.
+	maxVolumesAverageSize int64
+	// staleMountsAction is the action taken on the stale mounts found on the startup. Empty disables the scan.
+	staleMountsAction string
+	// grpcReflection registers the gRPC server reflection service for debugging with grpcurl.
+	grpcReflection bool
+	// provisionCooldown holds back CreateVolume on the placements that failed recently. Nil disables it.
+	provisionCooldown *utils.ProvisionCooldown
+	// lvgStatusTimeout is how long CreateVolume waits for the status of a storage class LVMVolumeGroup
+	// to be populated. Zero fails CreateVolume at once.
+	lvgStatusTimeout time.Duration
+	// lvNameTemplate builds the LV names on the nodes from the volume ID and the PVC metadata. Empty names the LVs
+	// after the volume IDs.
+	lvNameTemplate string
+	// foreignMountAction is the action NodePublishVolume takes on the target mounted from a foreign device.
+	// Empty is ForeignMountFail.
+	foreignMountAction string
+	// deviceProber checks the device is ready before NodePublishVolume mounts it. Nil disables the probe.
+	deviceProber        utils.DeviceProber
+	deviceProbeAttempts int
+	deviceProbeInterval time.Duration
+	// blockFSProber reads the usage of the filesystem inside the block volumes for NodeGetVolumeStats.
+	// Nil disables the probe.
+	blockFSProber utils.BlockFSProber
+	// volumeFreezer freezes the filesystem of the snapshot source volumes on their nodes.
+	volumeFreezer utils.VolumeFreezer
+	// strictThinSize makes CreateVolume wait for the actual size of the thin volumes to match the requested one
+	// instead of their Created phase only.
+	strictThinSize bool
+	// vgLimiter bounds the concurrent LV creations and deletions per LVMVolumeGroup. Nil means unlimited.
+	vgLimiter *utils.VGLimiter
+	// vgSlotHoldTimeout bounds the time a creation holds the LVMVolumeGroup slot waiting for the node agent.
+	vgSlotHoldTimeout time.Duration
+	// lvgSelector chooses the LVMVolumeGroup of a new volume among the ones located on the selected node.
+	lvgSelector *utils.LVGSelector
+	// freezeAgent makes the node plugin serve the freeze requests of the volumes of the node.
+	freezeAgent bool
+	frozenMu    sync.Mutex // protects frozen
+	// frozen are the filesystems frozen by the node plugin by the LVMLogicalVolume name.
+	frozen map[string]frozenVolume
+	// storageClassLabelsInterval is how often the node plugin publishes the storage classes of the node
+	// on the Node. Zero disables the publishing.
+	storageClassLabelsInterval time.Duration
+	// auditLog receives a JSON line per volume lifecycle call. Nil disables the audit log.
+	auditLog io.Writer
+	auditMu  sync.Mutex // serializes the writes to auditLog
+	// shutdownTimeout bounds the wait for the in-flight calls on shutdown. Zero means no limit.
+	shutdownTimeout time.Duration
+	drainMu         sync.Mutex // protects draining, nodeOpsInFlight and drained
+	// draining is set once the shutdown starts, so the new node operations are refused.
+	draining        bool
+	nodeOpsInFlight int
+	// drained is closed once the in-flight node operations finish while draining.
+	drained chan struct{}
+
 	csi.UnimplementedControllerServer
 	csi.UnimplementedIdentityServer
 	csi.UnimplementedNodeServer
 }
 
+// Option configures optional Driver behavior.
+type Option func(*Driver)
+
+// WithAsyncCreateVolume makes CreateVolume return as soon as the LVMLogicalVolume
+// is created instead of waiting for it to be provisioned. The external-provisioner
+// is expected to call CreateVolume again until the volume is ready.
+func WithAsyncCreateVolume(enabled bool) Option {
+	return func(d *Driver) {
+		d.asyncCreateVolume = enabled
+	}
+}
+
+// WithIOThrottler sets the throttler used to apply per-volume IO limits on publish.
+func WithIOThrottler(t utils.IOThrottler) Option {
+	return func(d *Driver) {
+		d.ioThrottler = t
+	}
+}
+
+// WithExcludeNodeTaint excludes the nodes having a taint with the given key from the volume placement.
+func WithExcludeNodeTaint(key string) Option {
+	return func(d *Driver) {
+		d.excludeNodeTaint = key
+	}
+}
+
+// WithTracerProvider enables the OpenTelemetry spans around the CSI operations.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(d *Driver) {
+		d.tracer = tp.Tracer(tracing.TracerName)
+	}
+}
+
+// WithDevPathBase sets the directory the LVM device paths are built from instead of /dev.
+func WithDevPathBase(base string) Option {
+	return func(d *Driver) {
+		d.devPathBase = base
+	}
+}
+
+// WithMaxConcurrentFormats limits the number of devices formatted concurrently by NodeStageVolume.
+// Staging the already formatted devices is not limited. Zero means no limit.
+func WithMaxConcurrentFormats(limit int) Option {
+	return func(d *Driver) {
+		if limit > 0 {
+			d.formatSemaphore = semaphore.NewWeighted(int64(limit))
+		}
+	}
+}
+
+// WithMountRetryPolicy sets the errors retried by the node plugin when mounting volumes.
+func WithMountRetryPolicy(policy utils.MountRetryPolicy) Option {
+	return func(d *Driver) {
+		if st, ok := d.storeManager.(*utils.Store); ok {
+			st.MountRetry = policy
+		}
+	}
+}
+
+// WithResizeToolPaths sets the paths NodeExpandVolume runs the filesystem resize tools from.
+func WithResizeToolPaths(paths utils.ResizeToolPaths) Option {
+	return func(d *Driver) {
+		if st, ok := d.storeManager.(*utils.Store); ok {
+			st.ResizeTools = paths
+		}
+	}
+}
+
+// WithListVolumesLayout makes ListVolumes report the LV segment layout in the volume context when it is known.
+func WithListVolumesLayout(enabled bool) Option {
+	return func(d *Driver) {
+		d.listVolumesLayout = enabled
+	}
+}
+
+// WithLVEnumerator sets the LV lookup used to detect the duplicate LV names on the node.
+func WithLVEnumerator(e utils.LVEnumerator) Option {
+	return func(d *Driver) {
+		d.lvEnumerator = e
+	}
+}
+
+// WithLVActivator sets the LVM layer used to activate the LVs on the node.
+func WithLVActivator(a utils.LVActivator) Option {
+	return func(d *Driver) {
+		d.lvActivator = a
+	}
+}
+
+// WithVGChecker sets the VG lookup used to verify the volume context VG exists on the node.
+func WithVGChecker(c utils.VGChecker) Option {
+	return func(d *Driver) {
+		d.vgChecker = c
+	}
+}
+
+// WithLVGLister sets the source of the LVMVolumeGroups the volume placement is chosen from.
+func WithLVGLister(l utils.LVGLister) Option {
+	return func(d *Driver) {
+		d.lvgLister = l
+	}
+}
+
+// WithLLVFinalizer sets the finalizer protecting the LVMLogicalVolumes created by the driver.
+func WithLLVFinalizer(finalizer string) Option {
+	return func(d *Driver) {
+		if finalizer != "" {
+			d.llvFinalizer = finalizer
+		}
+	}
+}
+
+// WithMountTimeout bounds the mount step of NodePublishVolume separately from the rest of the call.
+// Zero means the mount is bounded by the request deadline only.
+func WithMountTimeout(timeout time.Duration) Option {
+	return func(d *Driver) {
+		d.mountTimeout = timeout
+	}
+}
+
+// WithUnmountTimeout bounds the unmount step of NodeUnpublishVolume, so a hung unmount does not block
+// the node plugin. When lazy is set, a timed out unmount is followed by a lazy one (umount -l).
+func WithUnmountTimeout(timeout time.Duration, lazy bool) Option {
+	return func(d *Driver) {
+		d.unmountTimeout = timeout
+		d.lazyUnmount = lazy
+	}
+}
+
+// WithEphemeralDeleteGracePeriod delays the deletion of the LVMLogicalVolume of an ephemeral inline volume
+// after its unpublish, so the deletion does not race with the pod finishing its teardown. Zero deletes it at once.
+func WithEphemeralDeleteGracePeriod(gracePeriod time.Duration) Option {
+	return func(d *Driver) {
+		d.ephemeralDeleteGracePeriod = gracePeriod
+	}
+}
+
+// WithRegistrationTimeout makes the node plugin wait for the kubelet to register it, so a registration
+// that never happens is reported in the plugin log. The wait only reports it: the registration is retried by
+// the node-driver-registrar sidecar, restarted by its livenessProbe on --http-endpoint once the kubelet loses it.
+func WithRegistrationTimeout(timeout time.Duration) Option {
+	return func(d *Driver) {
+		d.registrationTimeout = timeout
+	}
+}
+
+// WithRequiredProvisionerSecrets makes CreateVolume require the given keys in the provisioner secrets.
+// The secrets are ignored if no keys are required.
+func WithRequiredProvisionerSecrets(keys []string) Option {
+	return func(d *Driver) {
+		d.requiredSecrets = keys
+	}
+}
+
+// WithTopologyKey sets the key of the node topology segment. It must be the same for the controller and the node plugins.
+func WithTopologyKey(key string) Option {
+	return func(d *Driver) {
+		if key != "" {
+			d.topologyKey = key
+		}
+	}
+}
+
+// WithMinVolumeSize sets the minimum size of the created volumes and the policy applied to the smaller requests:
+// utils.MinVolumeSizePolicyRoundUp or utils.MinVolumeSizePolicyReject. Zero disables the floor.
+func WithMinVolumeSize(size int64, policy string) Option {
+	return func(d *Driver) {
+		d.minVolumeSize = size
+		if policy != "" {
+			d.minVolumeSizePolicy = policy
+		}
+	}
+}
+
+// WithNodeSelector sets the strategy choosing the node to place a new volume on.
+func WithNodeSelector(s utils.NodeSelector) Option {
+	return func(d *Driver) {
+		if s != nil {
+			d.nodeSelector = s
+		}
+	}
+}
+
+// WithMaxVolumesPerNode sets the maximum number of volumes NodeGetInfo reports for the node.
+// It is also the ceiling of the dynamic limit. Zero means no limit.
+func WithMaxVolumesPerNode(limit int64) Option {
+	return func(d *Driver) {
+		d.maxVolumesPerNode = limit
+	}
+}
+
+// WithInodeFreeThreshold makes NodeGetVolumeStats report the filesystem volumes with less than the percent
+// of free inodes abnormal. Zero disables the check.
+func WithInodeFreeThreshold(percent int64) Option {
+	return func(d *Driver) {
+		d.inodeFreeThresholdPercent = percent
+	}
+}
+
+// WithDynamicMaxVolumesPerNode makes NodeGetInfo report the node LVG capacity divided by the assumed
+// average volume size instead of the static limit. Zero disables the dynamic limit.
+func WithDynamicMaxVolumesPerNode(averageSize int64) Option {
+	return func(d *Driver) {
+		d.maxVolumesAverageSize = averageSize
+	}
+}
+
+// WithStaleMountsAction enables the startup scan for the mounts of the volumes whose LVMLogicalVolumes
+// no longer exist. The action is StaleMountsReport or StaleMountsUnmount. Empty disables the scan.
+func WithStaleMountsAction(action string) Option {
+	return func(d *Driver) {
+		d.staleMountsAction = action
+	}
+}
+
+// WithGRPCReflection registers the gRPC server reflection service, so the plugin socket can be inspected with grpcurl.
+func WithGRPCReflection(enabled bool) Option {
+	return func(d *Driver) {
+		d.grpcReflection = enabled
+	}
+}
+
+// WithProvisionFailureCooldown makes CreateVolume return codes.Unavailable for the window after a provision
+// of the same storage class failed on the selected node. Zero disables the cooldown.
+func WithProvisionFailureCooldown(window time.Duration) Option {
+	return func(d *Driver) {
+		d.provisionCooldown = utils.NewProvisionCooldown(window)
+	}
+}
+
+// WithLVGStatusTimeout makes CreateVolume wait for the status of the storage class LVMVolumeGroups
+// to be populated by the node agent, e.g. right after they are created, instead of failing at once.
+func WithLVGStatusTimeout(timeout time.Duration) Option {
+	return func(d *Driver) {
+		d.lvgStatusTimeout = timeout
+	}
+}
+
+// WithLVNameTemplate sets the template of the LV names on the nodes, see utils.ExpandLVName.
+// The LVMLogicalVolume resources are still named after the volume IDs.
+func WithLVNameTemplate(tmpl string) Option {
+	return func(d *Driver) {
+		d.lvNameTemplate = tmpl
+	}
+}
+
+// WithForeignMountAction sets the action NodePublishVolume takes on the target already mounted from a device
+// other than the volume one: ForeignMountFail or ForeignMountForce.
+func WithForeignMountAction(action string) Option {
+	return func(d *Driver) {
+		d.foreignMountAction = action
+	}
+}
+
+// WithDeviceReadinessProbe makes NodePublishVolume probe the device before mounting it, up to the given number
+// of attempts separated by the interval. A nil prober disables the probe.
+func WithDeviceReadinessProbe(prober utils.DeviceProber, attempts int, interval time.Duration) Option {
+	return func(d *Driver) {
+		d.deviceProber = prober
+		d.deviceProbeAttempts = attempts
+		d.deviceProbeInterval = interval
+	}
+}
+
+// WithVolumeFreezer sets the freezer used by CreateSnapshot to quiesce the filesystem of the source volume.
+func WithVolumeFreezer(f utils.VolumeFreezer) Option {
+	return func(d *Driver) {
+		d.volumeFreezer = f
+	}
+}
+
+// WithFreezeAgent makes the node plugin serve the filesystem freeze requests of CreateSnapshot for the volumes
+// of the node. It must only be enabled on the node plugins, which see the mounts of the node.
+func WithFreezeAgent(enabled bool) Option {
+	return func(d *Driver) {
+		d.freezeAgent = enabled
+	}
+}
+
+// WithNodeStorageClassLabels makes the node plugin label the Node with the storage classes of the driver listing
+// an LVMVolumeGroup of the node every interval, so the workloads can be placed on the nodes serving a storage class.
+// It must only be enabled on the node plugins. Zero disables the labels.
+func WithNodeStorageClassLabels(interval time.Duration) Option {
+	return func(d *Driver) {
+		d.storageClassLabelsInterval = interval
+	}
+}
+
+// WithAuditLog makes the plugin append a JSON record of every volume lifecycle call, with the volume, the requesting
+// identity and the result, to the writer. The records never contain the secrets of the requests.
+func WithAuditLog(w io.Writer) Option {
+	return func(d *Driver) {
+		d.auditLog = w
+	}
+}
+
+// WithBlockFSUsageProbe makes NodeGetVolumeStats report the usage of the filesystem found inside a block volume
+// in the volume condition. The reported capacity of the block volume remains the device size.
+func WithBlockFSUsageProbe(p utils.BlockFSProber) Option {
+	return func(d *Driver) {
+		d.blockFSProber = p
+	}
+}
+
+// WithMaxConcurrentVGOperations limits the number of LV creations and deletions run concurrently on the same
+// LVMVolumeGroup. The operations on different LVMVolumeGroups are not limited. Zero means no limit.
+func WithMaxConcurrentVGOperations(limit int) Option {
+	return func(d *Driver) {
+		d.vgLimiter = utils.NewVGLimiter(limit)
+	}
+}
+
+// WithVGSlotHoldTimeout bounds the time an LV creation holds the LVMVolumeGroup slot waiting for the node agent
+// to pick the LVMLogicalVolume up. The slot is released once the agent does, or once the timeout expires.
+func WithVGSlotHoldTimeout(timeout time.Duration) Option {
+	return func(d *Driver) {
+		d.vgSlotHoldTimeout = timeout
+	}
+}
+
+// WithStrictThinSizeCheck makes CreateVolume wait for the actual size of a thin volume reported by the node agent
+// to match the requested size. By default the Created phase is enough, as the actual size of a thin volume may only
+// reflect the space allocated in the thin pool.
+func WithStrictThinSizeCheck(enabled bool) Option {
+	return func(d *Driver) {
+		d.strictThinSize = enabled
+	}
+}
+
+// WithShutdownTimeout sets the time the plugin waits on shutdown for the in-flight node operations and the rest
+// of the calls to finish before stopping forcibly. Zero means the plugin waits without a limit.
+func WithShutdownTimeout(timeout time.Duration) Option {
+	return func(d *Driver) {
+		d.shutdownTimeout = timeout
+	}
+}
+
 // NewDriver returns a CSI plugin that contains the necessary gRPC
 // interfaces to interact with Kubernetes over unix domain sockets for
 // managing  disks
-func NewDriver(csiAddress, driverName, address string, nodeName *string, log *logger.Logger, cl client.Client) (*Driver, error) {
+func NewDriver(csiAddress, driverName, address string, nodeName *string, log *logger.Logger, cl client.Client, opts ...Option) (*Driver, error) {
 	if driverName == "" {
 		driverName = DefaultDriverName
 	}
 
 	st := utils.NewStore(log)
 
-	return &Driver{
+	d := &Driver{
 		name:              driverName,
 		hostID:            *nodeName,
 		csiAddress:        csiAddress,
@@ -97,7 +549,64 @@ func NewDriver(csiAddress, driverName, address string, nodeName *string, log *lo
 		cl:                cl,
 		storeManager:      st,
 		inFlight:          internal.NewInFlight(),
-	}, nil
+		trimTargets:       make(map[string]struct{}),
+		ephemeralTargets:  make(map[string]struct{}),
+		tracer:            noop.NewTracerProvider().Tracer(tracing.TracerName),
+		devPathBase:       DefaultDevPathBase,
+		ioThrottler:       utils.NewCgroupIOThrottler(utils.DefaultIOCgroupPath),
+		lvEnumerator:      utils.NewLVSEnumerator(),
+		lvActivator:       utils.NewLVChangeActivator(),
+		vgChecker:         utils.NewVGSChecker(),
+		lvgLister:         utils.ClientLVGLister{Client: cl},
+		volumeFreezer:     utils.NewLLVVolumeFreezer(cl),
+		frozen:            make(map[string]frozenVolume),
+		conditionCache:    newVolumeConditionCache(),
+		vgLimiter:         utils.NewVGLimiter(utils.DefaultVGConcurrency),
+		vgSlotHoldTimeout: utils.DefaultVGSlotHoldTimeout,
+		lvgSelector:       utils.NewLVGSelector(),
+		nodeSelector:      utils.MostFreeNodeSelector{},
+		llvFinalizer:      utils.SDSLocalVolumeCSIFinalizer,
+		metrics:           metrics.New(),
+		topologyKey:       internal.TopologyKey,
+		shutdownTimeout:   DefaultShutdownTimeout,
+
+		minVolumeSize:       utils.DefaultMinVolumeSize.Value(),
+		minVolumeSizePolicy: utils.MinVolumeSizePolicyRoundUp,
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	if cl != nil {
+		d.metrics.Registry().MustRegister(metrics.NewCapacityCollector(cl))
+	}
+
+	return d, nil
+}
+
+// newGRPCServer returns the gRPC server with the CSI services registered.
+func (d *Driver) newGRPCServer() *grpc.Server {
+	// log response errors for better observability
+	errHandler := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		if err != nil {
+			d.log.Error(err, fmt.Sprintf("method %s method failed ", info.FullMethod))
+		}
+		return resp, err
+	}
+
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(d.traceInterceptor, d.auditInterceptor, d.drainInterceptor, d.metricsInterceptor, errHandler))
+	csi.RegisterIdentityServer(srv, d)
+	csi.RegisterControllerServer(srv, d)
+	csi.RegisterNodeServer(srv, d)
+
+	if d.grpcReflection {
+		d.log.Info("gRPC server reflection is enabled")
+		reflection.Register(srv)
+	}
+
+	return srv
 }
 
 func (d *Driver) Run(ctx context.Context) error {
@@ -128,24 +637,36 @@ func (d *Driver) Run(ctx context.Context) error {
 		return fmt.Errorf("failed to remove unix domain socket file %s, error: %s", grpcAddr, err)
 	}
 
-	grpcListener, err := net.Listen(u.Scheme, grpcAddr)
-	if err != nil {
-		return fmt.Errorf("failed to listen: %v", err)
+	// the node plugins register the topology key with kubelet, so the mismatch is visible in the CSINodes.
+	// The check is skipped if the CSINodes cannot be listed, e.g. by the node plugins lacking the RBAC.
+	if err := utils.CheckCSINodeTopologyKey(ctx, d.cl, d.name, d.topologyKey, d.hostID); err != nil {
+		if errors.Is(err, utils.ErrTopologyKeyMismatch) {
+			return fmt.Errorf("topology key check failed: %w", err)
+		}
+		d.log.Warning(fmt.Sprintf("unable to check the topology key %s: %v", d.topologyKey, err))
 	}
 
-	// log response errors for better observability
-	errHandler := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-		resp, err := handler(ctx, req)
-		if err != nil {
-			d.log.Error(err, fmt.Sprintf("method %s method failed ", info.FullMethod))
+	// the volumes of the filesystems whose resize tool is missing fail to expand with a FailedPrecondition
+	if st, ok := d.storeManager.(*utils.Store); ok {
+		for _, path := range st.ResizeTools.Missing(st.NodeStorage.Exec) {
+			d.log.Warning(fmt.Sprintf("resize tool %s is not found", path))
 		}
-		return resp, err
 	}
 
-	d.srv = grpc.NewServer(grpc.UnaryInterceptor(errHandler))
-	csi.RegisterIdentityServer(d.srv, d)
-	csi.RegisterControllerServer(d.srv, d)
-	csi.RegisterNodeServer(d.srv, d)
+	if err := d.checkDynamicVolumeLimit(ctx); err != nil {
+		return fmt.Errorf("max-volumes-average-volume-size check failed: %w", err)
+	}
+
+	if err := d.scanStaleMounts(ctx); err != nil {
+		return fmt.Errorf("stale-mounts scan failed: %w", err)
+	}
+
+	grpcListener, err := net.Listen(u.Scheme, grpcAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %v", err)
+	}
+
+	d.srv = d.newGRPCServer()
 
 	httpListener, err := net.Listen("tcp", d.address)
 	if err != nil {
@@ -156,6 +677,7 @@ func (d *Driver) Run(ctx context.Context) error {
 	mux.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
+	mux.Handle("/metrics", d.metrics.Handler())
 
 	d.httpSrv = http.Server{
 		Handler: mux,
@@ -164,7 +686,32 @@ func (d *Driver) Run(ctx context.Context) error {
 	d.ready = true
 	d.log.Info(fmt.Sprintf("grpc_addr %s http_addr %s starting server", grpcAddr, d.address))
 
+	// the kubelet registers the plugin through the node-driver-registrar sidecar once the CSI socket is served
+	if d.registrationTimeout > 0 {
+		go func() {
+			err := utils.WaitForDriverRegistration(ctx, d.cl, d.log, d.name, d.hostID, d.registrationTimeout, utils.DefaultRegistrationPollInterval)
+			switch {
+			case errors.Is(err, utils.ErrDriverNotRegistered) && ctx.Err() == nil:
+				d.log.Error(err, "the node plugin is not registered. Check the csi-node-driver-registrar container")
+			case err != nil && ctx.Err() == nil:
+				d.log.Warning(fmt.Sprintf("unable to check the registration of the node plugin: %v", err))
+			}
+		}()
+	}
+
 	var eg errgroup.Group
+	if d.freezeAgent {
+		eg.Go(func() error {
+			d.runFreezeAgent(ctx)
+			return nil
+		})
+	}
+	if d.storageClassLabelsInterval > 0 {
+		eg.Go(func() error {
+			d.runStorageClassLabeler(ctx, d.storageClassLabelsInterval)
+			return nil
+		})
+	}
 	eg.Go(func() error {
 		<-ctx.Done()
 		return d.httpSrv.Shutdown(context.Background())
@@ -176,7 +723,7 @@ func (d *Driver) Run(ctx context.Context) error {
 			d.readyMu.Lock()
 			d.ready = false
 			d.readyMu.Unlock()
-			d.srv.GracefulStop()
+			d.stopGRPCServer()
 		}()
 		return d.srv.Serve(grpcListener)
 	})
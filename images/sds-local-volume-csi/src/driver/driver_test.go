@@ -0,0 +1,39 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGRPCReflection(t *testing.T) {
+	const reflectionService = "grpc.reflection.v1.ServerReflection"
+
+	t.Run("registered_when_enabled", func(t *testing.T) {
+		services := newTestDriver(newFakeClient(), WithGRPCReflection(true)).newGRPCServer().GetServiceInfo()
+		assert.Contains(t, services, reflectionService)
+		assert.Contains(t, services, "csi.v1.Node")
+	})
+
+	t.Run("absent_when_disabled", func(t *testing.T) {
+		services := newTestDriver(newFakeClient()).newGRPCServer().GetServiceInfo()
+		assert.NotContains(t, services, reflectionService)
+		assert.Contains(t, services, "csi.v1.Controller")
+	})
+}
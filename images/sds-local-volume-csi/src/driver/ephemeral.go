@@ -0,0 +1,63 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"sds-local-volume-csi/internal"
+	"sds-local-volume-csi/pkg/utils"
+)
+
+const (
+	ephemeralDeleteAttempts = 5
+	ephemeralDeleteBackoff  = 500 * time.Millisecond
+)
+
+func isEphemeralVolume(volumeContext map[string]string) bool {
+	return volumeContext[internal.EphemeralKey] == "true"
+}
+
+// deleteEphemeralVolume deletes the LVMLogicalVolume of an unpublished ephemeral volume once the grace period
+// has passed. The deletion is best-effort: transient failures are retried with a backoff and the last one is
+// logged. It holds the node operation token taken by the caller, so the shutdown waits for it.
+func (d *Driver) deleteEphemeralVolume(volumeID string) {
+	defer d.releaseNodeOperation()
+
+	time.Sleep(d.ephemeralDeleteGracePeriod)
+
+	backoff := ephemeralDeleteBackoff
+	for attempt := 1; ; attempt++ {
+		err := utils.DeleteLVMLogicalVolume(context.Background(), d.cl, d.log, "", volumeID, d.llvFinalizer)
+		if err == nil || kerrors.IsNotFound(err) {
+			d.log.Info(fmt.Sprintf("[deleteEphemeralVolume][volumeID:%s] Ephemeral volume is deleted", volumeID))
+			return
+		}
+		if attempt == ephemeralDeleteAttempts {
+			d.log.Error(err, fmt.Sprintf("[deleteEphemeralVolume][volumeID:%s] Unable to delete the ephemeral volume after %d attempts", volumeID, attempt))
+			return
+		}
+
+		d.log.Warning(fmt.Sprintf("[deleteEphemeralVolume][volumeID:%s] Unable to delete the ephemeral volume, retrying in %s: %v", volumeID, backoff, err))
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"sds-local-volume-csi/pkg/utils"
+)
+
+const (
+	// ForeignMountFail fails NodePublishVolume with AlreadyExists if the target is mounted from a foreign device.
+	ForeignMountFail = "fail"
+	// ForeignMountForce unmounts the foreign device from the target and publishes the volume there.
+	ForeignMountForce = "force"
+)
+
+// ValidateForeignMountAction checks the action is one of the supported values.
+func ValidateForeignMountAction(action string) error {
+	switch action {
+	case ForeignMountFail, ForeignMountForce:
+		return nil
+	default:
+		return fmt.Errorf("unsupported foreign mount action %q, expected %q or %q", action, ForeignMountFail, ForeignMountForce)
+	}
+}
+
+// handleForeignMount checks the publish target is not a mount point of a device other than devPath,
+// e.g. left behind by a crashed publish of another volume, and applies the configured action if it is.
+func (d *Driver) handleForeignMount(volumeID, devPath, target string, block bool) error {
+	err := d.storeManager.CheckPublishTarget(devPath, target, block)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, utils.ErrForeignMount) {
+		return status.Errorf(codes.Internal, "[NodePublishVolume] Unable to check the target %q of volume %q: %v", target, volumeID, err)
+	}
+
+	if d.foreignMountAction != ForeignMountForce {
+		return status.Errorf(codes.AlreadyExists, "[NodePublishVolume] Target %q of volume %q is already mounted from a foreign device: %v", target, volumeID, err)
+	}
+
+	d.log.Warning(fmt.Sprintf("[NodePublishVolume] FORCE UNMOUNTING the foreign mount at the target %s of volume %s to publish %s there: %v", target, volumeID, devPath, err))
+	if err := d.storeManager.Unpublish(target); err != nil {
+		return status.Errorf(codes.Internal, "[NodePublishVolume] Unable to unmount the foreign mount at the target %q of volume %q: %v", target, volumeID, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"sds-local-volume-csi/internal"
+	"sds-local-volume-csi/pkg/utils"
+)
+
+const (
+	// freezeAnswerTimeout bounds the wait of CreateSnapshot for the node plugin to answer the freeze request.
+	freezeAnswerTimeout = 30 * time.Second
+	// thawTimeout bounds the removal of the freeze request once the snapshot is taken.
+	thawTimeout = 10 * time.Second
+	// freezeAgentPollInterval is how often the node plugin checks for the freeze requests.
+	freezeAgentPollInterval = time.Second
+	// maxFreezeDuration is how long the node plugin keeps a filesystem frozen if the request is not removed,
+	// e.g. because the controller plugin crashed, so the workload is not blocked forever.
+	maxFreezeDuration = 2 * time.Minute
+)
+
+// frozenVolume is a filesystem frozen by the node plugin.
+type frozenVolume struct {
+	requestID string
+	target    string
+	since     time.Time
+}
+
+// freezeSourceVolume freezes the filesystem of the snapshot source volume on its node and returns the function
+// thawing it. A nil function is returned if the volume is not mounted, so there is nothing to freeze.
+func (d *Driver) freezeSourceVolume(ctx context.Context, traceID string, llv *v1alpha1.LVMLogicalVolume, nodeName, snapshotName string) (func(), error) {
+	freezeCtx, cancel := context.WithTimeout(ctx, d.subTimeout(ctx, "CreateSnapshot", "filesystem freeze", freezeAnswerTimeout))
+	defer cancel()
+
+	d.log.Info(fmt.Sprintf("[CreateSnapshot][traceID:%s][volumeID:%s] freeze the filesystem of LVMLogicalVolume %s on node %s", traceID, snapshotName, llv.Name, nodeName))
+	thaw, err := d.volumeFreezer.Freeze(freezeCtx, llv, nodeName, snapshotName)
+	switch {
+	case errors.Is(err, utils.ErrVolumeNotMounted):
+		d.log.Info(fmt.Sprintf("[CreateSnapshot][traceID:%s][volumeID:%s] LVMLogicalVolume %s is not mounted. Skip the freeze", traceID, snapshotName, llv.Name))
+		return nil, nil
+	case errors.Is(err, utils.ErrFreezeAgentUnavailable):
+		d.log.Error(err, fmt.Sprintf("[CreateSnapshot][traceID:%s][volumeID:%s] no freeze agent answered on node %s", traceID, snapshotName, nodeName))
+		return nil, status.Errorf(codes.FailedPrecondition, "unable to freeze the filesystem of volume %s: %v. Run the node plugin of node %s with --fs-freeze-agent", llv.Name, err, nodeName)
+	case errors.Is(err, utils.ErrFreezeFailed):
+		d.log.Error(err, fmt.Sprintf("[CreateSnapshot][traceID:%s][volumeID:%s] unable to freeze the filesystem of LVMLogicalVolume %s", traceID, snapshotName, llv.Name))
+		return nil, status.Errorf(codes.FailedPrecondition, "unable to freeze the filesystem of volume %s: %v", llv.Name, err)
+	case err != nil:
+		d.log.Error(err, fmt.Sprintf("[CreateSnapshot][traceID:%s][volumeID:%s] unable to freeze the filesystem of LVMLogicalVolume %s", traceID, snapshotName, llv.Name))
+		return nil, status.Errorf(codes.Unavailable, "unable to freeze the filesystem of volume %s: %v", llv.Name, err)
+	}
+
+	return func() {
+		thawCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), thawTimeout)
+		defer cancel()
+
+		d.log.Info(fmt.Sprintf("[CreateSnapshot][traceID:%s][volumeID:%s] thaw the filesystem of LVMLogicalVolume %s", traceID, snapshotName, llv.Name))
+		if err := thaw(thawCtx); err != nil {
+			d.log.Error(err, fmt.Sprintf("[CreateSnapshot][traceID:%s][volumeID:%s] unable to thaw the filesystem of LVMLogicalVolume %s. The node plugin thaws it in %s", traceID, snapshotName, llv.Name, maxFreezeDuration))
+		}
+	}, nil
+}
+
+// runFreezeAgent serves the freeze requests of the volumes of the node until the context is done.
+// The filesystems still frozen are thawed on exit.
+func (d *Driver) runFreezeAgent(ctx context.Context) {
+	ticker := time.NewTicker(freezeAgentPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			d.thawExpired(time.Time{}, nil)
+			return
+		case <-ticker.C:
+		}
+
+		if err := d.reconcileFreezeRequests(ctx); err != nil {
+			d.log.Warning(fmt.Sprintf("[FreezeAgent] unable to serve the freeze requests: %v", err))
+		}
+	}
+}
+
+// reconcileFreezeRequests accepts the new freeze requests of the volumes of the node, freezes their filesystems
+// and thaws the ones whose request is removed or has been frozen for longer than maxFreezeDuration.
+func (d *Driver) reconcileFreezeRequests(ctx context.Context) error {
+	llvs := &v1alpha1.LVMLogicalVolumeList{}
+	if err := d.cl.List(ctx, llvs, client.MatchingLabels{internal.FreezeNodeLabel: d.hostID}); err != nil {
+		return fmt.Errorf("unable to list the LVMLogicalVolumes: %w", err)
+	}
+
+	requests := make(map[string]string, len(llvs.Items))
+	for i := range llvs.Items {
+		llv := &llvs.Items[i]
+		requestID := llv.Annotations[internal.FreezeRequestAnnotation]
+		if requestID == "" {
+			continue
+		}
+		requests[llv.Name] = requestID
+
+		answeredID, answeredState, _ := utils.ParseFreezeState(llv.Annotations[internal.FreezeStateAnnotation])
+		if answeredID == requestID && answeredState != internal.FreezeStateAccepted {
+			continue
+		}
+
+		if answeredID != requestID {
+			if err := d.answerFreezeRequest(ctx, llv, requestID, internal.FreezeStateAccepted, ""); err != nil {
+				d.log.Warning(fmt.Sprintf("[FreezeAgent] unable to accept the freeze request %s of LVMLogicalVolume %s: %v", requestID, llv.Name, err))
+				continue
+			}
+		}
+
+		state, message := internal.FreezeStateFrozen, ""
+		d.frozenMu.Lock()
+		f, frozen := d.frozen[llv.Name]
+		d.frozenMu.Unlock()
+		if !frozen || f.requestID != requestID {
+			state, message = d.freezeVolume(ctx, llv, requestID)
+		}
+		if err := d.answerFreezeRequest(ctx, llv, requestID, state, message); err != nil {
+			d.log.Warning(fmt.Sprintf("[FreezeAgent] unable to answer the freeze request %s of LVMLogicalVolume %s: %v", requestID, llv.Name, err))
+		}
+	}
+
+	d.thawExpired(time.Now().Add(-maxFreezeDuration), requests)
+	return nil
+}
+
+// answerFreezeRequest records the state of the freeze request on the LVMLogicalVolume.
+func (d *Driver) answerFreezeRequest(ctx context.Context, llv *v1alpha1.LVMLogicalVolume, requestID, state, message string) error {
+	patch := client.MergeFrom(llv.DeepCopy())
+	llv.Annotations[internal.FreezeStateAnnotation] = utils.FreezeState(requestID, state, message)
+	return d.cl.Patch(ctx, llv, patch)
+}
+
+// freezeVolume freezes the filesystem of the volume and returns the state answering the request.
+func (d *Driver) freezeVolume(ctx context.Context, llv *v1alpha1.LVMLogicalVolume, requestID string) (string, string) {
+	lvg, err := utils.GetLVMVolumeGroup(ctx, d.cl, llv.Spec.LVMVolumeGroupName)
+	if err != nil {
+		return internal.FreezeStateFailed, fmt.Sprintf("unable to get LVMVolumeGroup %s: %v", llv.Spec.LVMVolumeGroupName, err)
+	}
+
+	devPath := d.devicePath(lvg.Spec.ActualVGNameOnTheNode, llv.Spec.ActualLVNameOnTheNode)
+	target, err := d.storeManager.FindMountPoint(devPath)
+	if err != nil {
+		return internal.FreezeStateFailed, err.Error()
+	}
+	if target == "" {
+		d.log.Info(fmt.Sprintf("[FreezeAgent] Device %s of LVMLogicalVolume %s is not mounted. Nothing to freeze", devPath, llv.Name))
+		return internal.FreezeStateNotMounted, ""
+	}
+
+	if err := d.storeManager.Freeze(target); err != nil {
+		d.log.Error(err, fmt.Sprintf("[FreezeAgent] Unable to freeze the filesystem of LVMLogicalVolume %s mounted at %s", llv.Name, target))
+		return internal.FreezeStateFailed, err.Error()
+	}
+
+	d.log.Info(fmt.Sprintf("[FreezeAgent] Froze the filesystem of LVMLogicalVolume %s mounted at %s for request %s", llv.Name, target, requestID))
+	d.frozenMu.Lock()
+	d.frozen[llv.Name] = frozenVolume{requestID: requestID, target: target, since: time.Now()}
+	d.frozenMu.Unlock()
+
+	return internal.FreezeStateFrozen, ""
+}
+
+// thawExpired thaws the frozen filesystems whose request is no longer in the requests or was frozen before
+// the deadline. A zero deadline and nil requests thaw all of them.
+func (d *Driver) thawExpired(deadline time.Time, requests map[string]string) {
+	d.frozenMu.Lock()
+	defer d.frozenMu.Unlock()
+
+	for name, f := range d.frozen {
+		if requests[name] == f.requestID && f.since.After(deadline) && !deadline.IsZero() {
+			continue
+		}
+
+		if err := d.storeManager.Thaw(f.target); err != nil {
+			d.log.Error(err, fmt.Sprintf("[FreezeAgent] Unable to thaw the filesystem of LVMLogicalVolume %s mounted at %s", name, f.target))
+			continue
+		}
+		d.log.Info(fmt.Sprintf("[FreezeAgent] Thawed the filesystem of LVMLogicalVolume %s mounted at %s", name, f.target))
+		delete(d.frozen, name)
+	}
+}
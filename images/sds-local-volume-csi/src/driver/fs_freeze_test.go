@@ -0,0 +1,248 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"sds-local-volume-csi/internal"
+	"sds-local-volume-csi/pkg/utils"
+)
+
+// freezeEvents records the order of the freeze, snapshot and thaw events.
+type freezeEvents struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (e *freezeEvents) add(event string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events = append(e.events, event)
+}
+
+func (e *freezeEvents) get() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.events...)
+}
+
+type fakeVolumeFreezer struct {
+	events *freezeEvents
+	err    error
+}
+
+func (f *fakeVolumeFreezer) Freeze(_ context.Context, llv *snc.LVMLogicalVolume, nodeName, _ string) (func(context.Context) error, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.events.add("freeze " + llv.Name + " on " + nodeName)
+	return func(context.Context) error {
+		f.events.add("thaw " + llv.Name)
+		return nil
+	}, nil
+}
+
+func newTestFreezeObjects(nodeName string) []client.Object {
+	lvg := newTestLVG("lvg-1", nodeName, "10Gi")
+	lvg.Status.ThinPools = []snc.LVMVolumeGroupThinPoolStatus{{Name: "pool-1", AvailableSpace: resource.MustParse("10Gi")}}
+	llv := &snc.LVMLogicalVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-1"},
+		Spec: snc.LVMLogicalVolumeSpec{
+			ActualLVNameOnTheNode: "pvc-1",
+			Type:                  internal.LVMTypeThin,
+			Size:                  "1Gi",
+			LVMVolumeGroupName:    "lvg-1",
+			Thin:                  &snc.LVMLogicalVolumeThinSpec{PoolName: "pool-1"},
+		},
+		Status: &snc.LVMLogicalVolumeStatus{Phase: internal.LLVStatusCreated, ActualSize: resource.MustParse("1Gi")},
+	}
+	return []client.Object{lvg, llv}
+}
+
+// createSnapshotWhenRequested plays the node agent taking the snapshot once its LVMLogicalVolumeSnapshot is created.
+func createSnapshotWhenRequested(t *testing.T, cl client.Client, name string, events *freezeEvents) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		for ctx.Err() == nil {
+			llvs := &snc.LVMLogicalVolumeSnapshot{}
+			if err := cl.Get(ctx, client.ObjectKey{Name: name}, llvs); err == nil {
+				events.add("snapshot " + name)
+				llvs.Status = &snc.LVMLogicalVolumeSnapshotStatus{Phase: utils.LLVSStatusCreated, Size: resource.MustParse("1Gi")}
+				_ = cl.Update(ctx, llvs)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+}
+
+func newTestCreateSnapshotRequest(freeze string) *csi.CreateSnapshotRequest {
+	request := &csi.CreateSnapshotRequest{Name: "snap-1", SourceVolumeId: "pvc-1", Parameters: map[string]string{}}
+	if freeze != "" {
+		request.Parameters[internal.SnapshotFreezeKey] = freeze
+	}
+	return request
+}
+
+func TestCreateSnapshotFreeze(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("snapshot_is_taken_between_freeze_and_thaw", func(t *testing.T) {
+		events := &freezeEvents{}
+		cl := newFakeClient(newTestFreezeObjects("node-1")...)
+		d := newTestDriver(cl, WithVolumeFreezer(&fakeVolumeFreezer{events: events}))
+		createSnapshotWhenRequested(t, cl, "snap-1", events)
+
+		_, err := d.CreateSnapshot(ctx, newTestCreateSnapshotRequest("true"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"freeze pvc-1 on node-1", "snapshot snap-1", "thaw pvc-1"}, events.get())
+	})
+
+	t.Run("freeze_is_off_by_default", func(t *testing.T) {
+		events := &freezeEvents{}
+		cl := newFakeClient(newTestFreezeObjects("node-1")...)
+		d := newTestDriver(cl, WithVolumeFreezer(&fakeVolumeFreezer{events: events}))
+		createSnapshotWhenRequested(t, cl, "snap-1", events)
+
+		_, err := d.CreateSnapshot(ctx, newTestCreateSnapshotRequest(""))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"snapshot snap-1"}, events.get())
+	})
+
+	t.Run("unmounted_volume_is_not_frozen", func(t *testing.T) {
+		events := &freezeEvents{}
+		cl := newFakeClient(newTestFreezeObjects("node-1")...)
+		d := newTestDriver(cl, WithVolumeFreezer(&fakeVolumeFreezer{events: events, err: utils.ErrVolumeNotMounted}))
+		createSnapshotWhenRequested(t, cl, "snap-1", events)
+
+		_, err := d.CreateSnapshot(ctx, newTestCreateSnapshotRequest("true"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"snapshot snap-1"}, events.get())
+	})
+
+	t.Run("failed_freeze_fails_snapshot", func(t *testing.T) {
+		events := &freezeEvents{}
+		cl := newFakeClient(newTestFreezeObjects("node-1")...)
+		d := newTestDriver(cl, WithVolumeFreezer(&fakeVolumeFreezer{events: events, err: utils.ErrFreezeFailed}))
+
+		_, err := d.CreateSnapshot(ctx, newTestCreateSnapshotRequest("true"))
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+		assert.Empty(t, events.get())
+		assert.Error(t, cl.Get(ctx, client.ObjectKey{Name: "snap-1"}, &snc.LVMLogicalVolumeSnapshot{}))
+	})
+
+	t.Run("missing_agent_fails_fast", func(t *testing.T) {
+		cl := newFakeClient(newTestFreezeObjects("node-1")...)
+		d := newTestDriver(cl, WithVolumeFreezer(&utils.LLVVolumeFreezer{Client: cl, PollInterval: 10 * time.Millisecond, AckTimeout: 100 * time.Millisecond}))
+
+		start := time.Now()
+		_, err := d.CreateSnapshot(ctx, newTestCreateSnapshotRequest("true"))
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+		assert.ErrorContains(t, err, "--fs-freeze-agent")
+		assert.Less(t, time.Since(start), freezeAnswerTimeout)
+
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, llv))
+		assert.NotContains(t, llv.Labels, internal.FreezeNodeLabel)
+		assert.NotContains(t, llv.Annotations, internal.FreezeRequestAnnotation)
+	})
+
+	t.Run("invalid_freeze_is_rejected", func(t *testing.T) {
+		d := newTestDriver(newFakeClient(newTestFreezeObjects("node-1")...))
+
+		_, err := d.CreateSnapshot(ctx, newTestCreateSnapshotRequest("sometimes"))
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+func TestFreezeAgent(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("mounted_volume_is_frozen_for_the_snapshot", func(t *testing.T) {
+		// the controller and the node plugins share the API server, but not the mounts
+		cl := newFakeClient(newTestFreezeObjects("test-node")...)
+		controller := newTestDriver(cl)
+		node, st := newTestNodeDriver(WithFreezeAgent(true))
+		node.cl = cl
+		st.staged["/staging/pvc-1"] = "/dev/vg-lvg-1/pvc-1"
+
+		agentCtx, stopAgent := context.WithCancel(ctx)
+		defer stopAgent()
+		go node.runFreezeAgent(agentCtx)
+
+		events := &freezeEvents{}
+		createSnapshotWhenRequested(t, cl, "snap-1", events)
+
+		_, err := controller.CreateSnapshot(ctx, newTestCreateSnapshotRequest("true"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"snapshot snap-1"}, events.get())
+		st.mu.Lock()
+		assert.Contains(t, st.calls, "freeze /staging/pvc-1")
+		st.mu.Unlock()
+
+		// the request is removed, so the agent thaws the filesystem
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, llv))
+		assert.NotContains(t, llv.Labels, internal.FreezeNodeLabel)
+		assert.NotContains(t, llv.Annotations, internal.FreezeRequestAnnotation)
+		assert.Eventually(t, func() bool {
+			st.mu.Lock()
+			defer st.mu.Unlock()
+			return len(st.calls) == 2 && st.calls[1] == "thaw /staging/pvc-1"
+		}, 5*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("unmounted_volume_is_reported", func(t *testing.T) {
+		objects := newTestFreezeObjects("test-node")
+		llv := objects[1].(*snc.LVMLogicalVolume)
+		llv.Labels = map[string]string{internal.FreezeNodeLabel: "test-node"}
+		llv.Annotations = map[string]string{internal.FreezeRequestAnnotation: "snap-1"}
+		node, st := newTestNodeDriver()
+		node.cl = newFakeClient(objects...)
+
+		require.NoError(t, node.reconcileFreezeRequests(ctx))
+		assert.Empty(t, st.calls)
+
+		got := &snc.LVMLogicalVolume{}
+		require.NoError(t, node.cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, got))
+		assert.Equal(t, "snap-1:"+internal.FreezeStateNotMounted, got.Annotations[internal.FreezeStateAnnotation])
+	})
+
+	t.Run("expired_freeze_is_thawed", func(t *testing.T) {
+		node, st := newTestNodeDriver()
+		node.frozen["pvc-1"] = frozenVolume{requestID: "snap-1", target: "/staging/pvc-1", since: time.Now().Add(-maxFreezeDuration - time.Second)}
+
+		node.thawExpired(time.Now().Add(-maxFreezeDuration), map[string]string{"pvc-1": "snap-1"})
+		assert.Equal(t, []string{"thaw /staging/pvc-1"}, st.calls)
+		assert.Empty(t, node.frozen)
+	})
+}
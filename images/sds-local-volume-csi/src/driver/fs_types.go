@@ -0,0 +1,69 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"sds-local-volume-csi/internal"
+	"sds-local-volume-csi/pkg/utils"
+)
+
+// allowedFSTypes returns the filesystem types the storage class parameters allow. All the supported types are
+// allowed if the parameter is not set. An error is returned for a type the driver does not support.
+func allowedFSTypes(params map[string]string) ([]string, error) {
+	value := params[internal.AllowedFSTypesKey]
+	if value == "" {
+		types := make([]string, 0, len(ValidFSTypes))
+		for fsType := range ValidFSTypes {
+			types = append(types, fsType)
+		}
+		slices.Sort(types)
+		return types, nil
+	}
+
+	types := utils.SplitCommaSeparated(strings.ToLower(value))
+	if len(types) == 0 {
+		return nil, fmt.Errorf("invalid value %q of %s: no filesystem types", value, internal.AllowedFSTypesKey)
+	}
+	for _, fsType := range types {
+		if _, ok := ValidFSTypes[fsType]; !ok {
+			return nil, fmt.Errorf("invalid value %q of %s: unsupported filesystem type %q", value, internal.AllowedFSTypesKey, fsType)
+		}
+	}
+
+	return types, nil
+}
+
+// checkFSTypeAllowed checks the filesystem type, defaultFsType if empty, is allowed by the storage class parameters.
+func checkFSTypeAllowed(params map[string]string, fsType string) error {
+	allowed, err := allowedFSTypes(params)
+	if err != nil {
+		return err
+	}
+
+	if fsType == "" {
+		fsType = defaultFsType
+	}
+	if !slices.Contains(allowed, strings.ToLower(fsType)) {
+		return fmt.Errorf("filesystem type %q is not allowed, allowed types: %s", fsType, strings.Join(allowed, ", "))
+	}
+
+	return nil
+}
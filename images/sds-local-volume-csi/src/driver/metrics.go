@@ -0,0 +1,76 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// nodeOperations are the labels of the node plugin methods observed by metricsInterceptor.
+var nodeOperations = map[string]string{
+	"/csi.v1.Node/NodeStageVolume":     "stage",
+	"/csi.v1.Node/NodeUnstageVolume":   "unstage",
+	"/csi.v1.Node/NodePublishVolume":   "publish",
+	"/csi.v1.Node/NodeUnpublishVolume": "unpublish",
+}
+
+// metricsInterceptor counts the mount and unmount operations of the node plugin, records their durations
+// and tracks the published volumes.
+func (d *Driver) metricsInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	operation, ok := nodeOperations[info.FullMethod]
+	if !ok {
+		return handler(ctx, req)
+	}
+
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	d.metrics.ObserveNodeOperation(operation, status.Code(err).String(), requestFSType(req), time.Since(start))
+
+	if err == nil {
+		switch r := req.(type) {
+		case *csi.NodePublishVolumeRequest:
+			d.metrics.SetVolumeMounted(r.GetTargetPath(), true)
+		case *csi.NodeUnpublishVolumeRequest:
+			d.metrics.SetVolumeMounted(r.GetTargetPath(), false)
+		}
+	}
+
+	return resp, err
+}
+
+// requestFSType returns the filesystem type of the volume capability in the request, "block" for the block volumes,
+// or an empty string if the request has no volume capability.
+func requestFSType(req interface{}) string {
+	r, ok := req.(interface{ GetVolumeCapability() *csi.VolumeCapability })
+	if !ok || r.GetVolumeCapability() == nil {
+		return ""
+	}
+
+	if r.GetVolumeCapability().GetBlock() != nil {
+		return "block"
+	}
+
+	if fsType := r.GetVolumeCapability().GetMount().GetFsType(); fsType != "" {
+		return fsType
+	}
+	return defaultFsType
+}
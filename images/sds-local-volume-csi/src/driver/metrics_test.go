@@ -0,0 +1,112 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMetricsInterceptor(t *testing.T) {
+	ctx := context.Background()
+	publishInfo := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodePublishVolume"}
+	unpublishInfo := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeUnpublishVolume"}
+	publish := func(d *Driver) grpc.UnaryHandler {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			return d.NodePublishVolume(ctx, req.(*csi.NodePublishVolumeRequest))
+		}
+	}
+	unpublish := func(d *Driver) grpc.UnaryHandler {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			return d.NodeUnpublishVolume(ctx, req.(*csi.NodeUnpublishVolumeRequest))
+		}
+	}
+	mountedVolumes := func(n int) string {
+		return fmt.Sprintf(`
+# HELP sds_local_volume_csi_node_mounted_volumes Number of the volumes published by the node plugin since it started and not unpublished yet.
+# TYPE sds_local_volume_csi_node_mounted_volumes gauge
+sds_local_volume_csi_node_mounted_volumes %d
+`, n)
+	}
+
+	t.Run("publish_unpublish_cycle", func(t *testing.T) {
+		d, _ := newTestNodeDriver()
+		registry := d.metrics.Registry()
+
+		_, err := d.metricsInterceptor(ctx, newTestNodePublishVolumeRequest("pvc-1", nil), publishInfo, publish(d))
+		require.NoError(t, err)
+		assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(mountedVolumes(1)), "sds_local_volume_csi_node_mounted_volumes"))
+
+		_, err = d.metricsInterceptor(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc-1", TargetPath: "/target/pvc-1"}, unpublishInfo, unpublish(d))
+		require.NoError(t, err)
+		assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(mountedVolumes(0)), "sds_local_volume_csi_node_mounted_volumes"))
+
+		expected := `
+# HELP sds_local_volume_csi_node_operations_total Number of the stage, unstage, publish and unpublish operations of the node plugin.
+# TYPE sds_local_volume_csi_node_operations_total counter
+sds_local_volume_csi_node_operations_total{fs_type="",operation="unpublish",result="OK"} 1
+sds_local_volume_csi_node_operations_total{fs_type="ext4",operation="publish",result="OK"} 1
+`
+		assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "sds_local_volume_csi_node_operations_total"))
+
+		count, err := testutil.GatherAndCount(registry, "sds_local_volume_csi_node_operation_duration_seconds")
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
+	})
+
+	t.Run("failed_publish_is_counted_and_not_mounted", func(t *testing.T) {
+		d, _ := newTestNodeDriver()
+		registry := d.metrics.Registry()
+		request := newTestNodePublishVolumeRequest("pvc-1", nil)
+		request.VolumeCapability.GetMount().FsType = "xfs"
+		request.VolumeCapability.GetMount().MountFlags = []string{"cache=/cache/${zone}"}
+
+		_, err := d.metricsInterceptor(ctx, request, publishInfo, publish(d))
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		expected := `
+# HELP sds_local_volume_csi_node_operations_total Number of the stage, unstage, publish and unpublish operations of the node plugin.
+# TYPE sds_local_volume_csi_node_operations_total counter
+sds_local_volume_csi_node_operations_total{fs_type="xfs",operation="publish",result="InvalidArgument"} 1
+`
+		assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "sds_local_volume_csi_node_operations_total"))
+		assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(mountedVolumes(0)), "sds_local_volume_csi_node_mounted_volumes"))
+	})
+
+	t.Run("controller_methods_are_not_observed", func(t *testing.T) {
+		d, _ := newTestNodeDriver()
+
+		_, err := d.metricsInterceptor(ctx, &csi.DeleteVolumeRequest{VolumeId: "pvc-1"}, &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/DeleteVolume"}, func(context.Context, interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		require.NoError(t, err)
+
+		count, err := testutil.GatherAndCount(d.metrics.Registry(), "sds_local_volume_csi_node_operations_total")
+		require.NoError(t, err)
+		assert.Zero(t, count)
+	})
+}
@@ -18,7 +18,10 @@ package driver
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"path/filepath"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
@@ -27,8 +30,11 @@ import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 
 	"sds-local-volume-csi/internal"
+	"sds-local-volume-csi/pkg/utils"
 )
 
 const (
@@ -37,6 +43,9 @@ const (
 
 	// VolumeOperationAlreadyExists is message fmt returned to CO when there is another in-flight call on the given volumeID
 	VolumeOperationAlreadyExists = "An operation with the given volume=%q is already in progress"
+
+	// the thin pool data usage percent noted in the volume condition of the thin volumes
+	thinPoolUsageThresholdPercent = 80
 )
 
 var (
@@ -45,15 +54,24 @@ var (
 		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
 		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
 	}
 
 	ValidFSTypes = map[string]struct{}{
 		internal.FSTypeExt4: {},
 		internal.FSTypeXfs:  {},
 	}
+
+	// minFSSizes are the smallest devices the filesystems can be created on
+	minFSSizes = map[string]int64{
+		internal.FSTypeExt4: 1 << 20,
+		internal.FSTypeXfs:  16 << 20,
+	}
+
+	mountFlagVariableRegexp = regexp.MustCompile(`\$\{([^}]*)\}`)
 )
 
-func (d *Driver) NodeStageVolume(_ context.Context, request *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+func (d *Driver) NodeStageVolume(ctx context.Context, request *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	volumeID := request.GetVolumeId()
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "[NodeStageVolume] Volume id cannot be empty")
@@ -75,6 +93,11 @@ func (d *Driver) NodeStageVolume(_ context.Context, request *csi.NodeStageVolume
 		return nil, status.Error(codes.InvalidArgument, "[NodeStageVolume] Volume group name cannot be empty")
 	}
 
+	mountSync, err := getMountSync(context, volCap)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "[NodeStageVolume] %v", err)
+	}
+
 	if volCap.GetBlock() != nil {
 		d.log.Info("[NodeStageVolume] Block volume detected. Skipping staging.")
 		return &csi.NodeStageVolumeResponse{}, nil
@@ -95,6 +118,10 @@ func (d *Driver) NodeStageVolume(_ context.Context, request *csi.NodeStageVolume
 		d.log.Error(fmt.Errorf("[NodeStageVolume] Invalid fsType: %s. Supported values: %v", fsType, ValidFSTypes), "Invalid fsType")
 		return nil, status.Errorf(codes.InvalidArgument, "invalid fsType")
 	}
+	if err := checkFSTypeAllowed(context, fsType); err != nil {
+		d.log.Error(err, fmt.Sprintf("[NodeStageVolume] Filesystem type of volume %s is not allowed by the storage class", volumeID))
+		return nil, status.Errorf(codes.InvalidArgument, "[NodeStageVolume] %v", err)
+	}
 
 	formatOptions := []string{}
 
@@ -108,7 +135,22 @@ func (d *Driver) NodeStageVolume(_ context.Context, request *csi.NodeStageVolume
 		formatOptions = append(formatOptions, "-m", "bigtime=0,inobtcount=0,reflink=0", "-i", "nrext64=0")
 	}
 
-	mountOptions := collectMountOptions(fsType, mountVolume.GetMountFlags(), []string{})
+	if bytesPerInode := request.GetVolumeContext()[internal.FormatBytesPerInodeKey]; bytesPerInode != "" && fsType == internal.FSTypeExt4 {
+		if _, err := strconv.ParseInt(bytesPerInode, 10, 64); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "[NodeStageVolume] invalid %s %q: %v", internal.FormatBytesPerInodeKey, bytesPerInode, err)
+		}
+		formatOptions = append(formatOptions, "-i", bytesPerInode)
+	}
+
+	mountFlags, err := d.expandMountFlags(mountVolume.GetMountFlags())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "[NodeStageVolume] %v", err)
+	}
+
+	mountOptions := collectMountOptions(fsType, mountFlags, []string{})
+	if mountSync {
+		mountOptions = append(mountOptions, "sync")
+	}
 
 	d.log.Debug(fmt.Sprintf("[NodeStageVolume] Volume %s operation started", volumeID))
 	ok = d.inFlight.Insert(volumeID)
@@ -120,7 +162,23 @@ func (d *Driver) NodeStageVolume(_ context.Context, request *csi.NodeStageVolume
 		d.inFlight.Delete(volumeID)
 	}()
 
-	devPath := fmt.Sprintf("/dev/%s/%s", vgName, request.VolumeId)
+	if err := d.checkVGExists(vgName); err != nil {
+		d.log.Error(err, fmt.Sprintf("[NodeStageVolume] Volume group of volume %s is not found", request.VolumeId))
+		return nil, err
+	}
+
+	lvName := utils.LVNameFromVolumeContext(request.VolumeId, request.GetVolumeContext())
+	if err := d.checkDuplicateLV(vgName, lvName); err != nil {
+		d.log.Error(err, fmt.Sprintf("[NodeStageVolume] Volume %s has duplicates", request.VolumeId))
+		return nil, err
+	}
+
+	if err := d.activateLV(vgName, lvName, context); err != nil {
+		d.log.Error(err, fmt.Sprintf("[NodeStageVolume] Unable to activate volume %s", request.VolumeId))
+		return nil, err
+	}
+
+	devPath := d.devicePath(vgName, lvName)
 	d.log.Debug(fmt.Sprintf("[NodeStageVolume] Checking if device exists: %s", devPath))
 	exists, err := d.storeManager.PathExists(devPath)
 	if err != nil {
@@ -129,17 +187,62 @@ func (d *Driver) NodeStageVolume(_ context.Context, request *csi.NodeStageVolume
 	if !exists {
 		return nil, status.Errorf(codes.NotFound, "[NodeStageVolume] Device %s not found", devPath)
 	}
+	if err := d.checkDeviceSize("NodeStageVolume", volumeID, devPath, context); err != nil {
+		return nil, err
+	}
+
+	existingFsType, err := d.storeManager.GetDiskFormat(devPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "[NodeStageVolume] Error detecting filesystem on device %q: %v", devPath, err)
+	}
+	if err := checkEncryptionExpectation(context, devPath, existingFsType); err != nil {
+		d.log.Error(err, fmt.Sprintf("[NodeStageVolume] Device %s contradicts the encryption expectation", devPath))
+		return nil, err
+	}
+	if existingFsType != "" && existingFsType != strings.ToLower(fsType) {
+		d.log.Error(nil, fmt.Sprintf("[NodeStageVolume] Device %s already contains filesystem %s, requested %s", devPath, existingFsType, fsType))
+		return nil, status.Errorf(codes.FailedPrecondition, "[NodeStageVolume] Device %q already contains filesystem %q, requested fsType %q", devPath, existingFsType, fsType)
+	}
+	if existingFsType == "" {
+		if err := d.checkBlockToFSTransition(ctx, volumeID, devPath, context); err != nil {
+			d.log.Error(err, fmt.Sprintf("[NodeStageVolume] Device %s of volume %s is not formatted", devPath, volumeID))
+			return nil, err
+		}
+		if err := d.checkMinFSSize(devPath, fsType); err != nil {
+			d.log.Error(err, fmt.Sprintf("[NodeStageVolume] Device %s cannot be formatted as %s", devPath, fsType))
+			return nil, err
+		}
+		d.log.Info(fmt.Sprintf("[NodeStageVolume] Device %s is not formatted. It will be formatted as %s", devPath, fsType))
+	}
 
 	lvmType := context[internal.LvmTypeKey]
 	lvmThinPoolName := context[internal.ThinPoolNameKey]
 
+	formatPriority, err := utils.GetFormatPriority(context)
+	if err != nil {
+		d.log.Error(err, fmt.Sprintf("[NodeStageVolume] Invalid format priority of volume %s", volumeID))
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	d.log.Trace(fmt.Sprintf("formatOptions = %s", formatOptions))
 	d.log.Trace(fmt.Sprintf("mountOptions = %s", mountOptions))
 	d.log.Trace(fmt.Sprintf("lvmType = %s", lvmType))
 	d.log.Trace(fmt.Sprintf("lvmThinPoolName = %s", lvmThinPoolName))
 	d.log.Trace(fmt.Sprintf("fsType = %s", fsType))
 
-	err = d.storeManager.NodeStageVolumeFS(devPath, target, fsType, mountOptions, formatOptions, lvmType, lvmThinPoolName)
+	if existingFsType == "" && d.formatSemaphore != nil {
+		d.log.Debug(fmt.Sprintf("[NodeStageVolume] Waiting for a format slot for device %s", devPath))
+		if err := d.formatSemaphore.Acquire(ctx, 1); err != nil {
+			return nil, status.Errorf(codes.Aborted, "[NodeStageVolume] Error waiting for a format slot for device %q: %v", devPath, err)
+		}
+		defer d.formatSemaphore.Release(1)
+	}
+
+	if existingFsType == "" && context[internal.ThinAllocationKey] == internal.ThinAllocationPreallocated {
+		d.preallocate(ctx, volumeID, devPath)
+	}
+
+	err = d.storeManager.NodeStageVolumeFS(devPath, target, fsType, mountOptions, formatOptions, lvmType, lvmThinPoolName, formatPriority)
 	if err != nil {
 		d.log.Error(err, "[NodeStageVolume] Error mounting volume")
 		return nil, status.Errorf(codes.Internal, "[NodeStageVolume] Error format device %q and mounting volume at %q: %v", devPath, target, err)
@@ -159,11 +262,72 @@ func (d *Driver) NodeStageVolume(_ context.Context, request *csi.NodeStageVolume
 		}
 	}
 
+	d.recordAccessType(ctx, "NodeStageVolume", volumeID, internal.AccessTypeFilesystem)
 	d.log.Info(fmt.Sprintf("[NodeStageVolume] Volume %q (%q) successfully staged at %s. FsType: %s", volumeID, devPath, target, fsType))
 
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
+// checkBlockToFSTransition refuses to format the device of the volume last published as block, whose contents
+// written by the workload to the raw device are not a recognizable filesystem, unless the storage class forces it.
+// The check is best-effort like the record of recordAccessType: if the LVMLogicalVolume cannot be read, the device
+// is formatted as it was before the check.
+func (d *Driver) checkBlockToFSTransition(ctx context.Context, volumeID, devPath string, volumeContext map[string]string) error {
+	force, err := utils.GetFormatOverBlock(volumeContext)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "[NodeStageVolume] %v", err)
+	}
+
+	llv, err := utils.GetLVMLogicalVolume(ctx, d.cl, volumeID, "")
+	if kerrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		d.log.Warning(fmt.Sprintf("[NodeStageVolume] Unable to get LVMLogicalVolume %s to check the access type of the volume, formatting device %s as a new one: %v", volumeID, devPath, err))
+		return nil
+	}
+	if llv.Annotations[internal.AccessTypeAnnotation] != internal.AccessTypeBlock {
+		return nil
+	}
+
+	if force {
+		d.log.Warning(fmt.Sprintf("[NodeStageVolume] Device %s of volume %s was published as block. It is formatted as %s is set", devPath, volumeID, internal.FormatOverBlockKey))
+		return nil
+	}
+	return status.Errorf(codes.FailedPrecondition, "[NodeStageVolume] Device %q of volume %s was published as block and has no recognizable filesystem, refusing to format it over the possible block data. Set %s in the storage class to format it", devPath, volumeID, internal.FormatOverBlockKey)
+}
+
+// recordAccessType records the access type the volume is used with on its LVMLogicalVolume for the later
+// checkBlockToFSTransition. The record is best-effort, so the errors are only logged.
+func (d *Driver) recordAccessType(ctx context.Context, method, volumeID, accessType string) {
+	llv, err := utils.GetLVMLogicalVolume(ctx, d.cl, volumeID, "")
+	if err == nil {
+		err = utils.SetLLVAccessType(ctx, d.cl, llv, accessType)
+	}
+	if err != nil {
+		d.log.Warning(fmt.Sprintf("[%s] Unable to record the %s access type of volume %s: %v", method, accessType, volumeID, err))
+	}
+}
+
+// preallocate allocates every block of the new thin volume before it is formatted. The preallocation is
+// best-effort: on failure the volume is allocated lazily, which is recorded on its LVMLogicalVolume.
+func (d *Driver) preallocate(ctx context.Context, volumeID, devPath string) {
+	d.log.Info(fmt.Sprintf("[NodeStageVolume] Preallocating device %s of volume %s", devPath, volumeID))
+	err := d.storeManager.Preallocate(devPath)
+	if err == nil {
+		return
+	}
+
+	d.log.Warning(fmt.Sprintf("[NodeStageVolume] Unable to preallocate device %s: %v. Fall back to %s allocation", devPath, err, internal.ThinAllocationLazy))
+	llv, err := utils.GetLVMLogicalVolume(ctx, d.cl, volumeID, "")
+	if err == nil {
+		err = utils.SetLLVThinAllocation(ctx, d.cl, llv, internal.ThinAllocationLazy)
+	}
+	if err != nil {
+		d.log.Warning(fmt.Sprintf("[NodeStageVolume] Unable to record the %s allocation of volume %s: %v", internal.ThinAllocationLazy, volumeID, err))
+	}
+}
+
 func (d *Driver) NodeUnstageVolume(_ context.Context, request *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 	d.log.Debug(fmt.Sprintf("[NodeUnstageVolume] method called with request: %v", request))
 	volumeID := request.GetVolumeId()
@@ -185,15 +349,22 @@ func (d *Driver) NodeUnstageVolume(_ context.Context, request *csi.NodeUnstageVo
 		d.log.Debug(fmt.Sprintf("[NodeUnstageVolume] Volume %s operation completed", volumeID))
 		d.inFlight.Delete(volumeID)
 	}()
-	err := d.storeManager.Unstage(target)
+	// the filesystem volume is published from the staging target only, so its limits are cleared once it is unstaged
+	notMounted, err := d.storeManager.IsNotMountPoint(target)
+	if err == nil && !notMounted {
+		d.clearIOLimits("NodeUnstageVolume", volumeID, target)
+	}
+
+	err = d.storeManager.Unstage(target)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "[NodeUnstageVolume] Error unmounting volume %q mounted at %q: %v", volumeID, target, err)
 	}
+	d.conditionCache.forget(volumeID)
 
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
-func (d *Driver) NodePublishVolume(_ context.Context, request *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+func (d *Driver) NodePublishVolume(ctx context.Context, request *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	d.log.Info("Start method NodePublishVolume")
 	d.log.Trace("------------- NodePublishVolume --------------")
 	d.log.Trace(request.String())
@@ -220,23 +391,23 @@ func (d *Driver) NodePublishVolume(_ context.Context, request *csi.NodePublishVo
 	}
 
 	mountOptions := []string{"bind"}
-	if request.GetReadonly() {
+	readOnlyFlag, readOnlyMode := request.GetReadonly(), isReadOnlyAccessMode(volCap.GetAccessMode().GetMode())
+	if readOnlyFlag || readOnlyMode {
 		mountOptions = append(mountOptions, "ro")
 	}
+	d.log.Debug(fmt.Sprintf("[NodePublishVolume] Volume %s is published read-only: %t (readonly flag: %t, access mode %s: %t)", request.VolumeId, readOnlyFlag || readOnlyMode, readOnlyFlag, volCap.GetAccessMode().GetMode(), readOnlyMode))
 
 	vgName, ok := request.GetVolumeContext()[internal.VGNameKey]
 	if !ok {
 		return nil, status.Error(codes.InvalidArgument, "[NodePublishVolume] Volume group name cannot be empty")
 	}
 
-	devPath := fmt.Sprintf("/dev/%s/%s", vgName, request.VolumeId)
-	d.log.Debug(fmt.Sprintf("[NodePublishVolume] Checking if device exists: %s", devPath))
-	exists, err := d.storeManager.PathExists(devPath)
+	mountSync, err := getMountSync(request.GetVolumeContext(), volCap)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "[NodePublishVolume] Error checking if device exists: %v", err)
+		return nil, status.Errorf(codes.InvalidArgument, "[NodePublishVolume] %v", err)
 	}
-	if !exists {
-		return nil, status.Errorf(codes.NotFound, "[NodePublishVolume] Device %q not found", devPath)
+	if mountSync {
+		mountOptions = append(mountOptions, "sync")
 	}
 
 	d.log.Debug(fmt.Sprintf("[NodePublishVolume] Volume %s operation started", volumeID))
@@ -245,19 +416,68 @@ func (d *Driver) NodePublishVolume(_ context.Context, request *csi.NodePublishVo
 	if !ok {
 		return nil, status.Errorf(codes.Aborted, VolumeOperationAlreadyExists, volumeID)
 	}
+	// the volume of a timed out mount is released by the mount completing in the background
+	mountPending := false
 	defer func() {
+		if mountPending {
+			return
+		}
 		d.log.Debug(fmt.Sprintf("[NodePublishVolume] Volume %s operation completed", volumeID))
 		d.inFlight.Delete(volumeID)
 	}()
 
+	if err := d.checkVGExists(vgName); err != nil {
+		d.log.Error(err, fmt.Sprintf("[NodePublishVolume] Volume group of volume %s is not found", request.VolumeId))
+		return nil, err
+	}
+
+	lvName := utils.LVNameFromVolumeContext(request.VolumeId, request.GetVolumeContext())
+	if err := d.checkDuplicateLV(vgName, lvName); err != nil {
+		d.log.Error(err, fmt.Sprintf("[NodePublishVolume] Volume %s has duplicates", request.VolumeId))
+		return nil, err
+	}
+
+	if err := d.activateLV(vgName, lvName, request.GetVolumeContext()); err != nil {
+		d.log.Error(err, fmt.Sprintf("[NodePublishVolume] Unable to activate volume %s", request.VolumeId))
+		return nil, err
+	}
+
+	devPath := d.devicePath(vgName, lvName)
+	d.log.Debug(fmt.Sprintf("[NodePublishVolume] Checking if device exists: %s", devPath))
+	exists, err := d.storeManager.PathExists(devPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "[NodePublishVolume] Error checking if device exists: %v", err)
+	}
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "[NodePublishVolume] Device %q not found", devPath)
+	}
+
+	if err := d.waitForDeviceReady(ctx, volumeID, devPath); err != nil {
+		return nil, err
+	}
+	if err := d.checkDeviceSize("NodePublishVolume", volumeID, devPath, request.GetVolumeContext()); err != nil {
+		return nil, err
+	}
+
+	if err := d.handleForeignMount(volumeID, devPath, target, volCap.GetBlock() != nil); err != nil {
+		return nil, err
+	}
+
 	switch volCap.GetAccessType().(type) {
 	case *csi.VolumeCapability_Block:
 		d.log.Trace("[NodePublishVolume] Block volume detected.")
 
-		err := d.storeManager.NodePublishVolumeBlock(devPath, target, mountOptions)
+		var err error
+		mountPending, err = d.mountWithTimeout(ctx, volumeID, func() error {
+			return d.storeManager.NodePublishVolumeBlock(devPath, target, mountOptions)
+		})
+		if status.Code(err) == codes.DeadlineExceeded {
+			return nil, err
+		}
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, "[NodePublishVolume] Error mounting volume %q at %q: %v", devPath, target, err)
 		}
+		d.recordAccessType(ctx, "NodePublishVolume", volumeID, internal.AccessTypeBlock)
 
 	case *csi.VolumeCapability_Mount:
 		d.log.Trace("[NodePublishVolume] FS type volume detected.")
@@ -276,18 +496,160 @@ func (d *Driver) NodePublishVolume(_ context.Context, request *csi.NodePublishVo
 			return nil, status.Errorf(codes.InvalidArgument, "Invalid fsType")
 		}
 
-		mountOptions = collectMountOptions(fsType, mountVolume.GetMountFlags(), mountOptions)
+		mountFlags, err := d.expandMountFlags(mountVolume.GetMountFlags())
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "[NodePublishVolume] %v", err)
+		}
 
-		err := d.storeManager.NodePublishVolumeFS(source, devPath, target, fsType, mountOptions)
+		mountOptions = collectMountOptions(fsType, mountFlags, mountOptions)
+
+		mountPending, err = d.mountWithTimeout(ctx, volumeID, func() error {
+			return d.storeManager.NodePublishVolumeFS(source, devPath, target, fsType, mountOptions)
+		})
+		if status.Code(err) == codes.DeadlineExceeded {
+			return nil, err
+		}
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, "[NodePublishVolume] Error bind mounting volume %q. Source: %q. Target: %q. Mount options:%v. Err: %v", volumeID, source, target, mountOptions, err)
 		}
+
+		if request.GetVolumeContext()[internal.TrimOnUnpublishKey] == "true" {
+			d.trimTargetsMu.Lock()
+			d.trimTargets[target] = struct{}{}
+			d.trimTargetsMu.Unlock()
+		}
+	}
+
+	if err := d.applyIOLimits(volumeID, devPath, request.GetVolumeContext()); err != nil {
+		return nil, err
+	}
+
+	if isEphemeralVolume(request.GetVolumeContext()) {
+		d.ephemeralTargetsMu.Lock()
+		d.ephemeralTargets[target] = struct{}{}
+		d.ephemeralTargetsMu.Unlock()
 	}
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
-func (d *Driver) NodeUnpublishVolume(_ context.Context, request *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+// mountWithTimeout runs the mount bounded by the configured mount timeout and the request deadline.
+// The mount that did not complete in time keeps running in the background and true is returned: the volume
+// is kept in flight until the mount completes, so the publish retries are refused with Aborted instead of
+// racing it, and find the target mounted once it is released.
+func (d *Driver) mountWithTimeout(ctx context.Context, volumeID string, mount func() error) (bool, error) {
+	timeout := d.subTimeout(ctx, "NodePublishVolume", "mount", d.mountTimeout)
+	if timeout <= 0 {
+		return false, mount()
+	}
+
+	mountCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- mount()
+	}()
+
+	select {
+	case err := <-done:
+		return false, err
+	case <-mountCtx.Done():
+		// the plugin is not stopped in the middle of the mount
+		d.acquireNodeOperation()
+		go func() {
+			defer d.releaseNodeOperation()
+			err := <-done
+			d.log.Info(fmt.Sprintf("[NodePublishVolume] Timed out mount of volume %s completed, error: %v", volumeID, err))
+			d.inFlight.Delete(volumeID)
+		}()
+		return true, status.Errorf(codes.DeadlineExceeded, "[NodePublishVolume] mount did not complete in %s: %v", timeout, mountCtx.Err())
+	}
+}
+
+// isReadOnlyAccessMode reports whether the access mode allows the volume to be read only.
+func isReadOnlyAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY || mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
+
+// unmountWithTimeout unmounts the target, bounding the unmount by the unmount timeout. A timed out unmount
+// is followed by a lazy one if enabled, so the pod is not held by a filesystem stuck on I/O. Otherwise
+// the hung unmount is left running and the call fails with DeadlineExceeded.
+func (d *Driver) unmountWithTimeout(ctx context.Context, volumeID, target string) error {
+	timeout := d.subTimeout(ctx, "NodeUnpublishVolume", "unmount", d.unmountTimeout)
+	if timeout <= 0 {
+		return d.storeManager.Unpublish(target)
+	}
+
+	unmountCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- d.storeManager.Unpublish(target)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-unmountCtx.Done():
+	}
+
+	if !d.lazyUnmount {
+		return status.Errorf(codes.DeadlineExceeded, "[NodeUnpublishVolume] unmount of %q did not complete in %s: %v", target, timeout, unmountCtx.Err())
+	}
+
+	d.log.Warning(fmt.Sprintf("[NodeUnpublishVolume] Unmount of volume %s at %s did not complete in %s. Escalating to a lazy unmount", volumeID, target, timeout))
+	if err := d.storeManager.LazyUnmount(target); err != nil {
+		return fmt.Errorf("lazy unmount after the unmount timed out in %s: %w", timeout, err)
+	}
+	d.log.Info(fmt.Sprintf("[NodeUnpublishVolume] Volume %s is lazily unmounted from %s", volumeID, target))
+
+	return nil
+}
+
+// applyIOLimits applies the IO limits from the volume context to the volume device.
+// The limits are skipped with a warning if the kernel does not support IO throttling.
+func (d *Driver) applyIOLimits(volumeID, devPath string, volumeContext map[string]string) error {
+	limits, err := utils.GetIOLimits(volumeContext)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "[NodePublishVolume] Invalid IO limits for volume %q: %v", volumeID, err)
+	}
+
+	if limits.IsEmpty() {
+		return nil
+	}
+
+	d.log.Debug(fmt.Sprintf("[NodePublishVolume] Applying IO limits %+v to device %s of volume %s", limits, devPath, volumeID))
+	err = d.ioThrottler.SetIOLimits(devPath, limits)
+	if errors.Is(err, utils.ErrIOThrottlingUnsupported) {
+		d.log.Warning(fmt.Sprintf("[NodePublishVolume] IO limits for volume %s are skipped: %v", volumeID, err))
+		return nil
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "[NodePublishVolume] Error applying IO limits to device %q: %v", devPath, err)
+	}
+
+	return nil
+}
+
+// clearIOLimits resets the IO limits of the volume device at path, or of the device its filesystem is mounted from,
+// so they are not inherited by the next device getting the same number. The limits of the volume context are not known
+// on unstage and unpublish, so the device is cleared whether or not they were applied. A failure is only logged,
+// so the IO limits never keep the volume from being released.
+func (d *Driver) clearIOLimits(method, volumeID, path string) {
+	err := d.ioThrottler.ClearIOLimits(path)
+	if errors.Is(err, utils.ErrIOThrottlingUnsupported) {
+		return
+	}
+	if err != nil {
+		d.log.Warning(fmt.Sprintf("[%s] Unable to clear IO limits of volume %s mounted at %s: %v", method, volumeID, path, err))
+		return
+	}
+	d.log.Debug(fmt.Sprintf("[%s] IO limits of volume %s mounted at %s are cleared", method, volumeID, path))
+}
+
+func (d *Driver) NodeUnpublishVolume(ctx context.Context, request *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	d.log.Debug(fmt.Sprintf("[NodeUnpublishVolume] method called with request: %v", request))
 	d.log.Trace("------------- NodeUnpublishVolume --------------")
 	d.log.Trace(request.String())
@@ -313,17 +675,185 @@ func (d *Driver) NodeUnpublishVolume(_ context.Context, request *csi.NodeUnpubli
 		d.inFlight.Delete(volumeID)
 	}()
 
-	err := d.storeManager.Unpublish(target)
+	// the block volume is not staged, so its limits are cleared once the device is unpublished
+	if stats, err := d.storeManager.GetVolumeStats(target); err == nil && stats.Block {
+		d.clearIOLimits("NodeUnpublishVolume", volumeID, target)
+	}
+
+	d.trimTargetsMu.Lock()
+	_, trim := d.trimTargets[target]
+	d.trimTargetsMu.Unlock()
+	if trim {
+		d.log.Info(fmt.Sprintf("[NodeUnpublishVolume] Trimming volume %s mounted at %s", volumeID, target))
+		if err := d.storeManager.Trim(target); err != nil {
+			d.log.Warning(fmt.Sprintf("[NodeUnpublishVolume] Unable to trim volume %s mounted at %s: %v", volumeID, target, err))
+		}
+	}
+
+	err := d.unmountWithTimeout(ctx, volumeID, target)
 	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
 		return nil, status.Errorf(codes.Internal, "[NodeUnpublishVolume] Error unmounting volume %q mounted at %q: %v", volumeID, target, err)
 	}
 
+	d.trimTargetsMu.Lock()
+	delete(d.trimTargets, target)
+	d.trimTargetsMu.Unlock()
+
+	d.ephemeralTargetsMu.Lock()
+	_, ephemeral := d.ephemeralTargets[target]
+	delete(d.ephemeralTargets, target)
+	d.ephemeralTargetsMu.Unlock()
+	if ephemeral {
+		d.log.Info(fmt.Sprintf("[NodeUnpublishVolume] Ephemeral volume %s is deleted in %s", volumeID, d.ephemeralDeleteGracePeriod))
+		d.acquireNodeOperation()
+		go d.deleteEphemeralVolume(volumeID)
+	}
+
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
-func (d *Driver) NodeGetVolumeStats(_ context.Context, _ *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+func (d *Driver) NodeGetVolumeStats(ctx context.Context, request *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
 	d.log.Info("method NodeGetVolumeStats")
-	return &csi.NodeGetVolumeStatsResponse{}, nil
+
+	volumeID := request.GetVolumeId()
+	volumePath := request.GetVolumePath()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "[NodeGetVolumeStats] Volume id cannot be empty")
+	}
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "[NodeGetVolumeStats] Volume path cannot be empty")
+	}
+
+	exists, err := d.storeManager.PathExists(volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "[NodeGetVolumeStats] Error checking if path %q exists: %v", volumePath, err)
+	}
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "[NodeGetVolumeStats] Volume path %q does not exist", volumePath)
+	}
+
+	// the path may exist but not be mounted yet while the volume is being published
+	notMounted, err := d.storeManager.IsNotMountPoint(volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "[NodeGetVolumeStats] Error checking if %q is a mount point: %v", volumePath, err)
+	}
+	if notMounted {
+		return nil, status.Errorf(codes.FailedPrecondition, "[NodeGetVolumeStats] Volume path %q is not mounted yet", volumePath)
+	}
+
+	stats, err := d.storeManager.GetVolumeStats(volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "[NodeGetVolumeStats] Error getting stats of %q: %v", volumePath, err)
+	}
+
+	if stats.Block {
+		return d.blockVolumeStats(ctx, volumeID, volumePath, stats)
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     stats.TotalBytes,
+				Available: stats.AvailableBytes,
+				Used:      stats.UsedBytes,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     stats.TotalInodes,
+				Available: stats.AvailableInodes,
+				Used:      stats.UsedInodes,
+			},
+		},
+		VolumeCondition: d.volumeCondition(ctx, volumeID, stats),
+	}, nil
+}
+
+// blockVolumeStats reports the device size of the block volume as its capacity, since the statfs of a device node
+// describes the filesystem the node is on. The usage of the filesystem found inside the device is only informational.
+func (d *Driver) blockVolumeStats(ctx context.Context, volumeID, volumePath string, stats utils.VolumeStats) (*csi.NodeGetVolumeStatsResponse, error) {
+	size, err := d.storeManager.GetDeviceSize(volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "[NodeGetVolumeStats] Error getting the size of the block volume %q: %v", volumePath, err)
+	}
+
+	condition := d.volumeCondition(ctx, volumeID, stats)
+	if message := d.blockFSUsageMessage(volumeID, volumePath); message != "" {
+		if condition == nil {
+			condition = &csi.VolumeCondition{Message: message}
+		} else {
+			condition.Message += "; " + message
+		}
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage:           []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: size}},
+		VolumeCondition: condition,
+	}, nil
+}
+
+// blockFSUsageMessage describes the usage of the filesystem inside the block volume, or returns "" if the probe
+// is disabled or the device has no readable filesystem.
+func (d *Driver) blockFSUsageMessage(volumeID, volumePath string) string {
+	if d.blockFSProber == nil {
+		return ""
+	}
+
+	usage, err := d.blockFSProber.ProbeFSUsage(volumePath)
+	if err != nil {
+		if errors.Is(err, utils.ErrNoFilesystem) {
+			d.log.Debug(fmt.Sprintf("[NodeGetVolumeStats] Block volume %s has no recognizable filesystem: %v", volumeID, err))
+		} else {
+			d.log.Warning(fmt.Sprintf("[NodeGetVolumeStats] Unable to read the filesystem usage of block volume %s: %v", volumeID, err))
+		}
+		return ""
+	}
+
+	return fmt.Sprintf("%s filesystem inside the block device: %d of %d bytes used, %d available", usage.FSType, usage.UsedBytes, usage.TotalBytes, usage.AvailableBytes)
+}
+
+// volumeCondition reports the LVM type of the volume and, for the thin volumes, whether the thin pool usage
+// is above the threshold. These are informational, so they are omitted if the LVMLogicalVolume cannot be read.
+// The LVMLogicalVolume and the thin pool usage are cached by volumeConditionCache.
+// A filesystem volume running out of inodes is reported abnormal.
+func (d *Driver) volumeCondition(ctx context.Context, volumeID string, stats utils.VolumeStats) *csi.VolumeCondition {
+	var messages []string
+	if llv, err := d.volumeLLV(ctx, volumeID); err == nil {
+		message := fmt.Sprintf("LVM type: %s", llv.Spec.Type)
+		if llv.Spec.Type == internal.LVMTypeThin && llv.Spec.Thin != nil {
+			if usage, ok := d.thinPoolUsagePercent(ctx, llv.Spec.LVMVolumeGroupName, llv.Spec.Thin.PoolName); ok && usage >= thinPoolUsageThresholdPercent {
+				message += fmt.Sprintf(", thin pool %s is %d%% full, above the %d%% threshold", llv.Spec.Thin.PoolName, usage, thinPoolUsageThresholdPercent)
+			}
+			message += fmt.Sprintf(", allocation: %s", utils.GetThinAllocation(llv))
+		}
+		messages = append(messages, message)
+	}
+
+	abnormal := false
+	if free, ok := d.inodesFreePercent(stats); ok && free < d.inodeFreeThresholdPercent {
+		d.log.Warning(fmt.Sprintf("[NodeGetVolumeStats] Volume %s has %d%% of inodes free, below the %d%% threshold", volumeID, free, d.inodeFreeThresholdPercent))
+		abnormal = true
+		messages = append(messages, fmt.Sprintf("%d of %d inodes free (%d%%), below the %d%% threshold", stats.AvailableInodes, stats.TotalInodes, free, d.inodeFreeThresholdPercent))
+	}
+
+	if len(messages) == 0 {
+		return nil
+	}
+
+	return &csi.VolumeCondition{Abnormal: abnormal, Message: strings.Join(messages, "; ")}
+}
+
+// inodesFreePercent returns the free inodes percent of the filesystem volume. The block volumes and
+// the filesystems without a fixed number of inodes are not checked.
+func (d *Driver) inodesFreePercent(stats utils.VolumeStats) (int64, bool) {
+	if d.inodeFreeThresholdPercent <= 0 || stats.Block || stats.TotalInodes <= 0 {
+		return 0, false
+	}
+
+	return stats.AvailableInodes * 100 / stats.TotalInodes, true
 }
 
 func (d *Driver) NodeExpandVolume(_ context.Context, request *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
@@ -345,10 +875,44 @@ func (d *Driver) NodeExpandVolume(_ context.Context, request *csi.NodeExpandVolu
 	err := d.storeManager.ResizeFS(volumePath)
 	if err != nil {
 		d.log.Error(err, "d.mounter.ResizeFS:")
+		if errors.Is(err, utils.ErrResizeToolMissing) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	return &csi.NodeExpandVolumeResponse{}, nil
+	requiredBytes := request.GetCapacityRange().GetRequiredBytes()
+	if requiredBytes == 0 || request.GetVolumeCapability().GetBlock() != nil {
+		return &csi.NodeExpandVolumeResponse{}, nil
+	}
+
+	if err := d.verifyExpandedFS(volumePath, requiredBytes); err != nil {
+		d.log.Error(err, fmt.Sprintf("[NodeExpandVolume] Filesystem of volume %s is not grown", volumeID))
+		return nil, err
+	}
+
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: requiredBytes}, nil
+}
+
+// verifyExpandedFS checks the filesystem mounted at the volume path reports the requested size
+// within the filesystem overhead, so a partial grow is not reported as a successful expansion.
+func (d *Driver) verifyExpandedFS(volumePath string, requiredBytes int64) error {
+	stats, err := d.storeManager.GetVolumeStats(volumePath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "[NodeExpandVolume] unable to get the filesystem size at %s: %v", volumePath, err)
+	}
+
+	resizeDelta := resource.MustParse(internal.ResizeDelta)
+	// the filesystem metadata is not reported in the statfs total, so the grown filesystem is accepted
+	// if it is short of the requested size by at most the overhead of its type or the resize delta
+	delta := max(utils.FSOverheadBytes(stats.FSType, requiredBytes), resizeDelta.Value())
+	if stats.TotalBytes < requiredBytes-delta {
+		return status.Errorf(codes.Internal, "[NodeExpandVolume] filesystem at %s reports %d bytes after the grow, expected at least %d bytes of the requested %d",
+			volumePath, stats.TotalBytes, requiredBytes-delta, requiredBytes)
+	}
+
+	d.log.Info(fmt.Sprintf("[NodeExpandVolume] Filesystem at %s reports %d bytes after the grow, requested %d", volumePath, stats.TotalBytes, requiredBytes))
+	return nil
 }
 
 func (d *Driver) NodeGetCapabilities(_ context.Context, request *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
@@ -370,21 +934,199 @@ func (d *Driver) NodeGetCapabilities(_ context.Context, request *csi.NodeGetCapa
 	}, nil
 }
 
-func (d *Driver) NodeGetInfo(_ context.Context, _ *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+func (d *Driver) NodeGetInfo(ctx context.Context, _ *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
 	d.log.Info("method NodeGetInfo")
 	d.log.Info(fmt.Sprintf("hostID = %s", d.hostID))
 
 	return &csi.NodeGetInfoResponse{
-		NodeId: d.hostID,
-		//MaxVolumesPerNode: 10,
+		NodeId:            d.hostID,
+		MaxVolumesPerNode: d.nodeMaxVolumes(ctx),
 		AccessibleTopology: &csi.Topology{
 			Segments: map[string]string{
-				internal.TopologyKey: d.hostID,
+				d.topologyKey: d.hostID,
 			},
 		},
 	}, nil
 }
 
+// nodeMaxVolumes returns the maximum number of volumes reported for the node. The dynamic limit
+// falls back to the static one if the LVMVolumeGroups cannot be listed. The kubelet reads the limit
+// on the plugin registration only, so the dynamic limit reflects the capacity at the plugin start.
+func (d *Driver) nodeMaxVolumes(ctx context.Context) int64 {
+	if d.maxVolumesAverageSize <= 0 {
+		return d.maxVolumesPerNode
+	}
+
+	lvgs, err := d.lvgLister.ListLVGs(ctx)
+	if err != nil {
+		d.log.Warning(fmt.Sprintf("[NodeGetInfo] Unable to list LVMVolumeGroups. Report the static volume limit %d: %v", d.maxVolumesPerNode, err))
+		return d.maxVolumesPerNode
+	}
+
+	capacity := utils.NodeLVGCapacity(lvgs, d.hostID)
+	limit := utils.MaxVolumesForCapacity(capacity, d.maxVolumesAverageSize, d.maxVolumesPerNode)
+	d.log.Info(fmt.Sprintf("[NodeGetInfo] Node LVG capacity %d, assumed average volume size %d. Report the volume limit %d", capacity, d.maxVolumesAverageSize, limit))
+
+	return limit
+}
+
+// checkDynamicVolumeLimit rejects the dynamic volume limit of the node plugin lacking the permission to list
+// the LVMVolumeGroups, whose limit would silently fall back to the static one on every registration.
+func (d *Driver) checkDynamicVolumeLimit(ctx context.Context) error {
+	if d.maxVolumesAverageSize <= 0 {
+		return nil
+	}
+
+	if _, err := d.lvgLister.ListLVGs(ctx); kerrors.IsForbidden(err) {
+		return fmt.Errorf("the dynamic volume limit requires the permission to list LVMVolumeGroups: %w", err)
+	}
+
+	return nil
+}
+
+// checkMinFSSize returns an InvalidArgument status error if the device is smaller than the minimum size
+// of the filesystem, so it is reported clearly instead of failing in mkfs.
+func (d *Driver) checkMinFSSize(devPath, fsType string) error {
+	minSize, ok := minFSSizes[strings.ToLower(fsType)]
+	if !ok {
+		return nil
+	}
+
+	size, err := d.storeManager.GetDeviceSize(devPath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "[NodeStageVolume] Error getting the size of device %q: %v", devPath, err)
+	}
+
+	if size < minSize {
+		return status.Errorf(codes.InvalidArgument, "[NodeStageVolume] Device %q of %d bytes is smaller than the minimum %s filesystem size of %d bytes", devPath, size, fsType, minSize)
+	}
+
+	return nil
+}
+
+// checkEncryptionExpectation returns a FailedPrecondition status error if the presence of the LUKS header
+// on the device contradicts the encryption expected in the volume context. An unformatted device
+// is not encrypted, so it is not formatted as plain if the encryption is expected.
+func checkEncryptionExpectation(volumeContext map[string]string, devPath, diskFormat string) error {
+	expected, ok, err := utils.GetEncryptionExpected(volumeContext)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "[NodeStageVolume] %v", err)
+	}
+	if !ok {
+		return nil
+	}
+
+	encrypted := diskFormat == internal.LUKSFormat
+	switch {
+	case expected && !encrypted:
+		return status.Errorf(codes.FailedPrecondition, "[NodeStageVolume] Device %q is expected to be encrypted, but has no LUKS header (format %q)", devPath, diskFormat)
+	case !expected && encrypted:
+		return status.Errorf(codes.FailedPrecondition, "[NodeStageVolume] Device %q is expected to be plain, but has a LUKS header", devPath)
+	}
+
+	return nil
+}
+
+// checkVGExists returns a FailedPrecondition status error naming the VG if it does not exist on the node,
+// e.g. because the volume is published on a wrong node. A failing lookup is only logged.
+func (d *Driver) checkVGExists(vgName string) error {
+	exists, err := d.vgChecker.VGExists(vgName)
+	if err != nil {
+		d.log.Warning(fmt.Sprintf("[checkVGExists] Unable to check VG %s exists: %v", vgName, err))
+		return nil
+	}
+
+	if !exists {
+		return status.Errorf(codes.FailedPrecondition, "VG %s does not exist on node %s", vgName, d.hostID)
+	}
+
+	return nil
+}
+
+// checkDuplicateLV returns a FailedPrecondition status error if the LV exists in several VGs on the node,
+// so the device path might refer to the wrong one.
+func (d *Driver) checkDuplicateLV(vgName, lvName string) error {
+	vgs, err := d.lvEnumerator.FindLVVolumeGroups(lvName)
+	if err != nil {
+		d.log.Warning(fmt.Sprintf("[checkDuplicateLV] Unable to check LV %s for duplicates: %v", lvName, err))
+		return nil
+	}
+
+	if len(vgs) > 1 {
+		return status.Errorf(codes.FailedPrecondition, "LV %s exists in several VGs %v, expected only in %s", lvName, vgs, vgName)
+	}
+
+	return nil
+}
+
+// devicePath returns the path of the LV device node.
+func (d *Driver) devicePath(vgName, lvName string) string {
+	return filepath.Join(d.devPathBase, vgName, lvName)
+}
+
+// activateLV activates the LV in the mode set in the volume context. The LV is left as is if no mode is set.
+func (d *Driver) activateLV(vgName, lvName string, volumeContext map[string]string) error {
+	mode, err := utils.GetActivationMode(volumeContext)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if mode == "" {
+		return nil
+	}
+
+	d.log.Debug(fmt.Sprintf("[activateLV] Activating LV %s/%s in %s mode", vgName, lvName, mode))
+	if err := d.lvActivator.ActivateLV(vgName, lvName, mode); err != nil {
+		if errors.Is(err, utils.ErrLVActiveElsewhere) {
+			return status.Errorf(codes.FailedPrecondition, "LV %s/%s is active on another node: %v", vgName, lvName, err)
+		}
+		return status.Errorf(codes.Internal, "unable to activate LV %s/%s: %v", vgName, lvName, err)
+	}
+
+	return nil
+}
+
+// getMountSync returns whether the volume is mounted with the sync option. The option only applies to
+// the filesystem volumes, so an error is returned if it is set for a block volume.
+func getMountSync(volumeContext map[string]string, volCap *csi.VolumeCapability) (bool, error) {
+	sync, err := utils.GetMountSync(volumeContext)
+	if err != nil {
+		return false, err
+	}
+
+	if sync && volCap.GetBlock() != nil {
+		return false, fmt.Errorf("%s is not supported for block volumes", internal.MountSyncKey)
+	}
+
+	return sync, nil
+}
+
+// expandMountFlags substitutes the ${variable} templates in the mount flags with the node-specific values.
+func (d *Driver) expandMountFlags(mountFlags []string) ([]string, error) {
+	vars := map[string]string{
+		"nodeName": d.hostID,
+	}
+
+	expanded := make([]string, 0, len(mountFlags))
+	for _, flag := range mountFlags {
+		var unknown []string
+		result := mountFlagVariableRegexp.ReplaceAllStringFunc(flag, func(match string) string {
+			name := mountFlagVariableRegexp.FindStringSubmatch(match)[1]
+			val, ok := vars[name]
+			if !ok {
+				unknown = append(unknown, name)
+				return match
+			}
+			return val
+		})
+		if len(unknown) != 0 {
+			return nil, fmt.Errorf("unknown variables %v in mount option %q", unknown, flag)
+		}
+		expanded = append(expanded, result)
+	}
+
+	return expanded, nil
+}
+
 // collectMountOptions returns array of mount options from
 // VolumeCapability_MountVolume and special mount options for
 // given filesystem.
@@ -0,0 +1,62 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"sds-local-volume-csi/pkg/utils"
+)
+
+// runStorageClassLabeler publishes the storage classes the node has an LVMVolumeGroup of on the Node
+// every interval until the context is done.
+func (d *Driver) runStorageClassLabeler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.reconcileNodeStorageClasses(ctx); err != nil && ctx.Err() == nil {
+			d.log.Warning(fmt.Sprintf("[StorageClassLabeler] unable to publish the storage classes of node %s: %v", d.hostID, err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconcileNodeStorageClasses labels the Node with the storage classes listing an LVMVolumeGroup of the node.
+func (d *Driver) reconcileNodeStorageClasses(ctx context.Context) error {
+	classes, err := utils.NodeStorageClasses(ctx, d.cl, d.name, d.hostID)
+	if err != nil {
+		return err
+	}
+
+	changed, err := utils.SetNodeStorageClasses(ctx, d.cl, d.hostID, classes)
+	if err != nil {
+		return err
+	}
+	if changed {
+		d.log.Info(fmt.Sprintf("[StorageClassLabeler] node %s serves the storage classes %v", d.hostID, classes))
+	}
+
+	return nil
+}
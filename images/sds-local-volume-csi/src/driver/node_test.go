@@ -0,0 +1,1794 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	"sds-local-volume-csi/internal"
+	"sds-local-volume-csi/pkg/utils"
+)
+
+type fakeStoreManager struct {
+	mu sync.Mutex
+	// stageHook is called by NodeStageVolumeFS without holding mu.
+	stageHook func(source string)
+	// publishHook is called by NodePublishVolumeFS without holding mu.
+	publishHook func(target string)
+	// unpublishHook is called by Unpublish without holding mu.
+	unpublishHook func(target string)
+
+	diskFormats map[string]string
+	staged      map[string]string
+	published   map[string]string
+	// mountOpts are the mount options of the staging and publish targets.
+	mountOpts   map[string][]string
+	unpublished []string
+	calls       []string
+	// missingPaths and notMounted are the paths reported as missing and not mounted.
+	missingPaths map[string]struct{}
+	notMounted   map[string]struct{}
+	// targetDevices are the devices the publish targets are already mounted from.
+	targetDevices map[string]string
+	volumeStats   map[string]utils.VolumeStats
+	mountPoints   []string
+	// deviceSizes are the sizes of the devices. The devices not listed are large enough for any filesystem.
+	deviceSizes map[string]int64
+	resizeErr   error
+	// preallocateErr is returned by Preallocate.
+	preallocateErr error
+	// freezeErr is returned by Freeze.
+	freezeErr error
+	// formatPriorities are the mkfs priorities the targets were staged with.
+	formatPriorities map[string]utils.FormatPriority
+	// formatOpts are the mkfs options the targets were staged with.
+	formatOpts map[string][]string
+}
+
+func newFakeStoreManager() *fakeStoreManager {
+	return &fakeStoreManager{
+		diskFormats: map[string]string{},
+		staged:      map[string]string{},
+		published:   map[string]string{},
+		mountOpts:   map[string][]string{},
+	}
+}
+
+func (f *fakeStoreManager) NodeStageVolumeFS(source, target string, fsType string, mountOpts []string, formatOpts []string, _, _ string, formatPriority utils.FormatPriority) error {
+	if f.stageHook != nil {
+		f.stageHook(source)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.staged[target] = source
+	f.mountOpts[target] = mountOpts
+	if f.formatPriorities == nil {
+		f.formatPriorities = map[string]utils.FormatPriority{}
+	}
+	f.formatPriorities[target] = formatPriority
+	if f.formatOpts == nil {
+		f.formatOpts = map[string][]string{}
+	}
+	f.formatOpts[target] = formatOpts
+	if f.diskFormats[source] == "" {
+		f.diskFormats[source] = fsType
+	}
+	return nil
+}
+
+func (f *fakeStoreManager) NodePublishVolumeBlock(source, target string, _ []string) error {
+	f.published[target] = source
+	return nil
+}
+
+func (f *fakeStoreManager) NodePublishVolumeFS(_, devPath, target, _ string, mountOpts []string) error {
+	if f.publishHook != nil {
+		f.publishHook(target)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.published[target] = devPath
+	f.mountOpts[target] = mountOpts
+	return nil
+}
+
+func (f *fakeStoreManager) Unstage(_ string) error {
+	return nil
+}
+
+func (f *fakeStoreManager) Unpublish(target string) error {
+	if f.unpublishHook != nil {
+		f.unpublishHook(target)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unpublished = append(f.unpublished, target)
+	f.calls = append(f.calls, "unpublish "+target)
+	delete(f.targetDevices, target)
+	return nil
+}
+
+func (f *fakeStoreManager) LazyUnmount(target string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "lazy unmount "+target)
+	return nil
+}
+
+func (f *fakeStoreManager) IsNotMountPoint(target string) (bool, error) {
+	_, ok := f.notMounted[target]
+	return ok, nil
+}
+
+func (f *fakeStoreManager) CheckPublishTarget(devPath, target string, _ bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if device, ok := f.targetDevices[target]; ok && device != devPath {
+		return fmt.Errorf("%w: %s is mounted from %s", utils.ErrForeignMount, target, device)
+	}
+	return nil
+}
+
+func (f *fakeStoreManager) ResizeFS(_ string) error {
+	return f.resizeErr
+}
+
+func (f *fakeStoreManager) PathExists(path string) (bool, error) {
+	_, missing := f.missingPaths[path]
+	return !missing, nil
+}
+
+func (f *fakeStoreManager) GetVolumeStats(target string) (utils.VolumeStats, error) {
+	return f.volumeStats[target], nil
+}
+
+func (f *fakeStoreManager) ListMountPoints() ([]string, error) {
+	return f.mountPoints, nil
+}
+
+func (f *fakeStoreManager) GetDeviceSize(devicePath string) (int64, error) {
+	if size, ok := f.deviceSizes[devicePath]; ok {
+		return size, nil
+	}
+	return 1 << 30, nil
+}
+
+func (f *fakeStoreManager) NeedResize(_ string, _ string) (bool, error) {
+	return false, nil
+}
+
+func (f *fakeStoreManager) Trim(target string) error {
+	f.calls = append(f.calls, "trim "+target)
+	return nil
+}
+
+func (f *fakeStoreManager) Preallocate(devicePath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "preallocate "+devicePath)
+	return f.preallocateErr
+}
+
+func (f *fakeStoreManager) FindMountPoint(devicePath string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for target, source := range f.staged {
+		if source == devicePath {
+			return target, nil
+		}
+	}
+	return "", nil
+}
+
+func (f *fakeStoreManager) Freeze(target string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "freeze "+target)
+	return f.freezeErr
+}
+
+func (f *fakeStoreManager) Thaw(target string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "thaw "+target)
+	return nil
+}
+
+func (f *fakeStoreManager) GetDiskFormat(devicePath string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.diskFormats[devicePath], nil
+}
+
+type fakeIOThrottler struct {
+	err     error
+	devices map[string]utils.IOLimits
+	// cleared are the paths the limits were cleared for.
+	cleared []string
+}
+
+func (f *fakeIOThrottler) SetIOLimits(devPath string, limits utils.IOLimits) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.devices[devPath] = limits
+	return nil
+}
+
+func (f *fakeIOThrottler) ClearIOLimits(path string) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.cleared = append(f.cleared, path)
+	return nil
+}
+
+type fakeLVEnumerator map[string][]string
+
+func (f fakeLVEnumerator) FindLVVolumeGroups(lvName string) ([]string, error) {
+	return f[lvName], nil
+}
+
+// fakeVGChecker reports every VG as present except the missing ones.
+type fakeVGChecker struct {
+	missing []string
+	err     error
+}
+
+func (f fakeVGChecker) VGExists(vgName string) (bool, error) {
+	return !slices.Contains(f.missing, vgName), f.err
+}
+
+func newTestNodeDriver(opts ...Option) (*Driver, *fakeStoreManager) {
+	opts = append([]Option{WithLVEnumerator(fakeLVEnumerator{}), WithVGChecker(fakeVGChecker{})}, opts...)
+	d := newTestDriver(newFakeClient(), opts...)
+	st := newFakeStoreManager()
+	d.storeManager = st
+	return d, st
+}
+
+func newTestNodePublishVolumeRequest(volumeID string, volumeContext map[string]string) *csi.NodePublishVolumeRequest {
+	ctx := map[string]string{internal.VGNameKey: "vg-1"}
+	for k, v := range volumeContext {
+		ctx[k] = v
+	}
+
+	return &csi.NodePublishVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: "/staging/" + volumeID,
+		TargetPath:        "/target/" + volumeID,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+		VolumeContext: ctx,
+	}
+}
+
+func newTestNodeStageVolumeRequest(volumeID, fsType string) *csi.NodeStageVolumeRequest {
+	return &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: "/staging/" + volumeID,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType}},
+		},
+		VolumeContext: map[string]string{internal.VGNameKey: "vg-1"},
+	}
+}
+
+func TestNodeStageVolume(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("matching_filesystem_is_staged", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		st.diskFormats["/dev/vg-1/pvc-1"] = internal.FSTypeExt4
+
+		_, err := d.NodeStageVolume(ctx, newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeExt4))
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/vg-1/pvc-1", st.staged["/staging/pvc-1"])
+	})
+
+	t.Run("mismatched_filesystem_is_rejected", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		st.diskFormats["/dev/vg-1/pvc-1"] = internal.FSTypeExt4
+
+		_, err := d.NodeStageVolume(ctx, newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeXfs))
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+		assert.Empty(t, st.staged)
+		assert.Equal(t, internal.FSTypeExt4, st.diskFormats["/dev/vg-1/pvc-1"])
+	})
+
+	t.Run("ext4_is_formatted_with_bytes_per_inode", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		request := newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeExt4)
+		request.VolumeContext[internal.FormatBytesPerInodeKey] = "4096"
+
+		_, err := d.NodeStageVolume(ctx, request)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"-i", "4096"}, st.formatOpts["/staging/pvc-1"])
+	})
+
+	t.Run("xfs_ignores_bytes_per_inode", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		request := newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeXfs)
+		request.VolumeContext[internal.FormatBytesPerInodeKey] = "4096"
+
+		_, err := d.NodeStageVolume(ctx, request)
+		require.NoError(t, err)
+		assert.NotContains(t, st.formatOpts["/staging/pvc-1"], "4096")
+	})
+
+	t.Run("too_small_xfs_device_is_rejected", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		st.deviceSizes = map[string]int64{"/dev/vg-1/pvc-1": 8 << 20}
+
+		_, err := d.NodeStageVolume(ctx, newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeXfs))
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.ErrorContains(t, err, "minimum xfs filesystem size")
+		assert.Empty(t, st.staged)
+	})
+
+	t.Run("small_enough_xfs_device_is_formatted", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		st.deviceSizes = map[string]int64{"/dev/vg-1/pvc-1": 16 << 20}
+
+		_, err := d.NodeStageVolume(ctx, newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeXfs))
+		require.NoError(t, err)
+		assert.Equal(t, internal.FSTypeXfs, st.diskFormats["/dev/vg-1/pvc-1"])
+	})
+
+	t.Run("unformatted_device_is_formatted", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+
+		_, err := d.NodeStageVolume(ctx, newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeXfs))
+		require.NoError(t, err)
+		assert.Equal(t, internal.FSTypeXfs, st.diskFormats["/dev/vg-1/pvc-1"])
+		assert.Equal(t, utils.FormatPriority{}, st.formatPriorities["/staging/pvc-1"])
+	})
+
+	t.Run("format_priority_is_passed", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		req := newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeExt4)
+		req.VolumeContext[internal.FormatNiceKey] = "10"
+		req.VolumeContext[internal.FormatIONiceClassKey] = internal.IONiceClassIdle
+
+		_, err := d.NodeStageVolume(ctx, req)
+		require.NoError(t, err)
+		priority := st.formatPriorities["/staging/pvc-1"]
+		require.NotNil(t, priority.Nice)
+		assert.Equal(t, 10, *priority.Nice)
+		assert.Equal(t, internal.IONiceClassIdle, priority.IOClass)
+	})
+
+	t.Run("lv_name_from_volume_context_is_staged", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		req := newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeExt4)
+		req.VolumeContext[internal.LVNameKey] = "tenant-a-pvc-1"
+
+		_, err := d.NodeStageVolume(ctx, req)
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/vg-1/tenant-a-pvc-1", st.staged["/staging/pvc-1"])
+	})
+
+	t.Run("class_allowed_filesystem_is_staged", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		req := newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeXfs)
+		req.VolumeContext[internal.AllowedFSTypesKey] = internal.FSTypeXfs
+
+		_, err := d.NodeStageVolume(ctx, req)
+		require.NoError(t, err)
+		assert.Equal(t, internal.FSTypeXfs, st.diskFormats["/dev/vg-1/pvc-1"])
+	})
+
+	t.Run("class_disallowed_filesystem_is_rejected", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		req := newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeExt4)
+		req.VolumeContext[internal.AllowedFSTypesKey] = internal.FSTypeXfs
+
+		_, err := d.NodeStageVolume(ctx, req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.ErrorContains(t, err, "not allowed")
+		assert.Empty(t, st.staged)
+		assert.Empty(t, st.diskFormats)
+	})
+
+	t.Run("invalid_format_priority_is_rejected", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		req := newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeExt4)
+		req.VolumeContext[internal.FormatIONiceClassKey] = "realtime"
+
+		_, err := d.NodeStageVolume(ctx, req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.Empty(t, st.staged)
+	})
+}
+
+func TestNodeStageVolumePreallocation(t *testing.T) {
+	ctx := context.Background()
+	newRequest := func() *csi.NodeStageVolumeRequest {
+		req := newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeExt4)
+		req.VolumeContext[internal.ThinAllocationKey] = internal.ThinAllocationPreallocated
+		return req
+	}
+	newLLV := func() *snc.LVMLogicalVolume {
+		return &snc.LVMLogicalVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-1", Annotations: map[string]string{internal.ThinAllocationAnnotation: internal.ThinAllocationPreallocated}},
+			Spec:       snc.LVMLogicalVolumeSpec{Type: internal.LVMTypeThin, LVMVolumeGroupName: "lvg-1", Thin: &snc.LVMLogicalVolumeThinSpec{PoolName: "tp-1"}},
+		}
+	}
+
+	t.Run("unformatted_device_is_preallocated", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+
+		_, err := d.NodeStageVolume(ctx, newRequest())
+		require.NoError(t, err)
+		assert.Contains(t, st.calls, "preallocate /dev/vg-1/pvc-1")
+		assert.Equal(t, internal.FSTypeExt4, st.diskFormats["/dev/vg-1/pvc-1"])
+	})
+
+	t.Run("formatted_device_is_not_preallocated", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		st.diskFormats["/dev/vg-1/pvc-1"] = internal.FSTypeExt4
+
+		_, err := d.NodeStageVolume(ctx, newRequest())
+		require.NoError(t, err)
+		assert.NotContains(t, st.calls, "preallocate /dev/vg-1/pvc-1")
+	})
+
+	t.Run("lazy_volume_is_not_preallocated", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+
+		_, err := d.NodeStageVolume(ctx, newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeExt4))
+		require.NoError(t, err)
+		assert.NotContains(t, st.calls, "preallocate /dev/vg-1/pvc-1")
+	})
+
+	t.Run("failed_preallocation_falls_back_to_lazy", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		d.cl = newFakeClient(newLLV())
+		st.preallocateErr = errors.New("blkdiscard failed")
+
+		_, err := d.NodeStageVolume(ctx, newRequest())
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/vg-1/pvc-1", st.staged["/staging/pvc-1"])
+
+		llv, err := utils.GetLVMLogicalVolume(ctx, d.cl, "pvc-1", "")
+		require.NoError(t, err)
+		assert.Equal(t, internal.ThinAllocationLazy, llv.Annotations[internal.ThinAllocationAnnotation])
+	})
+}
+
+func TestNodeStageVolumeEncryptionExpectation(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name       string
+		expected   string
+		diskFormat string
+		code       codes.Code
+	}{
+		{name: "expected_encrypted_but_plain", expected: "true", diskFormat: internal.FSTypeExt4, code: codes.FailedPrecondition},
+		{name: "expected_encrypted_but_unformatted", expected: "true", diskFormat: "", code: codes.FailedPrecondition},
+		{name: "expected_plain_but_encrypted", expected: "false", diskFormat: internal.LUKSFormat, code: codes.FailedPrecondition},
+		{name: "expected_plain_and_plain", expected: "false", diskFormat: internal.FSTypeExt4, code: codes.OK},
+		{name: "invalid_expectation", expected: "maybe", diskFormat: internal.FSTypeExt4, code: codes.InvalidArgument},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, st := newTestNodeDriver()
+			st.diskFormats["/dev/vg-1/pvc-1"] = tc.diskFormat
+			request := newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeExt4)
+			request.VolumeContext[internal.EncryptionExpectedKey] = tc.expected
+
+			_, err := d.NodeStageVolume(ctx, request)
+			assert.Equal(t, tc.code, status.Code(err))
+			if tc.code != codes.OK {
+				assert.Empty(t, st.staged)
+				assert.Equal(t, tc.diskFormat, st.diskFormats["/dev/vg-1/pvc-1"])
+			}
+		})
+	}
+}
+
+func TestNodeStageVolumeBlockToFSTransition(t *testing.T) {
+	ctx := context.Background()
+
+	// newBlockUsedDriver returns the node driver whose volume pvc-1 has been published as block
+	newBlockUsedDriver := func(t *testing.T) (*Driver, *fakeStoreManager) {
+		d, st := newTestNodeDriver()
+		d.cl = newFakeClient(&snc.LVMLogicalVolume{ObjectMeta: metav1.ObjectMeta{Name: "pvc-1"}})
+
+		request := newTestNodePublishVolumeRequest("pvc-1", nil)
+		request.VolumeCapability = &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}
+		_, err := d.NodePublishVolume(ctx, request)
+		require.NoError(t, err)
+		return d, st
+	}
+	accessType := func(t *testing.T, d *Driver) string {
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, d.cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, llv))
+		return llv.Annotations[internal.AccessTypeAnnotation]
+	}
+
+	t.Run("block_volume_is_not_formatted", func(t *testing.T) {
+		d, st := newBlockUsedDriver(t)
+		assert.Equal(t, internal.AccessTypeBlock, accessType(t, d))
+
+		_, err := d.NodeStageVolume(ctx, newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeExt4))
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+		assert.ErrorContains(t, err, internal.FormatOverBlockKey)
+		assert.Empty(t, st.staged)
+		assert.Empty(t, st.diskFormats["/dev/vg-1/pvc-1"])
+		assert.Equal(t, internal.AccessTypeBlock, accessType(t, d))
+	})
+
+	t.Run("block_volume_is_formatted_when_forced", func(t *testing.T) {
+		d, st := newBlockUsedDriver(t)
+		request := newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeExt4)
+		request.VolumeContext[internal.FormatOverBlockKey] = "true"
+
+		_, err := d.NodeStageVolume(ctx, request)
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/vg-1/pvc-1", st.staged["/staging/pvc-1"])
+		assert.Equal(t, internal.FSTypeExt4, st.diskFormats["/dev/vg-1/pvc-1"])
+		assert.Equal(t, internal.AccessTypeFilesystem, accessType(t, d))
+	})
+
+	t.Run("block_volume_with_filesystem_is_staged", func(t *testing.T) {
+		d, st := newBlockUsedDriver(t)
+		st.diskFormats["/dev/vg-1/pvc-1"] = internal.FSTypeExt4
+
+		_, err := d.NodeStageVolume(ctx, newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeExt4))
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/vg-1/pvc-1", st.staged["/staging/pvc-1"])
+	})
+
+	t.Run("new_volume_is_formatted", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		d.cl = newFakeClient(&snc.LVMLogicalVolume{ObjectMeta: metav1.ObjectMeta{Name: "pvc-1"}})
+
+		_, err := d.NodeStageVolume(ctx, newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeExt4))
+		require.NoError(t, err)
+		assert.Equal(t, internal.FSTypeExt4, st.diskFormats["/dev/vg-1/pvc-1"])
+		assert.Equal(t, internal.AccessTypeFilesystem, accessType(t, d))
+	})
+
+	t.Run("forbidden_llv_does_not_fail_staging", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		d.cl = interceptor.NewClient(newFakeClient(), interceptor.Funcs{
+			Get: func(context.Context, client.WithWatch, client.ObjectKey, client.Object, ...client.GetOption) error {
+				return kerrors.NewForbidden(snc.SchemeGroupVersion.WithResource("lvmlogicalvolumes").GroupResource(), "pvc-1", errors.New("no RBAC"))
+			},
+			Patch: func(context.Context, client.WithWatch, client.Object, client.Patch, ...client.PatchOption) error {
+				return kerrors.NewForbidden(snc.SchemeGroupVersion.WithResource("lvmlogicalvolumes").GroupResource(), "pvc-1", errors.New("no RBAC"))
+			},
+		})
+
+		_, err := d.NodeStageVolume(ctx, newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeExt4))
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/vg-1/pvc-1", st.staged["/staging/pvc-1"])
+		assert.Equal(t, internal.FSTypeExt4, st.diskFormats["/dev/vg-1/pvc-1"])
+	})
+
+	t.Run("invalid_force_is_rejected", func(t *testing.T) {
+		d, st := newBlockUsedDriver(t)
+		request := newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeExt4)
+		request.VolumeContext[internal.FormatOverBlockKey] = "always"
+
+		_, err := d.NodeStageVolume(ctx, request)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.Empty(t, st.staged)
+	})
+}
+
+func TestNodeDeviceSize(t *testing.T) {
+	ctx := context.Background()
+	const volumeSize = "1073741824"
+
+	newStageRequest := func() *csi.NodeStageVolumeRequest {
+		request := newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeExt4)
+		request.VolumeContext[internal.VolumeSizeKey] = volumeSize
+		return request
+	}
+	newPublishRequest := func(block bool) *csi.NodePublishVolumeRequest {
+		request := newTestNodePublishVolumeRequest("pvc-1", map[string]string{internal.VolumeSizeKey: volumeSize})
+		if block {
+			request.VolumeCapability = &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}
+		}
+		return request
+	}
+
+	t.Run("zero_size_device_is_not_formatted", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		st.deviceSizes = map[string]int64{"/dev/vg-1/pvc-1": 0}
+
+		_, err := d.NodeStageVolume(ctx, newStageRequest())
+		assert.Equal(t, codes.Internal, status.Code(err))
+		assert.ErrorContains(t, err, "zero size")
+		assert.Empty(t, st.diskFormats["/dev/vg-1/pvc-1"])
+		assert.Empty(t, st.staged)
+	})
+
+	t.Run("zero_size_device_is_not_published", func(t *testing.T) {
+		for name, block := range map[string]bool{"block": true, "filesystem": false} {
+			t.Run(name, func(t *testing.T) {
+				d, st := newTestNodeDriver()
+				st.deviceSizes = map[string]int64{"/dev/vg-1/pvc-1": 0}
+
+				_, err := d.NodePublishVolume(ctx, newPublishRequest(block))
+				assert.Equal(t, codes.Internal, status.Code(err))
+				assert.Empty(t, st.published)
+			})
+		}
+	})
+
+	t.Run("implausibly_small_device_is_not_staged", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		st.deviceSizes = map[string]int64{"/dev/vg-1/pvc-1": 4 << 20}
+
+		_, err := d.NodeStageVolume(ctx, newStageRequest())
+		assert.Equal(t, codes.Internal, status.Code(err))
+		assert.ErrorContains(t, err, "/dev/vg-1/pvc-1")
+		assert.Empty(t, st.staged)
+	})
+
+	t.Run("device_of_provisioned_size_is_used", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		st.deviceSizes = map[string]int64{"/dev/vg-1/pvc-1": 1 << 30}
+
+		_, err := d.NodeStageVolume(ctx, newStageRequest())
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/vg-1/pvc-1", st.staged["/staging/pvc-1"])
+
+		_, err = d.NodePublishVolume(ctx, newPublishRequest(false))
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/vg-1/pvc-1", st.published["/target/pvc-1"])
+	})
+
+	t.Run("expanded_device_is_used", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		st.deviceSizes = map[string]int64{"/dev/vg-1/pvc-1": 4 << 30}
+
+		_, err := d.NodePublishVolume(ctx, newPublishRequest(true))
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/vg-1/pvc-1", st.published["/target/pvc-1"])
+	})
+
+	t.Run("invalid_volume_size_is_rejected", func(t *testing.T) {
+		d, _ := newTestNodeDriver()
+		request := newStageRequest()
+		request.VolumeContext[internal.VolumeSizeKey] = "1Gi"
+
+		_, err := d.NodeStageVolume(ctx, request)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+func TestNodePublishVolume(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("io_limits_applied_to_volume_device", func(t *testing.T) {
+		throttler := &fakeIOThrottler{devices: map[string]utils.IOLimits{}}
+		d, _ := newTestNodeDriver(WithIOThrottler(throttler))
+
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", map[string]string{
+			internal.MaxIOPSKey: "100",
+			internal.MaxBPSKey:  "2048",
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, map[string]utils.IOLimits{"/dev/vg-1/pvc-1": {MaxIOPS: 100, MaxBPS: 2048}}, throttler.devices)
+	})
+
+	t.Run("io_limits_skipped_when_unsupported", func(t *testing.T) {
+		throttler := &fakeIOThrottler{err: fmt.Errorf("no io.max: %w", utils.ErrIOThrottlingUnsupported)}
+		d, st := newTestNodeDriver(WithIOThrottler(throttler))
+
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", map[string]string{
+			internal.MaxIOPSKey: "100",
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/vg-1/pvc-1", st.published["/target/pvc-1"])
+	})
+
+	t.Run("mount_option_variables_are_substituted", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		request := newTestNodePublishVolumeRequest("pvc-1", nil)
+		request.VolumeCapability.GetMount().MountFlags = []string{"cache=/cache/${nodeName}"}
+
+		_, err := d.NodePublishVolume(ctx, request)
+		require.NoError(t, err)
+		assert.Contains(t, st.mountOpts["/target/pvc-1"], "cache=/cache/test-node")
+	})
+
+	t.Run("unknown_mount_option_variable_is_rejected", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		request := newTestNodePublishVolumeRequest("pvc-1", nil)
+		request.VolumeCapability.GetMount().MountFlags = []string{"cache=/cache/${zone}"}
+
+		_, err := d.NodePublishVolume(ctx, request)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.Empty(t, st.published)
+	})
+}
+
+func TestNodeIOLimitsCleanup(t *testing.T) {
+	ctx := context.Background()
+	unstageRequest := &csi.NodeUnstageVolumeRequest{VolumeId: "pvc-1", StagingTargetPath: "/staging/pvc-1"}
+	unpublishRequest := &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc-1", TargetPath: "/target/pvc-1"}
+
+	t.Run("filesystem_volume_is_cleared_on_unstage", func(t *testing.T) {
+		throttler := &fakeIOThrottler{devices: map[string]utils.IOLimits{}}
+		d, _ := newTestNodeDriver(WithIOThrottler(throttler))
+
+		_, err := d.NodeUnpublishVolume(ctx, unpublishRequest)
+		require.NoError(t, err)
+		assert.Empty(t, throttler.cleared)
+
+		_, err = d.NodeUnstageVolume(ctx, unstageRequest)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/staging/pvc-1"}, throttler.cleared)
+	})
+
+	t.Run("block_volume_is_cleared_on_unpublish", func(t *testing.T) {
+		throttler := &fakeIOThrottler{devices: map[string]utils.IOLimits{}}
+		d, st := newTestNodeDriver(WithIOThrottler(throttler))
+		st.volumeStats = map[string]utils.VolumeStats{"/target/pvc-1": {Block: true}}
+
+		_, err := d.NodeUnpublishVolume(ctx, unpublishRequest)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/target/pvc-1"}, throttler.cleared)
+	})
+
+	t.Run("unmounted_staging_target_is_not_cleared", func(t *testing.T) {
+		throttler := &fakeIOThrottler{devices: map[string]utils.IOLimits{}}
+		d, st := newTestNodeDriver(WithIOThrottler(throttler))
+		st.notMounted = map[string]struct{}{"/staging/pvc-1": {}}
+
+		_, err := d.NodeUnstageVolume(ctx, unstageRequest)
+		require.NoError(t, err)
+		assert.Empty(t, throttler.cleared)
+	})
+
+	t.Run("clear_failure_does_not_fail_unstage", func(t *testing.T) {
+		throttler := &fakeIOThrottler{err: errors.New("write io.max: permission denied")}
+		d, _ := newTestNodeDriver(WithIOThrottler(throttler))
+
+		_, err := d.NodeUnstageVolume(ctx, unstageRequest)
+		assert.NoError(t, err)
+	})
+}
+
+func TestNodeMountSync(t *testing.T) {
+	ctx := context.Background()
+	syncContext := map[string]string{internal.MountSyncKey: "true"}
+
+	t.Run("sync_is_added_for_filesystem_volume", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		stageRequest := newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeExt4)
+		stageRequest.VolumeContext[internal.MountSyncKey] = "true"
+
+		_, err := d.NodeStageVolume(ctx, stageRequest)
+		require.NoError(t, err)
+		assert.Contains(t, st.mountOpts["/staging/pvc-1"], "sync")
+
+		_, err = d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", syncContext))
+		require.NoError(t, err)
+		assert.Contains(t, st.mountOpts["/target/pvc-1"], "sync")
+	})
+
+	t.Run("sync_is_not_added_by_default", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		require.NoError(t, err)
+		assert.NotContains(t, st.mountOpts["/target/pvc-1"], "sync")
+	})
+
+	t.Run("sync_is_rejected_for_block_volume", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		blockCapability := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}
+
+		stageRequest := newTestNodeStageVolumeRequest("pvc-1", "")
+		stageRequest.VolumeContext[internal.MountSyncKey] = "true"
+		stageRequest.VolumeCapability = blockCapability
+		_, err := d.NodeStageVolume(ctx, stageRequest)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		publishRequest := newTestNodePublishVolumeRequest("pvc-1", syncContext)
+		publishRequest.VolumeCapability = blockCapability
+		_, err = d.NodePublishVolume(ctx, publishRequest)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.ErrorContains(t, err, "not supported for block volumes")
+		assert.Empty(t, st.published)
+	})
+
+	t.Run("invalid_value_is_rejected", func(t *testing.T) {
+		d, _ := newTestNodeDriver()
+
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", map[string]string{internal.MountSyncKey: "always"}))
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+// fakeDeviceProber fails the first failures probes of every device.
+type fakeDeviceProber struct {
+	mu       sync.Mutex
+	failures int
+	probes   map[string]int
+}
+
+func (f *fakeDeviceProber) ProbeDevice(devicePath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.probes == nil {
+		f.probes = make(map[string]int)
+	}
+	f.probes[devicePath]++
+	if f.probes[devicePath] <= f.failures {
+		return errors.New("device size is 0")
+	}
+	return nil
+}
+
+func TestNodePublishVolumeDeviceReadiness(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("mounted_after_probe_succeeds", func(t *testing.T) {
+		prober := &fakeDeviceProber{failures: 2}
+		d, st := newTestNodeDriver(WithDeviceReadinessProbe(prober, 5, time.Millisecond))
+
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		require.NoError(t, err)
+		assert.Equal(t, 3, prober.probes["/dev/vg-1/pvc-1"])
+		assert.Contains(t, st.published, "/target/pvc-1")
+	})
+
+	t.Run("never_ready_device_is_not_mounted", func(t *testing.T) {
+		prober := &fakeDeviceProber{failures: math.MaxInt}
+		d, st := newTestNodeDriver(WithDeviceReadinessProbe(prober, 3, time.Millisecond))
+
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+		assert.ErrorContains(t, err, "device size is 0")
+		assert.Equal(t, 3, prober.probes["/dev/vg-1/pvc-1"])
+		assert.NotContains(t, st.published, "/target/pvc-1")
+	})
+
+	t.Run("cancelled_request_stops_probing", func(t *testing.T) {
+		prober := &fakeDeviceProber{failures: math.MaxInt}
+		d, st := newTestNodeDriver(WithDeviceReadinessProbe(prober, 100, time.Hour))
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := d.NodePublishVolume(cancelled, newTestNodePublishVolumeRequest("pvc-1", nil))
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+		assert.Equal(t, 1, prober.probes["/dev/vg-1/pvc-1"])
+		assert.NotContains(t, st.published, "/target/pvc-1")
+	})
+
+	t.Run("probe_disabled_by_default", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		require.NoError(t, err)
+		assert.Contains(t, st.published, "/target/pvc-1")
+	})
+}
+
+func TestNodePublishVolumeForeignMount(t *testing.T) {
+	ctx := context.Background()
+	const target = "/target/pvc-1"
+
+	newDriver := func(opts ...Option) (*Driver, *fakeStoreManager) {
+		d, st := newTestNodeDriver(opts...)
+		st.targetDevices = map[string]string{target: "/dev/vg-1/pvc-2"}
+		return d, st
+	}
+
+	t.Run("fail_by_default", func(t *testing.T) {
+		d, st := newDriver()
+
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		assert.Equal(t, codes.AlreadyExists, status.Code(err))
+		assert.Empty(t, st.unpublished)
+		assert.NotContains(t, st.published, target)
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		d, st := newDriver(WithForeignMountAction(ForeignMountFail))
+
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		assert.Equal(t, codes.AlreadyExists, status.Code(err))
+		assert.ErrorContains(t, err, "/dev/vg-1/pvc-2")
+		assert.NotContains(t, st.published, target)
+	})
+
+	t.Run("force_unmounts_foreign_mount", func(t *testing.T) {
+		d, st := newDriver(WithForeignMountAction(ForeignMountForce))
+
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		require.NoError(t, err)
+		assert.Equal(t, []string{target}, st.unpublished)
+		assert.Equal(t, "/dev/vg-1/pvc-1", st.published[target])
+	})
+
+	t.Run("own_mount_is_kept", func(t *testing.T) {
+		d, st := newDriver(WithForeignMountAction(ForeignMountForce))
+		st.targetDevices[target] = "/dev/vg-1/pvc-1"
+
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		require.NoError(t, err)
+		assert.Empty(t, st.unpublished)
+	})
+}
+
+func TestNodeUnpublishVolume(t *testing.T) {
+	ctx := context.Background()
+	unpublishRequest := &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc-1", TargetPath: "/target/pvc-1"}
+
+	t.Run("trim_runs_before_unmount_when_enabled", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", map[string]string{
+			internal.TrimOnUnpublishKey: "true",
+		}))
+		require.NoError(t, err)
+
+		_, err = d.NodeUnpublishVolume(ctx, unpublishRequest)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"trim /target/pvc-1", "unpublish /target/pvc-1"}, st.calls)
+	})
+
+	t.Run("trim_is_skipped_when_disabled", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		require.NoError(t, err)
+
+		_, err = d.NodeUnpublishVolume(ctx, unpublishRequest)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"unpublish /target/pvc-1"}, st.calls)
+	})
+}
+
+func TestDevicePath(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("default_base", func(t *testing.T) {
+		d, _ := newTestNodeDriver()
+		assert.Equal(t, "/dev/vg-1/pvc-1", d.devicePath("vg-1", "pvc-1"))
+	})
+
+	t.Run("custom_base_is_used_by_stage_and_publish", func(t *testing.T) {
+		base := t.TempDir()
+		d, st := newTestNodeDriver(WithDevPathBase(base))
+		expected := filepath.Join(base, "vg-1", "pvc-1")
+
+		_, err := d.NodeStageVolume(ctx, newTestNodeStageVolumeRequest("pvc-1", "ext4"))
+		require.NoError(t, err)
+		assert.Equal(t, expected, st.staged["/staging/pvc-1"])
+
+		_, err = d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		require.NoError(t, err)
+		assert.Equal(t, expected, st.published["/target/pvc-1"])
+	})
+}
+
+func TestNodeStageVolumeFormatLimit(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("concurrent_formats_are_bounded", func(t *testing.T) {
+		d, st := newTestNodeDriver(WithMaxConcurrentFormats(2))
+		var active, maxActive int32
+		st.stageHook = func(string) {
+			n := atomic.AddInt32(&active, 1)
+			for {
+				m := atomic.LoadInt32(&maxActive)
+				if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+					break
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			atomic.AddInt32(&active, -1)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 6; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := d.NodeStageVolume(ctx, newTestNodeStageVolumeRequest(fmt.Sprintf("pvc-%d", i), "ext4"))
+				assert.NoError(t, err)
+			}(i)
+		}
+		wg.Wait()
+
+		assert.Equal(t, int32(2), maxActive)
+		assert.Len(t, st.staged, 6)
+	})
+
+	t.Run("mount_only_stage_is_not_throttled", func(t *testing.T) {
+		d, st := newTestNodeDriver(WithMaxConcurrentFormats(1))
+		st.diskFormats["/dev/vg-1/pvc-formatted"] = "ext4"
+		release := make(chan struct{})
+		formatting := make(chan struct{})
+		st.stageHook = func(source string) {
+			if source == "/dev/vg-1/pvc-new" {
+				close(formatting)
+				<-release
+			}
+		}
+
+		done := make(chan error)
+		go func() {
+			_, err := d.NodeStageVolume(ctx, newTestNodeStageVolumeRequest("pvc-new", "ext4"))
+			done <- err
+		}()
+		<-formatting
+
+		_, err := d.NodeStageVolume(ctx, newTestNodeStageVolumeRequest("pvc-formatted", "ext4"))
+		require.NoError(t, err)
+
+		close(release)
+		require.NoError(t, <-done)
+	})
+
+	t.Run("queued_format_honors_context", func(t *testing.T) {
+		d, st := newTestNodeDriver(WithMaxConcurrentFormats(1))
+		release := make(chan struct{})
+		formatting := make(chan struct{})
+		st.stageHook = func(source string) {
+			if source == "/dev/vg-1/pvc-first" {
+				close(formatting)
+				<-release
+			}
+		}
+
+		done := make(chan error)
+		go func() {
+			_, err := d.NodeStageVolume(ctx, newTestNodeStageVolumeRequest("pvc-first", "ext4"))
+			done <- err
+		}()
+		<-formatting
+
+		cancelCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		_, err := d.NodeStageVolume(cancelCtx, newTestNodeStageVolumeRequest("pvc-second", "ext4"))
+		assert.Equal(t, codes.Aborted, status.Code(err))
+
+		close(release)
+		require.NoError(t, <-done)
+	})
+}
+
+func TestNodeDuplicateLV(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("unique_lv_is_published", func(t *testing.T) {
+		d, st := newTestNodeDriver(WithLVEnumerator(fakeLVEnumerator{"pvc-1": {"vg-1"}}))
+
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/vg-1/pvc-1", st.published["/target/pvc-1"])
+	})
+
+	t.Run("duplicate_lv_is_rejected", func(t *testing.T) {
+		d, st := newTestNodeDriver(WithLVEnumerator(fakeLVEnumerator{"pvc-1": {"vg-1", "vg-2"}}))
+
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+		assert.ErrorContains(t, err, "[vg-1 vg-2]")
+		assert.Empty(t, st.published)
+
+		_, err = d.NodeStageVolume(ctx, newTestNodeStageVolumeRequest("pvc-1", "ext4"))
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+		assert.Empty(t, st.staged)
+	})
+}
+
+func TestNodeVGExists(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("vg_present_is_published", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/vg-1/pvc-1", st.published["/target/pvc-1"])
+	})
+
+	t.Run("vg_absent_is_rejected", func(t *testing.T) {
+		d, st := newTestNodeDriver(WithVGChecker(fakeVGChecker{missing: []string{"vg-1"}}))
+
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+		assert.ErrorContains(t, err, "VG vg-1 does not exist on node test-node")
+		assert.Empty(t, st.published)
+
+		_, err = d.NodeStageVolume(ctx, newTestNodeStageVolumeRequest("pvc-1", "ext4"))
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+		assert.Empty(t, st.staged)
+	})
+
+	t.Run("failing_lookup_is_ignored", func(t *testing.T) {
+		d, st := newTestNodeDriver(WithVGChecker(fakeVGChecker{err: errors.New("vgs failed")}))
+
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/vg-1/pvc-1", st.published["/target/pvc-1"])
+	})
+}
+
+func TestNodePublishVolumeMountTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("hanging_mount_times_out", func(t *testing.T) {
+		release := make(chan struct{})
+		defer close(release)
+
+		d, st := newTestNodeDriver(WithMountTimeout(50 * time.Millisecond))
+		st.publishHook = func(string) { <-release }
+
+		start := time.Now()
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+		assert.Less(t, time.Since(start), 5*time.Second)
+	})
+
+	t.Run("retry_is_refused_until_timed_out_mount_completes", func(t *testing.T) {
+		release := make(chan struct{})
+		d, st := newTestNodeDriver(WithMountTimeout(50 * time.Millisecond))
+		st.publishHook = func(string) { <-release }
+
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+		_, err = d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		assert.Equal(t, codes.Aborted, status.Code(err))
+
+		close(release)
+		assert.Eventually(t, func() bool {
+			_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("mount_within_timeout_succeeds", func(t *testing.T) {
+		d, st := newTestNodeDriver(WithMountTimeout(time.Second))
+
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		require.NoError(t, err)
+		assert.Equal(t, "/dev/vg-1/pvc-1", st.published["/target/pvc-1"])
+	})
+}
+
+func TestNodePublishVolumeReadOnly(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name     string
+		readonly bool
+		mode     csi.VolumeCapability_AccessMode_Mode
+		expected []string
+	}{
+		{name: "read_write", mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, expected: []string{"bind"}},
+		{name: "readonly_flag", readonly: true, mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, expected: []string{"bind", "ro"}},
+		{name: "single_node_reader_only_mode", mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, expected: []string{"bind", "ro"}},
+		{name: "multi_node_reader_only_mode", mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, expected: []string{"bind", "ro"}},
+		{name: "readonly_flag_and_mode", readonly: true, mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, expected: []string{"bind", "ro"}},
+		{name: "no_access_mode", expected: []string{"bind"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, st := newTestNodeDriver()
+			req := newTestNodePublishVolumeRequest("pvc-1", nil)
+			req.Readonly = tc.readonly
+			if tc.mode != csi.VolumeCapability_AccessMode_UNKNOWN {
+				req.VolumeCapability.AccessMode = &csi.VolumeCapability_AccessMode{Mode: tc.mode}
+			}
+
+			_, err := d.NodePublishVolume(ctx, req)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, st.mountOpts["/target/pvc-1"])
+		})
+	}
+}
+
+func TestNodeUnpublishVolumeUnmountTimeout(t *testing.T) {
+	ctx := context.Background()
+	request := &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc-1", TargetPath: "/target/pvc-1"}
+
+	t.Run("unmount_within_timeout_succeeds", func(t *testing.T) {
+		d, st := newTestNodeDriver(WithUnmountTimeout(time.Second, true))
+
+		_, err := d.NodeUnpublishVolume(ctx, request)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"unpublish /target/pvc-1"}, st.calls)
+	})
+
+	t.Run("hanging_unmount_times_out", func(t *testing.T) {
+		release := make(chan struct{})
+		defer close(release)
+
+		d, st := newTestNodeDriver(WithUnmountTimeout(50*time.Millisecond, false))
+		st.unpublishHook = func(string) { <-release }
+
+		start := time.Now()
+		_, err := d.NodeUnpublishVolume(ctx, request)
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+		assert.Less(t, time.Since(start), 5*time.Second)
+
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		assert.Empty(t, st.calls)
+	})
+
+	t.Run("hanging_unmount_falls_back_to_lazy_unmount", func(t *testing.T) {
+		release := make(chan struct{})
+		defer close(release)
+
+		d, st := newTestNodeDriver(WithUnmountTimeout(50*time.Millisecond, true))
+		st.unpublishHook = func(string) { <-release }
+		d.trimTargets["/target/pvc-1"] = struct{}{}
+
+		_, err := d.NodeUnpublishVolume(ctx, request)
+		require.NoError(t, err)
+		assert.NotContains(t, d.trimTargets, "/target/pvc-1")
+
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		assert.Equal(t, []string{"trim /target/pvc-1", "lazy unmount /target/pvc-1"}, st.calls)
+	})
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	ctx := context.Background()
+	request := &csi.NodeGetVolumeStatsRequest{VolumeId: "pvc-1", VolumePath: "/target/pvc-1"}
+
+	t.Run("path_does_not_exist", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		st.missingPaths = map[string]struct{}{"/target/pvc-1": {}}
+
+		_, err := d.NodeGetVolumeStats(ctx, request)
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("path_is_not_a_mount_point", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		st.notMounted = map[string]struct{}{"/target/pvc-1": {}}
+
+		_, err := d.NodeGetVolumeStats(ctx, request)
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	})
+
+	t.Run("mounted_volume_reports_usage", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		st.volumeStats = map[string]utils.VolumeStats{"/target/pvc-1": {
+			TotalBytes: 1000, AvailableBytes: 600, UsedBytes: 400,
+			TotalInodes: 100, AvailableInodes: 90, UsedInodes: 10,
+		}}
+
+		resp, err := d.NodeGetVolumeStats(ctx, request)
+		require.NoError(t, err)
+		assert.Equal(t, []*csi.VolumeUsage{
+			{Unit: csi.VolumeUsage_BYTES, Total: 1000, Available: 600, Used: 400},
+			{Unit: csi.VolumeUsage_INODES, Total: 100, Available: 90, Used: 10},
+		}, resp.Usage)
+	})
+
+	// the statfs of a block volume describes the devtmpfs, not the device
+	devtmpfs := utils.VolumeStats{TotalBytes: 4096, AvailableBytes: 4096, TotalInodes: 100, AvailableInodes: 50, Block: true}
+
+	t.Run("block_volume_with_ext4_reports_filesystem_usage", func(t *testing.T) {
+		prober := &fakeBlockFSProber{usage: map[string]utils.BlockFSUsage{
+			"/target/pvc-1": {FSType: internal.FSTypeExt4, TotalBytes: 1000, UsedBytes: 400, AvailableBytes: 550},
+		}}
+		d, st := newTestNodeDriver(WithBlockFSUsageProbe(prober))
+		st.volumeStats = map[string]utils.VolumeStats{"/target/pvc-1": devtmpfs}
+		st.deviceSizes = map[string]int64{"/target/pvc-1": 2 << 30}
+
+		resp, err := d.NodeGetVolumeStats(ctx, request)
+		require.NoError(t, err)
+		assert.Equal(t, []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: 2 << 30}}, resp.Usage)
+		require.NotNil(t, resp.VolumeCondition)
+		assert.False(t, resp.VolumeCondition.Abnormal)
+		assert.Equal(t, "ext4 filesystem inside the block device: 400 of 1000 bytes used, 550 available", resp.VolumeCondition.Message)
+	})
+
+	t.Run("block_volume_with_random_contents_reports_device_size", func(t *testing.T) {
+		d, st := newTestNodeDriver(WithBlockFSUsageProbe(&fakeBlockFSProber{}))
+		st.volumeStats = map[string]utils.VolumeStats{"/target/pvc-1": devtmpfs}
+		st.deviceSizes = map[string]int64{"/target/pvc-1": 2 << 30}
+
+		resp, err := d.NodeGetVolumeStats(ctx, request)
+		require.NoError(t, err)
+		assert.Equal(t, []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: 2 << 30}}, resp.Usage)
+		assert.Nil(t, resp.VolumeCondition)
+	})
+
+	t.Run("block_volume_is_not_probed_by_default", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		st.volumeStats = map[string]utils.VolumeStats{"/target/pvc-1": devtmpfs}
+
+		resp, err := d.NodeGetVolumeStats(ctx, request)
+		require.NoError(t, err)
+		assert.Equal(t, []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: 1 << 30}}, resp.Usage)
+		assert.Nil(t, resp.VolumeCondition)
+	})
+}
+
+// fakeBlockFSProber reports the usage of the devices listed and no filesystem on the rest.
+type fakeBlockFSProber struct {
+	usage map[string]utils.BlockFSUsage
+}
+
+func (f *fakeBlockFSProber) ProbeFSUsage(devicePath string) (utils.BlockFSUsage, error) {
+	if usage, ok := f.usage[devicePath]; ok {
+		return usage, nil
+	}
+	return utils.BlockFSUsage{}, utils.ErrNoFilesystem
+}
+
+func TestNodeExpandVolume(t *testing.T) {
+	ctx := context.Background()
+	newRequest := func(requiredBytes int64) *csi.NodeExpandVolumeRequest {
+		return &csi.NodeExpandVolumeRequest{
+			VolumeId:      "pvc-1",
+			VolumePath:    "/target/pvc-1",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: requiredBytes},
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			},
+		}
+	}
+
+	t.Run("grown_filesystem_is_verified", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		// the ext4 inode tables and journal take some of the requested space
+		st.volumeStats = map[string]utils.VolumeStats{"/target/pvc-1": {TotalBytes: 2<<30 - 100<<20, FSType: internal.FSTypeExt4}}
+
+		resp, err := d.NodeExpandVolume(ctx, newRequest(2<<30))
+		require.NoError(t, err)
+		assert.Equal(t, int64(2<<30), resp.CapacityBytes)
+	})
+
+	t.Run("grown_xfs_filesystem_is_verified", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		// the xfs internal log takes some of the requested space
+		st.volumeStats = map[string]utils.VolumeStats{"/target/pvc-1": {TotalBytes: 1<<40 - 512<<20, FSType: internal.FSTypeXfs}}
+
+		_, err := d.NodeExpandVolume(ctx, newRequest(1<<40))
+		assert.NoError(t, err)
+	})
+
+	t.Run("short_grow_within_flat_percent_is_detected", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		// the ext4 filesystem stopped 100Gi short of 1Ti, which is within 10% of the size
+		st.volumeStats = map[string]utils.VolumeStats{"/target/pvc-1": {TotalBytes: 1<<40 - 100<<30, FSType: internal.FSTypeExt4}}
+
+		_, err := d.NodeExpandVolume(ctx, newRequest(1<<40))
+		assert.Equal(t, codes.Internal, status.Code(err))
+	})
+
+	t.Run("short_grow_is_detected", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		// the filesystem kept its previous size
+		st.volumeStats = map[string]utils.VolumeStats{"/target/pvc-1": {TotalBytes: 1 << 30}}
+
+		_, err := d.NodeExpandVolume(ctx, newRequest(2<<30))
+		assert.Equal(t, codes.Internal, status.Code(err))
+		assert.ErrorContains(t, err, "reports 1073741824 bytes")
+	})
+
+	t.Run("block_volume_is_not_verified", func(t *testing.T) {
+		d, _ := newTestNodeDriver()
+		request := newRequest(2 << 30)
+		request.VolumeCapability.AccessType = &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}
+
+		_, err := d.NodeExpandVolume(ctx, request)
+		assert.NoError(t, err)
+	})
+
+	t.Run("missing_resize_tool_is_reported", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		st.resizeErr = fmt.Errorf("%w: xfs_growfs growing the xfs filesystem on device /dev/vg-1/pvc-1 is not found at /opt/xfs/xfs_growfs", utils.ErrResizeToolMissing)
+
+		_, err := d.NodeExpandVolume(ctx, newRequest(2<<30))
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+		assert.ErrorContains(t, err, "/opt/xfs/xfs_growfs")
+	})
+}
+
+func TestNodeGetVolumeStatsCondition(t *testing.T) {
+	ctx := context.Background()
+	request := &csi.NodeGetVolumeStatsRequest{VolumeId: "pvc-1", VolumePath: "/target/pvc-1"}
+
+	newLLV := func(spec snc.LVMLogicalVolumeSpec) *snc.LVMLogicalVolume {
+		return &snc.LVMLogicalVolume{ObjectMeta: metav1.ObjectMeta{Name: "pvc-1"}, Spec: spec}
+	}
+	newThinLVG := func(used string) *snc.LVMVolumeGroup {
+		lvg := newTestLVG("lvg-1", "test-node", "10Gi")
+		lvg.Status.ThinPools = []snc.LVMVolumeGroupThinPoolStatus{
+			{Name: "tp-1", ActualSize: resource.MustParse("10Gi"), UsedSize: resource.MustParse(used)},
+		}
+		return lvg
+	}
+	thinSpec := snc.LVMLogicalVolumeSpec{Type: internal.LVMTypeThin, LVMVolumeGroupName: "lvg-1", Thin: &snc.LVMLogicalVolumeThinSpec{PoolName: "tp-1"}}
+
+	for _, tc := range []struct {
+		name    string
+		objects []client.Object
+		message string
+	}{
+		{
+			name:    "thick_volume",
+			objects: []client.Object{newLLV(snc.LVMLogicalVolumeSpec{Type: internal.LVMTypeThick, LVMVolumeGroupName: "lvg-1"})},
+			message: "LVM type: Thick",
+		},
+		{
+			name:    "thin_volume",
+			objects: []client.Object{newLLV(thinSpec), newThinLVG("5Gi")},
+			message: "LVM type: Thin, allocation: lazy",
+		},
+		{
+			name: "preallocated_thin_volume",
+			objects: []client.Object{func() client.Object {
+				llv := newLLV(thinSpec)
+				llv.Annotations = map[string]string{internal.ThinAllocationAnnotation: internal.ThinAllocationPreallocated}
+				return llv
+			}(), newThinLVG("5Gi")},
+			message: "LVM type: Thin, allocation: preallocated",
+		},
+		{
+			name:    "thin_volume_pool_over_threshold",
+			objects: []client.Object{newLLV(thinSpec), newThinLVG("9Gi")},
+			message: "LVM type: Thin, thin pool tp-1 is 90% full, above the 80% threshold, allocation: lazy",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, _ := newTestNodeDriver()
+			d.cl = newFakeClient(tc.objects...)
+
+			resp, err := d.NodeGetVolumeStats(ctx, request)
+			require.NoError(t, err)
+			require.NotNil(t, resp.VolumeCondition)
+			assert.False(t, resp.VolumeCondition.Abnormal)
+			assert.Equal(t, tc.message, resp.VolumeCondition.Message)
+		})
+	}
+
+	t.Run("unknown_volume_has_no_condition", func(t *testing.T) {
+		d, _ := newTestNodeDriver()
+
+		resp, err := d.NodeGetVolumeStats(ctx, request)
+		require.NoError(t, err)
+		assert.Nil(t, resp.VolumeCondition)
+	})
+
+	// newCountingClient returns the client counting the Get calls, failing them with err if set
+	newCountingClient := func(gets *atomic.Int32, err error, objects ...client.Object) client.Client {
+		return interceptor.NewClient(newFakeClient(objects...), interceptor.Funcs{
+			Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+				gets.Add(1)
+				if err != nil {
+					return err
+				}
+				return c.Get(ctx, key, obj, opts...)
+			},
+		})
+	}
+
+	t.Run("client_error_does_not_fail_stats", func(t *testing.T) {
+		var gets atomic.Int32
+		d, _ := newTestNodeDriver()
+		d.cl = newCountingClient(&gets, kerrors.NewForbidden(snc.SchemeGroupVersion.WithResource("lvmlogicalvolumes").GroupResource(), "pvc-1", errors.New("no RBAC")))
+
+		for range 3 {
+			resp, err := d.NodeGetVolumeStats(ctx, request)
+			require.NoError(t, err)
+			assert.NotEmpty(t, resp.Usage)
+			assert.Nil(t, resp.VolumeCondition)
+		}
+		assert.Equal(t, int32(1), gets.Load(), "expected the failed read to be cached")
+	})
+
+	t.Run("objects_are_read_once", func(t *testing.T) {
+		var gets atomic.Int32
+		d, _ := newTestNodeDriver()
+		d.cl = newCountingClient(&gets, nil, newLLV(thinSpec), newThinLVG("9Gi"))
+
+		for range 3 {
+			resp, err := d.NodeGetVolumeStats(ctx, request)
+			require.NoError(t, err)
+			require.NotNil(t, resp.VolumeCondition)
+			assert.Equal(t, "LVM type: Thin, thin pool tp-1 is 90% full, above the 80% threshold, allocation: lazy", resp.VolumeCondition.Message)
+		}
+		assert.Equal(t, int32(2), gets.Load())
+	})
+}
+
+func TestNodeGetVolumeStatsInodeExhaustion(t *testing.T) {
+	ctx := context.Background()
+	request := &csi.NodeGetVolumeStatsRequest{VolumeId: "pvc-1", VolumePath: "/target/pvc-1"}
+	llv := &snc.LVMLogicalVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-1"},
+		Spec:       snc.LVMLogicalVolumeSpec{Type: internal.LVMTypeThick, LVMVolumeGroupName: "lvg-1"},
+	}
+
+	newDriver := func(stats utils.VolumeStats) *Driver {
+		d, st := newTestNodeDriver(WithInodeFreeThreshold(5))
+		d.cl = newFakeClient(llv)
+		st.volumeStats = map[string]utils.VolumeStats{"/target/pvc-1": stats}
+		return d
+	}
+
+	t.Run("inode_exhausted_filesystem_is_abnormal", func(t *testing.T) {
+		d := newDriver(utils.VolumeStats{
+			TotalBytes: 1000, AvailableBytes: 900, UsedBytes: 100,
+			TotalInodes: 1000, AvailableInodes: 10, UsedInodes: 990,
+		})
+
+		resp, err := d.NodeGetVolumeStats(ctx, request)
+		require.NoError(t, err)
+		require.NotNil(t, resp.VolumeCondition)
+		assert.True(t, resp.VolumeCondition.Abnormal)
+		assert.Equal(t, "LVM type: Thick; 10 of 1000 inodes free (1%), below the 5% threshold", resp.VolumeCondition.Message)
+		assert.Equal(t, &csi.VolumeUsage{Unit: csi.VolumeUsage_INODES, Total: 1000, Available: 10, Used: 990}, resp.Usage[1])
+	})
+
+	t.Run("healthy_filesystem_is_not_flagged", func(t *testing.T) {
+		d := newDriver(utils.VolumeStats{TotalInodes: 1000, AvailableInodes: 500, UsedInodes: 500})
+
+		resp, err := d.NodeGetVolumeStats(ctx, request)
+		require.NoError(t, err)
+		require.NotNil(t, resp.VolumeCondition)
+		assert.False(t, resp.VolumeCondition.Abnormal)
+		assert.Equal(t, "LVM type: Thick", resp.VolumeCondition.Message)
+	})
+
+	t.Run("block_volume_is_skipped", func(t *testing.T) {
+		d := newDriver(utils.VolumeStats{TotalInodes: 1000, AvailableInodes: 0, UsedInodes: 1000, Block: true})
+
+		resp, err := d.NodeGetVolumeStats(ctx, request)
+		require.NoError(t, err)
+		require.NotNil(t, resp.VolumeCondition)
+		assert.False(t, resp.VolumeCondition.Abnormal)
+	})
+
+	t.Run("exhaustion_is_reported_without_llv", func(t *testing.T) {
+		d := newDriver(utils.VolumeStats{TotalInodes: 1000, AvailableInodes: 0, UsedInodes: 1000})
+		d.cl = newFakeClient()
+
+		resp, err := d.NodeGetVolumeStats(ctx, request)
+		require.NoError(t, err)
+		require.NotNil(t, resp.VolumeCondition)
+		assert.True(t, resp.VolumeCondition.Abnormal)
+	})
+}
+
+type failingLVGLister struct{}
+
+func (failingLVGLister) ListLVGs(context.Context) ([]snc.LVMVolumeGroup, error) {
+	return nil, errors.New("forbidden")
+}
+
+func TestNodeGetInfoMaxVolumesPerNode(t *testing.T) {
+	ctx := context.Background()
+	lvgs := staleLVGLister{
+		*newTestLVG("lvg-1", "test-node", "100Gi"),
+		*newTestLVG("lvg-2", "test-node", "60Gi"),
+		*newTestLVG("lvg-other", "other-node", "1000Gi"),
+	}
+
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		expected int64
+	}{
+		{name: "no_limit", expected: 0},
+		{name: "static_limit", opts: []Option{WithMaxVolumesPerNode(50)}, expected: 50},
+		{name: "dynamic_limit", opts: []Option{WithDynamicMaxVolumesPerNode(10 << 30)}, expected: 16},
+		{name: "dynamic_limit_clamped_to_ceiling", opts: []Option{WithMaxVolumesPerNode(10), WithDynamicMaxVolumesPerNode(1 << 30)}, expected: 10},
+		{name: "dynamic_limit_is_at_least_one", opts: []Option{WithDynamicMaxVolumesPerNode(1 << 40)}, expected: 1},
+		{name: "static_fallback_on_list_error", opts: []Option{WithLVGLister(failingLVGLister{}), WithMaxVolumesPerNode(50), WithDynamicMaxVolumesPerNode(1 << 30)}, expected: 50},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, _ := newTestNodeDriver(append([]Option{WithLVGLister(lvgs)}, tc.opts...)...)
+
+			resp, err := d.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, resp.MaxVolumesPerNode)
+		})
+	}
+}
+
+func TestCheckDynamicVolumeLimit(t *testing.T) {
+	ctx := context.Background()
+	forbidden := utils.ClientLVGLister{Client: interceptor.NewClient(newFakeClient(), interceptor.Funcs{
+		List: func(context.Context, client.WithWatch, client.ObjectList, ...client.ListOption) error {
+			return kerrors.NewForbidden(snc.SchemeGroupVersion.WithResource("lvmvolumegroups").GroupResource(), "", errors.New("no RBAC"))
+		},
+	})}
+
+	t.Run("forbidden_list_is_rejected", func(t *testing.T) {
+		d, _ := newTestNodeDriver(WithLVGLister(forbidden), WithDynamicMaxVolumesPerNode(1<<30))
+		assert.ErrorContains(t, d.checkDynamicVolumeLimit(ctx), "list LVMVolumeGroups")
+	})
+
+	t.Run("static_limit_is_not_checked", func(t *testing.T) {
+		d, _ := newTestNodeDriver(WithLVGLister(forbidden), WithMaxVolumesPerNode(50))
+		assert.NoError(t, d.checkDynamicVolumeLimit(ctx))
+	})
+
+	t.Run("other_errors_fall_back_at_registration", func(t *testing.T) {
+		d, _ := newTestNodeDriver(WithLVGLister(failingLVGLister{}), WithDynamicMaxVolumesPerNode(1<<30))
+		assert.NoError(t, d.checkDynamicVolumeLimit(ctx))
+	})
+}
+
+type fakeLVActivator struct {
+	activated map[string]string
+	err       error
+}
+
+func (f *fakeLVActivator) ActivateLV(vgName, lvName, mode string) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.activated[vgName+"/"+lvName] = mode
+	return nil
+}
+
+func TestNodeLVActivation(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name      string
+		mode      string
+		err       error
+		code      codes.Code
+		activated map[string]string
+	}{
+		{name: "not_activated_without_mode", activated: map[string]string{}},
+		{name: "local_activation", mode: internal.ActivationModeLocal, activated: map[string]string{"vg-1/pvc-1": internal.ActivationModeLocal}},
+		{name: "exclusive_activation", mode: internal.ActivationModeExclusive, activated: map[string]string{"vg-1/pvc-1": internal.ActivationModeExclusive}},
+		{name: "exclusive_activation_active_elsewhere", mode: internal.ActivationModeExclusive, err: fmt.Errorf("lvchange: %w", utils.ErrLVActiveElsewhere), code: codes.FailedPrecondition},
+		{name: "invalid_mode", mode: "shared", code: codes.InvalidArgument},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Run("stage", func(t *testing.T) {
+				activator := &fakeLVActivator{activated: map[string]string{}, err: tc.err}
+				d, _ := newTestNodeDriver(WithLVActivator(activator))
+				request := newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeExt4)
+				request.VolumeContext[internal.ActivationModeKey] = tc.mode
+
+				_, err := d.NodeStageVolume(ctx, request)
+				assert.Equal(t, tc.code, status.Code(err))
+				if tc.activated != nil {
+					assert.Equal(t, tc.activated, activator.activated)
+				}
+			})
+
+			t.Run("publish", func(t *testing.T) {
+				activator := &fakeLVActivator{activated: map[string]string{}, err: tc.err}
+				d, _ := newTestNodeDriver(WithLVActivator(activator))
+
+				_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", map[string]string{internal.ActivationModeKey: tc.mode}))
+				assert.Equal(t, tc.code, status.Code(err))
+				if tc.activated != nil {
+					assert.Equal(t, tc.activated, activator.activated)
+				}
+			})
+		})
+	}
+
+	// the device checks and the activation run under the in-flight guard, so they never race another operation
+	t.Run("in_flight_volume_is_not_activated", func(t *testing.T) {
+		activator := &fakeLVActivator{activated: map[string]string{}}
+		d, st := newTestNodeDriver(WithLVActivator(activator))
+		require.True(t, d.inFlight.Insert("pvc-1"))
+
+		_, err := d.NodeStageVolume(ctx, newTestNodeStageVolumeRequest("pvc-1", internal.FSTypeExt4))
+		assert.Equal(t, codes.Aborted, status.Code(err))
+		_, err = d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", map[string]string{internal.ActivationModeKey: internal.ActivationModeLocal}))
+		assert.Equal(t, codes.Aborted, status.Code(err))
+		assert.Empty(t, activator.activated)
+		assert.Empty(t, st.published)
+	})
+}
+
+func TestNodeUnpublishEphemeralVolume(t *testing.T) {
+	ctx := context.Background()
+	newLLV := func() *snc.LVMLogicalVolume {
+		return &snc.LVMLogicalVolume{ObjectMeta: metav1.ObjectMeta{Name: "pvc-1", Finalizers: []string{utils.SDSLocalVolumeCSIFinalizer}}}
+	}
+	llvExists := func(d *Driver) bool {
+		return !kerrors.IsNotFound(d.cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, &snc.LVMLogicalVolume{}))
+	}
+	publishAndUnpublish := func(t *testing.T, d *Driver, volumeContext map[string]string) {
+		_, err := d.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", volumeContext))
+		require.NoError(t, err)
+		_, err = d.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc-1", TargetPath: "/target/pvc-1"})
+		require.NoError(t, err)
+	}
+
+	t.Run("grace_period_is_honored", func(t *testing.T) {
+		d, _ := newTestNodeDriver(WithEphemeralDeleteGracePeriod(300 * time.Millisecond))
+		d.cl = newFakeClient(newLLV())
+
+		publishAndUnpublish(t, d, map[string]string{internal.EphemeralKey: "true"})
+
+		assert.Never(t, func() bool { return !llvExists(d) }, 200*time.Millisecond, 20*time.Millisecond)
+		assert.Eventually(t, func() bool { return !llvExists(d) }, time.Second, 20*time.Millisecond)
+	})
+
+	t.Run("deletion_is_retried_on_transient_failure", func(t *testing.T) {
+		d, _ := newTestNodeDriver()
+		var deletes atomic.Int32
+		d.cl = interceptor.NewClient(newFakeClient(newLLV()), interceptor.Funcs{
+			Delete: func(ctx context.Context, cl client.WithWatch, obj client.Object, opts ...client.DeleteOption) error {
+				if deletes.Add(1) == 1 {
+					return kerrors.NewServiceUnavailable("apiserver is restarting")
+				}
+				return cl.Delete(ctx, obj, opts...)
+			},
+		})
+
+		publishAndUnpublish(t, d, map[string]string{internal.EphemeralKey: "true"})
+
+		assert.Eventually(t, func() bool { return !llvExists(d) }, 2*time.Second, 20*time.Millisecond)
+		assert.Equal(t, int32(2), deletes.Load())
+	})
+
+	t.Run("non_ephemeral_volume_is_kept", func(t *testing.T) {
+		d, _ := newTestNodeDriver()
+		d.cl = newFakeClient(newLLV())
+
+		publishAndUnpublish(t, d, nil)
+
+		assert.Never(t, func() bool { return !llvExists(d) }, 200*time.Millisecond, 20*time.Millisecond)
+	})
+
+	t.Run("shutdown_waits_for_pending_deletion", func(t *testing.T) {
+		d, _ := newTestNodeDriver(WithEphemeralDeleteGracePeriod(100 * time.Millisecond))
+		d.cl = newFakeClient(newLLV())
+
+		publishAndUnpublish(t, d, map[string]string{internal.EphemeralKey: "true"})
+
+		require.NoError(t, d.drainNodeOperations(ctx))
+		assert.False(t, llvExists(d))
+	})
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"sds-local-volume-csi/pkg/logger"
+	"sds-local-volume-csi/pkg/utils"
+)
+
+// registerWhenServed plays the node-driver-registrar and the kubelet: it retries to reach the plugin on the socket
+// until it is served, then records the driver of the node in its CSINode as the kubelet does.
+func registerWhenServed(ctx context.Context, cl client.Client, socket string) error {
+	conn, err := grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// the call waits for the socket, redialing it with backoff
+	info, err := csi.NewIdentityClient(conn).GetPluginInfo(ctx, &csi.GetPluginInfoRequest{}, grpc.WaitForReady(true))
+	if err != nil {
+		return err
+	}
+
+	nodeInfo, err := csi.NewNodeClient(conn).NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	if err != nil {
+		return err
+	}
+
+	return cl.Create(ctx, &storagev1.CSINode{
+		ObjectMeta: metav1.ObjectMeta{Name: nodeInfo.GetNodeId()},
+		Spec: storagev1.CSINodeSpec{Drivers: []storagev1.CSINodeDriver{
+			{Name: info.GetName(), NodeID: nodeInfo.GetNodeId()},
+		}},
+	})
+}
+
+func TestRegistrationWithLateSocket(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the unix socket path is limited to 108 bytes, which t.TempDir may exceed
+	dir, err := os.MkdirTemp("", "csi")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "csi.sock")
+
+	d, _ := newTestNodeDriver()
+	registered := make(chan error, 1)
+	go func() { registered <- registerWhenServed(ctx, d.cl, socket) }()
+
+	waited := make(chan error, 1)
+	go func() {
+		waited <- utils.WaitForDriverRegistration(ctx, d.cl, &logger.Logger{}, d.name, d.hostID, 5*time.Second, 10*time.Millisecond)
+	}()
+
+	// the plugin serves its socket only after the registrar and the wait have started
+	time.Sleep(100 * time.Millisecond)
+	lis, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	d.srv = d.newGRPCServer()
+	go func() { _ = d.srv.Serve(lis) }()
+	t.Cleanup(d.srv.Stop)
+
+	require.NoError(t, <-registered)
+	assert.NoError(t, <-waited)
+
+	csiNode := &storagev1.CSINode{}
+	require.NoError(t, d.cl.Get(ctx, client.ObjectKey{Name: d.hostID}, csiNode))
+	require.Len(t, csiNode.Spec.Drivers, 1)
+	assert.Equal(t, d.name, csiNode.Spec.Drivers[0].Name)
+}
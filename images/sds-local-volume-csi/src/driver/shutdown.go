@@ -0,0 +1,133 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultShutdownTimeout is the default time the plugin waits for the in-flight node operations on shutdown.
+// It is kept below the default termination grace period of the pods.
+const DefaultShutdownTimeout = 25 * time.Second
+
+// drainedNodeMethods are the node plugin methods waited for on shutdown, mapped to whether the new calls are
+// refused once the shutdown starts. The unpublish and unstage calls are still served, so the kubelet can tear down
+// the volumes of the pods evicted by the node drain.
+var drainedNodeMethods = map[string]bool{
+	"/csi.v1.Node/NodeStageVolume":     true,
+	"/csi.v1.Node/NodePublishVolume":   true,
+	"/csi.v1.Node/NodeExpandVolume":    true,
+	"/csi.v1.Node/NodeUnstageVolume":   false,
+	"/csi.v1.Node/NodeUnpublishVolume": false,
+}
+
+// drainInterceptor tracks the in-flight node operations and refuses the new ones with codes.Unavailable
+// once the plugin is shutting down.
+func (d *Driver) drainInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	refused, ok := drainedNodeMethods[info.FullMethod]
+	if !ok {
+		return handler(ctx, req)
+	}
+
+	d.drainMu.Lock()
+	if d.draining && refused {
+		d.drainMu.Unlock()
+		return nil, status.Errorf(codes.Unavailable, "%s is refused: the node plugin is shutting down", info.FullMethod)
+	}
+	d.nodeOpsInFlight++
+	d.drainMu.Unlock()
+	defer d.releaseNodeOperation()
+
+	return handler(ctx, req)
+}
+
+// acquireNodeOperation counts a node operation outliving its call, e.g. the mount left running by a timed out
+// publish, so the shutdown waits for it as well. It is called while the call is still counted, so the drain
+// cannot complete in between.
+func (d *Driver) acquireNodeOperation() {
+	d.drainMu.Lock()
+	defer d.drainMu.Unlock()
+	d.nodeOpsInFlight++
+}
+
+// releaseNodeOperation uncounts a finished node operation and completes the drain once none is left.
+func (d *Driver) releaseNodeOperation() {
+	d.drainMu.Lock()
+	defer d.drainMu.Unlock()
+	d.nodeOpsInFlight--
+	if d.nodeOpsInFlight == 0 && d.drained != nil {
+		close(d.drained)
+		d.drained = nil
+	}
+}
+
+// drainNodeOperations starts refusing the new node operations and waits for the in-flight ones until ctx is done,
+// including the mounts still running after their publish calls timed out and the pending ephemeral volume deletions.
+func (d *Driver) drainNodeOperations(ctx context.Context) error {
+	d.drainMu.Lock()
+	d.draining = true
+	if d.nodeOpsInFlight == 0 {
+		d.drainMu.Unlock()
+		return nil
+	}
+	d.log.Info(fmt.Sprintf("[drainNodeOperations] waiting for %d in-flight node operations", d.nodeOpsInFlight))
+	drained := make(chan struct{})
+	d.drained = drained
+	d.drainMu.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stopGRPCServer drains the node operations and stops the gRPC server gracefully within the shutdown timeout.
+// The server is stopped forcibly, cancelling the calls still running, once the timeout expires.
+func (d *Driver) stopGRPCServer() {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if d.shutdownTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, d.shutdownTimeout)
+	}
+	defer cancel()
+
+	if err := d.drainNodeOperations(ctx); err != nil {
+		d.log.Warning(fmt.Sprintf("[stopGRPCServer] the in-flight node operations did not finish in %s, stopping the server", d.shutdownTimeout))
+		d.srv.Stop()
+		return
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		d.srv.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		d.log.Warning(fmt.Sprintf("[stopGRPCServer] the in-flight calls did not finish in %s, stopping the server", d.shutdownTimeout))
+		d.srv.Stop()
+	}
+}
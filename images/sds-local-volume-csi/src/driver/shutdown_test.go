@@ -0,0 +1,180 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// serveTestNodeDriver serves the gRPC server of the driver in memory and returns the node client connected to it.
+func serveTestNodeDriver(t *testing.T, d *Driver) csi.NodeClient {
+	return csi.NewNodeClient(serveTestDriver(t, d))
+}
+
+// serveTestDriver serves the gRPC server of the driver in memory and returns the connection to it.
+func serveTestDriver(t *testing.T, d *Driver) *grpc.ClientConn {
+	lis := bufconn.Listen(1 << 20)
+	d.srv = d.newGRPCServer()
+	go func() { _ = d.srv.Serve(lis) }()
+	t.Cleanup(d.srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+// blockPublish makes the publish of the target block until the returned func is called.
+func blockPublish(st *fakeStoreManager, target string) (<-chan struct{}, func()) {
+	started, release := make(chan struct{}), make(chan struct{})
+	st.publishHook = func(t string) {
+		if t == target {
+			close(started)
+			<-release
+		}
+	}
+	return started, func() { close(release) }
+}
+
+func (d *Driver) isDraining() bool {
+	d.drainMu.Lock()
+	defer d.drainMu.Unlock()
+	return d.draining
+}
+
+func TestShutdownDrain(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("in_flight_publish_completes_and_new_ones_are_refused", func(t *testing.T) {
+		d, st := newTestNodeDriver()
+		nc := serveTestNodeDriver(t, d)
+		started, release := blockPublish(st, "/target/pvc-1")
+
+		published := make(chan error, 1)
+		go func() {
+			_, err := nc.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+			published <- err
+		}()
+		<-started
+
+		stopped := make(chan struct{})
+		go func() {
+			d.stopGRPCServer()
+			close(stopped)
+		}()
+		require.Eventually(t, d.isDraining, 5*time.Second, 10*time.Millisecond)
+
+		_, err := nc.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-2", nil))
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+		_, err = nc.NodeStageVolume(ctx, newTestNodeStageVolumeRequest("pvc-2", "ext4"))
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+
+		// the kubelet still tears down the volumes of the evicted pods
+		_, err = nc.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc-3", TargetPath: "/target/pvc-3"})
+		assert.NoError(t, err)
+
+		select {
+		case <-stopped:
+			t.Fatal("the server stopped before the in-flight publish finished")
+		default:
+		}
+
+		release()
+		require.NoError(t, <-published)
+		assert.Equal(t, "/dev/vg-1/pvc-1", st.published["/target/pvc-1"])
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the server did not stop after the in-flight publish finished")
+		}
+	})
+
+	t.Run("timed_out_mount_is_waited_for", func(t *testing.T) {
+		d, st := newTestNodeDriver(WithMountTimeout(50 * time.Millisecond))
+		nc := serveTestNodeDriver(t, d)
+		started, release := blockPublish(st, "/target/pvc-1")
+
+		_, err := nc.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+		require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+		<-started
+
+		stopped := make(chan struct{})
+		go func() {
+			d.stopGRPCServer()
+			close(stopped)
+		}()
+		require.Eventually(t, d.isDraining, 5*time.Second, 10*time.Millisecond)
+
+		select {
+		case <-stopped:
+			t.Fatal("the server stopped before the timed out mount finished")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		release()
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the server did not stop after the timed out mount finished")
+		}
+		assert.Equal(t, "/dev/vg-1/pvc-1", st.published["/target/pvc-1"])
+	})
+
+	t.Run("server_is_stopped_once_timeout_expires", func(t *testing.T) {
+		d, st := newTestNodeDriver(WithShutdownTimeout(100 * time.Millisecond))
+		nc := serveTestNodeDriver(t, d)
+		started, release := blockPublish(st, "/target/pvc-1")
+		defer release()
+
+		published := make(chan error, 1)
+		go func() {
+			_, err := nc.NodePublishVolume(ctx, newTestNodePublishVolumeRequest("pvc-1", nil))
+			published <- err
+		}()
+		<-started
+
+		start := time.Now()
+		d.stopGRPCServer()
+		assert.Less(t, time.Since(start), 5*time.Second)
+		assert.Error(t, <-published)
+	})
+
+	t.Run("idle_server_stops_at_once", func(t *testing.T) {
+		d, _ := newTestNodeDriver()
+		serveTestNodeDriver(t, d)
+
+		start := time.Now()
+		d.stopGRPCServer()
+		assert.Less(t, time.Since(start), time.Second)
+		assert.True(t, d.isDraining())
+	})
+}
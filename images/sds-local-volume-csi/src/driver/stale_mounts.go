@@ -0,0 +1,116 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"sds-local-volume-csi/pkg/utils"
+)
+
+const (
+	// StaleMountsReport logs the mounts of the volumes whose LVMLogicalVolumes no longer exist.
+	StaleMountsReport = "report"
+	// StaleMountsUnmount logs and unmounts the mounts of the volumes whose LVMLogicalVolumes no longer exist.
+	StaleMountsUnmount = "unmount"
+)
+
+// ValidateStaleMountsAction checks the action is empty, which disables the scan, or one of the supported values.
+func ValidateStaleMountsAction(action string) error {
+	switch action {
+	case "", StaleMountsReport, StaleMountsUnmount:
+		return nil
+	default:
+		return fmt.Errorf("unsupported stale mounts action %q, expected %q or %q", action, StaleMountsReport, StaleMountsUnmount)
+	}
+}
+
+// scanStaleMounts runs the startup scan for the stale mounts if configured. The scan of the node plugin lacking
+// the permission to list the LVMLogicalVolumes is rejected, as it would never find a stale mount. The other
+// errors are only logged.
+func (d *Driver) scanStaleMounts(ctx context.Context) error {
+	if d.staleMountsAction == "" {
+		return nil
+	}
+
+	_, err := d.reconcileStaleMounts(ctx)
+	if kerrors.IsForbidden(err) {
+		return err
+	}
+	if err != nil {
+		d.log.Warning(fmt.Sprintf("unable to scan for the stale mounts: %v", err))
+	}
+
+	return nil
+}
+
+// reconcileStaleMounts finds the mounts of the driver volumes whose LVMLogicalVolumes no longer exist,
+// e.g. were force-deleted while the node plugin was down, and unmounts them if configured to.
+// The volumes are identified by the volume data the kubelet keeps next to the mount points.
+// The stale mount paths are returned.
+func (d *Driver) reconcileStaleMounts(ctx context.Context) ([]string, error) {
+	mountPoints, err := d.storeManager.ListMountPoints()
+	if err != nil {
+		return nil, err
+	}
+
+	llvs := &v1alpha1.LVMLogicalVolumeList{}
+	if err := d.cl.List(ctx, llvs); err != nil {
+		return nil, fmt.Errorf("unable to list LVMLogicalVolumes: %w", err)
+	}
+	existing := make(map[string]struct{}, len(llvs.Items))
+	for _, llv := range llvs.Items {
+		existing[llv.Name] = struct{}{}
+	}
+
+	var stale []string
+	for _, mountPoint := range mountPoints {
+		data, err := utils.ReadCSIVolumeData(mountPoint)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				d.log.Warning(fmt.Sprintf("[reconcileStaleMounts] Unable to read the volume data of %s: %v", mountPoint, err))
+			}
+			continue
+		}
+		if data.DriverName != d.name {
+			continue
+		}
+		if _, ok := existing[data.VolumeHandle]; ok {
+			continue
+		}
+
+		stale = append(stale, mountPoint)
+		d.log.Warning(fmt.Sprintf("[reconcileStaleMounts] Mount %s of volume %s has no LVMLogicalVolume", mountPoint, data.VolumeHandle))
+
+		if d.staleMountsAction != StaleMountsUnmount {
+			continue
+		}
+		if err := d.storeManager.Unpublish(mountPoint); err != nil {
+			d.log.Error(err, fmt.Sprintf("[reconcileStaleMounts] Unable to unmount %s", mountPoint))
+			continue
+		}
+		d.log.Info(fmt.Sprintf("[reconcileStaleMounts] Stale mount %s of volume %s is unmounted", mountPoint, data.VolumeHandle))
+	}
+
+	return stale, nil
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+// newTestCSIMount creates the kubelet publish directory of the volume with its volume data and returns the mount path.
+func newTestCSIMount(t *testing.T, root, driverName, volumeID string) string {
+	dir := filepath.Join(root, "pods", "pod-"+volumeID, "volumes", "kubernetes.io~csi", volumeID)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "mount"), 0o750))
+	data := fmt.Sprintf(`{"driverName":%q,"volumeHandle":%q,"specVolID":%q}`, driverName, volumeID, volumeID)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "vol_data.json"), []byte(data), 0o600))
+	return filepath.Join(dir, "mount")
+}
+
+func TestReconcileStaleMounts(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name      string
+		action    string
+		unmounted bool
+	}{
+		{name: "stale_mount_is_reported", action: StaleMountsReport},
+		{name: "stale_mount_is_unmounted", action: StaleMountsUnmount, unmounted: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			alive := newTestCSIMount(t, root, DefaultDriverName, "pvc-alive")
+			gone := newTestCSIMount(t, root, DefaultDriverName, "pvc-gone")
+			foreign := newTestCSIMount(t, root, "other.csi.example.com", "pvc-foreign")
+
+			d := newTestDriver(newFakeClient(&snc.LVMLogicalVolume{ObjectMeta: metav1.ObjectMeta{Name: "pvc-alive"}}), WithStaleMountsAction(tc.action))
+			st := newFakeStoreManager()
+			st.mountPoints = []string{"/", alive, gone, foreign, filepath.Join(root, "not-a-csi-mount")}
+			d.storeManager = st
+
+			stale, err := d.reconcileStaleMounts(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []string{gone}, stale)
+
+			if tc.unmounted {
+				assert.Equal(t, []string{gone}, st.unpublished)
+			} else {
+				assert.Empty(t, st.unpublished)
+			}
+		})
+	}
+}
+
+func TestScanStaleMounts(t *testing.T) {
+	ctx := context.Background()
+	newDriver := func(listErr error) *Driver {
+		cl := interceptor.NewClient(newFakeClient(), interceptor.Funcs{
+			List: func(context.Context, client.WithWatch, client.ObjectList, ...client.ListOption) error {
+				return listErr
+			},
+		})
+		d := newTestDriver(cl, WithStaleMountsAction(StaleMountsReport))
+		d.storeManager = newFakeStoreManager()
+		return d
+	}
+
+	t.Run("forbidden_list_is_rejected", func(t *testing.T) {
+		d := newDriver(kerrors.NewForbidden(snc.SchemeGroupVersion.WithResource("lvmlogicalvolumes").GroupResource(), "", errors.New("no RBAC")))
+		assert.ErrorContains(t, d.scanStaleMounts(ctx), "unable to list LVMLogicalVolumes")
+	})
+
+	t.Run("other_errors_are_logged", func(t *testing.T) {
+		d := newDriver(errors.New("connection refused"))
+		assert.NoError(t, d.scanStaleMounts(ctx))
+	})
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+
+	"sds-local-volume-csi/pkg/tracing"
+)
+
+// traceInterceptor wraps every CSI call into a span named after the gRPC method.
+func (d *Driver) traceInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, span := d.tracer.Start(ctx, info.FullMethod, trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	if !span.IsRecording() {
+		return handler(ctx, req)
+	}
+
+	span.SetAttributes(tracing.NodeKey.String(d.hostID))
+	switch r := req.(type) {
+	case interface{ GetVolumeId() string }:
+		span.SetAttributes(tracing.VolumeIDKey.String(r.GetVolumeId()))
+	case interface{ GetName() string }:
+		span.SetAttributes(tracing.VolumeIDKey.String(r.GetName()))
+	}
+
+	resp, err := handler(ctx, req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+
+	return resp, err
+}
+
+// endSpan records the error, if any, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
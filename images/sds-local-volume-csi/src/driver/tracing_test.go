@@ -0,0 +1,92 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"sds-local-volume-csi/internal"
+	"sds-local-volume-csi/pkg/tracing"
+)
+
+func TestTraceInterceptor(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("provision_span_hierarchy", func(t *testing.T) {
+		recorder := tracetest.NewSpanRecorder()
+		cl := newFakeClient(newTestLVG("lvg-1", "node-1", "10Gi"), newTestNode("node-1"))
+		d := newTestDriver(cl, WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))))
+
+		// mark the LVMLogicalVolume as created as soon as it appears
+		go func() {
+			for i := 0; i < 100; i++ {
+				llv := &snc.LVMLogicalVolume{}
+				if err := cl.Get(ctx, client.ObjectKey{Name: "pvc-traced"}, llv); err == nil {
+					llv.Status = &snc.LVMLogicalVolumeStatus{Phase: internal.LLVStatusCreated, ActualSize: resource.MustParse("1Gi")}
+					_ = cl.Update(ctx, llv)
+					return
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		}()
+
+		info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+		_, err := d.traceInterceptor(ctx, newTestCreateVolumeRequest("pvc-traced", 1<<30, "- name: lvg-1\n"), info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return d.CreateVolume(ctx, req.(*csi.CreateVolumeRequest))
+		})
+		require.NoError(t, err)
+
+		spans := recorder.Ended()
+		require.Len(t, spans, 3)
+		root := spans[2]
+		assert.Equal(t, info.FullMethod, root.Name())
+		assert.False(t, root.Parent().IsValid())
+		assert.Contains(t, root.Attributes(), tracing.VolumeIDKey.String("pvc-traced"))
+		assert.Contains(t, root.Attributes(), tracing.LVGKey.String("lvg-1"))
+		assert.Contains(t, root.Attributes(), tracing.NodeKey.String("node-1"))
+
+		assert.Equal(t, "CreateLVMLogicalVolume", spans[0].Name())
+		assert.Equal(t, "WaitForStatusUpdate", spans[1].Name())
+		for _, child := range spans[:2] {
+			assert.Equal(t, root.SpanContext().SpanID(), child.Parent().SpanID())
+			assert.Equal(t, root.SpanContext().TraceID(), child.SpanContext().TraceID())
+		}
+	})
+
+	t.Run("noop_without_tracer_provider", func(t *testing.T) {
+		d := newTestDriver(newFakeClient())
+		called := false
+		_, err := d.traceInterceptor(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc-1"}, &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeUnpublishVolume"}, func(context.Context, interface{}) (interface{}, error) {
+			called = true
+			return nil, nil
+		})
+		require.NoError(t, err)
+		assert.True(t, called)
+	})
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+
+	"sds-local-volume-csi/pkg/utils"
+)
+
+const (
+	// volumeInfoTTL is how long the LVMLogicalVolume read for the volume condition is kept. Its LVM type
+	// and thin pool never change, so it is only refreshed for the thin allocation.
+	volumeInfoTTL = 10 * time.Minute
+	// thinPoolUsageTTL is how long the thin pool usage read from the LVMVolumeGroup status is kept.
+	// The failed reads are kept as long, so the API server is not asked on every NodeGetVolumeStats call.
+	thinPoolUsageTTL = time.Minute
+)
+
+type cachedVolumeInfo struct {
+	llv     *v1alpha1.LVMLogicalVolume
+	err     error
+	expires time.Time
+}
+
+type cachedThinPoolUsage struct {
+	percent int64
+	ok      bool
+	expires time.Time
+}
+
+// volumeConditionCache keeps the LVMLogicalVolumes and the thin pool usage reported by volumeCondition,
+// so the kubelet polling the volume stats does not read them from the API server on every call.
+type volumeConditionCache struct {
+	mu        sync.Mutex
+	volumes   map[string]cachedVolumeInfo
+	thinPools map[string]cachedThinPoolUsage
+}
+
+func newVolumeConditionCache() *volumeConditionCache {
+	return &volumeConditionCache{
+		volumes:   make(map[string]cachedVolumeInfo),
+		thinPools: make(map[string]cachedThinPoolUsage),
+	}
+}
+
+// forget removes the cached LVMLogicalVolume of the volume, e.g. once it is unstaged from the node.
+func (c *volumeConditionCache) forget(volumeID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.volumes, volumeID)
+}
+
+// pruneExpired removes the expired entries. The caller holds mu.
+func (c *volumeConditionCache) pruneExpired(now time.Time) {
+	for id, v := range c.volumes {
+		if now.After(v.expires) {
+			delete(c.volumes, id)
+		}
+	}
+	for key, u := range c.thinPools {
+		if now.After(u.expires) {
+			delete(c.thinPools, key)
+		}
+	}
+}
+
+// volumeLLV returns the LVMLogicalVolume of the volume read at most volumeInfoTTL ago, or the error of reading it
+// at most thinPoolUsageTTL ago.
+func (d *Driver) volumeLLV(ctx context.Context, volumeID string) (*v1alpha1.LVMLogicalVolume, error) {
+	now := time.Now()
+	d.conditionCache.mu.Lock()
+	cached, ok := d.conditionCache.volumes[volumeID]
+	d.conditionCache.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.llv, cached.err
+	}
+
+	llv, err := utils.GetLVMLogicalVolume(ctx, d.cl, volumeID, "")
+	cached = cachedVolumeInfo{llv: llv, err: err, expires: now.Add(volumeInfoTTL)}
+	if err != nil {
+		d.log.Warning(fmt.Sprintf("[NodeGetVolumeStats] Unable to get LVMLogicalVolume %s: %v", volumeID, err))
+		cached = cachedVolumeInfo{err: err, expires: now.Add(thinPoolUsageTTL)}
+	}
+
+	d.conditionCache.mu.Lock()
+	d.conditionCache.pruneExpired(now)
+	d.conditionCache.volumes[volumeID] = cached
+	d.conditionCache.mu.Unlock()
+
+	return cached.llv, cached.err
+}
+
+// thinPoolUsagePercent returns the data usage percent of the thin pool reported in the LVMVolumeGroup status
+// at most thinPoolUsageTTL ago.
+func (d *Driver) thinPoolUsagePercent(ctx context.Context, lvgName, thinPoolName string) (int64, bool) {
+	key := lvgName + "/" + thinPoolName
+	now := time.Now()
+	d.conditionCache.mu.Lock()
+	cached, ok := d.conditionCache.thinPools[key]
+	d.conditionCache.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.percent, cached.ok
+	}
+
+	cached = cachedThinPoolUsage{expires: now.Add(thinPoolUsageTTL)}
+	lvg, err := utils.GetLVMVolumeGroup(ctx, d.cl, lvgName)
+	if err != nil {
+		d.log.Warning(fmt.Sprintf("[NodeGetVolumeStats] Unable to get LVMVolumeGroup %s: %v", lvgName, err))
+	} else {
+		for _, tp := range lvg.Status.ThinPools {
+			if tp.Name == thinPoolName && tp.ActualSize.Value() > 0 {
+				cached.percent, cached.ok = tp.UsedSize.Value()*100/tp.ActualSize.Value(), true
+				break
+			}
+		}
+	}
+
+	d.conditionCache.mu.Lock()
+	d.conditionCache.pruneExpired(now)
+	d.conditionCache.thinPools[key] = cached
+	d.conditionCache.mu.Unlock()
+
+	return cached.percent, cached.ok
+}
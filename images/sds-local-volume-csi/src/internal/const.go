@@ -36,8 +36,160 @@ const (
 	BindingModeI                = "Immediate"
 	ResizeDelta                 = "32Mi"
 
+	ThinPoolSelectionStrategyKey      = "local.csi.storage.deckhouse.io/thin-pool-selection-strategy"
+	ThinPoolSelectionMostFree         = "most-free"
+	ThinPoolSelectionLowestOvercommit = "lowest-overcommit"
+
+	ProvisionTimeoutKey = "lvm.provision/timeout"
+	TrimOnUnpublishKey  = "lvm.thin/trim-on-unpublish"
+
+	// activation mode of the LV applied by the node plugin before using the device
+	ActivationModeKey       = "lvm.activation/mode"
+	ActivationModeLocal     = "local"
+	ActivationModeExclusive = "exclusive"
+
+	// whether the volume is expected to be encrypted at rest. The node plugin refuses to stage
+	// the device whose LUKS header presence contradicts it
+	EncryptionExpectedKey = "lvm.encryption/expected"
+	// blkid type of the LUKS encrypted devices
+	LUKSFormat = "crypto_LUKS"
+
+	// scheduling priority of mkfs formatting a new volume, so it does not starve the running workloads
+	FormatNiceKey           = "lvm.format/nice"
+	FormatIONiceClassKey    = "lvm.format/ionice-class"
+	FormatIONicePriorityKey = "lvm.format/ionice-priority"
+	IONiceClassBestEffort   = "best-effort"
+	IONiceClassIdle         = "idle"
+
+	// free space (a quantity or a percentage of the total) below which CreateVolume warns
+	// about the LVMVolumeGroup or thin pool filling up
+	FreeSpaceSoftThresholdKey = "lvm.capacity/free-space-soft-threshold"
+
 	FSTypeKey = "csi.storage.k8s.io/fstype"
 
+	// comma-separated filesystem types the volumes of the storage class can be formatted with
+	AllowedFSTypesKey = "lvm.fs/allowed-types"
+
+	// IO limits applied to the volume device by the node plugin
+	MaxIOPSKey = "lvm.io/max-iops"
+	MaxBPSKey  = "lvm.io/max-bps"
+
+	// whether the filesystem volumes are mounted with the sync option, so the writes are synchronous
+	MountSyncKey = "lvm.mount/sync"
+
+	// provisioning progress written to the LVMLogicalVolume by CreateVolume
+	ProvisioningConditionsAnnotation          = "local.csi.storage.deckhouse.io/provisioning-conditions"
+	ProvisioningConditionNodeSelected         = "NodeSelected"
+	ProvisioningConditionLVCreationRequested  = "LVCreationRequested"
+	ProvisioningConditionWaitingForActivation = "WaitingForActivation"
+	ProvisioningConditionProvisioned          = "Provisioned"
+
+	// last failed operation of the LVMLogicalVolume, cleared on success
+	LastErrorAnnotation     = "local.csi.storage.deckhouse.io/last-error"
+	LastErrorTimeAnnotation = "local.csi.storage.deckhouse.io/last-error-time"
+	MaxLastErrorLength      = 1024
+
+	// conflicting attempts to remove the finalizer of the LVMLogicalVolume being deleted, cleared once it is removed
+	FinalizerRemovalAttemptsAnnotation     = "local.csi.storage.deckhouse.io/finalizer-removal-attempts"
+	FinalizerRemovalLastConflictAnnotation = "local.csi.storage.deckhouse.io/finalizer-removal-last-conflict"
+
+	// allocation policy of the LV requested by CreateVolume and achieved by the node agent
+	RequestedAllocationPolicyAnnotation = "local.csi.storage.deckhouse.io/requested-allocation-policy"
+	AchievedAllocationPolicyAnnotation  = "local.csi.storage.deckhouse.io/achieved-allocation-policy"
+	AllocationPolicyContiguous          = "contiguous"
+	AllocationPolicyNormal              = "normal"
+	AllocationPolicyFragmented          = "fragmented"
+
+	// placement rationale of CreateVolume recorded on the LVMLogicalVolume and in the volume context of the PV
+	PlacementDecisionAnnotation = "local.csi.storage.deckhouse.io/placement-decision"
+	PlacementDecisionKey        = "lvm.placement/decision"
+	PlacementStrategySource     = "source"
+	PlacementStrategyWFFC       = "wait-for-first-consumer"
+
+	// lineage of the volumes restored from a snapshot or cloned from a volume
+	SourceVolumeLabel   = "local.csi.storage.deckhouse.io/source-volume"
+	SourceSnapshotLabel = "local.csi.storage.deckhouse.io/source-snapshot"
+
+	// LV segment layout reported by ListVolumes
+	LayoutContiguousKey = "lvm.layout/contiguous"
+	LayoutSegmentsKey   = "lvm.layout/segments"
+
+	// metric the node of a new volume is selected by. The inodes metric estimates the inodes the free space of
+	// the LVMVolumeGroups fits from the bytes-per-inode ratio, for the workloads creating many small files
+	SelectionMetricKey    = "lvm.selection/metric"
+	SelectionMetricBytes  = "bytes"
+	SelectionMetricInodes = "inodes"
+	BytesPerInodeKey      = "lvm.selection/bytes-per-inode"
+
+	// policy choosing among the storage class LVMVolumeGroups located on the node selected for a new volume.
+	// The named policy pins the volumes to the first of the comma-separated PinnedLVGsKey LVMVolumeGroups
+	// located on the node
+	SameNodeLVGPolicyKey        = "lvm.selection/same-node-policy"
+	SameNodeLVGPolicyMostFree   = "most-free"
+	SameNodeLVGPolicyNamed      = "named"
+	SameNodeLVGPolicyRoundRobin = "round-robin"
+	PinnedLVGsKey               = "lvm.selection/pinned-lvgs"
+
+	// bytes-per-inode ratio the ext4 filesystem of the volume is formatted with
+	FormatBytesPerInodeKey = "lvm.format/bytes-per-inode"
+
+	// access type the volume was last used with, recorded on the LVMLogicalVolume by the node plugin. The device
+	// of a volume last published as block is not formatted by NodeStageVolume unless FormatOverBlockKey is set,
+	// as the lack of a recognizable filesystem does not mean the device holds no data
+	AccessTypeAnnotation = "local.csi.storage.deckhouse.io/access-type"
+	AccessTypeBlock      = "block"
+	AccessTypeFilesystem = "filesystem"
+	FormatOverBlockKey   = "lvm.format/force-over-block"
+
+	// upper cap of the volume size, checked by CreateVolume and by ControllerExpandVolume, which gets the cap
+	// from the LVMLogicalVolume annotation, as the expansion requests do not carry the storage class parameters
+	MaxVolumeSizeKey        = "lvm.volume/max-size"
+	MaxVolumeSizeAnnotation = "local.csi.storage.deckhouse.io/max-size"
+
+	// provisioned size of the volume in bytes, recorded in the volume context of the PV. The node plugin refuses
+	// the device reporting zero size or a size implausibly smaller than it, e.g. of an LV not activated properly
+	VolumeSizeKey = "lvm.volume/size"
+
+	// whether the thin volumes are fully preallocated in the thin pool instead of allocated lazily on the first write.
+	// The allocation mode actually applied is recorded on the LVMLogicalVolume and in the volume context of the PV
+	ThinPreallocateKey         = "lvm.thin/preallocate"
+	ThinAllocationAnnotation   = "local.csi.storage.deckhouse.io/thin-allocation"
+	ThinAllocationKey          = "lvm.thin/allocation"
+	ThinAllocationLazy         = "lazy"
+	ThinAllocationPreallocated = "preallocated"
+
+	// filesystem freeze of the source volume for the time of CreateSnapshot, requested by the snapshot class.
+	// The controller plugin labels the LVMLogicalVolume with the node of the volume and annotates it with
+	// the request, and the node plugin accepts the request and then answers with the state of the request
+	SnapshotFreezeKey       = "lvm.snapshot/freeze"
+	FreezeNodeLabel         = "local.csi.storage.deckhouse.io/freeze-node"
+	FreezeRequestAnnotation = "local.csi.storage.deckhouse.io/freeze-request"
+	FreezeStateAnnotation   = "local.csi.storage.deckhouse.io/freeze-state"
+	FreezeStateAccepted     = "accepted"
+	FreezeStateFrozen       = "frozen"
+	FreezeStateNotMounted   = "not-mounted"
+	FreezeStateFailed       = "failed"
+
+	// storage classes of the driver the node has an LVMVolumeGroup of, published on the Node by the node plugin.
+	// The label is set per storage class for the node affinity, the annotation lists all of them
+	StorageClassLabelPrefix  = "storageclass.local.csi.storage.deckhouse.io/"
+	StorageClassesAnnotation = "local.csi.storage.deckhouse.io/storage-classes"
+
+	// PVC and PV names passed by the external-provisioner with --extra-create-metadata
+	PVCNameKey      = "csi.storage.k8s.io/pvc/name"
+	PVCNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+	PVNameKey       = "csi.storage.k8s.io/pv/name"
+
+	// pod the volume is published for, passed by the kubelet in the volume context if the CSIDriver has podInfoOnMount
+	PodNameKey           = "csi.storage.k8s.io/pod.name"
+	PodNamespaceKey      = "csi.storage.k8s.io/pod.namespace"
+	PodServiceAccountKey = "csi.storage.k8s.io/serviceAccount.name"
+	// EphemeralKey is set to "true" by the kubelet in the volume context of a CSI ephemeral inline volume
+	EphemeralKey = "csi.storage.k8s.io/ephemeral"
+
+	// name of the LV on the node when it differs from the volume ID
+	LVNameKey = "local.csi.storage.deckhouse.io/lv-name"
+
 	// supported filesystem types
 	FSTypeExt4 = "ext4"
 	FSTypeXfs  = "xfs"
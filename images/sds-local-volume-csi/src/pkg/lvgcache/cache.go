@@ -0,0 +1,155 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvgcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	crcache "sigs.k8s.io/controller-runtime/pkg/cache"
+
+	"sds-local-volume-csi/pkg/logger"
+)
+
+// ErrNotSynced is returned by ListLVGs until the initial list of the LVMVolumeGroups is received.
+var ErrNotSynced = errors.New("LVMVolumeGroup cache is not synced yet")
+
+// Cache holds the LVMVolumeGroups received from an informer. It is fed by the informer events
+// and fully refreshed by the informer resync, which bounds the lag of a missed update.
+type Cache struct {
+	log *logger.Logger
+
+	mu        sync.RWMutex
+	lvgs      map[string]*snc.LVMVolumeGroup
+	hasSynced func() bool
+}
+
+func New(log *logger.Logger) *Cache {
+	return &Cache{
+		log:  log,
+		lvgs: make(map[string]*snc.LVMVolumeGroup),
+	}
+}
+
+// Start runs an LVMVolumeGroup informer resynced every resyncPeriod feeding a new Cache.
+// It returns once the cache is synced.
+func Start(ctx context.Context, cfg *rest.Config, scheme *runtime.Scheme, resyncPeriod time.Duration, log *logger.Logger) (*Cache, error) {
+	informers, err := crcache.New(cfg, crcache.Options{Scheme: scheme, SyncPeriod: &resyncPeriod})
+	if err != nil {
+		return nil, fmt.Errorf("[lvgcache.Start] unable to create the informer cache: %w", err)
+	}
+
+	informer, err := informers.GetInformer(ctx, &snc.LVMVolumeGroup{})
+	if err != nil {
+		return nil, fmt.Errorf("[lvgcache.Start] unable to get the LVMVolumeGroup informer: %w", err)
+	}
+
+	c := New(log)
+	registration, err := informer.AddEventHandlerWithResyncPeriod(c, resyncPeriod)
+	if err != nil {
+		return nil, fmt.Errorf("[lvgcache.Start] unable to add the event handler: %w", err)
+	}
+	c.SetHasSynced(registration.HasSynced)
+
+	go func() {
+		if err := informers.Start(ctx); err != nil {
+			log.Error(err, "[lvgcache.Start] informer cache stopped")
+		}
+	}()
+
+	if !toolscache.WaitForCacheSync(ctx.Done(), registration.HasSynced) {
+		return nil, fmt.Errorf("[lvgcache.Start] %w", ErrNotSynced)
+	}
+
+	return c, nil
+}
+
+// SetHasSynced sets the function reporting whether the initial list of the LVMVolumeGroups is received.
+func (c *Cache) SetHasSynced(hasSynced func() bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hasSynced = hasSynced
+}
+
+func (c *Cache) OnAdd(obj interface{}, _ bool) {
+	c.set(obj)
+}
+
+func (c *Cache) OnUpdate(_, newObj interface{}) {
+	c.set(newObj)
+}
+
+func (c *Cache) OnDelete(obj interface{}) {
+	if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	lvg, ok := obj.(*snc.LVMVolumeGroup)
+	if !ok {
+		c.log.Warning(fmt.Sprintf("[lvgcache.OnDelete] unexpected object %T", obj))
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.lvgs, lvg.Name)
+}
+
+func (c *Cache) set(obj interface{}) {
+	lvg, ok := obj.(*snc.LVMVolumeGroup)
+	if !ok {
+		c.log.Warning(fmt.Sprintf("[lvgcache.set] unexpected object %T", obj))
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lvgs[lvg.Name] = lvg.DeepCopy()
+}
+
+// RefreshLVG replaces the cached LVMVolumeGroup with the given one read from the API server, e.g. once a volume
+// creation ran out of the space the cached status still shows. The informer events overwrite it as usual.
+func (c *Cache) RefreshLVG(lvg *snc.LVMVolumeGroup) {
+	c.set(lvg)
+}
+
+// ListLVGs returns a snapshot of the cached LVMVolumeGroups sorted by name. The snapshot is a copy,
+// so a single volume placement decision is not affected by the events received while it is made.
+func (c *Cache) ListLVGs(_ context.Context) ([]snc.LVMVolumeGroup, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.hasSynced != nil && !c.hasSynced() {
+		return nil, ErrNotSynced
+	}
+
+	lvgs := make([]snc.LVMVolumeGroup, 0, len(c.lvgs))
+	for _, lvg := range c.lvgs {
+		lvgs = append(lvgs, *lvg.DeepCopy())
+	}
+	sort.Slice(lvgs, func(i, j int) bool { return lvgs[i].Name < lvgs[j].Name })
+
+	return lvgs, nil
+}
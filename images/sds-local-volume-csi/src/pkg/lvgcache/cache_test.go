@@ -0,0 +1,119 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvgcache
+
+import (
+	"context"
+	"testing"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+
+	"sds-local-volume-csi/internal"
+	"sds-local-volume-csi/pkg/logger"
+	"sds-local-volume-csi/pkg/utils"
+)
+
+func newLVG(name, nodeName, vgFree string) *snc.LVMVolumeGroup {
+	return &snc.LVMVolumeGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       snc.LVMVolumeGroupSpec{Local: snc.LVMVolumeGroupLocalSpec{NodeName: nodeName}},
+		Status: snc.LVMVolumeGroupStatus{
+			Nodes:  []snc.LVMVolumeGroupNode{{Name: nodeName}},
+			VGFree: resource.MustParse(vgFree),
+		},
+	}
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	log := &logger.Logger{}
+
+	selectNode := func(t *testing.T, c *Cache) string {
+		lvgs, params, err := utils.GetStorageClassLVGsAndParameters(ctx, c, log, "- name: lvg-1\n- name: lvg-2\n")
+		require.NoError(t, err)
+		nodeName, _, err := utils.GetNodeWithMaxFreeSpace(lvgs, params, internal.LVMTypeThick)
+		require.NoError(t, err)
+		return nodeName
+	}
+
+	t.Run("events_are_reflected_in_selection", func(t *testing.T) {
+		c := New(log)
+
+		c.OnAdd(newLVG("lvg-1", "node-1", "10Gi"), true)
+		c.OnAdd(newLVG("lvg-2", "node-2", "5Gi"), true)
+		c.OnAdd(newLVG("lvg-other", "node-3", "100Gi"), true)
+		assert.Equal(t, "node-1", selectNode(t, c))
+
+		c.OnUpdate(newLVG("lvg-1", "node-1", "10Gi"), newLVG("lvg-1", "node-1", "1Gi"))
+		assert.Equal(t, "node-2", selectNode(t, c))
+
+		c.OnDelete(newLVG("lvg-2", "node-2", "5Gi"))
+		assert.Equal(t, "node-1", selectNode(t, c))
+
+		c.OnAdd(newLVG("lvg-2", "node-2", "5Gi"), false)
+		c.OnDelete(toolscache.DeletedFinalStateUnknown{Key: "lvg-2", Obj: newLVG("lvg-2", "node-2", "5Gi")})
+		lvgs, err := c.ListLVGs(ctx)
+		require.NoError(t, err)
+		require.Len(t, lvgs, 2)
+		assert.Equal(t, "lvg-1", lvgs[0].Name)
+		assert.Equal(t, "lvg-other", lvgs[1].Name)
+	})
+
+	t.Run("refreshed_lvg_is_reflected_in_selection", func(t *testing.T) {
+		c := New(log)
+		c.OnAdd(newLVG("lvg-1", "node-1", "10Gi"), true)
+		c.OnAdd(newLVG("lvg-2", "node-2", "5Gi"), true)
+		assert.Equal(t, "node-1", selectNode(t, c))
+
+		c.RefreshLVG(newLVG("lvg-1", "node-1", "1Gi"))
+		assert.Equal(t, "node-2", selectNode(t, c))
+	})
+
+	t.Run("snapshot_is_not_affected_by_later_events", func(t *testing.T) {
+		c := New(log)
+		c.OnAdd(newLVG("lvg-1", "node-1", "10Gi"), true)
+
+		snapshot, err := c.ListLVGs(ctx)
+		require.NoError(t, err)
+
+		c.OnUpdate(nil, newLVG("lvg-1", "node-1", "1Gi"))
+		snapshot[0].Status.VGFree = resource.MustParse("2Gi")
+
+		lvgs, err := c.ListLVGs(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "1Gi", lvgs[0].Status.VGFree.String())
+		assert.Equal(t, "2Gi", snapshot[0].Status.VGFree.String())
+	})
+
+	t.Run("not_synced_cache_is_not_used", func(t *testing.T) {
+		c := New(log)
+		synced := false
+		c.SetHasSynced(func() bool { return synced })
+
+		_, err := c.ListLVGs(ctx)
+		assert.ErrorIs(t, err, ErrNotSynced)
+
+		synced = true
+		_, err = c.ListLVGs(ctx)
+		assert.NoError(t, err)
+	})
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"sds-local-volume-csi/pkg/utils"
+)
+
+const capacityListTimeout = 10 * time.Second
+
+var (
+	lvgLabels      = []string{"node", "lvg"}
+	thinPoolLabels = []string{"node", "lvg", "thin_pool"}
+
+	lvgSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "lvg", "size_bytes"),
+		"Total size of the LVMVolumeGroup.", lvgLabels, nil)
+	lvgFreeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "lvg", "free_bytes"),
+		"Free space of the LVMVolumeGroup.", lvgLabels, nil)
+	lvgAllocatedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "lvg", "allocated_bytes"),
+		"Allocated space of the LVMVolumeGroup.", lvgLabels, nil)
+	thinPoolSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "thin_pool", "size_bytes"),
+		"Total size of the LVMVolumeGroup thin pool.", thinPoolLabels, nil)
+	thinPoolAvailableDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "thin_pool", "available_bytes"),
+		"Available space of the LVMVolumeGroup thin pool.", thinPoolLabels, nil)
+)
+
+// CapacityCollector reports the capacity of every LVMVolumeGroup and its thin pools.
+// The LVMVolumeGroups are listed once per scrape.
+type CapacityCollector struct {
+	cl client.Client
+}
+
+func NewCapacityCollector(cl client.Client) *CapacityCollector {
+	return &CapacityCollector{cl: cl}
+}
+
+func (c *CapacityCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lvgSizeDesc
+	ch <- lvgFreeDesc
+	ch <- lvgAllocatedDesc
+	ch <- thinPoolSizeDesc
+	ch <- thinPoolAvailableDesc
+}
+
+func (c *CapacityCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), capacityListTimeout)
+	defer cancel()
+
+	lvgs, err := utils.GetLVGList(ctx, c.cl)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(lvgSizeDesc, err)
+		return
+	}
+
+	for _, lvg := range lvgs.Items {
+		node := lvg.Spec.Local.NodeName
+		ch <- prometheus.MustNewConstMetric(lvgSizeDesc, prometheus.GaugeValue, float64(lvg.Status.VGSize.Value()), node, lvg.Name)
+		ch <- prometheus.MustNewConstMetric(lvgFreeDesc, prometheus.GaugeValue, float64(lvg.Status.VGFree.Value()), node, lvg.Name)
+		ch <- prometheus.MustNewConstMetric(lvgAllocatedDesc, prometheus.GaugeValue, float64(lvg.Status.AllocatedSize.Value()), node, lvg.Name)
+
+		for _, tp := range lvg.Status.ThinPools {
+			ch <- prometheus.MustNewConstMetric(thinPoolSizeDesc, prometheus.GaugeValue, float64(tp.ActualSize.Value()), node, lvg.Name, tp.Name)
+			ch <- prometheus.MustNewConstMetric(thinPoolAvailableDesc, prometheus.GaugeValue, float64(tp.AvailableSpace.Value()), node, lvg.Name, tp.Name)
+		}
+	}
+}
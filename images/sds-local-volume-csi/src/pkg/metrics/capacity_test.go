@@ -0,0 +1,83 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestCapacityCollector(t *testing.T) {
+	s := runtime.NewScheme()
+	require.NoError(t, snc.AddToScheme(s))
+
+	thick := &snc.LVMVolumeGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: "lvg-1"},
+		Spec:       snc.LVMVolumeGroupSpec{Local: snc.LVMVolumeGroupLocalSpec{NodeName: "node-1"}},
+		Status: snc.LVMVolumeGroupStatus{
+			VGSize:        resource.MustParse("10Gi"),
+			VGFree:        resource.MustParse("4Gi"),
+			AllocatedSize: resource.MustParse("6Gi"),
+		},
+	}
+	thin := &snc.LVMVolumeGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: "lvg-2"},
+		Spec:       snc.LVMVolumeGroupSpec{Local: snc.LVMVolumeGroupLocalSpec{NodeName: "node-2"}},
+		Status: snc.LVMVolumeGroupStatus{
+			VGSize:        resource.MustParse("20Gi"),
+			VGFree:        resource.MustParse("0"),
+			AllocatedSize: resource.MustParse("20Gi"),
+			ThinPools: []snc.LVMVolumeGroupThinPoolStatus{{
+				Name:           "pool-1",
+				ActualSize:     resource.MustParse("20Gi"),
+				AvailableSpace: resource.MustParse("8Gi"),
+			}},
+		},
+	}
+	cl := fake.NewClientBuilder().WithScheme(s).WithObjects(thick, thin).Build()
+
+	expected := `
+# HELP sds_local_volume_csi_lvg_allocated_bytes Allocated space of the LVMVolumeGroup.
+# TYPE sds_local_volume_csi_lvg_allocated_bytes gauge
+sds_local_volume_csi_lvg_allocated_bytes{lvg="lvg-1",node="node-1"} 6.442450944e+09
+sds_local_volume_csi_lvg_allocated_bytes{lvg="lvg-2",node="node-2"} 2.147483648e+10
+# HELP sds_local_volume_csi_lvg_free_bytes Free space of the LVMVolumeGroup.
+# TYPE sds_local_volume_csi_lvg_free_bytes gauge
+sds_local_volume_csi_lvg_free_bytes{lvg="lvg-1",node="node-1"} 4.294967296e+09
+sds_local_volume_csi_lvg_free_bytes{lvg="lvg-2",node="node-2"} 0
+# HELP sds_local_volume_csi_lvg_size_bytes Total size of the LVMVolumeGroup.
+# TYPE sds_local_volume_csi_lvg_size_bytes gauge
+sds_local_volume_csi_lvg_size_bytes{lvg="lvg-1",node="node-1"} 1.073741824e+10
+sds_local_volume_csi_lvg_size_bytes{lvg="lvg-2",node="node-2"} 2.147483648e+10
+# HELP sds_local_volume_csi_thin_pool_available_bytes Available space of the LVMVolumeGroup thin pool.
+# TYPE sds_local_volume_csi_thin_pool_available_bytes gauge
+sds_local_volume_csi_thin_pool_available_bytes{lvg="lvg-2",node="node-2",thin_pool="pool-1"} 8.589934592e+09
+# HELP sds_local_volume_csi_thin_pool_size_bytes Total size of the LVMVolumeGroup thin pool.
+# TYPE sds_local_volume_csi_thin_pool_size_bytes gauge
+sds_local_volume_csi_thin_pool_size_bytes{lvg="lvg-2",node="node-2",thin_pool="pool-1"} 2.147483648e+10
+`
+	assert.NoError(t, testutil.CollectAndCompare(NewCapacityCollector(cl), strings.NewReader(expected)))
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "sds_local_volume_csi"
+
+// Metrics holds the metrics exposed by the CSI driver.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	erroredLLVsMu sync.Mutex
+	erroredLLVs   map[string]struct{}
+	erroredLLVsG  prometheus.Gauge
+
+	freeSpaceBelowThreshold *prometheus.GaugeVec
+
+	allocationPolicyDivergences *prometheus.CounterVec
+
+	nodeOperations        *prometheus.CounterVec
+	nodeOperationDuration *prometheus.HistogramVec
+
+	mountedVolumesMu sync.Mutex
+	mountedVolumes   map[string]struct{}
+	mountedVolumesG  prometheus.Gauge
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry:       prometheus.NewRegistry(),
+		erroredLLVs:    make(map[string]struct{}),
+		mountedVolumes: make(map[string]struct{}),
+		erroredLLVsG: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "errored_llvs",
+			Help:      "Number of LVMLogicalVolumes whose last operation failed.",
+		}),
+		freeSpaceBelowThreshold: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "free_space_below_soft_threshold",
+			Help:      "Whether the free space of the LVMVolumeGroup or thin pool was below the storage class soft threshold after the last provision.",
+		}, []string{"node", "lvg", "thin_pool"}),
+		allocationPolicyDivergences: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "allocation_policy_divergences_total",
+			Help:      "Number of the provisioned LVMLogicalVolumes whose achieved allocation policy differs from the requested one.",
+		}, []string{"lvg"}),
+		nodeOperations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "node_operations_total",
+			Help:      "Number of the stage, unstage, publish and unpublish operations of the node plugin.",
+		}, []string{"operation", "result", "fs_type"}),
+		nodeOperationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "node_operation_duration_seconds",
+			Help:      "Duration of the stage, unstage, publish and unpublish operations of the node plugin.",
+			Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+		}, []string{"operation", "result", "fs_type"}),
+		mountedVolumesG: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "node_mounted_volumes",
+			Help:      "Number of the volumes published by the node plugin since it started and not unpublished yet.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.erroredLLVsG,
+		m.freeSpaceBelowThreshold,
+		m.allocationPolicyDivergences,
+		m.nodeOperations,
+		m.nodeOperationDuration,
+		m.mountedVolumesG,
+	)
+
+	return m
+}
+
+// Handler returns the HTTP handler serving the metrics.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Registry returns the registry the metrics are registered in.
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// SetLLVErrored marks the LVMLogicalVolume as errored or not.
+func (m *Metrics) SetLLVErrored(llvName string, errored bool) {
+	m.erroredLLVsMu.Lock()
+	defer m.erroredLLVsMu.Unlock()
+
+	if errored {
+		m.erroredLLVs[llvName] = struct{}{}
+	} else {
+		delete(m.erroredLLVs, llvName)
+	}
+	m.erroredLLVsG.Set(float64(len(m.erroredLLVs)))
+}
+
+// SetFreeSpaceBelowThreshold records whether the free space of the LVMVolumeGroup or its thin pool
+// is below the soft threshold. The thin pool is empty for the thick volumes.
+func (m *Metrics) SetFreeSpaceBelowThreshold(node, lvg, thinPool string, below bool) {
+	v := 0.0
+	if below {
+		v = 1
+	}
+	m.freeSpaceBelowThreshold.WithLabelValues(node, lvg, thinPool).Set(v)
+}
+
+// IncAllocationPolicyDivergences counts a volume of the LVMVolumeGroup provisioned with an allocation policy
+// other than the requested one.
+func (m *Metrics) IncAllocationPolicyDivergences(lvg string) {
+	m.allocationPolicyDivergences.WithLabelValues(lvg).Inc()
+}
+
+// ObserveNodeOperation counts the node plugin operation and records its duration. The result is the gRPC code
+// of the operation, and the filesystem type is empty for the operations not given the volume capability.
+func (m *Metrics) ObserveNodeOperation(operation, result, fsType string, duration time.Duration) {
+	m.nodeOperations.WithLabelValues(operation, result, fsType).Inc()
+	m.nodeOperationDuration.WithLabelValues(operation, result, fsType).Observe(duration.Seconds())
+}
+
+// SetVolumeMounted marks the volume published at the target path as mounted or not.
+func (m *Metrics) SetVolumeMounted(target string, mounted bool) {
+	m.mountedVolumesMu.Lock()
+	defer m.mountedVolumesMu.Unlock()
+
+	if mounted {
+		m.mountedVolumes[target] = struct{}{}
+	} else {
+		delete(m.mountedVolumes, target)
+	}
+	m.mountedVolumesG.Set(float64(len(m.mountedVolumes)))
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"sds-local-volume-csi/internal"
+)
+
+// GetFormatOverBlock returns whether the storage class allows formatting the device of a volume last published
+// as block that has no recognizable filesystem.
+func GetFormatOverBlock(params map[string]string) (bool, error) {
+	val, ok := params[internal.FormatOverBlockKey]
+	if !ok || val == "" {
+		return false, nil
+	}
+
+	force, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("invalid value %q of %s: %w", val, internal.FormatOverBlockKey, err)
+	}
+
+	return force, nil
+}
+
+// SetLLVAccessType records the access type the volume is used with on the LVMLogicalVolume.
+func SetLLVAccessType(ctx context.Context, kc client.Client, llv *snc.LVMLogicalVolume, accessType string) error {
+	if llv.Annotations[internal.AccessTypeAnnotation] == accessType {
+		return nil
+	}
+
+	patch := client.MergeFrom(llv.DeepCopy())
+	if llv.Annotations == nil {
+		llv.Annotations = make(map[string]string, 1)
+	}
+	llv.Annotations[internal.AccessTypeAnnotation] = accessType
+
+	return kc.Patch(ctx, llv, patch)
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"sds-local-volume-csi/pkg/logger"
+)
+
+// BatchDeleteFailure is an LVMLogicalVolume BatchDeleteLVMLogicalVolumes failed to delete.
+type BatchDeleteFailure struct {
+	Name string
+	Err  error
+}
+
+// BatchDeleteError reports the partial result of BatchDeleteLVMLogicalVolumes.
+// Its Unwrap returns the error of every failure and the context error if the batch was interrupted.
+type BatchDeleteError struct {
+	Deleted []string
+	Failed  []BatchDeleteFailure
+	// Skipped are the LVMLogicalVolumes not processed because the context was done.
+	Skipped []string
+	// ContextErr is the error of the context interrupting the batch.
+	ContextErr error
+}
+
+func (e *BatchDeleteError) Error() string {
+	total := len(e.Deleted) + len(e.Failed) + len(e.Skipped)
+	msg := fmt.Sprintf("deleted %d of %d LVMLogicalVolumes", len(e.Deleted), total)
+
+	if len(e.Failed) > 0 {
+		failures := make([]string, 0, len(e.Failed))
+		for _, f := range e.Failed {
+			failures = append(failures, fmt.Sprintf("%s: %v", f.Name, f.Err))
+		}
+		msg += "; failed: " + strings.Join(failures, ", ")
+	}
+
+	if len(e.Skipped) > 0 {
+		msg += fmt.Sprintf("; skipped after %v: %s", e.ContextErr, strings.Join(e.Skipped, ", "))
+	}
+
+	return msg
+}
+
+func (e *BatchDeleteError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failed)+1)
+	for _, f := range e.Failed {
+		errs = append(errs, f.Err)
+	}
+	if e.ContextErr != nil {
+		errs = append(errs, e.ContextErr)
+	}
+
+	return errs
+}
+
+// BatchDeleteLVMLogicalVolumes removes the finalizer from the LVMLogicalVolumes and deletes them one by one.
+// A failure does not stop the batch, while the context being done does. The names of the deleted
+// LVMLogicalVolumes are returned along with a *BatchDeleteError if any of them was not deleted.
+func BatchDeleteLVMLogicalVolumes(ctx context.Context, kc client.Client, log *logger.Logger, traceID string, names []string, finalizer string) ([]string, error) {
+	result := &BatchDeleteError{}
+	for i, name := range names {
+		if err := ctx.Err(); err != nil {
+			log.Warning(fmt.Sprintf("[BatchDeleteLVMLogicalVolumes][traceID:%s] context done. Skip %d LVMLogicalVolumes", traceID, len(names)-i))
+			result.Skipped = names[i:]
+			result.ContextErr = err
+			break
+		}
+
+		if err := DeleteLVMLogicalVolume(ctx, kc, log, traceID, name, finalizer); err != nil {
+			log.Error(err, fmt.Sprintf("[BatchDeleteLVMLogicalVolumes][traceID:%s][volumeID:%s] unable to delete LVMLogicalVolume", traceID, name))
+			result.Failed = append(result.Failed, BatchDeleteFailure{Name: name, Err: err})
+			continue
+		}
+
+		result.Deleted = append(result.Deleted, name)
+	}
+
+	if len(result.Failed) == 0 && len(result.Skipped) == 0 {
+		return result.Deleted, nil
+	}
+
+	return result.Deleted, result
+}
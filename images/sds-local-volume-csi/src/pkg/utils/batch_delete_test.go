@@ -0,0 +1,108 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	"sds-local-volume-csi/pkg/logger"
+)
+
+func TestBatchDeleteLVMLogicalVolumes(t *testing.T) {
+	errDeleteDenied := errors.New("delete denied")
+
+	// newClient returns a client with the LLVs failing to delete the denied one and calling onDelete on each deletion
+	newClient := func(t *testing.T, denied string, onDelete func()) client.Client {
+		s := runtime.NewScheme()
+		require.NoError(t, snc.AddToScheme(s))
+
+		var objs []client.Object
+		for _, name := range []string{"pvc-1", "pvc-2", "pvc-3"} {
+			objs = append(objs, &snc.LVMLogicalVolume{ObjectMeta: metav1.ObjectMeta{Name: name, Finalizers: []string{SDSLocalVolumeCSIFinalizer}}})
+		}
+
+		return fake.NewClientBuilder().WithScheme(s).WithObjects(objs...).WithInterceptorFuncs(interceptor.Funcs{
+			Delete: func(ctx context.Context, cl client.WithWatch, obj client.Object, opts ...client.DeleteOption) error {
+				if obj.GetName() == denied {
+					return errDeleteDenied
+				}
+				if onDelete != nil {
+					onDelete()
+				}
+				return cl.Delete(ctx, obj, opts...)
+			},
+		}).Build()
+	}
+
+	t.Run("all_deleted", func(t *testing.T) {
+		cl := newClient(t, "", nil)
+
+		deleted, err := BatchDeleteLVMLogicalVolumes(context.Background(), cl, &logger.Logger{}, "trace", []string{"pvc-1", "pvc-2"}, SDSLocalVolumeCSIFinalizer)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"pvc-1", "pvc-2"}, deleted)
+	})
+
+	t.Run("partial_failure", func(t *testing.T) {
+		cl := newClient(t, "pvc-2", nil)
+
+		deleted, err := BatchDeleteLVMLogicalVolumes(context.Background(), cl, &logger.Logger{}, "trace", []string{"pvc-1", "pvc-2", "pvc-missing", "pvc-3"}, SDSLocalVolumeCSIFinalizer)
+		assert.Equal(t, []string{"pvc-1", "pvc-3"}, deleted)
+
+		var batchErr *BatchDeleteError
+		require.ErrorAs(t, err, &batchErr)
+		assert.Equal(t, []string{"pvc-1", "pvc-3"}, batchErr.Deleted)
+		require.Len(t, batchErr.Failed, 2)
+		assert.Equal(t, "pvc-2", batchErr.Failed[0].Name)
+		assert.ErrorIs(t, batchErr.Failed[0].Err, errDeleteDenied)
+		assert.Equal(t, "pvc-missing", batchErr.Failed[1].Name)
+		assert.True(t, kerrors.IsNotFound(errors.Unwrap(batchErr.Failed[1].Err)))
+		assert.Empty(t, batchErr.Skipped)
+
+		assert.ErrorIs(t, err, errDeleteDenied)
+		assert.ErrorContains(t, err, "deleted 2 of 4 LVMLogicalVolumes; failed: pvc-2: delete denied, pvc-missing: get LVMLogicalVolume pvc-missing")
+	})
+
+	t.Run("cancellation_stops_processing", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cl := newClient(t, "", cancel)
+
+		deleted, err := BatchDeleteLVMLogicalVolumes(ctx, cl, &logger.Logger{}, "trace", []string{"pvc-1", "pvc-2", "pvc-3"}, SDSLocalVolumeCSIFinalizer)
+		assert.Equal(t, []string{"pvc-1"}, deleted)
+
+		var batchErr *BatchDeleteError
+		require.ErrorAs(t, err, &batchErr)
+		assert.Equal(t, []string{"pvc-2", "pvc-3"}, batchErr.Skipped)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.ErrorContains(t, err, "deleted 1 of 3 LVMLogicalVolumes; skipped after context canceled: pvc-2, pvc-3")
+
+		llv := &snc.LVMLogicalVolume{}
+		assert.NoError(t, cl.Get(context.Background(), client.ObjectKey{Name: "pvc-2"}, llv))
+	})
+}
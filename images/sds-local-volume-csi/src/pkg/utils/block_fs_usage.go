@@ -0,0 +1,160 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	utilexec "k8s.io/utils/exec"
+
+	"sds-local-volume-csi/internal"
+)
+
+// ErrNoFilesystem is returned by the BlockFSProber for the devices without a recognizable filesystem.
+var ErrNoFilesystem = errors.New("no recognizable filesystem")
+
+// BlockFSUsage is the usage of the filesystem found inside a block volume.
+type BlockFSUsage struct {
+	FSType         string
+	TotalBytes     int64
+	UsedBytes      int64
+	AvailableBytes int64
+}
+
+// BlockFSProber reads the usage of the filesystem a workload keeps inside its raw block volume.
+type BlockFSProber interface {
+	// ProbeFSUsage returns ErrNoFilesystem if the device has no filesystem it can read the usage of.
+	ProbeFSUsage(devicePath string) (BlockFSUsage, error)
+}
+
+// SuperblockFSProber reads the usage from the superblock of the ext and xfs filesystems without mounting them.
+// The free space counters in the superblock of a filesystem mounted by the workload are only updated
+// periodically, so the usage is approximate.
+type SuperblockFSProber struct {
+	Exec utilexec.Interface
+}
+
+func NewSuperblockFSProber() *SuperblockFSProber {
+	return &SuperblockFSProber{Exec: utilexec.New()}
+}
+
+func (p *SuperblockFSProber) ProbeFSUsage(devicePath string) (BlockFSUsage, error) {
+	fsType, err := p.fsType(devicePath)
+	if err != nil {
+		return BlockFSUsage{}, err
+	}
+
+	switch fsType {
+	case "ext2", "ext3", internal.FSTypeExt4:
+		return p.extUsage(devicePath, fsType)
+	case internal.FSTypeXfs:
+		return p.xfsUsage(devicePath)
+	default:
+		return BlockFSUsage{}, fmt.Errorf("[ProbeFSUsage] %w on %s: unsupported type %q", ErrNoFilesystem, devicePath, fsType)
+	}
+}
+
+// fsType probes the device for a filesystem signature, bypassing the blkid cache.
+func (p *SuperblockFSProber) fsType(devicePath string) (string, error) {
+	out, err := p.Exec.Command("blkid", "-p", "-s", "TYPE", "-o", "value", devicePath).CombinedOutput()
+	if err != nil {
+		// blkid exits with 2 if no signature is found
+		var exitErr utilexec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitStatus() == 2 {
+			return "", fmt.Errorf("[ProbeFSUsage] %w on %s", ErrNoFilesystem, devicePath)
+		}
+		return "", fmt.Errorf("[ProbeFSUsage] blkid %s failed: %w, output: %s", devicePath, err, string(out))
+	}
+
+	fsType := strings.TrimSpace(string(out))
+	if fsType == "" {
+		return "", fmt.Errorf("[ProbeFSUsage] %w on %s", ErrNoFilesystem, devicePath)
+	}
+	return fsType, nil
+}
+
+func (p *SuperblockFSProber) extUsage(devicePath, fsType string) (BlockFSUsage, error) {
+	out, err := p.Exec.Command("dumpe2fs", "-h", devicePath).CombinedOutput()
+	if err != nil {
+		return BlockFSUsage{}, fmt.Errorf("[ProbeFSUsage] dumpe2fs %s failed: %w, output: %s", devicePath, err, string(out))
+	}
+
+	fields, err := parseSuperblockFields(string(out), ":", "Block count", "Free blocks", "Reserved block count", "Block size")
+	if err != nil {
+		return BlockFSUsage{}, fmt.Errorf("[ProbeFSUsage] unable to parse the superblock of %s: %w", devicePath, err)
+	}
+
+	blockSize := fields["Block size"]
+	total, free, reserved := fields["Block count"], fields["Free blocks"], fields["Reserved block count"]
+	return BlockFSUsage{
+		FSType:         fsType,
+		TotalBytes:     total * blockSize,
+		UsedBytes:      (total - free) * blockSize,
+		AvailableBytes: max(free-reserved, 0) * blockSize,
+	}, nil
+}
+
+func (p *SuperblockFSProber) xfsUsage(devicePath string) (BlockFSUsage, error) {
+	out, err := p.Exec.Command("xfs_db", "-r", "-c", "sb 0", "-c", "print dblocks fdblocks blocksize", devicePath).CombinedOutput()
+	if err != nil {
+		return BlockFSUsage{}, fmt.Errorf("[ProbeFSUsage] xfs_db %s failed: %w, output: %s", devicePath, err, string(out))
+	}
+
+	fields, err := parseSuperblockFields(string(out), "=", "dblocks", "fdblocks", "blocksize")
+	if err != nil {
+		return BlockFSUsage{}, fmt.Errorf("[ProbeFSUsage] unable to parse the superblock of %s: %w", devicePath, err)
+	}
+
+	blockSize := fields["blocksize"]
+	total, free := fields["dblocks"], fields["fdblocks"]
+	return BlockFSUsage{
+		FSType:         internal.FSTypeXfs,
+		TotalBytes:     total * blockSize,
+		UsedBytes:      (total - free) * blockSize,
+		AvailableBytes: free * blockSize,
+	}, nil
+}
+
+// parseSuperblockFields returns the integer values of the given "name<sep> value" lines of the superblock dump.
+func parseSuperblockFields(out, sep string, names ...string) (map[string]int64, error) {
+	fields := make(map[string]int64, len(names))
+	for _, line := range strings.Split(out, "\n") {
+		name, value, ok := strings.Cut(line, sep)
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || !slices.Contains(names, name) {
+			continue
+		}
+
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", name, value, err)
+		}
+		fields[name] = n
+	}
+
+	for _, name := range names {
+		if _, ok := fields[name]; !ok {
+			return nil, fmt.Errorf("%s is missing", name)
+		}
+	}
+
+	return fields, nil
+}
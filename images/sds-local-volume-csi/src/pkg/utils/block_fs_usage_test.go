@@ -0,0 +1,125 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	utilexec "k8s.io/utils/exec"
+	fakeexec "k8s.io/utils/exec/testing"
+)
+
+type fakeCommandResult struct {
+	out string
+	err error
+}
+
+// newFakeExecSequence returns an exec expecting the commands with the given results in order.
+func newFakeExecSequence(t *testing.T, results ...fakeCommandResult) (*fakeexec.FakeExec, *[][]string) {
+	var calls [][]string
+	fake := &fakeexec.FakeExec{}
+	for _, result := range results {
+		fake.CommandScript = append(fake.CommandScript, func(cmd string, a ...string) utilexec.Cmd {
+			calls = append(calls, append([]string{cmd}, a...))
+			return &fakeexec.FakeCmd{
+				CombinedOutputScript: []fakeexec.FakeAction{
+					func() ([]byte, []byte, error) { return []byte(result.out), nil, result.err },
+				},
+			}
+		})
+	}
+	t.Cleanup(func() { assert.Equal(t, len(results), fake.CommandCalls) })
+	return fake, &calls
+}
+
+const testDumpe2fsOutput = `dumpe2fs 1.47.0 (5-Feb-2023)
+Filesystem volume name:   <none>
+Filesystem magic number:  0xEF53
+Inode count:              65536
+Block count:              262144
+Reserved block count:     13107
+Free blocks:              249189
+Free inodes:              65525
+Block size:               4096
+Fragment size:            4096
+`
+
+func TestSuperblockFSProber(t *testing.T) {
+	t.Run("ext4_usage_is_read_from_superblock", func(t *testing.T) {
+		fake, calls := newFakeExecSequence(t,
+			fakeCommandResult{out: "ext4\n"},
+			fakeCommandResult{out: testDumpe2fsOutput},
+		)
+		p := &SuperblockFSProber{Exec: fake}
+
+		usage, err := p.ProbeFSUsage("/dev/vg-1/pvc-1")
+		require.NoError(t, err)
+		assert.Equal(t, BlockFSUsage{
+			FSType:         "ext4",
+			TotalBytes:     262144 * 4096,
+			UsedBytes:      (262144 - 249189) * 4096,
+			AvailableBytes: (249189 - 13107) * 4096,
+		}, usage)
+		assert.Equal(t, [][]string{
+			{"blkid", "-p", "-s", "TYPE", "-o", "value", "/dev/vg-1/pvc-1"},
+			{"dumpe2fs", "-h", "/dev/vg-1/pvc-1"},
+		}, *calls)
+	})
+
+	t.Run("xfs_usage_is_read_from_superblock", func(t *testing.T) {
+		fake, _ := newFakeExecSequence(t,
+			fakeCommandResult{out: "xfs\n"},
+			fakeCommandResult{out: "dblocks = 262144\nfdblocks = 200000\nblocksize = 4096\n"},
+		)
+		p := &SuperblockFSProber{Exec: fake}
+
+		usage, err := p.ProbeFSUsage("/dev/vg-1/pvc-1")
+		require.NoError(t, err)
+		assert.Equal(t, BlockFSUsage{FSType: "xfs", TotalBytes: 262144 * 4096, UsedBytes: 62144 * 4096, AvailableBytes: 200000 * 4096}, usage)
+	})
+
+	t.Run("random_contents_have_no_filesystem", func(t *testing.T) {
+		fake, _ := newFakeExecSequence(t, fakeCommandResult{err: &fakeexec.FakeExitError{Status: 2}})
+		p := &SuperblockFSProber{Exec: fake}
+
+		_, err := p.ProbeFSUsage("/dev/vg-1/pvc-1")
+		assert.ErrorIs(t, err, ErrNoFilesystem)
+	})
+
+	t.Run("unsupported_filesystem_is_not_read", func(t *testing.T) {
+		fake, _ := newFakeExecSequence(t, fakeCommandResult{out: "crypto_LUKS\n"})
+		p := &SuperblockFSProber{Exec: fake}
+
+		_, err := p.ProbeFSUsage("/dev/vg-1/pvc-1")
+		assert.ErrorIs(t, err, ErrNoFilesystem)
+	})
+
+	t.Run("truncated_superblock_is_an_error", func(t *testing.T) {
+		fake, _ := newFakeExecSequence(t,
+			fakeCommandResult{out: "ext4\n"},
+			fakeCommandResult{out: "Block count:              262144\n"},
+		)
+		p := &SuperblockFSProber{Exec: fake}
+
+		_, err := p.ProbeFSUsage("/dev/vg-1/pvc-1")
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, ErrNoFilesystem)
+		assert.ErrorContains(t, err, "Free blocks is missing")
+	})
+}
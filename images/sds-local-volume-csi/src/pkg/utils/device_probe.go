@@ -0,0 +1,55 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"time"
+
+	utilexec "k8s.io/utils/exec"
+)
+
+const (
+	DefaultDeviceProbeAttempts = 5
+	DefaultDeviceProbeInterval = time.Second
+)
+
+// DeviceProber checks the device of a volume is ready to be mounted.
+type DeviceProber interface {
+	// ProbeDevice returns an error if the device is not ready yet.
+	ProbeDevice(devicePath string) error
+}
+
+// CommandDeviceProber probes the devices with a shell command, which gets the device path as $1
+// and exits with a non-zero code while the device is not ready, e.g. test "$(blockdev --getsize64 "$1")" -gt 0.
+type CommandDeviceProber struct {
+	Exec    utilexec.Interface
+	Command string
+}
+
+func NewCommandDeviceProber(command string) *CommandDeviceProber {
+	return &CommandDeviceProber{Exec: utilexec.New(), Command: command}
+}
+
+func (p *CommandDeviceProber) ProbeDevice(devicePath string) error {
+	out, err := p.Exec.Command("sh", "-c", p.Command, "device-probe", devicePath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("[ProbeDevice] readiness command failed for %s: %w, output: %s", devicePath, err, string(out))
+	}
+
+	return nil
+}
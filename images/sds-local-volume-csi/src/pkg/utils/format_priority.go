@@ -0,0 +1,136 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	utilexec "k8s.io/utils/exec"
+
+	"sds-local-volume-csi/internal"
+)
+
+// ioniceClasses maps the supported ionice scheduling classes to their numbers.
+// The realtime class is not supported, as formatting must not take precedence over the workloads.
+var ioniceClasses = map[string]string{
+	internal.IONiceClassBestEffort: "2",
+	internal.IONiceClassIdle:       "3",
+}
+
+// FormatPriority is the scheduling priority of mkfs.
+type FormatPriority struct {
+	// Nice is the niceness of mkfs. Nil leaves it as is.
+	Nice *int
+	// IOClass is internal.IONiceClassBestEffort or internal.IONiceClassIdle. Empty leaves the IO class as is.
+	IOClass string
+	// IOPriority is the priority within the best-effort class. Nil leaves the default one.
+	IOPriority *int
+}
+
+// GetFormatPriority reads the mkfs scheduling priority from the storage class parameters or the volume context.
+func GetFormatPriority(params map[string]string) (FormatPriority, error) {
+	var p FormatPriority
+
+	if val := params[internal.FormatNiceKey]; val != "" {
+		nice, err := strconv.Atoi(val)
+		if err != nil || nice < -20 || nice > 19 {
+			return p, fmt.Errorf("invalid value %q of %s: must be an integer from -20 to 19", val, internal.FormatNiceKey)
+		}
+		p.Nice = &nice
+	}
+
+	if val := params[internal.FormatIONiceClassKey]; val != "" {
+		if _, ok := ioniceClasses[val]; !ok {
+			return p, fmt.Errorf("invalid value %q of %s: supported values are %s and %s", val, internal.FormatIONiceClassKey, internal.IONiceClassBestEffort, internal.IONiceClassIdle)
+		}
+		p.IOClass = val
+	}
+
+	if val := params[internal.FormatIONicePriorityKey]; val != "" {
+		if p.IOClass != internal.IONiceClassBestEffort {
+			return p, fmt.Errorf("%s requires %s to be %s", internal.FormatIONicePriorityKey, internal.FormatIONiceClassKey, internal.IONiceClassBestEffort)
+		}
+		priority, err := strconv.Atoi(val)
+		if err != nil || priority < 0 || priority > 7 {
+			return p, fmt.Errorf("invalid value %q of %s: must be an integer from 0 to 7", val, internal.FormatIONicePriorityKey)
+		}
+		p.IOPriority = &priority
+	}
+
+	return p, nil
+}
+
+// formatExec returns the exec running mkfs under ionice and nice according to the priority.
+// The tools missing on the node are skipped with a warning, so mkfs runs with the default priority.
+func (s *Store) formatExec(p FormatPriority) utilexec.Interface {
+	var prefix []string
+
+	if p.IOClass != "" {
+		if _, err := s.NodeStorage.Exec.LookPath("ionice"); err != nil {
+			s.Log.Warning(fmt.Sprintf("[formatExec] ionice is not found, mkfs runs with the default IO priority: %v", err))
+		} else {
+			prefix = append(prefix, "ionice", "-c", ioniceClasses[p.IOClass])
+			if p.IOPriority != nil {
+				prefix = append(prefix, "-n", strconv.Itoa(*p.IOPriority))
+			}
+		}
+	}
+
+	if p.Nice != nil {
+		if _, err := s.NodeStorage.Exec.LookPath("nice"); err != nil {
+			s.Log.Warning(fmt.Sprintf("[formatExec] nice is not found, mkfs runs with the default CPU priority: %v", err))
+		} else {
+			prefix = append(prefix, "nice", "-n", strconv.Itoa(*p.Nice))
+		}
+	}
+
+	if len(prefix) == 0 {
+		return s.NodeStorage.Exec
+	}
+
+	return formatPriorityExec{Interface: s.NodeStorage.Exec, prefix: prefix}
+}
+
+// formatPriorityExec runs the mkfs commands prefixed with the ionice and nice commands and the other commands as is.
+type formatPriorityExec struct {
+	utilexec.Interface
+	prefix []string
+}
+
+func (e formatPriorityExec) args(cmd string, args []string) (string, []string) {
+	if !strings.HasPrefix(cmd, "mkfs") {
+		return cmd, args
+	}
+
+	prefixed := make([]string, 0, len(e.prefix)+len(args))
+	prefixed = append(prefixed, e.prefix[1:]...)
+	prefixed = append(prefixed, cmd)
+	return e.prefix[0], append(prefixed, args...)
+}
+
+func (e formatPriorityExec) Command(cmd string, args ...string) utilexec.Cmd {
+	cmd, args = e.args(cmd, args)
+	return e.Interface.Command(cmd, args...)
+}
+
+func (e formatPriorityExec) CommandContext(ctx context.Context, cmd string, args ...string) utilexec.Cmd {
+	cmd, args = e.args(cmd, args)
+	return e.Interface.CommandContext(ctx, cmd, args...)
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	mountutils "k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+	fakeexec "k8s.io/utils/exec/testing"
+
+	"sds-local-volume-csi/internal"
+	"sds-local-volume-csi/pkg/logger"
+)
+
+func TestGetFormatPriority(t *testing.T) {
+	t.Run("nothing_configured", func(t *testing.T) {
+		p, err := GetFormatPriority(map[string]string{})
+		require.NoError(t, err)
+		assert.Equal(t, FormatPriority{}, p)
+	})
+
+	t.Run("all_configured", func(t *testing.T) {
+		p, err := GetFormatPriority(map[string]string{
+			internal.FormatNiceKey:           "19",
+			internal.FormatIONiceClassKey:    internal.IONiceClassBestEffort,
+			internal.FormatIONicePriorityKey: "7",
+		})
+		require.NoError(t, err)
+		require.NotNil(t, p.Nice)
+		require.NotNil(t, p.IOPriority)
+		assert.Equal(t, 19, *p.Nice)
+		assert.Equal(t, internal.IONiceClassBestEffort, p.IOClass)
+		assert.Equal(t, 7, *p.IOPriority)
+	})
+
+	for name, params := range map[string]map[string]string{
+		"nice_out_of_range":        {internal.FormatNiceKey: "20"},
+		"nice_not_a_number":        {internal.FormatNiceKey: "low"},
+		"unsupported_class":        {internal.FormatIONiceClassKey: "realtime"},
+		"priority_without_class":   {internal.FormatIONicePriorityKey: "4"},
+		"priority_with_idle_class": {internal.FormatIONiceClassKey: internal.IONiceClassIdle, internal.FormatIONicePriorityKey: "4"},
+		"priority_out_of_range":    {internal.FormatIONiceClassKey: internal.IONiceClassBestEffort, internal.FormatIONicePriorityKey: "8"},
+		"priority_not_a_number":    {internal.FormatIONiceClassKey: internal.IONiceClassBestEffort, internal.FormatIONicePriorityKey: "high"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := GetFormatPriority(params)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestFormatExec(t *testing.T) {
+	nice := 10
+	priority := 4
+
+	// newStore returns a Store recording the commands and finding only the given tools
+	newStore := func(tools ...string) (*Store, *[][]string) {
+		var commands [][]string
+		run := func(cmd string, args ...string) utilexec.Cmd {
+			commands = append(commands, append([]string{cmd}, args...))
+			return &fakeexec.FakeCmd{}
+		}
+		fake := &fakeexec.FakeExec{
+			CommandScript: []fakeexec.FakeCommandAction{run, run},
+			LookPathFunc: func(file string) (string, error) {
+				for _, tool := range tools {
+					if tool == file {
+						return "/usr/bin/" + file, nil
+					}
+				}
+				return "", errors.New("executable file not found")
+			},
+		}
+
+		return &Store{
+			Log:         &logger.Logger{},
+			NodeStorage: mountutils.SafeFormatAndMount{Exec: fake},
+		}, &commands
+	}
+
+	t.Run("mkfs_is_wrapped_when_configured", func(t *testing.T) {
+		st, commands := newStore("ionice", "nice")
+		exec := st.formatExec(FormatPriority{Nice: &nice, IOClass: internal.IONiceClassBestEffort, IOPriority: &priority})
+
+		exec.Command("mkfs.ext4", "-F", "-m0", "/dev/vg-1/pvc-1")
+		exec.Command("blkid", "-p", "/dev/vg-1/pvc-1")
+		assert.Equal(t, [][]string{
+			{"ionice", "-c", "2", "-n", "4", "nice", "-n", "10", "mkfs.ext4", "-F", "-m0", "/dev/vg-1/pvc-1"},
+			{"blkid", "-p", "/dev/vg-1/pvc-1"},
+		}, *commands)
+	})
+
+	t.Run("mkfs_is_not_wrapped_when_not_configured", func(t *testing.T) {
+		st, commands := newStore("ionice", "nice")
+		exec := st.formatExec(FormatPriority{})
+
+		exec.Command("mkfs.xfs", "/dev/vg-1/pvc-1")
+		assert.Equal(t, [][]string{{"mkfs.xfs", "/dev/vg-1/pvc-1"}}, *commands)
+	})
+
+	t.Run("missing_tool_is_skipped", func(t *testing.T) {
+		st, commands := newStore("nice")
+		exec := st.formatExec(FormatPriority{Nice: &nice, IOClass: internal.IONiceClassIdle})
+
+		exec.Command("mkfs.xfs", "/dev/vg-1/pvc-1")
+		assert.Equal(t, [][]string{{"nice", "-n", "10", "mkfs.xfs", "/dev/vg-1/pvc-1"}}, *commands)
+	})
+
+	t.Run("mkfs_runs_as_is_without_tools", func(t *testing.T) {
+		st, commands := newStore()
+		exec := st.formatExec(FormatPriority{Nice: &nice, IOClass: internal.IONiceClassIdle})
+
+		exec.Command("mkfs.xfs", "/dev/vg-1/pvc-1")
+		assert.Equal(t, [][]string{{"mkfs.xfs", "/dev/vg-1/pvc-1"}}, *commands)
+	})
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"sds-local-volume-csi/internal"
+)
+
+const (
+	DefaultFreezePollInterval = 500 * time.Millisecond
+	// DefaultFreezeAckTimeout is how long the freeze request waits for the node plugin to accept it.
+	DefaultFreezeAckTimeout = 5 * time.Second
+)
+
+var (
+	// ErrVolumeNotMounted is returned by VolumeFreezer.Freeze for a volume not mounted on its node.
+	ErrVolumeNotMounted = errors.New("volume is not mounted")
+	// ErrFreezeFailed is returned by VolumeFreezer.Freeze if the node plugin fails to freeze the filesystem.
+	ErrFreezeFailed = errors.New("filesystem freeze failed")
+	// ErrFreezeAgentUnavailable is returned by VolumeFreezer.Freeze if no node plugin accepts the freeze request.
+	ErrFreezeAgentUnavailable = errors.New("no freeze agent accepted the request")
+)
+
+// GetSnapshotFreeze returns whether the snapshot class requests the filesystem of the source volume to be frozen
+// for the time of the snapshot.
+func GetSnapshotFreeze(params map[string]string) (bool, error) {
+	val, ok := params[internal.SnapshotFreezeKey]
+	if !ok || val == "" {
+		return false, nil
+	}
+
+	freeze, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("invalid value %q of %s: %w", val, internal.SnapshotFreezeKey, err)
+	}
+
+	return freeze, nil
+}
+
+// VolumeFreezer quiesces the filesystem of a volume mounted on its node.
+type VolumeFreezer interface {
+	// Freeze freezes the filesystem of the volume on the node and returns the function thawing it.
+	// ErrVolumeNotMounted is returned if the volume is not mounted on the node.
+	Freeze(ctx context.Context, llv *snc.LVMLogicalVolume, nodeName, requestID string) (func(context.Context) error, error)
+}
+
+// LLVVolumeFreezer requests the node plugin to freeze the filesystem through the LVMLogicalVolume: the request
+// is recorded in its label and annotation and the node plugin answers with the state annotation. The volume is
+// thawed by removing the request. The request not accepted by the node plugin within AckTimeout fails with
+// ErrFreezeAgentUnavailable, as no freeze agent runs on the node.
+type LLVVolumeFreezer struct {
+	Client       client.Client
+	PollInterval time.Duration
+	AckTimeout   time.Duration
+}
+
+func NewLLVVolumeFreezer(kc client.Client) *LLVVolumeFreezer {
+	return &LLVVolumeFreezer{Client: kc, PollInterval: DefaultFreezePollInterval, AckTimeout: DefaultFreezeAckTimeout}
+}
+
+func (f *LLVVolumeFreezer) Freeze(ctx context.Context, llv *snc.LVMLogicalVolume, nodeName, requestID string) (func(context.Context) error, error) {
+	patch := client.MergeFrom(llv.DeepCopy())
+	if llv.Labels == nil {
+		llv.Labels = make(map[string]string, 1)
+	}
+	if llv.Annotations == nil {
+		llv.Annotations = make(map[string]string, 1)
+	}
+	llv.Labels[internal.FreezeNodeLabel] = nodeName
+	llv.Annotations[internal.FreezeRequestAnnotation] = requestID
+	delete(llv.Annotations, internal.FreezeStateAnnotation)
+	if err := f.Client.Patch(ctx, llv, patch); err != nil {
+		return nil, fmt.Errorf("[Freeze] unable to request the freeze of LVMLogicalVolume %s: %w", llv.Name, err)
+	}
+
+	thaw := func(ctx context.Context) error {
+		return ClearFreezeRequest(ctx, f.Client, llv.Name)
+	}
+
+	ackDeadline := time.Now().Add(f.AckTimeout)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, errors.Join(fmt.Errorf("[Freeze] node %s did not answer the freeze request of LVMLogicalVolume %s: %w", nodeName, llv.Name, ctx.Err()), thaw(context.WithoutCancel(ctx)))
+		case <-time.After(f.PollInterval):
+		}
+
+		current, err := GetLVMLogicalVolume(ctx, f.Client, llv.Name, "")
+		if err != nil {
+			continue
+		}
+
+		id, state, message := ParseFreezeState(current.Annotations[internal.FreezeStateAnnotation])
+		if id != requestID {
+			if f.AckTimeout > 0 && time.Now().After(ackDeadline) {
+				return nil, errors.Join(fmt.Errorf("[Freeze] %w of LVMLogicalVolume %s on node %s within %s", ErrFreezeAgentUnavailable, llv.Name, nodeName, f.AckTimeout), thaw(context.WithoutCancel(ctx)))
+			}
+			continue
+		}
+
+		switch state {
+		case internal.FreezeStateAccepted:
+			continue
+		case internal.FreezeStateFrozen:
+			return thaw, nil
+		case internal.FreezeStateNotMounted:
+			return nil, errors.Join(ErrVolumeNotMounted, thaw(ctx))
+		default:
+			return nil, errors.Join(fmt.Errorf("%w on node %s: %s", ErrFreezeFailed, nodeName, message), thaw(ctx))
+		}
+	}
+}
+
+// ClearFreezeRequest removes the freeze request and its state from the LVMLogicalVolume.
+func ClearFreezeRequest(ctx context.Context, kc client.Client, llvName string) error {
+	llv, err := GetLVMLogicalVolume(ctx, kc, llvName, "")
+	if err != nil {
+		return fmt.Errorf("[ClearFreezeRequest] unable to get LVMLogicalVolume %s: %w", llvName, err)
+	}
+
+	patch := client.MergeFrom(llv.DeepCopy())
+	delete(llv.Labels, internal.FreezeNodeLabel)
+	delete(llv.Annotations, internal.FreezeRequestAnnotation)
+	delete(llv.Annotations, internal.FreezeStateAnnotation)
+
+	return kc.Patch(ctx, llv, patch)
+}
+
+// FreezeState returns the value of the state annotation answering the freeze request.
+func FreezeState(requestID, state, message string) string {
+	if message == "" {
+		return requestID + ":" + state
+	}
+	return requestID + ":" + state + ":" + message
+}
+
+// ParseFreezeState splits the value of the state annotation into the request ID, the state and the message.
+func ParseFreezeState(value string) (string, string, string) {
+	parts := strings.SplitN(value, ":", 3)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	return parts[0], parts[1], parts[2]
+}
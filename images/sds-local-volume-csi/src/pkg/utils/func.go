@@ -18,17 +18,24 @@ package utils
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"math"
+	"math/big"
 	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	slv "github.com/deckhouse/sds-local-volume/api/v1alpha1"
 	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
 	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"sds-local-volume-csi/internal"
@@ -36,16 +43,101 @@ import (
 )
 
 const (
-	LLVStatusCreated            = "Created"
-	LLVSStatusCreated           = "Created"
-	LLVStatusFailed             = "Failed"
-	LLVSStatusFailed            = "Failed"
-	LLVTypeThin                 = "Thin"
-	KubernetesAPIRequestLimit   = 3
-	KubernetesAPIRequestTimeout = 1
-	SDSLocalVolumeCSIFinalizer  = "storage.deckhouse.io/sds-local-volume-csi"
+	LLVStatusCreated           = "Created"
+	LLVStatusPending           = "Pending"
+	LLVSStatusCreated          = "Created"
+	LLVStatusFailed            = "Failed"
+	LLVSStatusFailed           = "Failed"
+	LLVTypeThin                = "Thin"
+	SDSLocalVolumeCSIFinalizer = "storage.deckhouse.io/sds-local-volume-csi"
+
+	DefaultKubernetesAPIRequestLimit   = 3
+	DefaultKubernetesAPIRequestTimeout = time.Second
 )
 
+// DefaultLVGListPageSize is the default number of the LVMVolumeGroups read from the API server per list request.
+const DefaultLVGListPageSize = 500
+
+// LVGListPageSize is the number of the LVMVolumeGroups read from the API server per list request. Zero reads them
+// in a single request. It is set once at startup.
+var LVGListPageSize int64 = DefaultLVGListPageSize
+
+// KubernetesAPIRequestLimit and KubernetesAPIRequestTimeout are the number of attempts of the Kubernetes API
+// requests retried on a conflict and the interval between the attempts. They are set once at startup.
+var (
+	KubernetesAPIRequestLimit   = DefaultKubernetesAPIRequestLimit
+	KubernetesAPIRequestTimeout = DefaultKubernetesAPIRequestTimeout
+)
+
+// ParseKubernetesAPIRetries parses the retry limit and interval of the Kubernetes API requests.
+// The empty values keep the defaults. Non-positive values are rejected.
+func ParseKubernetesAPIRetries(limit, timeout string) (int, time.Duration, error) {
+	parsedLimit, parsedTimeout := DefaultKubernetesAPIRequestLimit, DefaultKubernetesAPIRequestTimeout
+
+	if limit != "" {
+		v, err := strconv.Atoi(limit)
+		if err != nil || v <= 0 {
+			return 0, 0, fmt.Errorf("invalid Kubernetes API request limit %q: must be a positive integer", limit)
+		}
+		parsedLimit = v
+	}
+
+	if timeout != "" {
+		v, err := time.ParseDuration(timeout)
+		if err != nil || v <= 0 {
+			return 0, 0, fmt.Errorf("invalid Kubernetes API request timeout %q: must be a positive duration", timeout)
+		}
+		parsedTimeout = v
+	}
+
+	return parsedLimit, parsedTimeout, nil
+}
+
+// ErrLVGNotReady is returned when an LVMVolumeGroup status is not populated yet.
+var ErrLVGNotReady = errors.New("LVMVolumeGroup is not ready")
+
+// ErrNotReady is returned by the GetReady getters for the objects that exist but whose status is not populated yet,
+// so the callers can wait for them instead of failing as for the missing objects.
+var ErrNotReady = errors.New("status is not populated yet")
+
+// ErrThinPoolNotResolved is returned when the storage class does not specify the thin pool
+// and the LVMVolumeGroup does not have exactly one thin pool to fall back to.
+var ErrThinPoolNotResolved = errors.New("thin pool is not specified and cannot be resolved")
+
+// ErrThinPoolNotFound is returned when the thin pool specified by the storage class is not among
+// the thin pools of the LVMVolumeGroup.
+var ErrThinPoolNotFound = errors.New("thin pool is not found in the LVMVolumeGroup")
+
+// ErrLVGGone is returned when an LVMVolumeGroup was deleted while a volume was being provisioned on it.
+var ErrLVGGone = errors.New("LVMVolumeGroup no longer exists")
+
+// CheckLVGExists returns ErrLVGGone if the LVMVolumeGroup is not found or is being deleted.
+func CheckLVGExists(ctx context.Context, kc client.Client, lvgName string) error {
+	lvg, err := GetLVMVolumeGroup(ctx, kc, lvgName)
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			return fmt.Errorf("LVMVolumeGroup %s: %w", lvgName, ErrLVGGone)
+		}
+		return fmt.Errorf("unable to get LVMVolumeGroup %s: %w", lvgName, err)
+	}
+
+	if lvg.DeletionTimestamp != nil {
+		return fmt.Errorf("LVMVolumeGroup %s is being deleted: %w", lvgName, ErrLVGGone)
+	}
+
+	return nil
+}
+
+// GetLVGNodeName returns the name of the node the LVMVolumeGroup is located on.
+// ErrLVGNotReady is returned if the LVMVolumeGroup status has no nodes yet.
+func GetLVGNodeName(lvg snc.LVMVolumeGroup) (string, error) {
+	if len(lvg.Status.Nodes) == 0 {
+		return "", fmt.Errorf("LVMVolumeGroup %s has no nodes in status: %w", lvg.Name, ErrLVGNotReady)
+	}
+
+	return lvg.Status.Nodes[0].Name, nil
+}
+
 func CreateLVMLogicalVolumeSnapshot(
 	ctx context.Context,
 	kc client.Client,
@@ -125,7 +217,7 @@ func removeLLVSFinalizerIfExist(ctx context.Context, kc client.Client, log *logg
 			case <-ctx.Done():
 				return false, ctx.Err()
 			default:
-				time.Sleep(KubernetesAPIRequestTimeout * time.Second)
+				time.Sleep(KubernetesAPIRequestTimeout)
 				freshLLVS, getErr := GetLVMLogicalVolumeSnapshot(ctx, kc, llvs.Name, "")
 				if getErr != nil {
 					return false, fmt.Errorf("[removeLLVSFinalizerIfExist] error getting LVMLogicalVolumeSnapshot %s after update conflict: %w", llvs.Name, getErr)
@@ -139,6 +231,15 @@ func removeLLVSFinalizerIfExist(ctx context.Context, kc client.Client, log *logg
 	return false, fmt.Errorf("after %d attempts of removing finalizer %s from LVMLogicalVolumeSnapshot %s, last error: %w", KubernetesAPIRequestLimit, finalizer, llvs.Name, nil)
 }
 
+// IsLLVSReady reports whether the LVMLogicalVolumeSnapshot can be restored from. A snapshot is not ready
+// until the node reports its backing thin snapshot, e.g. while it is being created or after it has been lost.
+func IsLLVSReady(llvs *snc.LVMLogicalVolumeSnapshot) bool {
+	return llvs.DeletionTimestamp == nil &&
+		llvs.Status != nil &&
+		llvs.Status.Phase == LLVSStatusCreated &&
+		llvs.Status.ActualLVNameOnTheNode != ""
+}
+
 func WaitForLLVSStatusUpdate(
 	ctx context.Context,
 	kc client.Client,
@@ -198,13 +299,21 @@ func GetLVMLogicalVolumeSnapshot(ctx context.Context, kc client.Client, lvmLogic
 	return &llvs, err
 }
 
-func CreateLVMLogicalVolume(ctx context.Context, kc client.Client, log *logger.Logger, traceID, name string, lvmLogicalVolumeSpec snc.LVMLogicalVolumeSpec) (*snc.LVMLogicalVolume, error) {
-	var err error
-	llv := &snc.LVMLogicalVolume{
+// ErrLLVSpecConflict is returned when the LVMLogicalVolume to create already exists with a different spec.
+var ErrLLVSpecConflict = errors.New("LVMLogicalVolume already exists with a different spec")
+
+// CreateLVMLogicalVolume creates the LVMLogicalVolume. If it already exists, e.g. created by a retried request,
+// the existing one is returned if its spec matches the requested one, the sizes being compared within the delta.
+// ErrLLVSpecConflict is returned otherwise. created reports whether the LVMLogicalVolume was created by this call
+// rather than adopted.
+func CreateLVMLogicalVolume(ctx context.Context, kc client.Client, log *logger.Logger, traceID, name, finalizer string, labels, annotations map[string]string, lvmLogicalVolumeSpec snc.LVMLogicalVolumeSpec, delta resource.Quantity) (llv *snc.LVMLogicalVolume, created bool, err error) {
+	llv = &snc.LVMLogicalVolume{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:            name,
+			Labels:          labels,
+			Annotations:     annotations,
 			OwnerReferences: []metav1.OwnerReference{},
-			Finalizers:      []string{SDSLocalVolumeCSIFinalizer},
+			Finalizers:      []string{finalizer},
 		},
 		Spec: lvmLogicalVolumeSpec,
 	}
@@ -212,10 +321,89 @@ func CreateLVMLogicalVolume(ctx context.Context, kc client.Client, log *logger.L
 	log.Trace(fmt.Sprintf("[CreateLVMLogicalVolume][traceID:%s][volumeID:%s] LVMLogicalVolume: %+v", traceID, name, llv))
 
 	err = kc.Create(ctx, llv)
-	return llv, err
+	if !kerrors.IsAlreadyExists(err) {
+		return llv, err == nil, err
+	}
+
+	existing, err := GetLVMLogicalVolume(ctx, kc, name, "")
+	if err != nil {
+		return nil, false, fmt.Errorf("get existing LVMLogicalVolume %s: %w", name, err)
+	}
+	if mismatch := LLVSpecMismatch(existing.Spec, lvmLogicalVolumeSpec, delta); mismatch != "" {
+		return existing, false, fmt.Errorf("%w: %s", ErrLLVSpecConflict, mismatch)
+	}
+
+	log.Info(fmt.Sprintf("[CreateLVMLogicalVolume][traceID:%s][volumeID:%s] LVMLogicalVolume already exists with the requested spec. Reuse it", traceID, name))
+	return existing, false, nil
 }
 
-func DeleteLVMLogicalVolume(ctx context.Context, kc client.Client, log *logger.Logger, traceID, lvmLogicalVolumeName string) error {
+// LLVSpecMismatch describes the first field of the existing LVMLogicalVolume spec differing from the requested one.
+// The sizes match if they differ by less than the delta. An empty string is returned if the specs match.
+func LLVSpecMismatch(existing, requested snc.LVMLogicalVolumeSpec, delta resource.Quantity) string {
+	if existing.Type != requested.Type {
+		return fmt.Sprintf("type %s, requested %s", existing.Type, requested.Type)
+	}
+	if existing.LVMVolumeGroupName != requested.LVMVolumeGroupName {
+		return fmt.Sprintf("LVMVolumeGroup %s, requested %s", existing.LVMVolumeGroupName, requested.LVMVolumeGroupName)
+	}
+	if existing.ActualLVNameOnTheNode != requested.ActualLVNameOnTheNode {
+		return fmt.Sprintf("LV name %s, requested %s", existing.ActualLVNameOnTheNode, requested.ActualLVNameOnTheNode)
+	}
+
+	existingPool, requestedPool := "", ""
+	if existing.Thin != nil {
+		existingPool = existing.Thin.PoolName
+	}
+	if requested.Thin != nil {
+		requestedPool = requested.Thin.PoolName
+	}
+	if existingPool != requestedPool {
+		return fmt.Sprintf("thin pool %q, requested %q", existingPool, requestedPool)
+	}
+
+	var existingSource, requestedSource snc.LVMLogicalVolumeSource
+	if existing.Source != nil {
+		existingSource = *existing.Source
+	}
+	if requested.Source != nil {
+		requestedSource = *requested.Source
+	}
+	if existingSource != requestedSource {
+		return fmt.Sprintf("source %+v, requested %+v", existingSource, requestedSource)
+	}
+
+	existingSize, err := resource.ParseQuantity(existing.Size)
+	if err != nil {
+		return fmt.Sprintf("invalid size %q", existing.Size)
+	}
+	requestedSize, err := resource.ParseQuantity(requested.Size)
+	if err != nil {
+		return fmt.Sprintf("invalid requested size %q", requested.Size)
+	}
+	if !AreSizesEqualWithinDelta(existingSize, requestedSize, delta) {
+		return fmt.Sprintf("size %s, requested %s", existing.Size, requested.Size)
+	}
+
+	return ""
+}
+
+// LineageLabels returns the labels recording the source volume and snapshot of a clone or a restore.
+// The empty IDs and the IDs that are not valid label values are omitted.
+func LineageLabels(sourceVolumeID, sourceSnapshotID string) map[string]string {
+	labels := make(map[string]string, 2)
+	for key, id := range map[string]string{internal.SourceVolumeLabel: sourceVolumeID, internal.SourceSnapshotLabel: sourceSnapshotID} {
+		if id != "" && len(validation.IsValidLabelValue(id)) == 0 {
+			labels[key] = id
+		}
+	}
+
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+func DeleteLVMLogicalVolume(ctx context.Context, kc client.Client, log *logger.Logger, traceID, lvmLogicalVolumeName, finalizer string) error {
 	var err error
 
 	log.Trace(fmt.Sprintf("[DeleteLVMLogicalVolume][traceID:%s][volumeID:%s] Trying to find LVMLogicalVolume", traceID, lvmLogicalVolumeName))
@@ -225,16 +413,16 @@ func DeleteLVMLogicalVolume(ctx context.Context, kc client.Client, log *logger.L
 	}
 
 	log.Trace(fmt.Sprintf("[DeleteLVMLogicalVolume][traceID:%s][volumeID:%s] LVMLogicalVolume found: %+v (status: %+v)", traceID, lvmLogicalVolumeName, llv, llv.Status))
-	log.Trace(fmt.Sprintf("[DeleteLVMLogicalVolume][traceID:%s][volumeID:%s] Removing finalizer %s if exists", traceID, lvmLogicalVolumeName, SDSLocalVolumeCSIFinalizer))
+	log.Trace(fmt.Sprintf("[DeleteLVMLogicalVolume][traceID:%s][volumeID:%s] Removing finalizer %s if exists", traceID, lvmLogicalVolumeName, finalizer))
 
-	removed, err := removeLLVFinalizerIfExist(ctx, kc, log, llv, SDSLocalVolumeCSIFinalizer)
+	removed, err := removeLLVFinalizerIfExist(ctx, kc, log, llv, finalizer)
 	if err != nil {
 		return fmt.Errorf("remove finalizers from LVMLogicalVolume %s: %w", lvmLogicalVolumeName, err)
 	}
 	if removed {
-		log.Trace(fmt.Sprintf("[DeleteLVMLogicalVolume][traceID:%s][volumeID:%s] finalizer %s removed from LVMLogicalVolume %s", traceID, lvmLogicalVolumeName, SDSLocalVolumeCSIFinalizer, lvmLogicalVolumeName))
+		log.Trace(fmt.Sprintf("[DeleteLVMLogicalVolume][traceID:%s][volumeID:%s] finalizer %s removed from LVMLogicalVolume %s", traceID, lvmLogicalVolumeName, finalizer, lvmLogicalVolumeName))
 	} else {
-		log.Warning(fmt.Sprintf("[DeleteLVMLogicalVolume][traceID:%s][volumeID:%s] finalizer %s not found in LVMLogicalVolume %s", traceID, lvmLogicalVolumeName, SDSLocalVolumeCSIFinalizer, lvmLogicalVolumeName))
+		log.Warning(fmt.Sprintf("[DeleteLVMLogicalVolume][traceID:%s][volumeID:%s] finalizer %s not found in LVMLogicalVolume %s", traceID, lvmLogicalVolumeName, finalizer, lvmLogicalVolumeName))
 	}
 
 	log.Trace(fmt.Sprintf("[DeleteLVMLogicalVolume][traceID:%s][volumeID:%s] Trying to delete LVMLogicalVolume", traceID, lvmLogicalVolumeName))
@@ -242,7 +430,47 @@ func DeleteLVMLogicalVolume(ctx context.Context, kc client.Client, log *logger.L
 	return err
 }
 
-func WaitForStatusUpdate(ctx context.Context, kc client.Client, log *logger.Logger, traceID, lvmLogicalVolumeName, namespace string, llvSize, delta resource.Quantity) (int, error) {
+// WaitForLLVDeletion waits for the deleted LVMLogicalVolume to be gone, so it can be recreated with the same name.
+func WaitForLLVDeletion(ctx context.Context, kc client.Client, lvmLogicalVolumeName string) error {
+	for {
+		_, err := GetLVMLogicalVolume(ctx, kc, lvmLogicalVolumeName, "")
+		if kerrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("get LVMLogicalVolume %s: %w", lvmLogicalVolumeName, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// WaitForLLVPickup waits for the node agent to pick the LVMLogicalVolume up, i.e. for its phase to leave Pending.
+// The agent has run lvcreate by then, whether the LV is created or failed.
+func WaitForLLVPickup(ctx context.Context, kc client.Client, lvmLogicalVolumeName string) error {
+	for {
+		llv, err := GetLVMLogicalVolume(ctx, kc, lvmLogicalVolumeName, "")
+		if err != nil {
+			return fmt.Errorf("get LVMLogicalVolume %s: %w", lvmLogicalVolumeName, err)
+		}
+		if llv.Status != nil && llv.Status.Phase != "" && llv.Status.Phase != LLVStatusPending {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// WaitForStatusUpdate waits for the LVMLogicalVolume to be created with the size, see CheckLLVStatus.
+func WaitForStatusUpdate(ctx context.Context, kc client.Client, log *logger.Logger, traceID, lvmLogicalVolumeName, namespace string, llvSize, delta resource.Quantity, strictThinSize bool) (int, error) {
 	var attemptCounter int
 	sizeEquals := false
 	log.Info(fmt.Sprintf("[WaitForStatusUpdate][traceID:%s][volumeID:%s] Waiting for LVM Logical Volume status update", traceID, lvmLogicalVolumeName))
@@ -261,6 +489,11 @@ func WaitForStatusUpdate(ctx context.Context, kc client.Client, log *logger.Logg
 			return attemptCounter, err
 		}
 
+		if err := CheckLVGExists(ctx, kc, llv.Spec.LVMVolumeGroupName); errors.Is(err, ErrLVGGone) {
+			log.Warning(fmt.Sprintf("[WaitForStatusUpdate][traceID:%s][volumeID:%s] %v", traceID, lvmLogicalVolumeName, err))
+			return attemptCounter, err
+		}
+
 		if attemptCounter%10 == 0 {
 			log.Info(fmt.Sprintf("[WaitForStatusUpdate][traceID:%s][volumeID:%s] Attempt: %d,LVM Logical Volume: %+v; delta=%s; sizeEquals=%t", traceID, lvmLogicalVolumeName, attemptCounter, llv, delta.String(), sizeEquals))
 		}
@@ -269,18 +502,15 @@ func WaitForStatusUpdate(ctx context.Context, kc client.Client, log *logger.Logg
 			log.Trace(fmt.Sprintf("[WaitForStatusUpdate][traceID:%s][volumeID:%s] Attempt %d, LVM Logical Volume status: %+v, full LVMLogicalVolume resource: %+v", traceID, lvmLogicalVolumeName, attemptCounter, llv.Status, llv))
 			sizeEquals = AreSizesEqualWithinDelta(llvSize, llv.Status.ActualSize, delta)
 
-			if llv.DeletionTimestamp != nil {
-				return attemptCounter, fmt.Errorf("failed to create LVM logical volume on node for LVMLogicalVolume %s, reason: LVMLogicalVolume is being deleted", lvmLogicalVolumeName)
+			created, err := CheckLLVStatus(llv, llvSize, delta, strictThinSize)
+			if err != nil {
+				return attemptCounter, err
 			}
-
-			if llv.Status.Phase == LLVStatusFailed {
-				return attemptCounter, fmt.Errorf("failed to create LVM logical volume on node for LVMLogicalVolume %s, reason: %s", lvmLogicalVolumeName, llv.Status.Reason)
+			if created {
+				return attemptCounter, nil
 			}
 
 			if llv.Status.Phase == LLVStatusCreated {
-				if sizeEquals {
-					return attemptCounter, nil
-				}
 				log.Trace(fmt.Sprintf("[WaitForStatusUpdate][traceID:%s][volumeID:%s] Attempt %d, LVM Logical Volume created but size does not match the requested size yet. Waiting...", traceID, lvmLogicalVolumeName, attemptCounter))
 			} else {
 				log.Trace(fmt.Sprintf("[WaitForStatusUpdate][traceID:%s][volumeID:%s] Attempt %d, LVM Logical Volume status is not 'Created' yet. Waiting...", traceID, lvmLogicalVolumeName, attemptCounter))
@@ -289,6 +519,63 @@ func WaitForStatusUpdate(ctx context.Context, kc client.Client, log *logger.Logg
 	}
 }
 
+// LLVFailedError is returned for an LVMLogicalVolume in the Failed phase.
+type LLVFailedError struct {
+	Name   string
+	Reason string
+	// Conditions are the provisioning progress conditions of the LVMLogicalVolume.
+	Conditions []metav1.Condition
+}
+
+func (e *LLVFailedError) Error() string {
+	return fmt.Sprintf("failed to create LVM logical volume on node for LVMLogicalVolume %s, reason: %s", e.Name, e.Reason)
+}
+
+// CheckLLVStatus reports whether the LVMLogicalVolume is in the Created phase and its actual size
+// matches llvSize within delta. The actual size of a thin volume may only reflect the space allocated
+// in the thin pool, so the Created phase is enough for the thin volumes unless strictThinSize is set.
+// An error is returned if the LVMLogicalVolume is being deleted or failed.
+func CheckLLVStatus(llv *snc.LVMLogicalVolume, llvSize, delta resource.Quantity, strictThinSize bool) (bool, error) {
+	if llv.DeletionTimestamp != nil {
+		return false, fmt.Errorf("failed to create LVM logical volume on node for LVMLogicalVolume %s, reason: LVMLogicalVolume is being deleted", llv.Name)
+	}
+
+	if llv.Status == nil {
+		return false, nil
+	}
+
+	if llv.Status.Phase == LLVStatusFailed {
+		// the conditions only add context to the failure, so an unreadable annotation is ignored
+		conditions, _ := GetLLVProvisioningConditions(llv)
+		return false, &LLVFailedError{Name: llv.Name, Reason: llv.Status.Reason, Conditions: conditions}
+	}
+
+	if llv.Status.Phase != LLVStatusCreated {
+		return false, nil
+	}
+	if llv.Spec.Type == internal.LVMTypeThin && !strictThinSize {
+		return true, nil
+	}
+
+	return AreSizesEqualWithinDelta(llvSize, llv.Status.ActualSize, delta), nil
+}
+
+// GetReadyLVMLogicalVolume returns the LVMLogicalVolume whose status is set by the node agent.
+// The NotFound error of the API server is returned as is for a missing LVMLogicalVolume, and the LVMLogicalVolume
+// with ErrNotReady for the one the node agent has not picked up yet.
+func GetReadyLVMLogicalVolume(ctx context.Context, kc client.Client, lvmLogicalVolumeName, namespace string) (*snc.LVMLogicalVolume, error) {
+	llv, err := GetLVMLogicalVolume(ctx, kc, lvmLogicalVolumeName, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	if llv.Status == nil {
+		return llv, fmt.Errorf("%w: LVMLogicalVolume %s", ErrNotReady, lvmLogicalVolumeName)
+	}
+
+	return llv, nil
+}
+
 func GetLVMLogicalVolume(ctx context.Context, kc client.Client, lvmLogicalVolumeName, namespace string) (*snc.LVMLogicalVolume, error) {
 	var llv snc.LVMLogicalVolume
 
@@ -300,37 +587,301 @@ func GetLVMLogicalVolume(ctx context.Context, kc client.Client, lvmLogicalVolume
 	return &llv, err
 }
 
+// AreSizesEqualWithinDelta reports whether the sizes differ by less than the delta. The sizes are compared
+// as quantities, so the large sizes do not lose precision.
 func AreSizesEqualWithinDelta(leftSize, rightSize, allowedDelta resource.Quantity) bool {
-	leftSizeFloat := float64(leftSize.Value())
-	rightSizeFloat := float64(rightSize.Value())
+	diff := leftSize.DeepCopy()
+	diff.Sub(rightSize)
+	if diff.Sign() < 0 {
+		diff.Neg()
+	}
+
+	return diff.Cmp(allowedDelta) < 0
+}
 
-	return math.Abs(leftSizeFloat-rightSizeFloat) < float64(allowedDelta.Value())
+// IsLVGStatusPopulated reports whether the node agent has populated the nodes and the size
+// in the status of the LVMVolumeGroup. They are empty right after the LVMVolumeGroup is created.
+func IsLVGStatusPopulated(lvg snc.LVMVolumeGroup) bool {
+	return len(lvg.Status.Nodes) > 0 && !lvg.Status.VGSize.IsZero()
 }
 
 func GetNodeWithMaxFreeSpace(lvgs []snc.LVMVolumeGroup, storageClassLVGParametersMap map[string]string, lvmType string) (nodeName string, freeSpace resource.Quantity, err error) {
-	var maxFreeSpace int64
+	maxFreeSpace := *resource.NewQuantity(0, resource.BinarySI)
+	var notReadyLVGs []string
 	for _, lvg := range lvgs {
-		switch lvmType {
-		case internal.LVMTypeThick:
-			freeSpace = lvg.Status.VGFree
-		case internal.LVMTypeThin:
-			thinPoolName, ok := storageClassLVGParametersMap[lvg.Name]
-			if !ok {
-				return "", freeSpace, fmt.Errorf("thin pool name for lvg %s not found in storage class parameters: %+v", lvg.Name, storageClassLVGParametersMap)
+		lvgNodeName, err := GetLVGNodeName(lvg)
+		if err != nil {
+			notReadyLVGs = append(notReadyLVGs, lvg.Name)
+			continue
+		}
+
+		freeSpace, err = GetLVGFreeSpace(lvg, storageClassLVGParametersMap, lvmType)
+		if err != nil {
+			return "", freeSpace, err
+		}
+
+		if freeSpace.Cmp(maxFreeSpace) > 0 {
+			nodeName = lvgNodeName
+			maxFreeSpace = freeSpace.DeepCopy()
+		}
+	}
+
+	if len(notReadyLVGs) == len(lvgs) && len(lvgs) != 0 {
+		return "", freeSpace, fmt.Errorf("all LVMVolumeGroups %v have no nodes in status: %w", notReadyLVGs, ErrLVGNotReady)
+	}
+
+	return nodeName, maxFreeSpace, nil
+}
+
+// ErrTopologyKeyMismatch is returned when the nodes registered the driver with another topology key.
+var ErrTopologyKeyMismatch = errors.New("topology key mismatch")
+
+// CheckCSINodeTopologyKey returns ErrTopologyKeyMismatch if any CSINode registered the driver with the topology keys
+// not including topologyKey. The skipNode CSINode is not checked, as its registration is refreshed
+// after the node plugin restarts.
+func CheckCSINodeTopologyKey(ctx context.Context, kc client.Client, driverName, topologyKey, skipNode string) error {
+	csiNodes := &storagev1.CSINodeList{}
+	if err := kc.List(ctx, csiNodes); err != nil {
+		return fmt.Errorf("unable to list CSINodes: %w", err)
+	}
+
+	var mismatched []string
+	for _, csiNode := range csiNodes.Items {
+		if csiNode.Name == skipNode {
+			continue
+		}
+
+		for _, drv := range csiNode.Spec.Drivers {
+			if drv.Name == driverName && len(drv.TopologyKeys) > 0 && !slices.Contains(drv.TopologyKeys, topologyKey) {
+				mismatched = append(mismatched, fmt.Sprintf("%s %v", csiNode.Name, drv.TopologyKeys))
 			}
-			freeSpace, err = GetLVMThinPoolFreeSpace(lvg, thinPoolName)
-			if err != nil {
-				return "", freeSpace, fmt.Errorf("get free space for thin pool %s in lvg %s: %w", thinPoolName, lvg.Name, err)
+		}
+	}
+
+	if len(mismatched) > 0 {
+		return fmt.Errorf("%w: the nodes registered driver %s with topology keys other than %s: %s", ErrTopologyKeyMismatch, driverName, topologyKey, strings.Join(mismatched, ", "))
+	}
+
+	return nil
+}
+
+// SplitCommaSeparated splits the comma-separated list dropping the empty items.
+func SplitCommaSeparated(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
+
+// ValidateProvisionerSecrets checks that the provisioner secrets contain all the required keys.
+// The secret values are never included in the error.
+func ValidateProvisionerSecrets(secrets map[string]string, required []string) error {
+	var missing []string
+	for _, key := range required {
+		if secrets[key] == "" {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("required provisioner secret keys are missing: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// ResolveThinPoolName returns the thin pool of the LVMVolumeGroup to be used for the storage class.
+// If the storage class does not specify the pool, the sole thin pool of the LVMVolumeGroup is used.
+// ErrThinPoolNotResolved is returned if the LVMVolumeGroup has no thin pools or several of them.
+func ResolveThinPoolName(lvg snc.LVMVolumeGroup, storageClassLVGParametersMap map[string]string) (string, error) {
+	poolName, ok := storageClassLVGParametersMap[lvg.Name]
+	if !ok {
+		return "", fmt.Errorf("thin pool name for lvg %s not found in storage class parameters: %+v", lvg.Name, storageClassLVGParametersMap)
+	}
+	if poolName != "" {
+		return poolName, nil
+	}
+
+	switch len(lvg.Status.ThinPools) {
+	case 1:
+		return lvg.Status.ThinPools[0].Name, nil
+	case 0:
+		return "", fmt.Errorf("LVMVolumeGroup %s has no thin pools: %w", lvg.Name, ErrThinPoolNotResolved)
+	default:
+		names := make([]string, 0, len(lvg.Status.ThinPools))
+		for _, tp := range lvg.Status.ThinPools {
+			names = append(names, tp.Name)
+		}
+		return "", fmt.Errorf("LVMVolumeGroup %s has several thin pools %v, specify thin.poolName in the storage class: %w", lvg.Name, names, ErrThinPoolNotResolved)
+	}
+}
+
+// checkThinPoolExists returns ErrThinPoolNotFound listing the available thin pools if the LVMVolumeGroup
+// has no thin pool with the name, e.g. because of a typo in the storage class.
+func checkThinPoolExists(lvg snc.LVMVolumeGroup, poolName string) error {
+	names := make([]string, 0, len(lvg.Status.ThinPools))
+	for _, tp := range lvg.Status.ThinPools {
+		if tp.Name == poolName {
+			return nil
+		}
+		names = append(names, tp.Name)
+	}
+
+	return fmt.Errorf("thin pool %s of LVMVolumeGroup %s: %w, available thin pools: %v", poolName, lvg.Name, ErrThinPoolNotFound, names)
+}
+
+// GetLVGFreeSpace returns the space available for a new volume of the lvmType in the LVMVolumeGroup.
+func GetLVGFreeSpace(lvg snc.LVMVolumeGroup, storageClassLVGParametersMap map[string]string, lvmType string) (freeSpace resource.Quantity, err error) {
+	switch lvmType {
+	case internal.LVMTypeThick:
+		freeSpace = lvg.Status.VGFree
+	case internal.LVMTypeThin:
+		thinPoolName, err := ResolveThinPoolName(lvg, storageClassLVGParametersMap)
+		if err != nil {
+			return freeSpace, err
+		}
+		freeSpace, err = GetLVMThinPoolFreeSpace(lvg, thinPoolName)
+		if err != nil {
+			return freeSpace, fmt.Errorf("get free space for thin pool %s in lvg %s: %w", thinPoolName, lvg.Name, err)
+		}
+	}
+
+	return freeSpace, nil
+}
+
+// GetNodeWithLowestThinPoolOvercommit returns the node whose storage class thin pool has the lowest overcommit ratio
+// (allocated virtual size divided by the physical pool size). Pools with equal ratios are compared by free space.
+func GetNodeWithLowestThinPoolOvercommit(lvgs []snc.LVMVolumeGroup, storageClassLVGParametersMap map[string]string) (nodeName, thinPoolName string, freeSpace resource.Quantity, overcommitRatio float64, err error) {
+	found := false
+	var notReadyLVGs []string
+	for _, lvg := range lvgs {
+		lvgNodeName, err := GetLVGNodeName(lvg)
+		if err != nil {
+			notReadyLVGs = append(notReadyLVGs, lvg.Name)
+			continue
+		}
+
+		poolName, err := ResolveThinPoolName(lvg, storageClassLVGParametersMap)
+		if err != nil {
+			return "", "", freeSpace, 0, err
+		}
+
+		ratio, err := GetLVMThinPoolOvercommitRatio(lvg, poolName)
+		if err != nil {
+			return "", "", freeSpace, 0, fmt.Errorf("get overcommit ratio for thin pool %s in lvg %s: %w", poolName, lvg.Name, err)
+		}
+
+		poolFreeSpace, err := GetLVMThinPoolFreeSpace(lvg, poolName)
+		if err != nil {
+			return "", "", freeSpace, 0, fmt.Errorf("get free space for thin pool %s in lvg %s: %w", poolName, lvg.Name, err)
+		}
+
+		if !found || ratio < overcommitRatio || (ratio == overcommitRatio && poolFreeSpace.Cmp(freeSpace) > 0) {
+			found = true
+			nodeName = lvgNodeName
+			thinPoolName = poolName
+			freeSpace = poolFreeSpace
+			overcommitRatio = ratio
+		}
+	}
+
+	if !found && len(notReadyLVGs) != 0 {
+		return "", "", freeSpace, 0, fmt.Errorf("all LVMVolumeGroups %v have no nodes in status: %w", notReadyLVGs, ErrLVGNotReady)
+	}
+
+	return nodeName, thinPoolName, freeSpace, overcommitRatio, nil
+}
+
+// GetLVMThinPoolOvercommitRatio returns the ratio of the virtual size allocated in the thin pool to its physical size.
+func GetLVMThinPoolOvercommitRatio(lvg snc.LVMVolumeGroup, thinPoolName string) (float64, error) {
+	thinPool, err := getLVMThinPoolStatus(lvg, thinPoolName)
+	if err != nil {
+		return 0, err
+	}
+
+	if thinPool.ActualSize.IsZero() {
+		return 0, fmt.Errorf("[GetLVMThinPoolOvercommitRatio] thin pool %s in lvg %s has zero size", thinPoolName, lvg.Name)
+	}
+
+	return float64(thinPool.AllocatedSize.Value()) / float64(thinPool.ActualSize.Value()), nil
+}
+
+// LVGCandidate is the result of checking whether the volume fits the LVMVolumeGroup.
+type LVGCandidate struct {
+	LVG       string
+	Node      string
+	FreeSpace resource.Quantity
+	// Rejection is the reason the LVMVolumeGroup can't be used. It is empty if the volume fits.
+	Rejection string
+}
+
+// EvaluateLVGCandidates checks whether the volume of the given size fits each of the LVMVolumeGroups.
+func EvaluateLVGCandidates(lvgs []snc.LVMVolumeGroup, storageClassLVGParametersMap map[string]string, lvmType string, size resource.Quantity) []LVGCandidate {
+	candidates := make([]LVGCandidate, 0, len(lvgs))
+	for _, lvg := range lvgs {
+		candidate := LVGCandidate{LVG: lvg.Name, Node: lvg.Spec.Local.NodeName}
+
+		if _, err := GetLVGNodeName(lvg); err != nil {
+			candidate.Rejection = "LVMVolumeGroup is not ready"
+			candidates = append(candidates, candidate)
+			continue
+		}
+
+		freeSpace, err := GetLVGFreeSpace(lvg, storageClassLVGParametersMap, lvmType)
+		if err != nil {
+			candidate.Rejection = fmt.Sprintf("unable to get free space: %v", err)
+			candidates = append(candidates, candidate)
+			continue
+		}
+
+		candidate.FreeSpace = freeSpace
+		if freeSpace.Cmp(size) < 0 {
+			candidate.Rejection = fmt.Sprintf("free space %s is less than the requested %s", freeSpace.String(), size.String())
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	return candidates
+}
+
+// FilterSchedulableLVGs drops the LVMVolumeGroups located on cordoned nodes or on nodes having the excludeTaintKey taint.
+func FilterSchedulableLVGs(ctx context.Context, kc client.Client, log *logger.Logger, lvgs []snc.LVMVolumeGroup, excludeTaintKey string) ([]snc.LVMVolumeGroup, error) {
+	result := make([]snc.LVMVolumeGroup, 0, len(lvgs))
+	for _, lvg := range lvgs {
+		nodeName, err := GetLVGNodeName(lvg)
+		if err != nil {
+			// not ready LVMVolumeGroups are handled by the selection itself
+			result = append(result, lvg)
+			continue
+		}
+
+		node := &corev1.Node{}
+		err = kc.Get(ctx, client.ObjectKey{Name: nodeName}, node)
+		if err != nil {
+			if kerrors.IsNotFound(err) {
+				log.Warning(fmt.Sprintf("[FilterSchedulableLVGs] node %s of lvg %s not found. Exclude it", nodeName, lvg.Name))
+				continue
 			}
+			return nil, fmt.Errorf("get node %s: %w", nodeName, err)
+		}
+
+		if node.Spec.Unschedulable {
+			log.Info(fmt.Sprintf("[FilterSchedulableLVGs] node %s of lvg %s is unschedulable. Exclude it", nodeName, lvg.Name))
+			continue
 		}
 
-		if freeSpace.Value() > maxFreeSpace {
-			nodeName = lvg.Status.Nodes[0].Name
-			maxFreeSpace = freeSpace.Value()
+		if excludeTaintKey != "" && slices.ContainsFunc(node.Spec.Taints, func(t corev1.Taint) bool { return t.Key == excludeTaintKey }) {
+			log.Info(fmt.Sprintf("[FilterSchedulableLVGs] node %s of lvg %s has taint %s. Exclude it", nodeName, lvg.Name, excludeTaintKey))
+			continue
 		}
+
+		result = append(result, lvg)
 	}
 
-	return nodeName, *resource.NewQuantity(maxFreeSpace, resource.BinarySI), nil
+	return result, nil
 }
 
 func GetLVMVolumeGroup(ctx context.Context, kc client.Client, lvgName string) (*snc.LVMVolumeGroup, error) {
@@ -347,6 +898,22 @@ func GetLVMVolumeGroup(ctx context.Context, kc client.Client, lvgName string) (*
 	return lvg, nil
 }
 
+// GetReadyLVMVolumeGroup returns the LVMVolumeGroup whose status is populated by the node agent, see IsLVGStatusPopulated.
+// The NotFound error of the API server is returned as is for a missing LVMVolumeGroup, and the LVMVolumeGroup
+// with ErrNotReady, also matching ErrLVGNotReady, for the one whose status is not populated yet.
+func GetReadyLVMVolumeGroup(ctx context.Context, kc client.Client, lvgName string) (*snc.LVMVolumeGroup, error) {
+	lvg, err := GetLVMVolumeGroup(ctx, kc, lvgName)
+	if err != nil {
+		return nil, err
+	}
+
+	if !IsLVGStatusPopulated(*lvg) {
+		return lvg, fmt.Errorf("%w: %w: LVMVolumeGroup %s", ErrLVGNotReady, ErrNotReady, lvgName)
+	}
+
+	return lvg, nil
+}
+
 func GetLVMVolumeGroupFreeSpace(lvg snc.LVMVolumeGroup) (vgFreeSpace resource.Quantity) {
 	vgFreeSpace = lvg.Status.VGSize
 	vgFreeSpace.Sub(lvg.Status.AllocatedSize)
@@ -354,69 +921,230 @@ func GetLVMVolumeGroupFreeSpace(lvg snc.LVMVolumeGroup) (vgFreeSpace resource.Qu
 }
 
 func GetLVMThinPoolFreeSpace(lvg snc.LVMVolumeGroup, thinPoolName string) (thinPoolFreeSpace resource.Quantity, err error) {
-	var storagePoolThinPool *snc.LVMVolumeGroupThinPoolStatus
-	for _, thinPool := range lvg.Status.ThinPools {
-		if thinPool.Name == thinPoolName {
-			storagePoolThinPool = &thinPool
-			break
-		}
+	storagePoolThinPool, err := getLVMThinPoolStatus(lvg, thinPoolName)
+	if err != nil {
+		return thinPoolFreeSpace, fmt.Errorf("[GetLVMThinPoolFreeSpace] %w", err)
 	}
 
-	if storagePoolThinPool == nil {
-		return thinPoolFreeSpace, fmt.Errorf("[GetLVMThinPoolFreeSpace] thin pool %s not found in lvg %+v", thinPoolName, lvg)
+	return storagePoolThinPool.AvailableSpace, nil
+}
+
+func getLVMThinPoolStatus(lvg snc.LVMVolumeGroup, thinPoolName string) (*snc.LVMVolumeGroupThinPoolStatus, error) {
+	for i := range lvg.Status.ThinPools {
+		if lvg.Status.ThinPools[i].Name == thinPoolName {
+			return &lvg.Status.ThinPools[i], nil
+		}
 	}
 
-	return storagePoolThinPool.AvailableSpace, nil
+	return nil, checkThinPoolExists(lvg, thinPoolName)
 }
 
+// ErrInvalidExpandSize is returned by ExpandLVMLogicalVolume for a new size that cannot be applied.
+var ErrInvalidExpandSize = errors.New("invalid new size")
+
+// ExpandLVMLogicalVolume sets the new size of the LVMLogicalVolume. The size must be a positive quantity
+// larger than the actual size of the volume, otherwise ErrInvalidExpandSize is returned and nothing is updated.
 func ExpandLVMLogicalVolume(ctx context.Context, kc client.Client, llv *snc.LVMLogicalVolume, newSize string) error {
-	llv.Spec.Size = newSize
+	size, err := resource.ParseQuantity(newSize)
+	if err != nil {
+		return fmt.Errorf("%w %q of LVMLogicalVolume %s: %v", ErrInvalidExpandSize, newSize, llv.Name, err)
+	}
+
+	if size.Sign() <= 0 {
+		return fmt.Errorf("%w %q of LVMLogicalVolume %s: the size must be positive", ErrInvalidExpandSize, newSize, llv.Name)
+	}
+
+	if llv.Status != nil && size.Cmp(llv.Status.ActualSize) <= 0 {
+		return fmt.Errorf("%w %q of LVMLogicalVolume %s: the size must exceed the actual size %s", ErrInvalidExpandSize, newSize, llv.Name, llv.Status.ActualSize.String())
+	}
+
+	llv.Spec.Size = size.String()
 	return kc.Update(ctx, llv)
 }
 
+// ParseLVMVolumeGroups parses and validates the yaml LVMVolumeGroups parameter of a storage class.
+// The parameter is either a list of the entries or an LVMVolumeGroupsWithDefaults object.
+// In the latter form every entry must resolve to a thin pool, its own or the default one.
+func ParseLVMVolumeGroups(lvgsParam string) (LVMVolumeGroups, error) {
+	var lvgs LVMVolumeGroups
+	withDefaults := false
+	if err := yaml.Unmarshal([]byte(lvgsParam), &lvgs); err != nil {
+		var obj LVMVolumeGroupsWithDefaults
+		if objErr := yaml.UnmarshalStrict([]byte(lvgsParam), &obj); objErr != nil {
+			return nil, fmt.Errorf("unable to unmarshal LVMVolumeGroups: %w", err)
+		}
+		lvgs = obj.VolumeGroups
+		withDefaults = true
+
+		for i := range lvgs {
+			if lvgs[i].Thin == nil && obj.DefaultThinPoolName != "" {
+				lvgs[i].Thin = &VolumeGroupThin{PoolName: obj.DefaultThinPoolName}
+			}
+		}
+	}
+
+	if len(lvgs) == 0 {
+		return nil, errors.New("no LVMVolumeGroups specified")
+	}
+
+	seen := make(map[string]int, len(lvgs))
+	for i, lvg := range lvgs {
+		if strings.TrimSpace(lvg.Name) == "" {
+			return nil, fmt.Errorf("LVMVolumeGroups entry %d: name is empty", i)
+		}
+
+		if idx, ok := seen[lvg.Name]; ok {
+			return nil, fmt.Errorf("LVMVolumeGroups entry %d: LVMVolumeGroup %s is already specified in entry %d", i, lvg.Name, idx)
+		}
+		seen[lvg.Name] = i
+
+		if lvg.Thin != nil && strings.TrimSpace(lvg.Thin.PoolName) == "" {
+			return nil, fmt.Errorf("LVMVolumeGroups entry %d (%s): thin.poolName is empty", i, lvg.Name)
+		}
+
+		if lvg.BytesPerInode != "" {
+			if _, err := parseBytesPerInode(lvg.BytesPerInode); err != nil {
+				return nil, fmt.Errorf("LVMVolumeGroups entry %d (%s): invalid bytesPerInode: %w", i, lvg.Name, err)
+			}
+		}
+
+		if withDefaults && lvg.Thin == nil {
+			return nil, fmt.Errorf("LVMVolumeGroups entry %d (%s): neither thin.poolName nor defaultThinPoolName is specified", i, lvg.Name)
+		}
+	}
+
+	return lvgs, nil
+}
+
+// LVGLister lists the LVMVolumeGroups the volume placement is chosen from.
+type LVGLister interface {
+	ListLVGs(ctx context.Context) ([]snc.LVMVolumeGroup, error)
+}
+
+// ClientLVGLister reads the LVMVolumeGroups from the API server on every call.
+type ClientLVGLister struct {
+	Client client.Client
+}
+
+func (l ClientLVGLister) ListLVGs(ctx context.Context) ([]snc.LVMVolumeGroup, error) {
+	lvgs, err := GetLVGList(ctx, l.Client)
+	if err != nil {
+		return nil, err
+	}
+	return lvgs.Items, nil
+}
+
+func (l ClientLVGLister) VisitLVGs(ctx context.Context, fn func(lvg *snc.LVMVolumeGroup) error) error {
+	return ForEachLVG(ctx, l.Client, fn)
+}
+
+// LVGVisitor is implemented by the LVGListers streaming the LVMVolumeGroups page by page, so the callers keeping
+// only some of them do not hold all of them in memory.
+type LVGVisitor interface {
+	// VisitLVGs calls fn for every LVMVolumeGroup and stops at the first error fn returns.
+	VisitLVGs(ctx context.Context, fn func(lvg *snc.LVMVolumeGroup) error) error
+}
+
+// LVGRefresher is implemented by the LVGListers serving the LVMVolumeGroups from a cache, whose free space
+// may lag behind the space actually left on the nodes.
+type LVGRefresher interface {
+	// RefreshLVG replaces the cached LVMVolumeGroup with the given up-to-date one.
+	RefreshLVG(lvg *snc.LVMVolumeGroup)
+}
+
 func GetStorageClassLVGsAndParameters(
 	ctx context.Context,
-	kc client.Client,
+	lister LVGLister,
 	log *logger.Logger,
 	storageClassLVGParametersString string,
 ) (storageClassLVGs []snc.LVMVolumeGroup, storageClassLVGParametersMap map[string]string, err error) {
-	var storageClassLVGParametersList LVMVolumeGroups
-	err = yaml.Unmarshal([]byte(storageClassLVGParametersString), &storageClassLVGParametersList)
+	storageClassLVGParametersList, err := ParseLVMVolumeGroups(storageClassLVGParametersString)
 	if err != nil {
-		log.Error(err, "unmarshal yaml lvmVolumeGroup")
+		log.Error(err, "[GetStorageClassLVGs] unable to parse the storage class LVMVolumeGroups")
 		return nil, nil, err
 	}
 
 	storageClassLVGParametersMap = make(map[string]string, len(storageClassLVGParametersList))
 	for _, v := range storageClassLVGParametersList {
-		storageClassLVGParametersMap[v.Name] = v.Thin.PoolName
+		storageClassLVGParametersMap[v.Name] = v.ThinPoolName()
 	}
 	log.Info(fmt.Sprintf("[GetStorageClassLVGs] StorageClass LVM volume groups parameters map: %+v", storageClassLVGParametersMap))
 
-	lvgs, err := GetLVGList(ctx, kc)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	for _, lvg := range lvgs.Items {
+	processLVG := func(lvg *snc.LVMVolumeGroup) error {
 		log.Trace(fmt.Sprintf("[GetStorageClassLVGs] process lvg: %+v", lvg))
 
 		_, ok := storageClassLVGParametersMap[lvg.Name]
 		if ok {
 			log.Info(fmt.Sprintf("[GetStorageClassLVGs] found lvg from storage class: %s", lvg.Name))
-			log.Info(fmt.Sprintf("[GetStorageClassLVGs] lvg.Status.Nodes[0].Name: %s", lvg.Status.Nodes[0].Name))
-			storageClassLVGs = append(storageClassLVGs, lvg)
+			if nodeName, err := GetLVGNodeName(*lvg); err != nil {
+				log.Warning(fmt.Sprintf("[GetStorageClassLVGs] %v", err))
+			} else {
+				log.Info(fmt.Sprintf("[GetStorageClassLVGs] lvg node name: %s", nodeName))
+			}
+			storageClassLVGs = append(storageClassLVGs, *lvg)
 		} else {
 			log.Trace(fmt.Sprintf("[GetStorageClassLVGs] skip lvg: %s", lvg.Name))
 		}
+		return nil
+	}
+
+	// only the storage class LVMVolumeGroups are kept, so they are streamed if the lister supports it
+	if visitor, ok := lister.(LVGVisitor); ok {
+		if err := visitor.VisitLVGs(ctx, processLVG); err != nil {
+			return nil, nil, err
+		}
+		return storageClassLVGs, storageClassLVGParametersMap, nil
+	}
+
+	lvgs, err := lister.ListLVGs(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range lvgs {
+		_ = processLVG(&lvgs[i])
 	}
 
 	return storageClassLVGs, storageClassLVGParametersMap, nil
 }
 
+// GetLVGList returns all the LVMVolumeGroups, read page by page, see ForEachLVG.
 func GetLVGList(ctx context.Context, kc client.Client) (*snc.LVMVolumeGroupList, error) {
 	listLvgs := &snc.LVMVolumeGroupList{}
-	return listLvgs, kc.List(ctx, listLvgs)
+	err := ForEachLVG(ctx, kc, func(lvg *snc.LVMVolumeGroup) error {
+		listLvgs.Items = append(listLvgs.Items, *lvg)
+		return nil
+	})
+	return listLvgs, err
+}
+
+// ForEachLVG calls fn for every LVMVolumeGroup, reading them from the API server in pages of LVGListPageSize,
+// so only a page is held in memory at a time. The iteration stops at the first error fn returns.
+func ForEachLVG(ctx context.Context, kc client.Client, fn func(lvg *snc.LVMVolumeGroup) error) error {
+	var continueToken string
+	for {
+		opts := make([]client.ListOption, 0, 2)
+		if LVGListPageSize > 0 {
+			opts = append(opts, client.Limit(LVGListPageSize))
+		}
+		if continueToken != "" {
+			opts = append(opts, client.Continue(continueToken))
+		}
+
+		page := &snc.LVMVolumeGroupList{}
+		if err := kc.List(ctx, page, opts...); err != nil {
+			return err
+		}
+		for i := range page.Items {
+			if err := fn(&page.Items[i]); err != nil {
+				return err
+			}
+		}
+
+		continueToken = page.Continue
+		if continueToken == "" {
+			return nil
+		}
+	}
 }
 
 func GetLLVSpec(
@@ -428,19 +1156,26 @@ func GetLLVSpec(
 	llvSize resource.Quantity,
 	contiguous bool,
 	source *snc.LVMLogicalVolumeSource,
-) snc.LVMLogicalVolumeSpec {
+) (snc.LVMLogicalVolumeSpec, error) {
 	lvmLogicalVolumeSpec := snc.LVMLogicalVolumeSpec{
 		ActualLVNameOnTheNode: lvName,
 		Type:                  lvmType,
-		Size:                  llvSize.String(),
+		Size:                  CapacityBytesToQuantity(llvSize.Value()).String(),
 		LVMVolumeGroupName:    selectedLVG.Name,
 		Source:                source,
 	}
 
 	switch lvmType {
 	case internal.LVMTypeThin:
+		poolName, err := ResolveThinPoolName(selectedLVG, storageClassLVGParametersMap)
+		if err != nil {
+			return lvmLogicalVolumeSpec, err
+		}
+		if err := checkThinPoolExists(selectedLVG, poolName); err != nil {
+			return lvmLogicalVolumeSpec, err
+		}
 		lvmLogicalVolumeSpec.Thin = &snc.LVMLogicalVolumeThinSpec{
-			PoolName: storageClassLVGParametersMap[selectedLVG.Name],
+			PoolName: poolName,
 		}
 		log.Info(fmt.Sprintf("[GetLLVSpec] Thin pool name: %s", lvmLogicalVolumeSpec.Thin.PoolName))
 	case internal.LVMTypeThick:
@@ -453,16 +1188,17 @@ func GetLLVSpec(
 		log.Info(fmt.Sprintf("[GetLLVSpec] Thick contiguous: %t", contiguous))
 	}
 
-	return lvmLogicalVolumeSpec
+	return lvmLogicalVolumeSpec, nil
 }
 
+// SelectLVG returns the first of the LVMVolumeGroups located on the node. CreateVolume chooses among them
+// with the LVGSelector.
 func SelectLVG(storageClassLVGs []snc.LVMVolumeGroup, nodeName string) (*snc.LVMVolumeGroup, error) {
-	for i := 0; i < len(storageClassLVGs); i++ {
-		if storageClassLVGs[i].Status.Nodes[0].Name == nodeName {
-			return &storageClassLVGs[i], nil
-		}
+	nodeLVGs, err := lvgsOnNode(storageClassLVGs, nodeName)
+	if err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("[SelectLVG] no LVMVolumeGroup found for node %s", nodeName)
+	return nodeLVGs[0], nil
 }
 
 func SelectLVGByName(storageClassLVGs []snc.LVMVolumeGroup, name string) (*snc.LVMVolumeGroup, error) {
@@ -485,6 +1221,7 @@ func SelectLVGByActualNameOnTheNode(storageClassLVGs []snc.LVMVolumeGroup, nodeN
 }
 
 func removeLLVFinalizerIfExist(ctx context.Context, kc client.Client, log *logger.Logger, llv *snc.LVMLogicalVolume, finalizer string) (bool, error) {
+	var lastErr error
 	for attempt := 0; attempt < KubernetesAPIRequestLimit; attempt++ {
 		removed := false
 		for i, val := range llv.Finalizers {
@@ -500,6 +1237,7 @@ func removeLLVFinalizerIfExist(ctx context.Context, kc client.Client, log *logge
 		}
 
 		log.Trace(fmt.Sprintf("[removeLLVFinalizerIfExist] removing finalizer %s from LVMLogicalVolume %s", finalizer, llv.Name))
+		clearLLVFinalizerConflicts(llv)
 		err := kc.Update(ctx, llv)
 		if err == nil {
 			return true, nil
@@ -508,6 +1246,7 @@ func removeLLVFinalizerIfExist(ctx context.Context, kc client.Client, log *logge
 		if !kerrors.IsConflict(err) {
 			return false, fmt.Errorf("[removeLLVFinalizerIfExist] error updating LVMLogicalVolume %s: %w", llv.Name, err)
 		}
+		lastErr = err
 
 		if attempt < KubernetesAPIRequestLimit-1 {
 			log.Trace(fmt.Sprintf("[removeLLVFinalizerIfExist] conflict while updating LVMLogicalVolume %s, retrying...", llv.Name))
@@ -515,18 +1254,158 @@ func removeLLVFinalizerIfExist(ctx context.Context, kc client.Client, log *logge
 			case <-ctx.Done():
 				return false, ctx.Err()
 			default:
-				time.Sleep(KubernetesAPIRequestTimeout * time.Second)
+				time.Sleep(KubernetesAPIRequestTimeout)
 				freshLLV, getErr := GetLVMLogicalVolume(ctx, kc, llv.Name, "")
 				if getErr != nil {
 					return false, fmt.Errorf("[removeLLVFinalizerIfExist] error getting LVMLogicalVolume %s after update conflict: %w", llv.Name, getErr)
 				}
 				// Update the llv struct with fresh data (without changing pointers because we need the new resource version outside of this function)
 				*llv = *freshLLV
+				recordLLVFinalizerConflict(ctx, kc, log, llv)
+			}
+		}
+	}
+
+	if fresh, getErr := GetLVMLogicalVolume(ctx, kc, llv.Name, ""); getErr == nil {
+		recordLLVFinalizerConflict(ctx, kc, log, fresh)
+	}
+	return false, fmt.Errorf("after %d attempts of removing finalizer %s from LVMLogicalVolume %s, last error: %w", KubernetesAPIRequestLimit, finalizer, llv.Name, lastErr)
+}
+
+// recordLLVFinalizerConflict shows the finalizer removal retries on the LVMLogicalVolume. It is informational,
+// so a failure is only logged.
+func recordLLVFinalizerConflict(ctx context.Context, kc client.Client, log *logger.Logger, llv *snc.LVMLogicalVolume) {
+	if err := RecordLLVFinalizerConflict(ctx, kc, llv, time.Now()); err != nil {
+		log.Warning(fmt.Sprintf("[removeLLVFinalizerIfExist] unable to record the finalizer removal attempts on LVMLogicalVolume %s: %v", llv.Name, err))
+	}
+}
+
+// GetProvisionTimeout returns the provisioning timeout from the storage class parameters clamped to maxTimeout,
+// or defaultTimeout if the parameter is not set.
+func GetProvisionTimeout(params map[string]string, defaultTimeout, maxTimeout time.Duration) (time.Duration, error) {
+	val, ok := params[internal.ProvisionTimeoutKey]
+	if !ok || val == "" {
+		return defaultTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q of %s: %w", val, internal.ProvisionTimeoutKey, err)
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("invalid value %q of %s: must be positive", val, internal.ProvisionTimeoutKey)
+	}
+
+	return min(timeout, maxTimeout), nil
+}
+
+// FreeSpaceThreshold is either an absolute free space or a percentage of the total space.
+type FreeSpaceThreshold struct {
+	Quantity resource.Quantity
+	Percent  float64
+}
+
+// IsZero reports whether the threshold is not set.
+func (t FreeSpaceThreshold) IsZero() bool {
+	return t.Quantity.IsZero() && t.Percent == 0
+}
+
+// IsBelow reports whether the free space is below the threshold. The percentage is applied
+// with the big floats, so the large sizes do not lose precision.
+func (t FreeSpaceThreshold) IsBelow(free, total resource.Quantity) bool {
+	if t.Percent > 0 {
+		scaledFree := new(big.Float).SetPrec(128).SetInt64(free.Value())
+		scaledFree.Mul(scaledFree, big.NewFloat(100))
+		scaledTotal := new(big.Float).SetPrec(128).SetInt64(total.Value())
+		scaledTotal.Mul(scaledTotal, big.NewFloat(t.Percent))
+		return scaledFree.Cmp(scaledTotal) < 0
+	}
+	return free.Cmp(t.Quantity) < 0
+}
+
+func (t FreeSpaceThreshold) String() string {
+	if t.Percent > 0 {
+		return strconv.FormatFloat(t.Percent, 'f', -1, 64) + "%"
+	}
+	return t.Quantity.String()
+}
+
+// GetFreeSpaceSoftThreshold returns the free space soft threshold from the storage class parameters.
+// A zero threshold is returned if the parameter is not set.
+func GetFreeSpaceSoftThreshold(params map[string]string) (FreeSpaceThreshold, error) {
+	val := strings.TrimSpace(params[internal.FreeSpaceSoftThresholdKey])
+	if val == "" {
+		return FreeSpaceThreshold{}, nil
+	}
+
+	if percent, ok := strings.CutSuffix(val, "%"); ok {
+		p, err := strconv.ParseFloat(strings.TrimSpace(percent), 64)
+		if err != nil || p <= 0 || p > 100 {
+			return FreeSpaceThreshold{}, fmt.Errorf("invalid value %q of %s: percentage must be in (0, 100]", val, internal.FreeSpaceSoftThresholdKey)
+		}
+		return FreeSpaceThreshold{Percent: p}, nil
+	}
+
+	q, err := resource.ParseQuantity(val)
+	if err != nil {
+		return FreeSpaceThreshold{}, fmt.Errorf("invalid value %q of %s: %w", val, internal.FreeSpaceSoftThresholdKey, err)
+	}
+	if q.Sign() <= 0 {
+		return FreeSpaceThreshold{}, fmt.Errorf("invalid value %q of %s: must be positive", val, internal.FreeSpaceSoftThresholdKey)
+	}
+
+	return FreeSpaceThreshold{Quantity: q}, nil
+}
+
+// GetLLVSegmentLayout returns the known segment layout of the LVMLogicalVolume or nil if it can't be determined.
+// The node agent reports only the contiguity of thick LVs, so a contiguous LV is the only one with a known segment count.
+func GetLLVSegmentLayout(llv *snc.LVMLogicalVolume) map[string]string {
+	if llv.Spec.Type != internal.LVMTypeThick || llv.Status == nil || llv.Status.Contiguous == nil {
+		return nil
+	}
+
+	if !*llv.Status.Contiguous {
+		return map[string]string{internal.LayoutContiguousKey: "false"}
+	}
+
+	return map[string]string{
+		internal.LayoutContiguousKey: "true",
+		internal.LayoutSegmentsKey:   "1",
+	}
+}
+
+// ValidateLVMTypeParameters checks the storage class parameters do not mix the thin and thick ones:
+// a thin volume cannot be contiguous, and a thick volume cannot use thin pools or the thin pool settings.
+// The LVM type and the LVMVolumeGroups are checked as the LocalStorageClass webhook checks the spec.
+func ValidateLVMTypeParameters(params map[string]string) error {
+	lvmType := params[internal.LvmTypeKey]
+	spec := slv.LocalStorageClassLVMSpec{
+		Type:  lvmType,
+		Thick: &slv.LocalStorageClassLVMThickSpec{Contiguous: params[internal.LVMVThickContiguousParamKey] == "true"},
+	}
+
+	if lvmType == internal.LVMTypeThick {
+		if strategy := params[internal.ThinPoolSelectionStrategyKey]; strategy != "" {
+			return fmt.Errorf("%s is only supported for %s volumes, but %s is %s", internal.ThinPoolSelectionStrategyKey, internal.LVMTypeThin, internal.LvmTypeKey, lvmType)
+		}
+		if params[internal.ThinPreallocateKey] == "true" {
+			return fmt.Errorf("%s is only supported for %s volumes, but %s is %s", internal.ThinPreallocateKey, internal.LVMTypeThin, internal.LvmTypeKey, lvmType)
+		}
+
+		lvgs, err := ParseLVMVolumeGroups(params[internal.LVMVolumeGroupKey])
+		if err != nil {
+			return err
+		}
+		for _, lvg := range lvgs {
+			specLVG := slv.LocalStorageClassLVG{Name: lvg.Name}
+			if lvg.Thin != nil {
+				specLVG.Thin = &slv.LocalStorageClassLVMThinPoolSpec{PoolName: lvg.Thin.PoolName}
 			}
+			spec.LVMVolumeGroups = append(spec.LVMVolumeGroups, specLVG)
 		}
 	}
 
-	return false, fmt.Errorf("after %d attempts of removing finalizer %s from LVMLogicalVolume %s, last error: %w", KubernetesAPIRequestLimit, finalizer, llv.Name, nil)
+	return spec.ValidateLVMType()
 }
 
 func IsContiguous(request *csi.CreateVolumeRequest, lvmType string) bool {
@@ -0,0 +1,765 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	storagev1 "k8s.io/api/storage/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	"sds-local-volume-csi/internal"
+	"sds-local-volume-csi/pkg/logger"
+)
+
+func newLVG(name, nodeName, vgFree string) snc.LVMVolumeGroup {
+	lvg := snc.LVMVolumeGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: snc.LVMVolumeGroupStatus{
+			VGFree: resource.MustParse(vgFree),
+		},
+	}
+	if nodeName != "" {
+		lvg.Status.Nodes = []snc.LVMVolumeGroupNode{{Name: nodeName}}
+	}
+	return lvg
+}
+
+func TestSelection(t *testing.T) {
+	t.Run("GetNodeWithMaxFreeSpace_skips_lvg_without_nodes", func(t *testing.T) {
+		lvgs := []snc.LVMVolumeGroup{
+			newLVG("lvg-not-ready", "", "100Gi"),
+			newLVG("lvg-1", "node-1", "10Gi"),
+		}
+
+		assert.NotPanics(t, func() {
+			nodeName, freeSpace, err := GetNodeWithMaxFreeSpace(lvgs, nil, internal.LVMTypeThick)
+			assert.NoError(t, err)
+			assert.Equal(t, "node-1", nodeName)
+			assert.Equal(t, "10Gi", freeSpace.String())
+		})
+	})
+
+	t.Run("GetNodeWithMaxFreeSpace_all_lvgs_not_ready_returns_error", func(t *testing.T) {
+		lvgs := []snc.LVMVolumeGroup{newLVG("lvg-not-ready", "", "100Gi")}
+
+		_, _, err := GetNodeWithMaxFreeSpace(lvgs, nil, internal.LVMTypeThick)
+		assert.ErrorIs(t, err, ErrLVGNotReady)
+	})
+
+	t.Run("SelectLVG_skips_lvg_without_nodes", func(t *testing.T) {
+		lvgs := []snc.LVMVolumeGroup{
+			newLVG("lvg-not-ready", "", "100Gi"),
+			newLVG("lvg-1", "node-1", "10Gi"),
+		}
+
+		lvg, err := SelectLVG(lvgs, "node-1")
+		if assert.NoError(t, err) {
+			assert.Equal(t, "lvg-1", lvg.Name)
+		}
+
+		_, err = SelectLVG(lvgs, "node-2")
+		assert.ErrorIs(t, err, ErrLVGNotReady)
+		assert.ErrorContains(t, err, "lvg-not-ready")
+	})
+
+	t.Run("GetNodeWithLowestThinPoolOvercommit_prefers_less_overcommitted_pool", func(t *testing.T) {
+		risky := newLVG("lvg-risky", "node-1", "0")
+		risky.Status.ThinPools = []snc.LVMVolumeGroupThinPoolStatus{{
+			Name:           "pool",
+			ActualSize:     resource.MustParse("100Gi"),
+			AllocatedSize:  resource.MustParse("400Gi"),
+			AvailableSpace: resource.MustParse("80Gi"),
+		}}
+		safe := newLVG("lvg-safe", "node-2", "0")
+		safe.Status.ThinPools = []snc.LVMVolumeGroupThinPoolStatus{{
+			Name:           "pool",
+			ActualSize:     resource.MustParse("100Gi"),
+			AllocatedSize:  resource.MustParse("50Gi"),
+			AvailableSpace: resource.MustParse("30Gi"),
+		}}
+		lvgs := []snc.LVMVolumeGroup{risky, safe}
+		params := map[string]string{"lvg-risky": "pool", "lvg-safe": "pool"}
+
+		nodeName, _, err := GetNodeWithMaxFreeSpace(lvgs, params, internal.LVMTypeThin)
+		assert.NoError(t, err)
+		assert.Equal(t, "node-1", nodeName)
+
+		nodeName, poolName, freeSpace, ratio, err := GetNodeWithLowestThinPoolOvercommit(lvgs, params)
+		assert.NoError(t, err)
+		assert.Equal(t, "node-2", nodeName)
+		assert.Equal(t, "pool", poolName)
+		assert.Equal(t, "30Gi", freeSpace.String())
+		assert.InDelta(t, 0.5, ratio, 0.001)
+	})
+}
+
+func TestGetProvisionTimeout(t *testing.T) {
+	t.Run("default_is_used_when_not_set", func(t *testing.T) {
+		timeout, err := GetProvisionTimeout(map[string]string{}, time.Minute, time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, time.Minute, timeout)
+	})
+
+	t.Run("class_timeout_overrides_default", func(t *testing.T) {
+		timeout, err := GetProvisionTimeout(map[string]string{internal.ProvisionTimeoutKey: "10m"}, time.Minute, time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, 10*time.Minute, timeout)
+	})
+
+	t.Run("class_timeout_is_clamped", func(t *testing.T) {
+		timeout, err := GetProvisionTimeout(map[string]string{internal.ProvisionTimeoutKey: "48h"}, time.Minute, time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, time.Hour, timeout)
+	})
+
+	t.Run("unparseable_timeout_is_rejected", func(t *testing.T) {
+		_, err := GetProvisionTimeout(map[string]string{internal.ProvisionTimeoutKey: "soon"}, time.Minute, time.Hour)
+		assert.ErrorContains(t, err, internal.ProvisionTimeoutKey)
+	})
+}
+
+func TestParseLVMVolumeGroups(t *testing.T) {
+	t.Run("valid_multi_entry", func(t *testing.T) {
+		lvgs, err := ParseLVMVolumeGroups("- name: lvg-1\n  thin:\n    poolName: pool-1\n- name: lvg-2\n- name: lvg-3\n  thin: null\n")
+		require.NoError(t, err)
+		require.Len(t, lvgs, 3)
+		assert.Equal(t, "lvg-1", lvgs[0].Name)
+		assert.Equal(t, "pool-1", lvgs[0].ThinPoolName())
+		assert.Nil(t, lvgs[1].Thin)
+		assert.Equal(t, "", lvgs[2].ThinPoolName())
+	})
+
+	for _, tc := range []struct {
+		name   string
+		yaml   string
+		errMsg string
+	}{
+		{name: "not_a_list", yaml: "name: lvg-1\n", errMsg: "unable to unmarshal"},
+		{name: "empty_list", yaml: "[]\n", errMsg: "no LVMVolumeGroups specified"},
+		{name: "empty_name", yaml: "- name: lvg-1\n- thin:\n    poolName: pool-1\n", errMsg: "entry 1: name is empty"},
+		{name: "duplicate_name", yaml: "- name: lvg-1\n- name: lvg-1\n", errMsg: "entry 1: LVMVolumeGroup lvg-1 is already specified in entry 0"},
+		{name: "empty_pool_name", yaml: "- name: lvg-1\n- name: lvg-2\n  thin: {}\n", errMsg: "entry 1 (lvg-2): thin.poolName is empty"},
+		{name: "malformed_thin", yaml: "- name: lvg-1\n  thin: pool-1\n", errMsg: "unable to unmarshal"},
+		{name: "unknown_top_level_field", yaml: "defaultPool: pool-1\nvolumeGroups:\n- name: lvg-1\n", errMsg: "unable to unmarshal"},
+		{name: "empty_default_form", yaml: "defaultThinPoolName: pool-1\n", errMsg: "no LVMVolumeGroups specified"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseLVMVolumeGroups(tc.yaml)
+			assert.ErrorContains(t, err, tc.errMsg)
+		})
+	}
+}
+
+func TestGetStorageClassLVGsAndParametersDefaultThinPool(t *testing.T) {
+	ctx := context.Background()
+	s := runtime.NewScheme()
+	require.NoError(t, snc.AddToScheme(s))
+	lvg1, lvg2 := newLVG("lvg-1", "node-1", "10Gi"), newLVG("lvg-2", "node-2", "10Gi")
+	lister := ClientLVGLister{Client: fake.NewClientBuilder().WithScheme(s).WithObjects(&lvg1, &lvg2).Build()}
+
+	t.Run("default_applied", func(t *testing.T) {
+		lvgs, params, err := GetStorageClassLVGsAndParameters(ctx, lister, &logger.Logger{}, "defaultThinPoolName: pool-1\nvolumeGroups:\n- name: lvg-1\n- name: lvg-2\n")
+		require.NoError(t, err)
+		assert.Len(t, lvgs, 2)
+		assert.Equal(t, map[string]string{"lvg-1": "pool-1", "lvg-2": "pool-1"}, params)
+	})
+
+	t.Run("per_lvg_override", func(t *testing.T) {
+		_, params, err := GetStorageClassLVGsAndParameters(ctx, lister, &logger.Logger{}, "defaultThinPoolName: pool-1\nvolumeGroups:\n- name: lvg-1\n- name: lvg-2\n  thin:\n    poolName: pool-2\n")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"lvg-1": "pool-1", "lvg-2": "pool-2"}, params)
+	})
+
+	t.Run("no_pool_error", func(t *testing.T) {
+		_, _, err := GetStorageClassLVGsAndParameters(ctx, lister, &logger.Logger{}, "volumeGroups:\n- name: lvg-1\n  thin:\n    poolName: pool-2\n- name: lvg-2\n")
+		assert.ErrorContains(t, err, "entry 1 (lvg-2): neither thin.poolName nor defaultThinPoolName is specified")
+	})
+
+	t.Run("list_form_is_unchanged", func(t *testing.T) {
+		_, params, err := GetStorageClassLVGsAndParameters(ctx, lister, &logger.Logger{}, "- name: lvg-1\n- name: lvg-2\n")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"lvg-1": "", "lvg-2": ""}, params)
+	})
+}
+
+func TestGetLLVSpecThinPoolFallback(t *testing.T) {
+	log := &logger.Logger{}
+	size := resource.MustParse("1Gi")
+
+	newThinLVG := func(pools ...string) snc.LVMVolumeGroup {
+		lvg := snc.LVMVolumeGroup{ObjectMeta: metav1.ObjectMeta{Name: "lvg-1"}}
+		for _, pool := range pools {
+			lvg.Status.ThinPools = append(lvg.Status.ThinPools, snc.LVMVolumeGroupThinPoolStatus{Name: pool})
+		}
+		return lvg
+	}
+
+	t.Run("storage_class_pool_is_used", func(t *testing.T) {
+		spec, err := GetLLVSpec(log, "lv", newThinLVG("pool-1", "pool-2"), map[string]string{"lvg-1": "pool-2"}, internal.LVMTypeThin, size, false, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "pool-2", spec.Thin.PoolName)
+	})
+
+	t.Run("sole_pool_is_used_when_not_specified", func(t *testing.T) {
+		spec, err := GetLLVSpec(log, "lv", newThinLVG("pool-1"), map[string]string{"lvg-1": ""}, internal.LVMTypeThin, size, false, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "pool-1", spec.Thin.PoolName)
+	})
+
+	t.Run("several_pools_require_explicit_selection", func(t *testing.T) {
+		_, err := GetLLVSpec(log, "lv", newThinLVG("pool-1", "pool-2"), map[string]string{"lvg-1": ""}, internal.LVMTypeThin, size, false, nil)
+		assert.ErrorIs(t, err, ErrThinPoolNotResolved)
+		assert.ErrorContains(t, err, "pool-1")
+	})
+
+	t.Run("no_pools_cannot_be_resolved", func(t *testing.T) {
+		_, err := GetLLVSpec(log, "lv", newThinLVG(), map[string]string{"lvg-1": ""}, internal.LVMTypeThin, size, false, nil)
+		assert.ErrorIs(t, err, ErrThinPoolNotResolved)
+	})
+
+	t.Run("misnamed_pool_is_rejected", func(t *testing.T) {
+		_, err := GetLLVSpec(log, "lv", newThinLVG("pool-1", "pool-2"), map[string]string{"lvg-1": "pool-3"}, internal.LVMTypeThin, size, false, nil)
+		assert.ErrorIs(t, err, ErrThinPoolNotFound)
+		assert.ErrorContains(t, err, "thin pool pool-3 of LVMVolumeGroup lvg-1")
+		assert.ErrorContains(t, err, "available thin pools: [pool-1 pool-2]")
+	})
+}
+
+func TestCheckCSINodeTopologyKey(t *testing.T) {
+	ctx := context.Background()
+	s := runtime.NewScheme()
+	require.NoError(t, storagev1.AddToScheme(s))
+
+	newCSINode := func(name string, keys ...string) *storagev1.CSINode {
+		return &storagev1.CSINode{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: storagev1.CSINodeSpec{Drivers: []storagev1.CSINodeDriver{
+				{Name: "local.csi.storage.deckhouse.io", NodeID: name, TopologyKeys: keys},
+				{Name: "other.csi.example.com", NodeID: name, TopologyKeys: []string{"other/node"}},
+			}},
+		}
+	}
+	cl := fake.NewClientBuilder().WithScheme(s).WithObjects(
+		newCSINode("node-1", "example.com/node"),
+		newCSINode("node-2", internal.TopologyKey),
+		newCSINode("node-3"),
+	).Build()
+
+	t.Run("matching_key", func(t *testing.T) {
+		assert.NoError(t, CheckCSINodeTopologyKey(ctx, cl, "local.csi.storage.deckhouse.io", "example.com/node", "node-2"))
+	})
+
+	t.Run("mismatched_key", func(t *testing.T) {
+		err := CheckCSINodeTopologyKey(ctx, cl, "local.csi.storage.deckhouse.io", "example.com/node", "")
+		assert.ErrorIs(t, err, ErrTopologyKeyMismatch)
+		assert.ErrorContains(t, err, "node-2")
+		assert.NotContains(t, err.Error(), "node-3")
+	})
+}
+
+func TestParseKubernetesAPIRetries(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		limit, timeout, err := ParseKubernetesAPIRetries("", "")
+		require.NoError(t, err)
+		assert.Equal(t, DefaultKubernetesAPIRequestLimit, limit)
+		assert.Equal(t, DefaultKubernetesAPIRequestTimeout, timeout)
+	})
+
+	t.Run("overrides", func(t *testing.T) {
+		limit, timeout, err := ParseKubernetesAPIRetries("5", "250ms")
+		require.NoError(t, err)
+		assert.Equal(t, 5, limit)
+		assert.Equal(t, 250*time.Millisecond, timeout)
+	})
+
+	for name, values := range map[string][2]string{
+		"zero_limit":        {"0", ""},
+		"negative_limit":    {"-1", ""},
+		"non_numeric_limit": {"many", ""},
+		"zero_timeout":      {"", "0s"},
+		"negative_timeout":  {"", "-1s"},
+		"unitless_timeout":  {"", "1"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := ParseKubernetesAPIRetries(values[0], values[1])
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestKubernetesAPIRequestLimitOverride(t *testing.T) {
+	ctx := context.Background()
+	t.Cleanup(func() {
+		KubernetesAPIRequestLimit, KubernetesAPIRequestTimeout = DefaultKubernetesAPIRequestLimit, DefaultKubernetesAPIRequestTimeout
+	})
+
+	t.Setenv("KUBERNETES_API_REQUEST_LIMIT", "5")
+	t.Setenv("KUBERNETES_API_REQUEST_TIMEOUT", "1ms")
+	limit, timeout, err := ParseKubernetesAPIRetries(os.Getenv("KUBERNETES_API_REQUEST_LIMIT"), os.Getenv("KUBERNETES_API_REQUEST_TIMEOUT"))
+	require.NoError(t, err)
+	KubernetesAPIRequestLimit, KubernetesAPIRequestTimeout = limit, timeout
+
+	s := runtime.NewScheme()
+	require.NoError(t, snc.AddToScheme(s))
+	llv := &snc.LVMLogicalVolume{ObjectMeta: metav1.ObjectMeta{Name: "pvc-1", Finalizers: []string{SDSLocalVolumeCSIFinalizer}}}
+	updates := 0
+	cl := fake.NewClientBuilder().WithScheme(s).WithObjects(llv).WithInterceptorFuncs(interceptor.Funcs{
+		Update: func(context.Context, client.WithWatch, client.Object, ...client.UpdateOption) error {
+			updates++
+			return kerrors.NewConflict(schema.GroupResource{Group: "storage.deckhouse.io", Resource: "lvmlogicalvolumes"}, "pvc-1", errors.New("conflict"))
+		},
+	}).Build()
+
+	err = DeleteLVMLogicalVolume(ctx, cl, &logger.Logger{}, "trace", "pvc-1", SDSLocalVolumeCSIFinalizer)
+	assert.Error(t, err)
+	assert.Equal(t, 5, updates)
+}
+
+func TestRemoveLLVFinalizerConflictAnnotations(t *testing.T) {
+	ctx := context.Background()
+	KubernetesAPIRequestTimeout = time.Millisecond
+	t.Cleanup(func() { KubernetesAPIRequestTimeout = DefaultKubernetesAPIRequestTimeout })
+
+	s := runtime.NewScheme()
+	require.NoError(t, snc.AddToScheme(s))
+	conflict := kerrors.NewConflict(schema.GroupResource{Group: "storage.deckhouse.io", Resource: "lvmlogicalvolumes"}, "pvc-1", errors.New("conflict"))
+
+	// newConflictingClient fails the first conflicts updates of the LVMLogicalVolume and records
+	// the attempts annotation the LVMLogicalVolume has at each update
+	newConflictingClient := func(llv *snc.LVMLogicalVolume, conflicts int) (client.Client, *[]string) {
+		var seen []string
+		cl := fake.NewClientBuilder().WithScheme(s).WithObjects(llv).WithInterceptorFuncs(interceptor.Funcs{
+			Update: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+				current := &snc.LVMLogicalVolume{}
+				require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(obj), current))
+				seen = append(seen, current.Annotations[internal.FinalizerRemovalAttemptsAnnotation])
+				if len(seen) <= conflicts {
+					return conflict
+				}
+				return c.Update(ctx, obj, opts...)
+			},
+		}).Build()
+		return cl, &seen
+	}
+	newLLV := func() *snc.LVMLogicalVolume {
+		return &snc.LVMLogicalVolume{ObjectMeta: metav1.ObjectMeta{Name: "pvc-1", Finalizers: []string{SDSLocalVolumeCSIFinalizer}}}
+	}
+
+	t.Run("attempts_are_shown_during_conflicts_and_cleared_on_success", func(t *testing.T) {
+		cl, seen := newConflictingClient(newLLV(), 2)
+		llv := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, llv))
+
+		removed, err := removeLLVFinalizerIfExist(ctx, cl, &logger.Logger{}, llv, SDSLocalVolumeCSIFinalizer)
+		require.NoError(t, err)
+		assert.True(t, removed)
+		assert.Equal(t, []string{"", "1", "2"}, *seen)
+
+		got := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, got))
+		assert.Empty(t, got.Finalizers)
+		assert.NotContains(t, got.Annotations, internal.FinalizerRemovalAttemptsAnnotation)
+		assert.NotContains(t, got.Annotations, internal.FinalizerRemovalLastConflictAnnotation)
+	})
+
+	t.Run("attempts_accumulate_across_calls", func(t *testing.T) {
+		cl, _ := newConflictingClient(newLLV(), 100)
+
+		for i := 0; i < 2; i++ {
+			llv := &snc.LVMLogicalVolume{}
+			require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, llv))
+			_, err := removeLLVFinalizerIfExist(ctx, cl, &logger.Logger{}, llv, SDSLocalVolumeCSIFinalizer)
+			assert.ErrorIs(t, err, conflict)
+		}
+
+		got := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, got))
+		assert.Equal(t, []string{SDSLocalVolumeCSIFinalizer}, got.Finalizers)
+		assert.Equal(t, strconv.Itoa(2*KubernetesAPIRequestLimit), got.Annotations[internal.FinalizerRemovalAttemptsAnnotation])
+		conflictTime, err := time.Parse(time.RFC3339, got.Annotations[internal.FinalizerRemovalLastConflictAnnotation])
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now(), conflictTime, time.Minute)
+	})
+}
+
+func TestLargeQuantities(t *testing.T) {
+	// 7Ei is close to math.MaxInt64, where float64 can't tell the sizes a byte apart
+	huge := resource.MustParse("7Ei")
+	hugePlusByte := huge.DeepCopy()
+	hugePlusByte.Add(*resource.NewQuantity(1, resource.BinarySI))
+	hugeMinusByte := huge.DeepCopy()
+	hugeMinusByte.Sub(*resource.NewQuantity(1, resource.BinarySI))
+
+	t.Run("sizes_a_byte_apart_are_not_equal_within_a_byte", func(t *testing.T) {
+		assert.False(t, AreSizesEqualWithinDelta(huge, hugePlusByte, *resource.NewQuantity(1, resource.BinarySI)))
+		assert.True(t, AreSizesEqualWithinDelta(huge, hugePlusByte, *resource.NewQuantity(2, resource.BinarySI)))
+		assert.True(t, AreSizesEqualWithinDelta(hugePlusByte, huge, *resource.NewQuantity(2, resource.BinarySI)))
+	})
+
+	t.Run("most_free_space_is_selected_by_a_byte", func(t *testing.T) {
+		lvgs := []snc.LVMVolumeGroup{newLVG("lvg-1", "node-1", "7Ei"), newLVG("lvg-2", "node-2", "7Ei")}
+		lvgs[1].Status.VGFree = hugePlusByte
+
+		nodeName, freeSpace, err := GetNodeWithMaxFreeSpace(lvgs, nil, internal.LVMTypeThick)
+		require.NoError(t, err)
+		assert.Equal(t, "node-2", nodeName)
+		assert.Equal(t, 0, freeSpace.Cmp(hugePlusByte))
+	})
+
+	t.Run("least_fitting_space_is_selected_by_a_byte", func(t *testing.T) {
+		lvgs := []snc.LVMVolumeGroup{newLVG("lvg-1", "node-1", "7Ei"), newLVG("lvg-2", "node-2", "7Ei")}
+		lvgs[0].Status.VGFree = hugePlusByte
+
+		nodeName, freeSpace, err := BinPackNodeSelector{}.SelectNode(lvgs, nil, internal.LVMTypeThick, resource.MustParse("1Ei"))
+		require.NoError(t, err)
+		assert.Equal(t, "node-2", nodeName)
+		assert.Equal(t, 0, freeSpace.Cmp(huge))
+	})
+
+	t.Run("percent_threshold_is_precise", func(t *testing.T) {
+		threshold := FreeSpaceThreshold{Percent: 100}
+		assert.True(t, threshold.IsBelow(hugeMinusByte, huge))
+		assert.False(t, threshold.IsBelow(huge, huge))
+	})
+
+	t.Run("node_capacity_saturates", func(t *testing.T) {
+		lvgs := []snc.LVMVolumeGroup{newLVG("lvg-1", "node-1", "0"), newLVG("lvg-2", "node-1", "0")}
+		lvgs[0].Spec.Local.NodeName, lvgs[1].Spec.Local.NodeName = "node-1", "node-1"
+		lvgs[0].Status.VGSize, lvgs[1].Status.VGSize = huge, huge
+
+		assert.Equal(t, int64(math.MaxInt64), NodeLVGCapacity(lvgs, "node-1"))
+	})
+}
+
+func TestValidateLVMTypeParameters(t *testing.T) {
+	const (
+		thickLVGs = "- name: lvg-1\n"
+		thinLVGs  = "- name: lvg-1\n  thin:\n    poolName: pool-1\n"
+	)
+
+	for _, tc := range []struct {
+		name   string
+		params map[string]string
+		err    string
+	}{
+		{
+			name:   "thick",
+			params: map[string]string{internal.LvmTypeKey: internal.LVMTypeThick, internal.LVMVolumeGroupKey: thickLVGs},
+		},
+		{
+			name:   "thick_contiguous",
+			params: map[string]string{internal.LvmTypeKey: internal.LVMTypeThick, internal.LVMVolumeGroupKey: thickLVGs, internal.LVMVThickContiguousParamKey: "true"},
+		},
+		{
+			name:   "thin",
+			params: map[string]string{internal.LvmTypeKey: internal.LVMTypeThin, internal.LVMVolumeGroupKey: thinLVGs},
+		},
+		{
+			name:   "thin_with_selection_strategy",
+			params: map[string]string{internal.LvmTypeKey: internal.LVMTypeThin, internal.LVMVolumeGroupKey: thinLVGs, internal.ThinPoolSelectionStrategyKey: internal.ThinPoolSelectionMostFree},
+		},
+		{
+			name:   "thin_not_contiguous",
+			params: map[string]string{internal.LvmTypeKey: internal.LVMTypeThin, internal.LVMVolumeGroupKey: thinLVGs, internal.LVMVThickContiguousParamKey: "false"},
+		},
+		{
+			name:   "thin_contiguous_is_contradictory",
+			params: map[string]string{internal.LvmTypeKey: internal.LVMTypeThin, internal.LVMVolumeGroupKey: thinLVGs, internal.LVMVThickContiguousParamKey: "true"},
+			err:    "contiguous allocation (thick.contiguous) is only supported for Thick volumes",
+		},
+		{
+			name:   "thick_with_thin_pool_is_contradictory",
+			params: map[string]string{internal.LvmTypeKey: internal.LVMTypeThick, internal.LVMVolumeGroupKey: thinLVGs},
+			err:    "thin pool pool-1 of LVMVolumeGroup lvg-1 is only supported for Thin volumes",
+		},
+		{
+			name:   "thick_with_selection_strategy_is_contradictory",
+			params: map[string]string{internal.LvmTypeKey: internal.LVMTypeThick, internal.LVMVolumeGroupKey: thickLVGs, internal.ThinPoolSelectionStrategyKey: internal.ThinPoolSelectionMostFree},
+			err:    "thin-pool-selection-strategy is only supported for Thin volumes",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateLVMTypeParameters(tc.params)
+			if tc.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestExpandLVMLogicalVolume(t *testing.T) {
+	ctx := context.Background()
+	s := runtime.NewScheme()
+	require.NoError(t, snc.AddToScheme(s))
+
+	newClient := func() (client.Client, *snc.LVMLogicalVolume) {
+		llv := &snc.LVMLogicalVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-1"},
+			Spec:       snc.LVMLogicalVolumeSpec{Size: "1Gi"},
+			Status:     &snc.LVMLogicalVolumeStatus{Phase: LLVStatusCreated, ActualSize: resource.MustParse("1Gi")},
+		}
+		cl := fake.NewClientBuilder().WithScheme(s).WithObjects(llv).Build()
+		got := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, got))
+		return cl, got
+	}
+
+	t.Run("valid_expand_updates_size", func(t *testing.T) {
+		cl, llv := newClient()
+
+		require.NoError(t, ExpandLVMLogicalVolume(ctx, cl, llv, "2Gi"))
+
+		got := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, got))
+		assert.Equal(t, "2Gi", got.Spec.Size)
+	})
+
+	for _, tc := range []struct {
+		name string
+		size string
+		err  string
+	}{
+		{name: "unparseable_size_is_rejected", size: "2 gigabytes", err: "invalid new size \"2 gigabytes\""},
+		{name: "non_positive_size_is_rejected", size: "-1Gi", err: "the size must be positive"},
+		{name: "same_size_is_rejected", size: "1024Mi", err: "the size must exceed the actual size 1Gi"},
+		{name: "smaller_size_is_rejected", size: "512Mi", err: "the size must exceed the actual size 1Gi"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cl, llv := newClient()
+
+			err := ExpandLVMLogicalVolume(ctx, cl, llv, tc.size)
+			assert.ErrorIs(t, err, ErrInvalidExpandSize)
+			assert.ErrorContains(t, err, tc.err)
+
+			got := &snc.LVMLogicalVolume{}
+			require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, got))
+			assert.Equal(t, "1Gi", got.Spec.Size)
+		})
+	}
+}
+
+func TestLLVSpecMismatch(t *testing.T) {
+	delta := resource.MustParse(internal.ResizeDelta)
+	requested := snc.LVMLogicalVolumeSpec{
+		ActualLVNameOnTheNode: "pvc-1",
+		Type:                  internal.LVMTypeThin,
+		Size:                  "1Gi",
+		LVMVolumeGroupName:    "lvg-1",
+		Thin:                  &snc.LVMLogicalVolumeThinSpec{PoolName: "pool-1"},
+	}
+
+	t.Run("matching_spec", func(t *testing.T) {
+		existing := requested
+		existing.Size = "1040Mi"
+		assert.Empty(t, LLVSpecMismatch(existing, requested, delta))
+	})
+
+	for _, tc := range []struct {
+		name   string
+		modify func(spec *snc.LVMLogicalVolumeSpec)
+		want   string
+	}{
+		{name: "size_beyond_delta", modify: func(spec *snc.LVMLogicalVolumeSpec) { spec.Size = "2Gi" }, want: "size 2Gi, requested 1Gi"},
+		{name: "type", modify: func(spec *snc.LVMLogicalVolumeSpec) { spec.Type = internal.LVMTypeThick }, want: "type Thick, requested Thin"},
+		{name: "lvg", modify: func(spec *snc.LVMLogicalVolumeSpec) { spec.LVMVolumeGroupName = "lvg-2" }, want: "LVMVolumeGroup lvg-2, requested lvg-1"},
+		{name: "thin_pool", modify: func(spec *snc.LVMLogicalVolumeSpec) { spec.Thin = &snc.LVMLogicalVolumeThinSpec{PoolName: "pool-2"} }, want: `thin pool "pool-2", requested "pool-1"`},
+		{name: "source", modify: func(spec *snc.LVMLogicalVolumeSpec) {
+			spec.Source = &snc.LVMLogicalVolumeSource{Kind: "LVMLogicalVolume", Name: "pvc-0"}
+		}, want: "source"},
+	} {
+		t.Run(tc.name+"_mismatch", func(t *testing.T) {
+			existing := requested
+			tc.modify(&existing)
+			assert.Contains(t, LLVSpecMismatch(existing, requested, delta), tc.want)
+		})
+	}
+}
+
+func TestGetReady(t *testing.T) {
+	ctx := context.Background()
+	s := runtime.NewScheme()
+	require.NoError(t, snc.AddToScheme(s))
+
+	readyLVG := newLVG("lvg-ready", "node-1", "10Gi")
+	readyLVG.Status.VGSize = resource.MustParse("10Gi")
+	notReadyLVG := newLVG("lvg-not-ready", "", "0")
+	readyLLV := &snc.LVMLogicalVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "llv-ready"},
+		Status:     &snc.LVMLogicalVolumeStatus{Phase: LLVStatusCreated, ActualSize: resource.MustParse("1Gi")},
+	}
+	notReadyLLV := &snc.LVMLogicalVolume{ObjectMeta: metav1.ObjectMeta{Name: "llv-not-ready"}}
+	cl := fake.NewClientBuilder().WithScheme(s).WithObjects(&readyLVG, &notReadyLVG, readyLLV, notReadyLLV).Build()
+
+	t.Run("found_and_ready", func(t *testing.T) {
+		lvg, err := GetReadyLVMVolumeGroup(ctx, cl, "lvg-ready")
+		require.NoError(t, err)
+		assert.Equal(t, "lvg-ready", lvg.Name)
+
+		llv, err := GetReadyLVMLogicalVolume(ctx, cl, "llv-ready", "")
+		require.NoError(t, err)
+		assert.Equal(t, LLVStatusCreated, llv.Status.Phase)
+	})
+
+	t.Run("found_but_not_ready", func(t *testing.T) {
+		lvg, err := GetReadyLVMVolumeGroup(ctx, cl, "lvg-not-ready")
+		assert.ErrorIs(t, err, ErrNotReady)
+		assert.ErrorIs(t, err, ErrLVGNotReady)
+		assert.False(t, kerrors.IsNotFound(err))
+		require.NotNil(t, lvg)
+		assert.Equal(t, "lvg-not-ready", lvg.Name)
+
+		llv, err := GetReadyLVMLogicalVolume(ctx, cl, "llv-not-ready", "")
+		assert.ErrorIs(t, err, ErrNotReady)
+		assert.False(t, kerrors.IsNotFound(err))
+		require.NotNil(t, llv)
+	})
+
+	t.Run("not_found", func(t *testing.T) {
+		_, err := GetReadyLVMVolumeGroup(ctx, cl, "lvg-missing")
+		assert.True(t, kerrors.IsNotFound(err))
+		assert.NotErrorIs(t, err, ErrNotReady)
+
+		_, err = GetReadyLVMLogicalVolume(ctx, cl, "llv-missing", "")
+		assert.True(t, kerrors.IsNotFound(err))
+		assert.NotErrorIs(t, err, ErrNotReady)
+	})
+}
+
+// newPagingLVGClient returns a client serving the LVMVolumeGroups in the pages of the requested limit, as the fake
+// client ignores the limit, and the limits of the list requests it has served.
+func newPagingLVGClient(t *testing.T, count int) (client.Client, *[]int64) {
+	s := runtime.NewScheme()
+	require.NoError(t, snc.AddToScheme(s))
+
+	objects := make([]client.Object, 0, count)
+	for i := 0; i < count; i++ {
+		lvg := newLVG(fmt.Sprintf("lvg-%03d", i), fmt.Sprintf("node-%03d", i), "10Gi")
+		objects = append(objects, &lvg)
+	}
+
+	var limits []int64
+	cl := fake.NewClientBuilder().WithScheme(s).WithObjects(objects...).WithInterceptorFuncs(interceptor.Funcs{
+		List: func(ctx context.Context, cl client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+			listOpts := (&client.ListOptions{}).ApplyOptions(opts)
+			limits = append(limits, listOpts.Limit)
+			if err := cl.List(ctx, list); err != nil {
+				return err
+			}
+
+			lvgs := list.(*snc.LVMVolumeGroupList)
+			offset := 0
+			if listOpts.Continue != "" {
+				offset, _ = strconv.Atoi(listOpts.Continue)
+			}
+			end := len(lvgs.Items)
+			if listOpts.Limit > 0 && offset+int(listOpts.Limit) < end {
+				end = offset + int(listOpts.Limit)
+				lvgs.Continue = strconv.Itoa(end)
+			}
+			lvgs.Items = lvgs.Items[offset:end]
+			return nil
+		},
+	}).Build()
+
+	return cl, &limits
+}
+
+func TestForEachLVG(t *testing.T) {
+	ctx := context.Background()
+	setPageSize := func(t *testing.T, size int64) {
+		LVGListPageSize = size
+		t.Cleanup(func() { LVGListPageSize = DefaultLVGListPageSize })
+	}
+
+	t.Run("all_lvgs_are_listed_in_pages", func(t *testing.T) {
+		setPageSize(t, 10)
+		cl, limits := newPagingLVGClient(t, 95)
+
+		lvgs, err := GetLVGList(ctx, cl)
+		require.NoError(t, err)
+		assert.Len(t, lvgs.Items, 95)
+		assert.Len(t, *limits, 10)
+		assert.Equal(t, int64(10), (*limits)[0])
+
+		seen := make(map[string]struct{}, len(lvgs.Items))
+		for _, lvg := range lvgs.Items {
+			seen[lvg.Name] = struct{}{}
+		}
+		assert.Len(t, seen, 95)
+	})
+
+	t.Run("zero_page_size_lists_at_once", func(t *testing.T) {
+		setPageSize(t, 0)
+		cl, limits := newPagingLVGClient(t, 95)
+
+		lvgs, err := GetLVGList(ctx, cl)
+		require.NoError(t, err)
+		assert.Len(t, lvgs.Items, 95)
+		assert.Equal(t, []int64{0}, *limits)
+	})
+
+	t.Run("iteration_stops_at_error", func(t *testing.T) {
+		setPageSize(t, 10)
+		cl, limits := newPagingLVGClient(t, 95)
+		stop := errors.New("stop")
+
+		visited := 0
+		err := ForEachLVG(ctx, cl, func(*snc.LVMVolumeGroup) error {
+			visited++
+			if visited == 15 {
+				return stop
+			}
+			return nil
+		})
+		assert.ErrorIs(t, err, stop)
+		assert.Equal(t, 15, visited)
+		assert.Len(t, *limits, 2)
+	})
+
+	t.Run("storage_class_lvgs_are_selected_from_all_pages", func(t *testing.T) {
+		setPageSize(t, 10)
+		cl, limits := newPagingLVGClient(t, 95)
+
+		lvgs, params, err := GetStorageClassLVGsAndParameters(ctx, ClientLVGLister{Client: cl}, &logger.Logger{}, "- name: lvg-003\n- name: lvg-094\n")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"lvg-003": "", "lvg-094": ""}, params)
+		require.Len(t, lvgs, 2)
+		assert.Equal(t, "lvg-003", lvgs[0].Name)
+		assert.Equal(t, "lvg-094", lvgs[1].Name)
+		assert.Len(t, *limits, 10)
+	})
+}
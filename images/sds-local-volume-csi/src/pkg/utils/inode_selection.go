@@ -0,0 +1,140 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"sds-local-volume-csi/internal"
+)
+
+const (
+	// NodeSelectorMostFreeInodes places the volumes on the node whose LVMVolumeGroup fits the most inodes.
+	NodeSelectorMostFreeInodes = "most-free-inodes"
+	// DefaultBytesPerInode is the inode ratio mkfs.ext4 uses for the filesystems of the default type.
+	DefaultBytesPerInode int64 = 16 * 1024
+	// minBytesPerInode is the smallest inode ratio mkfs.ext4 accepts.
+	minBytesPerInode int64 = 1024
+)
+
+// GetSelectionMetric returns the metric of the storage class the node of a new volume is selected by.
+// Bytes are the default.
+func GetSelectionMetric(params map[string]string) (string, error) {
+	switch metric := params[internal.SelectionMetricKey]; metric {
+	case "":
+		return internal.SelectionMetricBytes, nil
+	case internal.SelectionMetricBytes, internal.SelectionMetricInodes:
+		return metric, nil
+	default:
+		return "", fmt.Errorf("invalid value %q of %s: expected %q or %q", metric, internal.SelectionMetricKey, internal.SelectionMetricBytes, internal.SelectionMetricInodes)
+	}
+}
+
+// GetLVGBytesPerInode returns the bytes-per-inode ratio of each storage class LVMVolumeGroup: the one of its
+// entry in the LVMVolumeGroups parameter, the storage class one or DefaultBytesPerInode.
+func GetLVGBytesPerInode(params map[string]string) (map[string]int64, error) {
+	defaultRatio := DefaultBytesPerInode
+	if value, ok := params[internal.BytesPerInodeKey]; ok {
+		ratio, err := parseBytesPerInode(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q of %s: %w", value, internal.BytesPerInodeKey, err)
+		}
+		defaultRatio = ratio
+	}
+
+	lvgs, err := ParseLVMVolumeGroups(params[internal.LVMVolumeGroupKey])
+	if err != nil {
+		return nil, err
+	}
+
+	ratios := make(map[string]int64, len(lvgs))
+	for _, lvg := range lvgs {
+		ratios[lvg.Name] = defaultRatio
+		if lvg.BytesPerInode != "" {
+			// validated by ParseLVMVolumeGroups
+			ratios[lvg.Name], _ = parseBytesPerInode(lvg.BytesPerInode)
+		}
+	}
+
+	return ratios, nil
+}
+
+func parseBytesPerInode(value string) (int64, error) {
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		return 0, err
+	}
+	if q.Value() < minBytesPerInode {
+		return 0, fmt.Errorf("must be at least %d", minBytesPerInode)
+	}
+	return q.Value(), nil
+}
+
+// MostFreeInodesNodeSelector selects the node whose LVMVolumeGroup fits the most inodes, estimated from
+// its free space and bytes-per-inode ratio, among the ones fitting the volume.
+type MostFreeInodesNodeSelector struct {
+	// BytesPerInode is the ratio of each LVMVolumeGroup. The ones not listed use DefaultBytesPerInode.
+	BytesPerInode map[string]int64
+}
+
+func (MostFreeInodesNodeSelector) Name() string {
+	return NodeSelectorMostFreeInodes
+}
+
+func (s MostFreeInodesNodeSelector) SelectNode(lvgs []snc.LVMVolumeGroup, storageClassLVGParametersMap map[string]string, lvmType string, size resource.Quantity) (string, resource.Quantity, error) {
+	var nodeName string
+	var nodeFreeSpace resource.Quantity
+	maxInodes := int64(-1)
+	for _, lvg := range lvgs {
+		lvgNodeName, err := GetLVGNodeName(lvg)
+		if err != nil {
+			continue
+		}
+
+		freeSpace, err := GetLVGFreeSpace(lvg, storageClassLVGParametersMap, lvmType)
+		if err != nil {
+			return "", freeSpace, err
+		}
+		if freeSpace.Cmp(size) < 0 {
+			continue
+		}
+
+		if inodes := s.EstimateInodes(lvg.Name, freeSpace); inodes > maxInodes {
+			nodeName = lvgNodeName
+			nodeFreeSpace = freeSpace
+			maxInodes = inodes
+		}
+	}
+
+	if maxInodes < 0 {
+		return GetNodeWithMaxFreeSpace(lvgs, storageClassLVGParametersMap, lvmType)
+	}
+
+	return nodeName, nodeFreeSpace, nil
+}
+
+// EstimateInodes returns the number of inodes the filesystems formatted on the free space of the LVMVolumeGroup have.
+func (s MostFreeInodesNodeSelector) EstimateInodes(lvgName string, freeSpace resource.Quantity) int64 {
+	ratio, ok := s.BytesPerInode[lvgName]
+	if !ok || ratio <= 0 {
+		ratio = DefaultBytesPerInode
+	}
+	return freeSpace.Value() / ratio
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"testing"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"sds-local-volume-csi/internal"
+)
+
+func TestGetLVGBytesPerInode(t *testing.T) {
+	const lvgsParam = "- name: lvg-1\n  bytesPerInode: 64Ki\n- name: lvg-2\n"
+
+	t.Run("default_ratio", func(t *testing.T) {
+		ratios, err := GetLVGBytesPerInode(map[string]string{internal.LVMVolumeGroupKey: lvgsParam})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int64{"lvg-1": 64 * 1024, "lvg-2": DefaultBytesPerInode}, ratios)
+	})
+
+	t.Run("storage_class_ratio", func(t *testing.T) {
+		ratios, err := GetLVGBytesPerInode(map[string]string{internal.LVMVolumeGroupKey: lvgsParam, internal.BytesPerInodeKey: "4096"})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int64{"lvg-1": 64 * 1024, "lvg-2": 4096}, ratios)
+	})
+
+	t.Run("invalid_storage_class_ratio", func(t *testing.T) {
+		_, err := GetLVGBytesPerInode(map[string]string{internal.LVMVolumeGroupKey: lvgsParam, internal.BytesPerInodeKey: "512"})
+		assert.ErrorContains(t, err, `invalid value "512" of lvm.selection/bytes-per-inode: must be at least 1024`)
+	})
+
+	t.Run("invalid_lvg_ratio", func(t *testing.T) {
+		_, err := GetLVGBytesPerInode(map[string]string{internal.LVMVolumeGroupKey: "- name: lvg-1\n  bytesPerInode: many\n"})
+		assert.ErrorContains(t, err, "LVMVolumeGroups entry 0 (lvg-1): invalid bytesPerInode")
+	})
+
+	t.Run("selection_metric", func(t *testing.T) {
+		metric, err := GetSelectionMetric(nil)
+		require.NoError(t, err)
+		assert.Equal(t, internal.SelectionMetricBytes, metric)
+
+		_, err = GetSelectionMetric(map[string]string{internal.SelectionMetricKey: "files"})
+		assert.Error(t, err)
+	})
+}
+
+func TestMostFreeInodesNodeSelector(t *testing.T) {
+	// lvg-1 has more free bytes, but its filesystems are formatted with a 16 times larger inode ratio
+	lvgs := []snc.LVMVolumeGroup{
+		newLVG("lvg-1", "node-1", "50Gi"),
+		newLVG("lvg-2", "node-2", "20Gi"),
+		newLVG("lvg-3", "node-3", "6Gi"),
+	}
+	inodeSelector := MostFreeInodesNodeSelector{BytesPerInode: map[string]int64{"lvg-1": 64 * 1024, "lvg-2": 4096, "lvg-3": 1024}}
+
+	t.Run("byte_and_inode_selection_diverge", func(t *testing.T) {
+		nodeName, _, err := MostFreeNodeSelector{}.SelectNode(lvgs, nil, internal.LVMTypeThick, resource.MustParse("1Gi"))
+		require.NoError(t, err)
+		assert.Equal(t, "node-1", nodeName)
+
+		nodeName, freeSpace, err := inodeSelector.SelectNode(lvgs, nil, internal.LVMTypeThick, resource.MustParse("1Gi"))
+		require.NoError(t, err)
+		assert.Equal(t, "node-3", nodeName)
+		assert.Equal(t, "6Gi", freeSpace.String())
+		assert.Equal(t, NodeSelectorMostFreeInodes, inodeSelector.Name())
+	})
+
+	t.Run("lvgs_not_fitting_volume_are_skipped", func(t *testing.T) {
+		nodeName, freeSpace, err := inodeSelector.SelectNode(lvgs, nil, internal.LVMTypeThick, resource.MustParse("10Gi"))
+		require.NoError(t, err)
+		assert.Equal(t, "node-2", nodeName)
+		assert.Equal(t, "20Gi", freeSpace.String())
+	})
+
+	t.Run("no_lvg_fits_volume", func(t *testing.T) {
+		nodeName, freeSpace, err := inodeSelector.SelectNode(lvgs, nil, internal.LVMTypeThick, resource.MustParse("100Gi"))
+		require.NoError(t, err)
+		assert.Equal(t, "node-1", nodeName)
+		assert.Equal(t, "50Gi", freeSpace.String())
+	})
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"sds-local-volume-csi/internal"
+)
+
+const (
+	// DefaultIOCgroupPath is the cgroup v2 directory whose io.max limits are applied to the volume devices.
+	DefaultIOCgroupPath = "/sys/fs/cgroup/kubepods.slice"
+
+	ioMaxFile = "io.max"
+)
+
+// ErrIOThrottlingUnsupported is returned when the kernel does not provide the cgroup io controller.
+var ErrIOThrottlingUnsupported = errors.New("io throttling is not supported")
+
+// IOLimits describes the IO limits requested for a volume. Zero values mean "no limit".
+type IOLimits struct {
+	MaxIOPS int64
+	MaxBPS  int64
+}
+
+func (l IOLimits) IsEmpty() bool {
+	return l.MaxIOPS == 0 && l.MaxBPS == 0
+}
+
+type IOThrottler interface {
+	SetIOLimits(devPath string, limits IOLimits) error
+	// ClearIOLimits removes the limits of the device node or of the device the filesystem at path is mounted from.
+	ClearIOLimits(path string) error
+}
+
+// CgroupIOThrottler applies IO limits via the cgroup v2 io.max interface.
+type CgroupIOThrottler struct {
+	CgroupPath string
+	// deviceNumber returns the major and minor numbers of the device. Replaced in tests.
+	deviceNumber func(path string) (uint32, uint32, error)
+}
+
+func NewCgroupIOThrottler(cgroupPath string) *CgroupIOThrottler {
+	if cgroupPath == "" {
+		cgroupPath = DefaultIOCgroupPath
+	}
+
+	return &CgroupIOThrottler{
+		CgroupPath:   cgroupPath,
+		deviceNumber: getDeviceNumber,
+	}
+}
+
+func (t *CgroupIOThrottler) SetIOLimits(devPath string, limits IOLimits) error {
+	return t.writeIOMax("SetIOLimits", devPath, func(major, minor uint32) string {
+		return formatIOMaxLine(major, minor, limits)
+	})
+}
+
+// ClearIOLimits resets all the io.max limits of the device, so they are not inherited by the next device
+// getting the same number once the volume is removed.
+func (t *CgroupIOThrottler) ClearIOLimits(path string) error {
+	return t.writeIOMax("ClearIOLimits", path, func(major, minor uint32) string {
+		return fmt.Sprintf("%d:%d rbps=max wbps=max riops=max wiops=max", major, minor)
+	})
+}
+
+func (t *CgroupIOThrottler) writeIOMax(method, path string, formatLine func(major, minor uint32) string) error {
+	ioMaxPath := filepath.Join(t.CgroupPath, ioMaxFile)
+	if _, err := os.Stat(ioMaxPath); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("[%s] %s not found: %w", method, ioMaxPath, ErrIOThrottlingUnsupported)
+		}
+		return fmt.Errorf("[%s] unable to stat %s: %w", method, ioMaxPath, err)
+	}
+
+	major, minor, err := t.deviceNumber(path)
+	if err != nil {
+		return fmt.Errorf("[%s] unable to get device number of %s: %w", method, path, err)
+	}
+
+	line := formatLine(major, minor)
+	if err := os.WriteFile(ioMaxPath, []byte(line), 0644); err != nil {
+		return fmt.Errorf("[%s] unable to write %q to %s: %w", method, line, ioMaxPath, err)
+	}
+
+	return nil
+}
+
+// GetIOLimits reads the IO limits from the storage class parameters or the volume context.
+func GetIOLimits(params map[string]string) (IOLimits, error) {
+	var limits IOLimits
+	var err error
+
+	if limits.MaxIOPS, err = parseIOLimit(params, internal.MaxIOPSKey); err != nil {
+		return limits, err
+	}
+	if limits.MaxBPS, err = parseIOLimit(params, internal.MaxBPSKey); err != nil {
+		return limits, err
+	}
+
+	return limits, nil
+}
+
+func parseIOLimit(params map[string]string, key string) (int64, error) {
+	val, ok := params[key]
+	if !ok || val == "" {
+		return 0, nil
+	}
+
+	limit, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("invalid value %q of %s: must be a positive integer", val, key)
+	}
+
+	return limit, nil
+}
+
+func formatIOMaxLine(major, minor uint32, limits IOLimits) string {
+	fields := []string{fmt.Sprintf("%d:%d", major, minor)}
+	if limits.MaxIOPS > 0 {
+		fields = append(fields, fmt.Sprintf("riops=%d", limits.MaxIOPS), fmt.Sprintf("wiops=%d", limits.MaxIOPS))
+	}
+	if limits.MaxBPS > 0 {
+		fields = append(fields, fmt.Sprintf("rbps=%d", limits.MaxBPS), fmt.Sprintf("wbps=%d", limits.MaxBPS))
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// getDeviceNumber returns the number of the device node at path, or of the device the filesystem holding path
+// is mounted from.
+func getDeviceNumber(path string) (uint32, uint32, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return 0, 0, err
+	}
+
+	if st.Mode&unix.S_IFMT == unix.S_IFBLK {
+		return unix.Major(st.Rdev), unix.Minor(st.Rdev), nil
+	}
+	return unix.Major(st.Dev), unix.Minor(st.Dev), nil
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"sds-local-volume-csi/internal"
+)
+
+func TestIOThrottler(t *testing.T) {
+	deviceNumbers := map[string][2]uint32{
+		"/dev/vg-1/pvc-1": {253, 7},
+	}
+	fakeDeviceNumber := func(devPath string) (uint32, uint32, error) {
+		n, ok := deviceNumbers[devPath]
+		if !ok {
+			return 0, 0, os.ErrNotExist
+		}
+		return n[0], n[1], nil
+	}
+
+	t.Run("limits_are_written_for_the_device", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, ioMaxFile), nil, 0644))
+		throttler := &CgroupIOThrottler{CgroupPath: dir, deviceNumber: fakeDeviceNumber}
+
+		err := throttler.SetIOLimits("/dev/vg-1/pvc-1", IOLimits{MaxIOPS: 100, MaxBPS: 1048576})
+		require.NoError(t, err)
+
+		content, err := os.ReadFile(filepath.Join(dir, ioMaxFile))
+		require.NoError(t, err)
+		assert.Equal(t, "253:7 riops=100 wiops=100 rbps=1048576 wbps=1048576", string(content))
+	})
+
+	t.Run("missing_io_controller_returns_unsupported", func(t *testing.T) {
+		throttler := &CgroupIOThrottler{CgroupPath: t.TempDir(), deviceNumber: fakeDeviceNumber}
+
+		err := throttler.SetIOLimits("/dev/vg-1/pvc-1", IOLimits{MaxIOPS: 100})
+		assert.ErrorIs(t, err, ErrIOThrottlingUnsupported)
+	})
+
+	t.Run("limits_are_cleared_for_the_device", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, ioMaxFile), nil, 0644))
+		throttler := &CgroupIOThrottler{CgroupPath: dir, deviceNumber: fakeDeviceNumber}
+
+		err := throttler.ClearIOLimits("/dev/vg-1/pvc-1")
+		require.NoError(t, err)
+
+		content, err := os.ReadFile(filepath.Join(dir, ioMaxFile))
+		require.NoError(t, err)
+		assert.Equal(t, "253:7 rbps=max wbps=max riops=max wiops=max", string(content))
+	})
+
+	t.Run("missing_io_controller_is_not_cleared", func(t *testing.T) {
+		throttler := &CgroupIOThrottler{CgroupPath: t.TempDir(), deviceNumber: fakeDeviceNumber}
+
+		err := throttler.ClearIOLimits("/dev/vg-1/pvc-1")
+		assert.ErrorIs(t, err, ErrIOThrottlingUnsupported)
+	})
+
+	t.Run("mount_point_resolves_to_the_mounted_device", func(t *testing.T) {
+		dir := t.TempDir()
+		var st unix.Stat_t
+		require.NoError(t, unix.Stat(dir, &st))
+
+		major, minor, err := getDeviceNumber(dir)
+		require.NoError(t, err)
+		assert.Equal(t, [2]uint32{unix.Major(st.Dev), unix.Minor(st.Dev)}, [2]uint32{major, minor})
+	})
+
+	t.Run("GetIOLimits", func(t *testing.T) {
+		limits, err := GetIOLimits(map[string]string{internal.MaxIOPSKey: "500"})
+		require.NoError(t, err)
+		assert.Equal(t, IOLimits{MaxIOPS: 500}, limits)
+
+		_, err = GetIOLimits(map[string]string{internal.MaxBPSKey: "-1"})
+		assert.ErrorContains(t, err, internal.MaxBPSKey)
+	})
+}
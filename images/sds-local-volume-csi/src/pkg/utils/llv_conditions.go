@@ -0,0 +1,185 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"sds-local-volume-csi/internal"
+)
+
+// GetLLVProvisioningConditions returns the provisioning progress conditions stored in the LVMLogicalVolume annotation.
+// The LVMLogicalVolume status is owned by the node agent, so the conditions are kept in an annotation.
+func GetLLVProvisioningConditions(llv *snc.LVMLogicalVolume) ([]metav1.Condition, error) {
+	raw, ok := llv.Annotations[internal.ProvisioningConditionsAnnotation]
+	if !ok || raw == "" {
+		return nil, nil
+	}
+
+	var conditions []metav1.Condition
+	if err := json.Unmarshal([]byte(raw), &conditions); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal the %s annotation of LVMLogicalVolume %s: %w", internal.ProvisioningConditionsAnnotation, llv.Name, err)
+	}
+
+	return conditions, nil
+}
+
+// SetLLVProvisioningConditions sets the provisioning progress conditions of the LVMLogicalVolume.
+// The LastTransitionTime of the changed conditions is set to now.
+func SetLLVProvisioningConditions(ctx context.Context, kc client.Client, llv *snc.LVMLogicalVolume, conditions ...metav1.Condition) error {
+	current, err := GetLLVProvisioningConditions(llv)
+	if err != nil {
+		return err
+	}
+
+	for _, condition := range conditions {
+		condition.ObservedGeneration = llv.Generation
+		meta.SetStatusCondition(&current, condition)
+	}
+
+	raw, err := json.Marshal(current)
+	if err != nil {
+		return fmt.Errorf("unable to marshal the provisioning conditions: %w", err)
+	}
+
+	patch := client.MergeFrom(llv.DeepCopy())
+	if llv.Annotations == nil {
+		llv.Annotations = make(map[string]string, 1)
+	}
+	llv.Annotations[internal.ProvisioningConditionsAnnotation] = string(raw)
+
+	return kc.Patch(ctx, llv, patch)
+}
+
+// NewProvisioningCondition returns a true provisioning progress condition of the given type.
+func NewProvisioningCondition(conditionType, message string) metav1.Condition {
+	return metav1.Condition{
+		Type:    conditionType,
+		Status:  metav1.ConditionTrue,
+		Reason:  conditionType,
+		Message: message,
+	}
+}
+
+// SetLLVLastError records the error of the last operation on the LVMLogicalVolume.
+// The error message is truncated to internal.MaxLastErrorLength bytes.
+func SetLLVLastError(ctx context.Context, kc client.Client, llv *snc.LVMLogicalVolume, opErr error, now time.Time) error {
+	msg := opErr.Error()
+	if len(msg) > internal.MaxLastErrorLength {
+		msg = msg[:internal.MaxLastErrorLength-3] + "..."
+	}
+
+	patch := client.MergeFrom(llv.DeepCopy())
+	if llv.Annotations == nil {
+		llv.Annotations = make(map[string]string, 2)
+	}
+	llv.Annotations[internal.LastErrorAnnotation] = msg
+	llv.Annotations[internal.LastErrorTimeAnnotation] = now.UTC().Format(time.RFC3339)
+
+	return kc.Patch(ctx, llv, patch)
+}
+
+// ClearLLVLastError removes the recorded last error from the LVMLogicalVolume, if any.
+func ClearLLVLastError(ctx context.Context, kc client.Client, llv *snc.LVMLogicalVolume) error {
+	_, hasError := llv.Annotations[internal.LastErrorAnnotation]
+	_, hasTime := llv.Annotations[internal.LastErrorTimeAnnotation]
+	if !hasError && !hasTime {
+		return nil
+	}
+
+	patch := client.MergeFrom(llv.DeepCopy())
+	delete(llv.Annotations, internal.LastErrorAnnotation)
+	delete(llv.Annotations, internal.LastErrorTimeAnnotation)
+
+	return kc.Patch(ctx, llv, patch)
+}
+
+// RecordLLVFinalizerConflict increments the finalizer removal attempts recorded on the LVMLogicalVolume and records
+// the time of the conflict. The merge patch does not carry the resource version, so it does not conflict itself.
+func RecordLLVFinalizerConflict(ctx context.Context, kc client.Client, llv *snc.LVMLogicalVolume, now time.Time) error {
+	attempts, _ := strconv.Atoi(llv.Annotations[internal.FinalizerRemovalAttemptsAnnotation])
+
+	patch := client.MergeFrom(llv.DeepCopy())
+	if llv.Annotations == nil {
+		llv.Annotations = make(map[string]string, 2)
+	}
+	llv.Annotations[internal.FinalizerRemovalAttemptsAnnotation] = strconv.Itoa(attempts + 1)
+	llv.Annotations[internal.FinalizerRemovalLastConflictAnnotation] = now.UTC().Format(time.RFC3339)
+
+	return kc.Patch(ctx, llv, patch)
+}
+
+// clearLLVFinalizerConflicts removes the recorded finalizer removal attempts from the LVMLogicalVolume object,
+// so they are cleared by the same update removing the finalizer.
+func clearLLVFinalizerConflicts(llv *snc.LVMLogicalVolume) {
+	delete(llv.Annotations, internal.FinalizerRemovalAttemptsAnnotation)
+	delete(llv.Annotations, internal.FinalizerRemovalLastConflictAnnotation)
+}
+
+// RequestedAllocationPolicyAnnotations returns the annotation recording the allocation policy requested for a new LV.
+func RequestedAllocationPolicyAnnotations(contiguous bool) map[string]string {
+	policy := internal.AllocationPolicyNormal
+	if contiguous {
+		policy = internal.AllocationPolicyContiguous
+	}
+	return map[string]string{internal.RequestedAllocationPolicyAnnotation: policy}
+}
+
+// AchievedAllocationPolicy returns the allocation policy the node agent reports for the LVMLogicalVolume
+// or "" if the status does not expose it. Only the contiguity of the thick LVs is reported.
+func AchievedAllocationPolicy(llv *snc.LVMLogicalVolume) string {
+	if llv.Spec.Type != internal.LVMTypeThick || llv.Status == nil || llv.Status.Contiguous == nil {
+		return ""
+	}
+
+	if *llv.Status.Contiguous {
+		return internal.AllocationPolicyContiguous
+	}
+	return internal.AllocationPolicyFragmented
+}
+
+// IsAllocationPolicyDiverged reports whether a contiguous LV was requested but a fragmented one was achieved.
+func IsAllocationPolicyDiverged(llv *snc.LVMLogicalVolume) bool {
+	return llv.Annotations[internal.RequestedAllocationPolicyAnnotation] == internal.AllocationPolicyContiguous &&
+		AchievedAllocationPolicy(llv) == internal.AllocationPolicyFragmented
+}
+
+// SetLLVAchievedAllocationPolicy records the achieved allocation policy on the LVMLogicalVolume.
+// Nothing is patched if the policy is unknown or already recorded.
+func SetLLVAchievedAllocationPolicy(ctx context.Context, kc client.Client, llv *snc.LVMLogicalVolume) error {
+	policy := AchievedAllocationPolicy(llv)
+	if policy == "" || llv.Annotations[internal.AchievedAllocationPolicyAnnotation] == policy {
+		return nil
+	}
+
+	patch := client.MergeFrom(llv.DeepCopy())
+	if llv.Annotations == nil {
+		llv.Annotations = make(map[string]string, 1)
+	}
+	llv.Annotations[internal.AchievedAllocationPolicyAnnotation] = policy
+
+	return kc.Patch(ctx, llv, patch)
+}
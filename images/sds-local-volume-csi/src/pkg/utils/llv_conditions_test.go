@@ -0,0 +1,112 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"sds-local-volume-csi/internal"
+)
+
+func TestLLVLastError(t *testing.T) {
+	ctx := context.Background()
+	s := runtime.NewScheme()
+	require.NoError(t, snc.AddToScheme(s))
+
+	llv := &snc.LVMLogicalVolume{ObjectMeta: metav1.ObjectMeta{Name: "pvc-1"}}
+	cl := fake.NewClientBuilder().WithScheme(s).WithObjects(llv).Build()
+
+	t.Run("long_error_is_truncated", func(t *testing.T) {
+		now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		require.NoError(t, SetLLVLastError(ctx, cl, llv, errors.New(strings.Repeat("x", 2*internal.MaxLastErrorLength)), now))
+
+		got := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, got))
+		assert.Len(t, got.Annotations[internal.LastErrorAnnotation], internal.MaxLastErrorLength)
+		assert.Equal(t, "2024-01-02T03:04:05Z", got.Annotations[internal.LastErrorTimeAnnotation])
+	})
+
+	t.Run("clear_removes_annotations", func(t *testing.T) {
+		require.NoError(t, ClearLLVLastError(ctx, cl, llv))
+
+		got := &snc.LVMLogicalVolume{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "pvc-1"}, got))
+		assert.NotContains(t, got.Annotations, internal.LastErrorAnnotation)
+		assert.NotContains(t, got.Annotations, internal.LastErrorTimeAnnotation)
+	})
+}
+
+func TestAchievedAllocationPolicy(t *testing.T) {
+	contiguous, fragmented := true, false
+
+	for _, tc := range []struct {
+		name     string
+		llv      *snc.LVMLogicalVolume
+		expected string
+		diverged bool
+	}{
+		{
+			name:     "contiguous_thick_lv",
+			llv:      &snc.LVMLogicalVolume{Spec: snc.LVMLogicalVolumeSpec{Type: internal.LVMTypeThick}, Status: &snc.LVMLogicalVolumeStatus{Contiguous: &contiguous}},
+			expected: internal.AllocationPolicyContiguous,
+		},
+		{
+			name: "fragmented_thick_lv_requested_contiguous",
+			llv: &snc.LVMLogicalVolume{
+				ObjectMeta: metav1.ObjectMeta{Annotations: RequestedAllocationPolicyAnnotations(true)},
+				Spec:       snc.LVMLogicalVolumeSpec{Type: internal.LVMTypeThick},
+				Status:     &snc.LVMLogicalVolumeStatus{Contiguous: &fragmented},
+			},
+			expected: internal.AllocationPolicyFragmented,
+			diverged: true,
+		},
+		{
+			name: "fragmented_thick_lv_requested_normal",
+			llv: &snc.LVMLogicalVolume{
+				ObjectMeta: metav1.ObjectMeta{Annotations: RequestedAllocationPolicyAnnotations(false)},
+				Spec:       snc.LVMLogicalVolumeSpec{Type: internal.LVMTypeThick},
+				Status:     &snc.LVMLogicalVolumeStatus{Contiguous: &fragmented},
+			},
+			expected: internal.AllocationPolicyFragmented,
+		},
+		{
+			name: "thin_lv_is_unknown",
+			llv:  &snc.LVMLogicalVolume{Spec: snc.LVMLogicalVolumeSpec{Type: internal.LVMTypeThin}, Status: &snc.LVMLogicalVolumeStatus{Contiguous: &contiguous}},
+		},
+		{
+			name: "unreported_contiguity_is_unknown",
+			llv:  &snc.LVMLogicalVolume{Spec: snc.LVMLogicalVolumeSpec{Type: internal.LVMTypeThick}, Status: &snc.LVMLogicalVolumeStatus{}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, AchievedAllocationPolicy(tc.llv))
+			assert.Equal(t, tc.diverged, IsAllocationPolicyDiverged(tc.llv))
+		})
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"sds-local-volume-csi/internal"
+)
+
+const (
+	// LVNameTemplateVolumeID is replaced with the volume ID, i.e. the PV name, in the LV name template.
+	LVNameTemplateVolumeID = "${pv.name}"
+	// LVNameTemplatePVCNamespace is replaced with the namespace of the PVC in the LV name template.
+	LVNameTemplatePVCNamespace = "${pvc.namespace}"
+	// LVNameTemplatePVCName is replaced with the name of the PVC in the LV name template.
+	LVNameTemplatePVCName = "${pvc.name}"
+
+	// MaxLVNameLength is the longest LV name LVM accepts.
+	MaxLVNameLength = 127
+
+	// MaxDMNameLength is the longest device-mapper name the kernel accepts, DM_NAME_LEN without the terminating NUL.
+	MaxDMNameLength = 127
+	// dmNameReservedSuffix is the longest suffix LVM appends to the device-mapper name of an LV, e.g. for the origin
+	// of a snapshot, so the name of the LV itself leaves room for it.
+	dmNameReservedSuffix = "-real"
+
+	lvNameHashLength = 8
+)
+
+// ValidateLVNameTemplate checks the LV name template refers to the volume ID, which keeps the LV names unique.
+func ValidateLVNameTemplate(tmpl string) error {
+	if tmpl == "" {
+		return nil
+	}
+
+	if !strings.Contains(tmpl, LVNameTemplateVolumeID) {
+		return fmt.Errorf("LV name template %q must contain %s", tmpl, LVNameTemplateVolumeID)
+	}
+
+	return nil
+}
+
+// ExpandLVName returns the LV name of the volume built from the template and the PVC metadata in the parameters.
+// The volume ID is returned as is if the template is empty.
+func ExpandLVName(tmpl, volumeID string, params map[string]string) string {
+	if tmpl == "" {
+		return volumeID
+	}
+
+	name := strings.NewReplacer(
+		LVNameTemplateVolumeID, volumeID,
+		LVNameTemplatePVCNamespace, params[internal.PVCNamespaceKey],
+		LVNameTemplatePVCName, params[internal.PVCNameKey],
+	).Replace(tmpl)
+
+	return SanitizeLVName(name)
+}
+
+// SanitizeLVName makes the name follow the LVM naming rules. The characters other than a-z, A-Z, 0-9, '+', '_', '.'
+// and '-' are replaced with '_', the leading '-' is dropped, and a name longer than MaxLVNameLength is truncated
+// and suffixed with the hash of the full name to keep it unique.
+func SanitizeLVName(name string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '+', r == '_', r == '.', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	sanitized = strings.TrimLeft(sanitized, "-")
+
+	if len(sanitized) > MaxLVNameLength {
+		sum := sha256.Sum256([]byte(name))
+		hash := hex.EncodeToString(sum[:])[:lvNameHashLength]
+		sanitized = sanitized[:MaxLVNameLength-lvNameHashLength-1] + "-" + hash
+	}
+
+	return sanitized
+}
+
+// LVNameFromVolumeContext returns the LV name of the volume recorded in the volume context, or the volume ID
+// for the volumes created without an LV name template.
+func LVNameFromVolumeContext(volumeID string, volumeContext map[string]string) string {
+	if name := volumeContext[internal.LVNameKey]; name != "" {
+		return name
+	}
+
+	return volumeID
+}
+
+// DMName returns the device-mapper name of the LV: the VG and LV names with '-' doubled, joined with '-'.
+func DMName(vgName, lvName string) string {
+	return strings.ReplaceAll(vgName, "-", "--") + "-" + strings.ReplaceAll(lvName, "-", "--")
+}
+
+// ValidateDMNameLength checks the device-mapper name of the LV fits MaxDMNameLength along with the suffixes LVM
+// may append to it. The LV names within MaxLVNameLength may still exceed it once the VG name is prepended and
+// the dashes are doubled.
+func ValidateDMNameLength(vgName, lvName string) error {
+	name := DMName(vgName, lvName)
+	if length := len(name) + len(dmNameReservedSuffix); length > MaxDMNameLength {
+		return fmt.Errorf("device-mapper name %s of LV %s in VG %s is %d characters long including the %q suffix LVM may append, above the %d limit", name, lvName, vgName, length, dmNameReservedSuffix, MaxDMNameLength)
+	}
+
+	return nil
+}
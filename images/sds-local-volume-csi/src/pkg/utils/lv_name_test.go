@@ -0,0 +1,101 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"sds-local-volume-csi/internal"
+)
+
+func TestLVName(t *testing.T) {
+	params := map[string]string{
+		internal.PVCNamespaceKey: "tenant-a",
+		internal.PVCNameKey:      "data",
+	}
+
+	t.Run("empty_template_returns_volume_id", func(t *testing.T) {
+		assert.Equal(t, "pvc-1", ExpandLVName("", "pvc-1", params))
+	})
+
+	t.Run("template_is_expanded", func(t *testing.T) {
+		assert.Equal(t, "tenant-a_data_pvc-1", ExpandLVName("${pvc.namespace}_${pvc.name}_${pv.name}", "pvc-1", params))
+	})
+
+	t.Run("missing_metadata_is_expanded_empty", func(t *testing.T) {
+		assert.Equal(t, "pvc-1", ExpandLVName("${pvc.namespace}${pv.name}", "pvc-1", nil))
+	})
+
+	t.Run("invalid_characters_are_replaced", func(t *testing.T) {
+		assert.Equal(t, "ns_pvc-1_x", ExpandLVName("ns/${pv.name}:x", "pvc-1", params))
+		assert.Equal(t, "pvc-1", SanitizeLVName("--pvc-1"))
+		assert.Equal(t, "a+b.c_d", SanitizeLVName("a+b.c d"))
+	})
+
+	t.Run("long_name_is_truncated_uniquely", func(t *testing.T) {
+		long := strings.Repeat("n", 200)
+		first := SanitizeLVName(long + "-pvc-1")
+		second := SanitizeLVName(long + "-pvc-2")
+
+		assert.Len(t, first, MaxLVNameLength)
+		assert.Len(t, second, MaxLVNameLength)
+		assert.NotEqual(t, first, second)
+		assert.True(t, strings.HasPrefix(first, strings.Repeat("n", 100)))
+	})
+
+	t.Run("template_without_volume_id_is_rejected", func(t *testing.T) {
+		assert.NoError(t, ValidateLVNameTemplate(""))
+		assert.NoError(t, ValidateLVNameTemplate("${pvc.namespace}-${pv.name}"))
+		assert.ErrorContains(t, ValidateLVNameTemplate("${pvc.namespace}-${pvc.name}"), "must contain ${pv.name}")
+	})
+
+	t.Run("lv_name_from_volume_context", func(t *testing.T) {
+		assert.Equal(t, "pvc-1", LVNameFromVolumeContext("pvc-1", nil))
+		assert.Equal(t, "tenant-a-pvc-1", LVNameFromVolumeContext("pvc-1", map[string]string{internal.LVNameKey: "tenant-a-pvc-1"}))
+	})
+}
+
+func TestValidateDMNameLength(t *testing.T) {
+	t.Run("dashes_are_doubled", func(t *testing.T) {
+		assert.Equal(t, "vg--data-tenant--a--pvc--1", DMName("vg-data", "tenant-a-pvc-1"))
+	})
+
+	t.Run("name_within_limit_passes", func(t *testing.T) {
+		// 3 + 1 + 118 + 5 = 127
+		assert.NoError(t, ValidateDMNameLength("vg1", strings.Repeat("a", 118)))
+	})
+
+	t.Run("name_above_limit_is_rejected", func(t *testing.T) {
+		assert.ErrorContains(t, ValidateDMNameLength("vg1", strings.Repeat("a", 119)), "128 characters long")
+	})
+
+	t.Run("doubled_dashes_are_counted", func(t *testing.T) {
+		// the LV name fits MaxLVNameLength, but its dashes double in the device-mapper name
+		lvName := strings.Repeat("a-", 50)
+		assert.LessOrEqual(t, len(lvName), MaxLVNameLength)
+		assert.Error(t, ValidateDMNameLength("vg1", lvName))
+	})
+
+	t.Run("vg_name_is_counted", func(t *testing.T) {
+		lvName := strings.Repeat("a", 100)
+		assert.NoError(t, ValidateDMNameLength("vg1", lvName))
+		assert.Error(t, ValidateDMNameLength(strings.Repeat("v", 30), lvName))
+	})
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"sds-local-volume-csi/internal"
+)
+
+// SameNodeLVGPolicy is the policy choosing among the storage class LVMVolumeGroups located on the selected node.
+type SameNodeLVGPolicy struct {
+	Name string
+	// Pinned are the LVMVolumeGroups of the named policy in the order of preference.
+	Pinned []string
+}
+
+// GetSameNodeLVGPolicy returns the same-node LVMVolumeGroup policy of the storage class, most-free by default.
+// The named policy requires the pinned LVMVolumeGroups, which must be listed in the storage class.
+func GetSameNodeLVGPolicy(params map[string]string, storageClassLVGParametersMap map[string]string) (SameNodeLVGPolicy, error) {
+	policy := SameNodeLVGPolicy{Name: params[internal.SameNodeLVGPolicyKey]}
+	pinned := SplitCommaSeparated(params[internal.PinnedLVGsKey])
+
+	switch policy.Name {
+	case "":
+		policy.Name = internal.SameNodeLVGPolicyMostFree
+	case internal.SameNodeLVGPolicyMostFree, internal.SameNodeLVGPolicyRoundRobin:
+	case internal.SameNodeLVGPolicyNamed:
+		if len(pinned) == 0 {
+			return SameNodeLVGPolicy{}, fmt.Errorf("%s is required by the %s policy of %s", internal.PinnedLVGsKey, policy.Name, internal.SameNodeLVGPolicyKey)
+		}
+		for _, name := range pinned {
+			if _, ok := storageClassLVGParametersMap[name]; !ok {
+				return SameNodeLVGPolicy{}, fmt.Errorf("invalid value %q of %s: LVMVolumeGroup %s is not listed in the storage class", params[internal.PinnedLVGsKey], internal.PinnedLVGsKey, name)
+			}
+		}
+		policy.Pinned = pinned
+	default:
+		return SameNodeLVGPolicy{}, fmt.Errorf("invalid value %q of %s: expected %q, %q or %q", policy.Name, internal.SameNodeLVGPolicyKey,
+			internal.SameNodeLVGPolicyMostFree, internal.SameNodeLVGPolicyNamed, internal.SameNodeLVGPolicyRoundRobin)
+	}
+
+	return policy, nil
+}
+
+// LVGSelector chooses the LVMVolumeGroup of a new volume among the storage class ones located on the selected node.
+// It keeps the position of the round-robin policy per node, so it is shared by the CreateVolume calls.
+type LVGSelector struct {
+	mu   sync.Mutex // protects next
+	next map[string]int
+}
+
+func NewLVGSelector() *LVGSelector {
+	return &LVGSelector{next: make(map[string]int)}
+}
+
+// Select returns the LVMVolumeGroup of the node chosen by the policy and the name of the policy actually applied.
+// The most-free and round-robin policies choose among the LVMVolumeGroups the volume fits in, if any does.
+// The named policy falls back to most-free if none of the pinned LVMVolumeGroups is located on the node.
+// An ErrLVGNotReady error is returned if no ready LVMVolumeGroup is located on the node.
+func (s *LVGSelector) Select(
+	lvgs []snc.LVMVolumeGroup,
+	nodeName string,
+	policy SameNodeLVGPolicy,
+	storageClassLVGParametersMap map[string]string,
+	lvmType string,
+	size resource.Quantity,
+) (*snc.LVMVolumeGroup, string, error) {
+	nodeLVGs, err := lvgsOnNode(lvgs, nodeName)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if policy.Name == internal.SameNodeLVGPolicyNamed {
+		for _, name := range policy.Pinned {
+			if i := slices.IndexFunc(nodeLVGs, func(lvg *snc.LVMVolumeGroup) bool { return lvg.Name == name }); i >= 0 {
+				return nodeLVGs[i], internal.SameNodeLVGPolicyNamed, nil
+			}
+		}
+		policy.Name = internal.SameNodeLVGPolicyMostFree
+	}
+
+	if len(nodeLVGs) == 1 {
+		return nodeLVGs[0], policy.Name, nil
+	}
+
+	freeSpace := make(map[string]resource.Quantity, len(nodeLVGs))
+	fitting := make([]*snc.LVMVolumeGroup, 0, len(nodeLVGs))
+	for _, lvg := range nodeLVGs {
+		free, err := GetLVGFreeSpace(*lvg, storageClassLVGParametersMap, lvmType)
+		if err != nil {
+			return nil, "", err
+		}
+		freeSpace[lvg.Name] = free
+		if free.Cmp(size) >= 0 {
+			fitting = append(fitting, lvg)
+		}
+	}
+	if len(fitting) != 0 {
+		nodeLVGs = fitting
+	}
+
+	if policy.Name == internal.SameNodeLVGPolicyRoundRobin {
+		slices.SortFunc(nodeLVGs, func(a, b *snc.LVMVolumeGroup) int { return strings.Compare(a.Name, b.Name) })
+
+		s.mu.Lock()
+		i := s.next[nodeName] % len(nodeLVGs)
+		s.next[nodeName] = i + 1
+		s.mu.Unlock()
+
+		return nodeLVGs[i], policy.Name, nil
+	}
+
+	selected := nodeLVGs[0]
+	for _, lvg := range nodeLVGs[1:] {
+		if free := freeSpace[lvg.Name]; free.Cmp(freeSpace[selected.Name]) > 0 {
+			selected = lvg
+		}
+	}
+	return selected, policy.Name, nil
+}
+
+// lvgsOnNode returns the LVMVolumeGroups located on the node. The LVMVolumeGroups without the nodes in the status
+// are skipped, and an ErrLVGNotReady error is returned if none of the rest is located on the node.
+func lvgsOnNode(lvgs []snc.LVMVolumeGroup, nodeName string) ([]*snc.LVMVolumeGroup, error) {
+	var nodeLVGs []*snc.LVMVolumeGroup
+	var notReadyLVGs []string
+	for i := range lvgs {
+		lvgNodeName, err := GetLVGNodeName(lvgs[i])
+		if err != nil {
+			notReadyLVGs = append(notReadyLVGs, lvgs[i].Name)
+			continue
+		}
+
+		if lvgNodeName == nodeName {
+			nodeLVGs = append(nodeLVGs, &lvgs[i])
+		}
+	}
+
+	switch {
+	case len(nodeLVGs) != 0:
+		return nodeLVGs, nil
+	case len(notReadyLVGs) != 0:
+		return nil, fmt.Errorf("[SelectLVG] no LVMVolumeGroup found for node %s, skipped LVMVolumeGroups %v: %w", nodeName, notReadyLVGs, ErrLVGNotReady)
+	default:
+		return nil, fmt.Errorf("[SelectLVG] no LVMVolumeGroup found for node %s", nodeName)
+	}
+}
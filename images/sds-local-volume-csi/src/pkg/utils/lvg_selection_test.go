@@ -0,0 +1,158 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"testing"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"sds-local-volume-csi/internal"
+)
+
+func TestLVGSelector(t *testing.T) {
+	lvgs := []snc.LVMVolumeGroup{
+		newLVG("lvg-b", "node-1", "10Gi"),
+		newLVG("lvg-c", "node-1", "40Gi"),
+		newLVG("lvg-a", "node-1", "20Gi"),
+		newLVG("lvg-other-node", "node-2", "100Gi"),
+		newLVG("lvg-not-ready", "", "100Gi"),
+	}
+	params := map[string]string{"lvg-a": "", "lvg-b": "", "lvg-c": "", "lvg-other-node": "", "lvg-not-ready": ""}
+	size := resource.MustParse("1Gi")
+	selectLVG := func(t *testing.T, s *LVGSelector, policy SameNodeLVGPolicy, size resource.Quantity) (string, string) {
+		lvg, applied, err := s.Select(lvgs, "node-1", policy, params, internal.LVMTypeThick, size)
+		require.NoError(t, err)
+		return lvg.Name, applied
+	}
+
+	t.Run("most_free_selects_lvg_with_most_free_space", func(t *testing.T) {
+		name, applied := selectLVG(t, NewLVGSelector(), SameNodeLVGPolicy{Name: internal.SameNodeLVGPolicyMostFree}, size)
+		assert.Equal(t, "lvg-c", name)
+		assert.Equal(t, internal.SameNodeLVGPolicyMostFree, applied)
+	})
+
+	t.Run("named_selects_first_pinned_lvg_on_node", func(t *testing.T) {
+		policy := SameNodeLVGPolicy{Name: internal.SameNodeLVGPolicyNamed, Pinned: []string{"lvg-other-node", "lvg-b", "lvg-a"}}
+
+		name, applied := selectLVG(t, NewLVGSelector(), policy, size)
+		assert.Equal(t, "lvg-b", name)
+		assert.Equal(t, internal.SameNodeLVGPolicyNamed, applied)
+	})
+
+	t.Run("named_selects_pinned_lvg_lacking_space", func(t *testing.T) {
+		policy := SameNodeLVGPolicy{Name: internal.SameNodeLVGPolicyNamed, Pinned: []string{"lvg-b"}}
+
+		name, _ := selectLVG(t, NewLVGSelector(), policy, resource.MustParse("30Gi"))
+		assert.Equal(t, "lvg-b", name)
+	})
+
+	t.Run("named_falls_back_to_most_free_without_pinned_lvg_on_node", func(t *testing.T) {
+		policy := SameNodeLVGPolicy{Name: internal.SameNodeLVGPolicyNamed, Pinned: []string{"lvg-other-node"}}
+
+		name, applied := selectLVG(t, NewLVGSelector(), policy, size)
+		assert.Equal(t, "lvg-c", name)
+		assert.Equal(t, internal.SameNodeLVGPolicyMostFree, applied)
+	})
+
+	t.Run("round_robin_rotates_lvgs_by_name", func(t *testing.T) {
+		s := NewLVGSelector()
+		policy := SameNodeLVGPolicy{Name: internal.SameNodeLVGPolicyRoundRobin}
+
+		var names []string
+		for range 4 {
+			name, applied := selectLVG(t, s, policy, size)
+			assert.Equal(t, internal.SameNodeLVGPolicyRoundRobin, applied)
+			names = append(names, name)
+		}
+		assert.Equal(t, []string{"lvg-a", "lvg-b", "lvg-c", "lvg-a"}, names)
+
+		other, _, err := s.Select(lvgs, "node-2", policy, params, internal.LVMTypeThick, size)
+		require.NoError(t, err)
+		assert.Equal(t, "lvg-other-node", other.Name)
+	})
+
+	t.Run("round_robin_skips_lvgs_lacking_space", func(t *testing.T) {
+		s := NewLVGSelector()
+		policy := SameNodeLVGPolicy{Name: internal.SameNodeLVGPolicyRoundRobin}
+
+		var names []string
+		for range 3 {
+			name, _ := selectLVG(t, s, policy, resource.MustParse("15Gi"))
+			names = append(names, name)
+		}
+		assert.Equal(t, []string{"lvg-a", "lvg-c", "lvg-a"}, names)
+	})
+
+	t.Run("all_lvgs_are_candidates_if_none_fits", func(t *testing.T) {
+		name, _ := selectLVG(t, NewLVGSelector(), SameNodeLVGPolicy{Name: internal.SameNodeLVGPolicyRoundRobin}, resource.MustParse("1Ti"))
+		assert.Equal(t, "lvg-a", name)
+
+		name, _ = selectLVG(t, NewLVGSelector(), SameNodeLVGPolicy{Name: internal.SameNodeLVGPolicyMostFree}, resource.MustParse("1Ti"))
+		assert.Equal(t, "lvg-c", name)
+	})
+
+	t.Run("thin_pool_free_space_is_compared", func(t *testing.T) {
+		thinLVGs := []snc.LVMVolumeGroup{newLVG("lvg-a", "node-1", "100Gi"), newLVG("lvg-b", "node-1", "10Gi")}
+		thinLVGs[0].Status.ThinPools = []snc.LVMVolumeGroupThinPoolStatus{{Name: "pool", AvailableSpace: resource.MustParse("5Gi")}}
+		thinLVGs[1].Status.ThinPools = []snc.LVMVolumeGroupThinPoolStatus{{Name: "pool", AvailableSpace: resource.MustParse("8Gi")}}
+
+		lvg, _, err := NewLVGSelector().Select(thinLVGs, "node-1", SameNodeLVGPolicy{Name: internal.SameNodeLVGPolicyMostFree},
+			map[string]string{"lvg-a": "pool", "lvg-b": "pool"}, internal.LVMTypeThin, size)
+		require.NoError(t, err)
+		assert.Equal(t, "lvg-b", lvg.Name)
+	})
+
+	t.Run("node_without_ready_lvgs_is_reported", func(t *testing.T) {
+		_, _, err := NewLVGSelector().Select(lvgs, "node-3", SameNodeLVGPolicy{Name: internal.SameNodeLVGPolicyMostFree}, params, internal.LVMTypeThick, size)
+		assert.ErrorIs(t, err, ErrLVGNotReady)
+	})
+}
+
+func TestGetSameNodeLVGPolicy(t *testing.T) {
+	scLVGs := map[string]string{"lvg-a": "", "lvg-b": ""}
+
+	t.Run("most_free_is_default", func(t *testing.T) {
+		policy, err := GetSameNodeLVGPolicy(map[string]string{}, scLVGs)
+		require.NoError(t, err)
+		assert.Equal(t, SameNodeLVGPolicy{Name: internal.SameNodeLVGPolicyMostFree}, policy)
+	})
+
+	t.Run("named_with_pinned_lvgs", func(t *testing.T) {
+		policy, err := GetSameNodeLVGPolicy(map[string]string{
+			internal.SameNodeLVGPolicyKey: internal.SameNodeLVGPolicyNamed,
+			internal.PinnedLVGsKey:        "lvg-b, lvg-a",
+		}, scLVGs)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"lvg-b", "lvg-a"}, policy.Pinned)
+	})
+
+	invalid := map[string]map[string]string{
+		"unknown_policy":       {internal.SameNodeLVGPolicyKey: "random"},
+		"named_without_pinned": {internal.SameNodeLVGPolicyKey: internal.SameNodeLVGPolicyNamed},
+		"pinned_not_listed":    {internal.SameNodeLVGPolicyKey: internal.SameNodeLVGPolicyNamed, internal.PinnedLVGsKey: "lvg-a,lvg-c"},
+	}
+	for name, params := range invalid {
+		t.Run(name+"_is_rejected", func(t *testing.T) {
+			_, err := GetSameNodeLVGPolicy(params, scLVGs)
+			assert.Error(t, err)
+		})
+	}
+}
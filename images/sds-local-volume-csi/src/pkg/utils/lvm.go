@@ -0,0 +1,180 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	utilexec "k8s.io/utils/exec"
+
+	"sds-local-volume-csi/internal"
+)
+
+// LVEnumerator looks up the LVs present on the node.
+type LVEnumerator interface {
+	// FindLVVolumeGroups returns the names of the VGs containing an LV with the given name.
+	FindLVVolumeGroups(lvName string) ([]string, error)
+}
+
+// LVSEnumerator enumerates the LVs with the lvs command.
+type LVSEnumerator struct {
+	Exec utilexec.Interface
+}
+
+func NewLVSEnumerator() *LVSEnumerator {
+	return &LVSEnumerator{Exec: utilexec.New()}
+}
+
+func (e *LVSEnumerator) FindLVVolumeGroups(lvName string) ([]string, error) {
+	out, err := e.Exec.Command("lvs", "--noheadings", "-o", "vg_name", "-S", "lv_name="+lvName).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("[FindLVVolumeGroups] lvs failed: %w, output: %s", err, string(out))
+	}
+
+	var vgs []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if vg := strings.TrimSpace(line); vg != "" {
+			vgs = append(vgs, vg)
+		}
+	}
+
+	return vgs, nil
+}
+
+// VGChecker checks the VGs present on the node.
+type VGChecker interface {
+	// VGExists reports whether the VG with the given name exists on the node.
+	VGExists(vgName string) (bool, error)
+}
+
+// VGSChecker checks the VGs with the vgs command.
+type VGSChecker struct {
+	Exec utilexec.Interface
+}
+
+func NewVGSChecker() *VGSChecker {
+	return &VGSChecker{Exec: utilexec.New()}
+}
+
+func (c *VGSChecker) VGExists(vgName string) (bool, error) {
+	out, err := c.Exec.Command("vgs", "--noheadings", "-o", "vg_name", "-S", "vg_name="+vgName).CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("[VGExists] vgs failed: %w, output: %s", err, string(out))
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) == vgName {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// ErrLVActiveElsewhere is returned when the LV can't be activated exclusively as it is active on another host.
+var ErrLVActiveElsewhere = errors.New("LV is active on another host")
+
+// lvActiveElsewhereMessages are the lvchange messages of the exclusive activation failing because of another host.
+var lvActiveElsewhereMessages = []string{
+	"locked by other host",
+	"lock held by other host",
+	"is active on other host",
+}
+
+// LVActivator activates the LVs on the node.
+type LVActivator interface {
+	// ActivateLV activates the LV in the given mode (internal.ActivationModeLocal or internal.ActivationModeExclusive).
+	ActivateLV(vgName, lvName, mode string) error
+}
+
+// LVChangeActivator activates the LVs with the lvchange command.
+type LVChangeActivator struct {
+	Exec utilexec.Interface
+}
+
+func NewLVChangeActivator() *LVChangeActivator {
+	return &LVChangeActivator{Exec: utilexec.New()}
+}
+
+func (a *LVChangeActivator) ActivateLV(vgName, lvName, mode string) error {
+	var flag string
+	switch mode {
+	case internal.ActivationModeLocal:
+		flag = "-aly"
+	case internal.ActivationModeExclusive:
+		flag = "-aey"
+	default:
+		return fmt.Errorf("[ActivateLV] unsupported activation mode %q", mode)
+	}
+
+	out, err := a.Exec.Command("lvchange", flag, vgName+"/"+lvName).CombinedOutput()
+	if err != nil {
+		for _, msg := range lvActiveElsewhereMessages {
+			if strings.Contains(strings.ToLower(string(out)), msg) {
+				return fmt.Errorf("[ActivateLV] lvchange %s %s/%s: %w: %s", flag, vgName, lvName, ErrLVActiveElsewhere, strings.TrimSpace(string(out)))
+			}
+		}
+		return fmt.Errorf("[ActivateLV] lvchange %s %s/%s failed: %w, output: %s", flag, vgName, lvName, err, string(out))
+	}
+
+	return nil
+}
+
+// GetActivationMode returns the LV activation mode from the storage class parameters or the volume context.
+// An empty mode means the LV is not activated by the node plugin.
+func GetActivationMode(params map[string]string) (string, error) {
+	switch mode := params[internal.ActivationModeKey]; mode {
+	case "", internal.ActivationModeLocal, internal.ActivationModeExclusive:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid value %q of %s: supported values are %s and %s", mode, internal.ActivationModeKey, internal.ActivationModeLocal, internal.ActivationModeExclusive)
+	}
+}
+
+// GetEncryptionExpected returns whether the volume is expected to be encrypted at rest.
+// The returned ok is false if the expectation is not set.
+func GetEncryptionExpected(params map[string]string) (expected, ok bool, err error) {
+	value, ok := params[internal.EncryptionExpectedKey]
+	if !ok {
+		return false, false, nil
+	}
+
+	expected, err = strconv.ParseBool(value)
+	if err != nil {
+		return false, false, fmt.Errorf("invalid value %q of %s: %w", value, internal.EncryptionExpectedKey, err)
+	}
+
+	return expected, true, nil
+}
+
+// GetMountSync returns whether the filesystem volume is mounted with the sync option.
+func GetMountSync(params map[string]string) (bool, error) {
+	value, ok := params[internal.MountSyncKey]
+	if !ok {
+		return false, nil
+	}
+
+	sync, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value %q of %s: %w", value, internal.MountSyncKey, err)
+	}
+
+	return sync, nil
+}
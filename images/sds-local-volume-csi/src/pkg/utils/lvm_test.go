@@ -0,0 +1,109 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	utilexec "k8s.io/utils/exec"
+	fakeexec "k8s.io/utils/exec/testing"
+
+	"sds-local-volume-csi/internal"
+)
+
+// newFakeExec returns an exec expecting a single command with the given output.
+func newFakeExec(t *testing.T, out string, err error) (*fakeexec.FakeExec, *[]string) {
+	var args []string
+	fake := &fakeexec.FakeExec{
+		CommandScript: []fakeexec.FakeCommandAction{
+			func(cmd string, a ...string) utilexec.Cmd {
+				args = append([]string{cmd}, a...)
+				return &fakeexec.FakeCmd{
+					CombinedOutputScript: []fakeexec.FakeAction{
+						func() ([]byte, []byte, error) { return []byte(out), nil, err },
+					},
+				}
+			},
+		},
+	}
+	t.Cleanup(func() { assert.Equal(t, 1, fake.CommandCalls) })
+	return fake, &args
+}
+
+func newFakeLVChange(t *testing.T, out string, err error) (*LVChangeActivator, *[]string) {
+	fake, args := newFakeExec(t, out, err)
+	return &LVChangeActivator{Exec: fake}, args
+}
+
+func TestLVChangeActivator(t *testing.T) {
+	t.Run("local_activation", func(t *testing.T) {
+		a, args := newFakeLVChange(t, "", nil)
+
+		require.NoError(t, a.ActivateLV("vg-1", "pvc-1", internal.ActivationModeLocal))
+		assert.Equal(t, []string{"lvchange", "-aly", "vg-1/pvc-1"}, *args)
+	})
+
+	t.Run("exclusive_activation", func(t *testing.T) {
+		a, args := newFakeLVChange(t, "", nil)
+
+		require.NoError(t, a.ActivateLV("vg-1", "pvc-1", internal.ActivationModeExclusive))
+		assert.Equal(t, []string{"lvchange", "-aey", "vg-1/pvc-1"}, *args)
+	})
+
+	t.Run("exclusive_activation_active_elsewhere", func(t *testing.T) {
+		a, _ := newFakeLVChange(t, "  LV locked by other host: vg-1 pvc-1\n", &fakeexec.FakeExitError{Status: 5})
+
+		err := a.ActivateLV("vg-1", "pvc-1", internal.ActivationModeExclusive)
+		assert.ErrorIs(t, err, ErrLVActiveElsewhere)
+	})
+
+	t.Run("other_failure", func(t *testing.T) {
+		a, _ := newFakeLVChange(t, "  Volume group \"vg-1\" not found\n", &fakeexec.FakeExitError{Status: 5})
+
+		err := a.ActivateLV("vg-1", "pvc-1", internal.ActivationModeExclusive)
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrLVActiveElsewhere)
+	})
+}
+
+func TestVGSChecker(t *testing.T) {
+	t.Run("vg_present", func(t *testing.T) {
+		fake, args := newFakeExec(t, "  vg-1\n", nil)
+
+		exists, err := (&VGSChecker{Exec: fake}).VGExists("vg-1")
+		require.NoError(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, []string{"vgs", "--noheadings", "-o", "vg_name", "-S", "vg_name=vg-1"}, *args)
+	})
+
+	t.Run("vg_absent", func(t *testing.T) {
+		fake, _ := newFakeExec(t, "", nil)
+
+		exists, err := (&VGSChecker{Exec: fake}).VGExists("vg-1")
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("vgs_failure", func(t *testing.T) {
+		fake, _ := newFakeExec(t, "  /dev/mapper/control: open failed\n", &fakeexec.FakeExitError{Status: 5})
+
+		_, err := (&VGSChecker{Exec: fake}).VGExists("vg-1")
+		assert.ErrorContains(t, err, "vgs failed")
+	})
+}
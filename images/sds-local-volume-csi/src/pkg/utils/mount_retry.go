@@ -0,0 +1,100 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultRetryableMountErrors are the mount errors considered transient by default:
+// a busy device (e.g. still being activated or released by udev), an interrupted
+// system call and a temporarily unavailable resource.
+var DefaultRetryableMountErrors = []string{
+	"EBUSY",
+	"device or resource busy",
+	"EINTR",
+	"interrupted system call",
+	"EAGAIN",
+	"resource temporarily unavailable",
+}
+
+const (
+	DefaultMountRetryAttempts = 3
+	DefaultMountRetryInterval = time.Second
+)
+
+// MountRetryPolicy defines which mount errors are retried and how.
+type MountRetryPolicy struct {
+	// Attempts is the total number of mount attempts. Values below 2 disable the retry.
+	Attempts int
+	Interval time.Duration
+	// RetryableErrors are the errno names (e.g. EBUSY) and the case-insensitive
+	// substrings of the mounter error considered transient.
+	RetryableErrors []string
+}
+
+func DefaultMountRetryPolicy() MountRetryPolicy {
+	return MountRetryPolicy{
+		Attempts:        DefaultMountRetryAttempts,
+		Interval:        DefaultMountRetryInterval,
+		RetryableErrors: DefaultRetryableMountErrors,
+	}
+}
+
+// ParseRetryableMountErrors splits a comma-separated list of the retryable mount error patterns.
+func ParseRetryableMountErrors(patterns string) []string {
+	return SplitCommaSeparated(patterns)
+}
+
+// IsRetryable reports whether the mounter error matches any of the retryable patterns.
+func (p MountRetryPolicy) IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var errnoName string
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		errnoName = unix.ErrnoName(errno)
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, pattern := range p.RetryableErrors {
+		if pattern == errnoName || strings.Contains(msg, strings.ToLower(pattern)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Do calls mount until it succeeds, returns a non-retryable error or the attempts are exhausted.
+func (p MountRetryPolicy) Do(mount func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = mount()
+		if err == nil || attempt >= p.Attempts || !p.IsRetryable(err) {
+			return err
+		}
+		time.Sleep(p.Interval)
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountRetryPolicy(t *testing.T) {
+	policy := MountRetryPolicy{Attempts: 3, RetryableErrors: ParseRetryableMountErrors("EBUSY, wrong fs type")}
+
+	t.Run("configured_transient_error_is_retried", func(t *testing.T) {
+		calls := 0
+		err := policy.Do(func() error {
+			calls++
+			if calls < 3 {
+				return errors.New("mount failed: exit status 32, output: Wrong FS type, bad option")
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, calls)
+	})
+
+	t.Run("errno_name_is_matched", func(t *testing.T) {
+		calls := 0
+		err := policy.Do(func() error {
+			calls++
+			return fmt.Errorf("mount: %w", syscall.EBUSY)
+		})
+		assert.ErrorIs(t, err, syscall.EBUSY)
+		assert.Equal(t, 3, calls)
+	})
+
+	t.Run("permanent_error_fails_fast", func(t *testing.T) {
+		calls := 0
+		err := policy.Do(func() error {
+			calls++
+			return errors.New("mount: special device does not exist")
+		})
+		assert.Error(t, err)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("error_not_in_configured_set_fails_fast", func(t *testing.T) {
+		calls := 0
+		err := policy.Do(func() error {
+			calls++
+			return fmt.Errorf("mount: %w", syscall.EAGAIN)
+		})
+		assert.ErrorIs(t, err, syscall.EAGAIN)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("default_patterns", func(t *testing.T) {
+		assert.True(t, DefaultMountRetryPolicy().IsRetryable(errors.New("mount: /mnt: Device or resource busy")))
+		assert.False(t, DefaultMountRetryPolicy().IsRetryable(errors.New("mount: permission denied")))
+	})
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// NodeSelectorMostFree places the volumes on the node with the most free space, spreading them over the nodes.
+	NodeSelectorMostFree = "most-free"
+	// NodeSelectorBinPack places the volumes on the node with the least free space fitting them, consolidating them on fewer nodes.
+	NodeSelectorBinPack = "bin-pack"
+)
+
+// NodeSelector chooses the node to place a new volume on among the LVMVolumeGroups of the storage class.
+type NodeSelector interface {
+	// Name returns the name of the strategy.
+	Name() string
+	// SelectNode returns the selected node and the free space for the volume on it. If no node fits the size,
+	// the node with the most free space is returned, so the caller reports the shortage against it.
+	// An ErrLVGNotReady error is returned if none of the LVMVolumeGroups is ready.
+	SelectNode(lvgs []snc.LVMVolumeGroup, storageClassLVGParametersMap map[string]string, lvmType string, size resource.Quantity) (string, resource.Quantity, error)
+}
+
+// NewNodeSelector returns the node selector of the strategy.
+func NewNodeSelector(strategy string) (NodeSelector, error) {
+	switch strategy {
+	case NodeSelectorMostFree:
+		return MostFreeNodeSelector{}, nil
+	case NodeSelectorBinPack:
+		return BinPackNodeSelector{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported node selection strategy %q, expected %q or %q", strategy, NodeSelectorMostFree, NodeSelectorBinPack)
+	}
+}
+
+// MostFreeNodeSelector selects the node with the most free space.
+type MostFreeNodeSelector struct{}
+
+func (MostFreeNodeSelector) Name() string {
+	return NodeSelectorMostFree
+}
+
+func (MostFreeNodeSelector) SelectNode(lvgs []snc.LVMVolumeGroup, storageClassLVGParametersMap map[string]string, lvmType string, _ resource.Quantity) (string, resource.Quantity, error) {
+	return GetNodeWithMaxFreeSpace(lvgs, storageClassLVGParametersMap, lvmType)
+}
+
+// BinPackNodeSelector selects the node with the least free space the volume fits in.
+type BinPackNodeSelector struct{}
+
+func (BinPackNodeSelector) Name() string {
+	return NodeSelectorBinPack
+}
+
+func (BinPackNodeSelector) SelectNode(lvgs []snc.LVMVolumeGroup, storageClassLVGParametersMap map[string]string, lvmType string, size resource.Quantity) (string, resource.Quantity, error) {
+	var nodeName string
+	var minFitting *resource.Quantity
+	for _, lvg := range lvgs {
+		lvgNodeName, err := GetLVGNodeName(lvg)
+		if err != nil {
+			continue
+		}
+
+		freeSpace, err := GetLVGFreeSpace(lvg, storageClassLVGParametersMap, lvmType)
+		if err != nil {
+			return "", freeSpace, err
+		}
+
+		if freeSpace.Cmp(size) >= 0 && (minFitting == nil || freeSpace.Cmp(*minFitting) < 0) {
+			nodeName = lvgNodeName
+			minFitting = &freeSpace
+		}
+	}
+
+	if minFitting == nil {
+		return GetNodeWithMaxFreeSpace(lvgs, storageClassLVGParametersMap, lvmType)
+	}
+
+	return nodeName, *minFitting, nil
+}
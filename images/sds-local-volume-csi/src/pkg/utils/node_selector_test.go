@@ -0,0 +1,65 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"testing"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"sds-local-volume-csi/internal"
+)
+
+func TestNodeSelector(t *testing.T) {
+	lvgs := []snc.LVMVolumeGroup{
+		newLVG("lvg-not-ready", "", "100Gi"),
+		newLVG("lvg-1", "node-1", "50Gi"),
+		newLVG("lvg-2", "node-2", "8Gi"),
+		newLVG("lvg-3", "node-3", "20Gi"),
+	}
+
+	for _, tc := range []struct {
+		strategy  string
+		size      string
+		nodeName  string
+		freeSpace string
+	}{
+		{strategy: NodeSelectorMostFree, size: "10Gi", nodeName: "node-1", freeSpace: "50Gi"},
+		{strategy: NodeSelectorBinPack, size: "10Gi", nodeName: "node-3", freeSpace: "20Gi"},
+		{strategy: NodeSelectorBinPack, size: "5Gi", nodeName: "node-2", freeSpace: "8Gi"},
+		{strategy: NodeSelectorBinPack, size: "60Gi", nodeName: "node-1", freeSpace: "50Gi"},
+	} {
+		t.Run(tc.strategy+"_"+tc.size, func(t *testing.T) {
+			selector, err := NewNodeSelector(tc.strategy)
+			require.NoError(t, err)
+			assert.Equal(t, tc.strategy, selector.Name())
+
+			nodeName, freeSpace, err := selector.SelectNode(lvgs, nil, internal.LVMTypeThick, resource.MustParse(tc.size))
+			require.NoError(t, err)
+			assert.Equal(t, tc.nodeName, nodeName)
+			assert.Equal(t, tc.freeSpace, freeSpace.String())
+		})
+	}
+
+	t.Run("unsupported_strategy", func(t *testing.T) {
+		_, err := NewNodeSelector("random")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"sds-local-volume-csi/internal"
+)
+
+// NodeStorageClasses returns the sorted names of the storage classes of the driver listing an LVMVolumeGroup
+// located on the node. The storage classes with an invalid LVMVolumeGroups parameter are skipped, as no volume
+// can be provisioned from them.
+func NodeStorageClasses(ctx context.Context, kc client.Client, driverName, nodeName string) ([]string, error) {
+	nodeLVGs := make(map[string]struct{})
+	err := ForEachLVG(ctx, kc, func(lvg *snc.LVMVolumeGroup) error {
+		for _, node := range lvg.Status.Nodes {
+			if node.Name == nodeName {
+				nodeLVGs[lvg.Name] = struct{}{}
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	scs := &storagev1.StorageClassList{}
+	if err := kc.List(ctx, scs); err != nil {
+		return nil, fmt.Errorf("unable to list the StorageClasses: %w", err)
+	}
+
+	var classes []string
+	for _, sc := range scs.Items {
+		if sc.Provisioner != driverName {
+			continue
+		}
+
+		lvgs, err := ParseLVMVolumeGroups(sc.Parameters[internal.LVMVolumeGroupKey])
+		if err != nil {
+			continue
+		}
+		if slices.ContainsFunc(lvgs, func(lvg VolumeGroup) bool {
+			_, ok := nodeLVGs[lvg.Name]
+			return ok
+		}) {
+			classes = append(classes, sc.Name)
+		}
+	}
+	slices.Sort(classes)
+
+	return classes, nil
+}
+
+// SetNodeStorageClasses labels the node with a StorageClassLabelPrefix label per storage class and records
+// the comma-separated list of them in the StorageClassesAnnotation. The labels of the storage classes not listed
+// are removed. The storage classes whose name is not a valid label name are only recorded in the annotation.
+// The node is patched only if its labels or annotation differ, and the returned flag reports whether it was.
+func SetNodeStorageClasses(ctx context.Context, kc client.Client, nodeName string, classes []string) (bool, error) {
+	node := &corev1.Node{}
+	if err := kc.Get(ctx, client.ObjectKey{Name: nodeName}, node); err != nil {
+		return false, fmt.Errorf("unable to get Node %s: %w", nodeName, err)
+	}
+
+	desired := make(map[string]struct{}, len(classes))
+	for _, name := range classes {
+		key := internal.StorageClassLabelPrefix + name
+		if len(validation.IsQualifiedName(key)) == 0 {
+			desired[key] = struct{}{}
+		}
+	}
+
+	labels := make(map[string]interface{})
+	for key := range node.Labels {
+		if _, ok := desired[key]; !ok && strings.HasPrefix(key, internal.StorageClassLabelPrefix) {
+			labels[key] = nil
+		}
+	}
+	for key := range desired {
+		if _, ok := node.Labels[key]; !ok {
+			labels[key] = "true"
+		}
+	}
+
+	annotations := make(map[string]interface{})
+	value, ok := node.Annotations[internal.StorageClassesAnnotation]
+	switch joined := strings.Join(classes, ","); {
+	case joined == "" && ok:
+		annotations[internal.StorageClassesAnnotation] = nil
+	case joined != "" && joined != value:
+		annotations[internal.StorageClassesAnnotation] = joined
+	}
+
+	if len(labels) == 0 && len(annotations) == 0 {
+		return false, nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      labels,
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if err := kc.Patch(ctx, node, client.RawPatch(types.MergePatchType, patch)); err != nil {
+		return false, fmt.Errorf("unable to patch Node %s: %w", nodeName, err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"sds-local-volume-csi/internal"
+)
+
+func TestNodeStorageClasses(t *testing.T) {
+	const driverName = "local.csi.storage.deckhouse.io"
+	ctx := context.Background()
+
+	s := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(s))
+	require.NoError(t, snc.AddToScheme(s))
+
+	newSC := func(name, provisioner string, lvgs ...string) *storagev1.StorageClass {
+		var param strings.Builder
+		for _, lvg := range lvgs {
+			param.WriteString("- name: " + lvg + "\n")
+		}
+		return &storagev1.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: name},
+			Provisioner: provisioner,
+			Parameters:  map[string]string{internal.LVMVolumeGroupKey: param.String()},
+		}
+	}
+	lvgs := []snc.LVMVolumeGroup{
+		newLVG("lvg-1-a", "node-1", "10Gi"),
+		newLVG("lvg-1-b", "node-1", "10Gi"),
+		newLVG("lvg-2", "node-2", "10Gi"),
+		newLVG("lvg-not-ready", "", "10Gi"),
+	}
+	newClient := func(objs ...client.Object) client.Client {
+		for i := range lvgs {
+			objs = append(objs, &lvgs[i])
+		}
+		return fake.NewClientBuilder().WithScheme(s).WithObjects(objs...).Build()
+	}
+	scs := []client.Object{
+		newSC("sc-node-1", driverName, "lvg-1-a"),
+		newSC("sc-both-nodes", driverName, "lvg-2", "lvg-1-b"),
+		newSC("sc-node-2", driverName, "lvg-2"),
+		newSC("sc-not-ready", driverName, "lvg-not-ready"),
+		newSC("sc-missing-lvg", driverName, "lvg-missing"),
+		newSC("sc-other-driver", "other.csi.example.com", "lvg-1-a"),
+		newSC("sc-invalid", driverName),
+	}
+	nodeLabels := func(t *testing.T, cl client.Client, name string) (map[string]string, string) {
+		node := &corev1.Node{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: name}, node))
+		labels := map[string]string{}
+		for key, value := range node.Labels {
+			if strings.HasPrefix(key, internal.StorageClassLabelPrefix) {
+				labels[strings.TrimPrefix(key, internal.StorageClassLabelPrefix)] = value
+			}
+		}
+		return labels, node.Annotations[internal.StorageClassesAnnotation]
+	}
+
+	t.Run("storage_classes_match_node_lvgs", func(t *testing.T) {
+		cl := newClient(scs...)
+
+		classes, err := NodeStorageClasses(ctx, cl, driverName, "node-1")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"sc-both-nodes", "sc-node-1"}, classes)
+
+		classes, err = NodeStorageClasses(ctx, cl, driverName, "node-2")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"sc-both-nodes", "sc-node-2"}, classes)
+
+		classes, err = NodeStorageClasses(ctx, cl, driverName, "node-3")
+		require.NoError(t, err)
+		assert.Empty(t, classes)
+	})
+
+	t.Run("node_labels_match_storage_classes", func(t *testing.T) {
+		node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+			Name: "node-1",
+			Labels: map[string]string{
+				"kubernetes.io/hostname":                           "node-1",
+				internal.StorageClassLabelPrefix + "sc-node-1":     "true",
+				internal.StorageClassLabelPrefix + "sc-deleted":    "true",
+				internal.StorageClassLabelPrefix + "sc-node-moved": "true",
+			},
+		}}
+		cl := newClient(append(scs, node)...)
+
+		classes, err := NodeStorageClasses(ctx, cl, driverName, "node-1")
+		require.NoError(t, err)
+		changed, err := SetNodeStorageClasses(ctx, cl, "node-1", classes)
+		require.NoError(t, err)
+		assert.True(t, changed)
+
+		labels, annotation := nodeLabels(t, cl, "node-1")
+		assert.Equal(t, map[string]string{"sc-both-nodes": "true", "sc-node-1": "true"}, labels)
+		assert.Equal(t, "sc-both-nodes,sc-node-1", annotation)
+
+		updated := &corev1.Node{}
+		require.NoError(t, cl.Get(ctx, client.ObjectKey{Name: "node-1"}, updated))
+		assert.Equal(t, "node-1", updated.Labels["kubernetes.io/hostname"])
+
+		changed, err = SetNodeStorageClasses(ctx, cl, "node-1", classes)
+		require.NoError(t, err)
+		assert.False(t, changed)
+	})
+
+	t.Run("labels_are_removed_with_last_lvg", func(t *testing.T) {
+		node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}
+		cl := newClient(append(scs, node)...)
+		_, err := SetNodeStorageClasses(ctx, cl, "node-1", []string{"sc-node-1"})
+		require.NoError(t, err)
+
+		changed, err := SetNodeStorageClasses(ctx, cl, "node-1", nil)
+		require.NoError(t, err)
+		assert.True(t, changed)
+
+		labels, annotation := nodeLabels(t, cl, "node-1")
+		assert.Empty(t, labels)
+		assert.Empty(t, annotation)
+	})
+
+	t.Run("invalid_label_name_is_annotated_only", func(t *testing.T) {
+		long := strings.Repeat("a", 64)
+		cl := newClient(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}})
+
+		_, err := SetNodeStorageClasses(ctx, cl, "node-1", []string{long, "sc-node-1"})
+		require.NoError(t, err)
+
+		labels, annotation := nodeLabels(t, cl, "node-1")
+		assert.Equal(t, map[string]string{"sc-node-1": "true"}, labels)
+		assert.Equal(t, long+",sc-node-1", annotation)
+	})
+}
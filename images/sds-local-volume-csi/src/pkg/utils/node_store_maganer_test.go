@@ -1,10 +1,16 @@
 package utils
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	mountutils "k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+	fakeexec "k8s.io/utils/exec/testing"
 
 	"sds-local-volume-csi/pkg/logger"
 )
@@ -94,3 +100,230 @@ func TestNodeStoreManager(t *testing.T) {
 		})
 	})
 }
+
+// lyingMounter reports the mounts as successful, registering them with the given device or not at all if it is empty.
+type lyingMounter struct {
+	*mountutils.FakeMounter
+	device string
+}
+
+func (m *lyingMounter) Mount(_ string, target string, fstype string, options []string) error {
+	if m.device != "" {
+		m.MountPoints = append(m.MountPoints, mountutils.MountPoint{Device: m.device, Path: target, Type: fstype, Opts: options})
+	}
+	return nil
+}
+
+func TestNodePublishVolumeMountVerification(t *testing.T) {
+	const devPath = "/dev/vg-1/pvc-1"
+
+	newStore := func(device string) *Store {
+		return &Store{
+			Log: &logger.Logger{},
+			NodeStorage: mountutils.SafeFormatAndMount{
+				Interface: &lyingMounter{FakeMounter: mountutils.NewFakeMounter(nil), device: device},
+			},
+			MountRetry: DefaultMountRetryPolicy(),
+		}
+	}
+
+	t.Run("fs_mount_is_verified", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "mount")
+
+		err := newStore(devPath).NodePublishVolumeFS("/staging/pvc-1", devPath, target, "ext4", []string{"bind"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("unregistered_fs_mount_is_detected", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "mount")
+
+		err := newStore("").NodePublishVolumeFS("/staging/pvc-1", devPath, target, "ext4", []string{"bind"})
+		assert.ErrorIs(t, err, ErrMountNotVerified)
+		assert.ErrorContains(t, err, "not found in mount info")
+	})
+
+	t.Run("fs_mount_of_other_device_is_detected", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "mount")
+
+		err := newStore("/dev/vg-2/pvc-1").NodePublishVolumeFS("/staging/pvc-1", devPath, target, "ext4", []string{"bind"})
+		assert.ErrorIs(t, err, ErrMountNotVerified)
+		assert.ErrorContains(t, err, "does not match expected source device path")
+	})
+
+	t.Run("unregistered_block_mount_is_detected", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "block")
+
+		// the device node the block volume is published from must exist
+		err := newStore("").NodePublishVolumeBlock("/dev/null", target, []string{"bind"})
+		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrMountNotVerified)
+		assert.ErrorContains(t, err, "not found in mount info")
+	})
+
+	t.Run("block_mount_of_other_device_is_detected", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "block")
+
+		// the fake mount leaves the target a regular file, so its device number differs
+		err := newStore("devtmpfs").NodePublishVolumeBlock("/dev/null", target, []string{"bind"})
+		assert.ErrorIs(t, err, ErrMountNotVerified)
+		assert.ErrorContains(t, err, "has device number 0")
+	})
+}
+
+func TestCheckPublishTarget(t *testing.T) {
+	const devPath = "/dev/vg-1/pvc-1"
+
+	newStore := func(target, device string) *Store {
+		f := mountutils.NewFakeMounter(nil)
+		if device != "" {
+			f.MountPoints = []mountutils.MountPoint{{Device: device, Path: target}}
+		}
+		return &Store{
+			Log:         &logger.Logger{},
+			NodeStorage: mountutils.SafeFormatAndMount{Interface: f},
+		}
+	}
+
+	t.Run("missing_target_passes", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "mount")
+
+		assert.NoError(t, newStore(target, "").CheckPublishTarget(devPath, target, false))
+	})
+
+	t.Run("not_mounted_target_passes", func(t *testing.T) {
+		target := t.TempDir()
+
+		assert.NoError(t, newStore(target, "").CheckPublishTarget(devPath, target, false))
+	})
+
+	t.Run("mount_of_volume_device_passes", func(t *testing.T) {
+		target := t.TempDir()
+
+		assert.NoError(t, newStore(target, devPath).CheckPublishTarget(devPath, target, false))
+		assert.NoError(t, newStore(target, "/dev/mapper/vg--1-pvc--1").CheckPublishTarget(devPath, target, false))
+	})
+
+	t.Run("fs_mount_of_foreign_device_is_detected", func(t *testing.T) {
+		target := t.TempDir()
+
+		err := newStore(target, "/dev/vg-1/pvc-2").CheckPublishTarget(devPath, target, false)
+		assert.ErrorIs(t, err, ErrForeignMount)
+		assert.ErrorContains(t, err, "mounted from /dev/vg-1/pvc-2")
+	})
+
+	t.Run("block_mount_of_foreign_device_is_detected", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "block")
+		require.NoError(t, os.WriteFile(target, nil, 0644))
+
+		// the target is a regular file, so its device number differs from the one of the volume device
+		err := newStore(target, "devtmpfs").CheckPublishTarget("/dev/null", target, true)
+		assert.ErrorIs(t, err, ErrForeignMount)
+		assert.ErrorContains(t, err, "has device number 0")
+	})
+}
+
+func TestEnsureMountTarget(t *testing.T) {
+	t.Run("mount_target_is_directory", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "pods", "pod-1", "mount")
+
+		require.NoError(t, EnsureMountTarget(target, false))
+		info, err := os.Stat(target)
+		require.NoError(t, err)
+		assert.True(t, info.IsDir())
+		assert.Equal(t, mountTargetDirMode, info.Mode().Perm()&mountTargetDirMode)
+
+		// idempotent
+		assert.NoError(t, EnsureMountTarget(target, false))
+	})
+
+	t.Run("block_target_is_empty_file", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "pods", "pod-1", "block")
+
+		require.NoError(t, EnsureMountTarget(target, true))
+		info, err := os.Stat(target)
+		require.NoError(t, err)
+		assert.True(t, info.Mode().IsRegular())
+		assert.Zero(t, info.Size())
+		assert.Equal(t, os.FileMode(0), info.Mode().Perm()&^mountTargetFileMode)
+
+		// idempotent
+		assert.NoError(t, EnsureMountTarget(target, true))
+	})
+
+	t.Run("block_target_directory_is_rejected", func(t *testing.T) {
+		target := t.TempDir()
+
+		assert.ErrorContains(t, EnsureMountTarget(target, true), "is a directory")
+	})
+
+	t.Run("mount_target_file_is_rejected", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "mount")
+		require.NoError(t, os.WriteFile(target, nil, 0644))
+
+		assert.ErrorContains(t, EnsureMountTarget(target, false), "is not a directory")
+	})
+
+	t.Run("publish_creates_targets", func(t *testing.T) {
+		dir := t.TempDir()
+		store := &Store{
+			Log:         &logger.Logger{},
+			NodeStorage: mountutils.SafeFormatAndMount{Interface: &lyingMounter{FakeMounter: mountutils.NewFakeMounter(nil)}},
+			MountRetry:  DefaultMountRetryPolicy(),
+		}
+
+		// the mounts are not registered, so the verification fails after the targets are created
+		_ = store.NodePublishVolumeFS("/staging/pvc-1", "/dev/vg-1/pvc-1", filepath.Join(dir, "fs", "mount"), "ext4", []string{"bind"})
+		info, err := os.Stat(filepath.Join(dir, "fs", "mount"))
+		require.NoError(t, err)
+		assert.True(t, info.IsDir())
+
+		_ = store.NodePublishVolumeBlock("/dev/null", filepath.Join(dir, "block", "pvc-1"), []string{"bind"})
+		info, err = os.Stat(filepath.Join(dir, "block", "pvc-1"))
+		require.NoError(t, err)
+		assert.True(t, info.Mode().IsRegular())
+	})
+}
+
+func TestLazyUnmount(t *testing.T) {
+	newStore := func(out string, err error) (*Store, *[]string) {
+		var args []string
+		fake := &fakeexec.FakeExec{
+			CommandScript: []fakeexec.FakeCommandAction{
+				func(cmd string, a ...string) utilexec.Cmd {
+					args = append([]string{cmd}, a...)
+					return &fakeexec.FakeCmd{
+						CombinedOutputScript: []fakeexec.FakeAction{
+							func() ([]byte, []byte, error) { return []byte(out), nil, err },
+						},
+					}
+				},
+			},
+		}
+		return &Store{Log: &logger.Logger{}, NodeStorage: mountutils.SafeFormatAndMount{Exec: fake}}, &args
+	}
+
+	t.Run("target_is_detached_and_removed", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "mount")
+		require.NoError(t, os.Mkdir(target, 0750))
+		st, args := newStore("", nil)
+
+		require.NoError(t, st.LazyUnmount(target))
+		assert.Equal(t, []string{"umount", "-l", target}, *args)
+		assert.NoDirExists(t, target)
+	})
+
+	t.Run("not_mounted_target_is_ignored", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "mount")
+		st, _ := newStore("umount: "+target+": not mounted.", errors.New("exit status 32"))
+
+		assert.NoError(t, st.LazyUnmount(target))
+	})
+
+	t.Run("failure_is_reported", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "mount")
+		st, _ := newStore("umount: "+target+": must be superuser to unmount.", errors.New("exit status 32"))
+
+		err := st.LazyUnmount(target)
+		assert.ErrorContains(t, err, "must be superuser")
+	})
+}
@@ -17,11 +17,16 @@ limitations under the License.
 package utils
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 
+	"golang.org/x/sys/unix"
 	mountutils "k8s.io/mount-utils"
 	utilexec "k8s.io/utils/exec"
 
@@ -30,20 +35,47 @@ import (
 )
 
 type NodeStoreManager interface {
-	NodeStageVolumeFS(source, target string, fsType string, mountOpts []string, formatOpts []string, lvmType, lvmThinPoolName string) error
+	NodeStageVolumeFS(source, target string, fsType string, mountOpts []string, formatOpts []string, lvmType, lvmThinPoolName string, formatPriority FormatPriority) error
 	NodePublishVolumeBlock(source, target string, mountOpts []string) error
 	NodePublishVolumeFS(source, devPath, target, fsType string, mountOpts []string) error
 	Unstage(target string) error
 	Unpublish(target string) error
+	LazyUnmount(target string) error
 	IsNotMountPoint(target string) (bool, error)
+	CheckPublishTarget(devPath, target string, block bool) error
 	ResizeFS(target string) error
 	PathExists(path string) (bool, error)
 	NeedResize(devicePath string, deviceMountPath string) (bool, error)
+	GetDiskFormat(devicePath string) (string, error)
+	Trim(target string) error
+	Preallocate(devicePath string) error
+	FindMountPoint(devicePath string) (string, error)
+	Freeze(target string) error
+	Thaw(target string) error
+	GetVolumeStats(target string) (VolumeStats, error)
+	ListMountPoints() ([]string, error)
+	GetDeviceSize(devicePath string) (int64, error)
+}
+
+// VolumeStats is the usage of the filesystem mounted at the volume path.
+type VolumeStats struct {
+	TotalBytes      int64
+	AvailableBytes  int64
+	UsedBytes       int64
+	TotalInodes     int64
+	AvailableInodes int64
+	UsedInodes      int64
+	// Block is set if the volume path is a device node, i.e. a published block volume.
+	Block bool
+	// FSType is the type of the filesystem mounted at the volume path, if it is ext4 or xfs.
+	FSType string
 }
 
 type Store struct {
 	Log         *logger.Logger
 	NodeStorage mountutils.SafeFormatAndMount
+	MountRetry  MountRetryPolicy
+	ResizeTools ResizeToolPaths
 }
 
 func NewStore(logger *logger.Logger) *Store {
@@ -53,10 +85,11 @@ func NewStore(logger *logger.Logger) *Store {
 			Interface: mountutils.New("/bin/mount"),
 			Exec:      utilexec.New(),
 		},
+		MountRetry: DefaultMountRetryPolicy(),
 	}
 }
 
-func (s *Store) NodeStageVolumeFS(source, target string, fsType string, mountOpts []string, formatOpts []string, lvmType, lvmThinPoolName string) error {
+func (s *Store) NodeStageVolumeFS(source, target string, fsType string, mountOpts []string, formatOpts []string, lvmType, lvmThinPoolName string, formatPriority FormatPriority) error {
 	s.Log.Trace(" ----== Start NodeStageVolumeFS ==---- ")
 
 	s.Log.Trace("≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈ Format options ≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈")
@@ -83,15 +116,8 @@ func (s *Store) NodeStageVolumeFS(source, target string, fsType string, mountOpt
 	s.Log.Trace("≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈ FS MOUNT ≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈")
 	s.Log.Trace("-----------------== start MkdirAll ==-----------------")
 	s.Log.Trace("mkdir create dir =" + target)
-	exists, err := s.PathExists(target)
-	if err != nil {
-		return fmt.Errorf("[PathExists] could not check if target directory %s exists: %w", target, err)
-	}
-	if !exists {
-		s.Log.Debug(fmt.Sprintf("Creating target directory %s", target))
-		if err := os.MkdirAll(target, os.FileMode(0755)); err != nil {
-			return fmt.Errorf("[MkdirAll] could not create target directory %s: %w", target, err)
-		}
+	if err := EnsureMountTarget(target, false); err != nil {
+		return fmt.Errorf("[NodeStageVolumeFS] %w", err)
 	}
 	s.Log.Trace("-----------------== stop MkdirAll ==-----------------")
 
@@ -127,7 +153,15 @@ func (s *Store) NodeStageVolumeFS(source, target string, fsType string, mountOpt
 	if lvmType == internal.LVMTypeThin {
 		s.Log.Trace(fmt.Sprintf("LVM type is Thin. Thin pool name: %s", lvmThinPoolName))
 	}
-	err = s.NodeStorage.FormatAndMountSensitiveWithFormatOptions(source, target, fsType, mountOpts, nil, formatOpts)
+	storage := s.NodeStorage
+	storage.Exec = s.formatExec(formatPriority)
+	err = s.MountRetry.Do(func() error {
+		err := storage.FormatAndMountSensitiveWithFormatOptions(source, target, fsType, mountOpts, nil, formatOpts)
+		if err != nil && s.MountRetry.IsRetryable(err) {
+			s.Log.Warning(fmt.Sprintf("[NodeStageVolumeFS] transient error mounting %s to %s: %v", source, target, err))
+		}
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("failed to FormatAndMount : %w", err)
 	}
@@ -158,13 +192,8 @@ func (s *Store) NodePublishVolumeBlock(source, target string, mountOpts []string
 	s.Log.Trace("≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈ MODE SOURCE  ≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈≈")
 
 	s.Log.Trace("-----------------== start Create File ==---------------")
-	f, err := os.OpenFile(target, os.O_CREATE, os.FileMode(0644))
-	if err != nil {
-		if !os.IsExist(err) {
-			return fmt.Errorf("[NodePublishVolumeBlock] could not create bind target for block volume %s, %w", target, err)
-		}
-	} else {
-		_ = f.Close()
+	if err := EnsureMountTarget(target, true); err != nil {
+		return fmt.Errorf("[NodePublishVolumeBlock] could not create bind target for block volume: %w", err)
 	}
 	s.Log.Trace("-----------------== stop Create File ==---------------")
 	s.Log.Trace("-----------------== start Mount ==---------------")
@@ -173,6 +202,9 @@ func (s *Store) NodePublishVolumeBlock(source, target string, mountOpts []string
 		s.Log.Error(err, "[NodePublishVolumeBlock] mount error :")
 		return err
 	}
+	if err := verifyBlockMount(s, source, target); err != nil {
+		return fmt.Errorf("[NodePublishVolumeBlock] %w: %v", ErrMountNotVerified, err)
+	}
 	s.Log.Trace("-----------------== stop Mount ==---------------")
 	s.Log.Trace("-----------------== stop NodePublishVolumeBlock ==---------------")
 	return nil
@@ -181,23 +213,13 @@ func (s *Store) NodePublishVolumeBlock(source, target string, mountOpts []string
 func (s *Store) NodePublishVolumeFS(source, devPath, target, fsType string, mountOpts []string) error {
 	s.Log.Info(" ----== Start NodePublishVolumeFS ==---- ")
 	s.Log.Trace(fmt.Sprintf("[NodePublishVolumeFS] params source=%q target=%q mountOptions=%v", source, target, mountOpts))
-	isMountPoint := false
-	exists, err := s.PathExists(target)
-	if err != nil {
-		return fmt.Errorf("[NodePublishVolumeFS] could not check if target file %s exists: %w", target, err)
+	if err := EnsureMountTarget(target, false); err != nil {
+		return fmt.Errorf("[NodePublishVolumeFS] %w", err)
 	}
 
-	if exists {
-		s.Log.Trace(fmt.Sprintf("[NodePublishVolumeFS] target file %s already exists", target))
-		isMountPoint, err = s.NodeStorage.IsMountPoint(target)
-		if err != nil {
-			return fmt.Errorf("[NodePublishVolumeFS] could not check if target file %s is a mount point: %w", target, err)
-		}
-	} else {
-		s.Log.Trace(fmt.Sprintf("[NodePublishVolumeFS] creating target file %q", target))
-		if err := os.MkdirAll(target, os.FileMode(0755)); err != nil {
-			return fmt.Errorf("[NodePublishVolumeFS] could not create target file %q: %w", target, err)
-		}
+	isMountPoint, err := s.NodeStorage.IsMountPoint(target)
+	if err != nil {
+		return fmt.Errorf("[NodePublishVolumeFS] could not check if target file %s is a mount point: %w", target, err)
 	}
 
 	if isMountPoint {
@@ -210,10 +232,19 @@ func (s *Store) NodePublishVolumeFS(source, devPath, target, fsType string, moun
 		return nil
 	}
 
-	err = s.NodeStorage.Interface.Mount(source, target, fsType, mountOpts)
+	err = s.MountRetry.Do(func() error {
+		err := s.NodeStorage.Interface.Mount(source, target, fsType, mountOpts)
+		if err != nil && s.MountRetry.IsRetryable(err) {
+			s.Log.Warning(fmt.Sprintf("[NodePublishVolumeFS] transient error bind mounting %s to %s: %v", source, target, err))
+		}
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("[NodePublishVolumeFS] failed to bind mount %q to %q with mount options %v: %w", source, target, mountOpts, err)
 	}
+	if err := checkMount(s, devPath, target, mountOpts); err != nil {
+		return fmt.Errorf("[NodePublishVolumeFS] %w: %v", ErrMountNotVerified, err)
+	}
 
 	s.Log.Trace("-----------------== stop NodePublishVolumeFS ==---------------")
 	return nil
@@ -238,15 +269,71 @@ func (s *Store) Unstage(target string) error {
 	return err
 }
 
+// LazyUnmount detaches the filesystem mounted at the target with umount -l. The kernel cleans the
+// filesystem up once it is no longer busy. The target is removed if it is already empty.
+func (s *Store) LazyUnmount(target string) error {
+	s.Log.Info(fmt.Sprintf("[lazy unmount volume] target=%s", target))
+	out, err := s.NodeStorage.Exec.Command("umount", "-l", target).CombinedOutput()
+	if err != nil && !strings.Contains(string(out), "not mounted") {
+		return fmt.Errorf("umount -l %s failed: %w, output: %s", target, err, strings.TrimSpace(string(out)))
+	}
+
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		s.Log.Warning(fmt.Sprintf("[lazy unmount volume] unable to remove target %s: %v", target, err))
+	}
+
+	return nil
+}
+
 func (s *Store) IsNotMountPoint(target string) (bool, error) {
-	notMounted, err := s.NodeStorage.IsMountPoint(target)
+	mounted, err := s.NodeStorage.IsMountPoint(target)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return true, nil
 		}
 		return false, err
 	}
-	return notMounted, nil
+	return !mounted, nil
+}
+
+// CheckPublishTarget returns ErrForeignMount if the target is a mount point of a device other than devPath.
+// A target that does not exist, is not a mount point or is a mount of devPath passes the check.
+func (s *Store) CheckPublishTarget(devPath, target string, block bool) error {
+	notMounted, err := s.IsNotMountPoint(target)
+	if err != nil {
+		return fmt.Errorf("[CheckPublishTarget] could not check if target %s is a mount point: %w", target, err)
+	}
+	if notMounted {
+		return nil
+	}
+
+	if block {
+		if err := verifyBlockMount(s, devPath, target); err != nil {
+			return fmt.Errorf("[CheckPublishTarget] %w: %v", ErrForeignMount, err)
+		}
+		return nil
+	}
+
+	mntInfo, err := s.NodeStorage.Interface.List()
+	if err != nil {
+		return fmt.Errorf("[CheckPublishTarget] failed to list mounts: %w", err)
+	}
+	// the mounts stacked on the target are listed in the mount order, so the last one is visible
+	mountPath, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		mountPath = target
+	}
+	device := ""
+	for _, m := range mntInfo {
+		if m.Path == mountPath {
+			device = m.Device
+		}
+	}
+	if device != devPath && device != toMapperPath(devPath) {
+		return fmt.Errorf("[CheckPublishTarget] %w: %s is mounted from %s, expected %s", ErrForeignMount, target, device, devPath)
+	}
+
+	return nil
 }
 
 func (s *Store) ResizeFS(mountTarget string) error {
@@ -259,7 +346,18 @@ func (s *Store) ResizeFS(mountTarget string) error {
 
 	s.Log.Info("Found device for resizing", "devicePath", devicePath, "mountTarget", mountTarget)
 
-	_, err = mountutils.NewResizeFs(s.NodeStorage.Exec).Resize(devicePath, mountTarget)
+	exec := resizeToolExec{Interface: s.NodeStorage.Exec, paths: s.ResizeTools}
+	format, err := s.NodeStorage.GetDiskFormat(devicePath)
+	if err != nil {
+		return fmt.Errorf("failed to get the filesystem of device %s: %w", devicePath, err)
+	}
+	if tool, ok := ResizeTool(format); ok {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("%w: %s growing the %s filesystem on device %s is not found at %s: %v", ErrResizeToolMissing, tool, format, devicePath, s.ResizeTools.Path(tool), err)
+		}
+	}
+
+	_, err = mountutils.NewResizeFs(exec).Resize(devicePath, mountTarget)
 	if err != nil {
 		s.Log.Error(err, "Failed to resize filesystem", "devicePath", devicePath, "mountTarget", mountTarget)
 		return fmt.Errorf("failed to resize filesystem %s on device %s: %w", mountTarget, devicePath, err)
@@ -273,8 +371,141 @@ func (s *Store) PathExists(path string) (bool, error) {
 	return mountutils.PathExists(path)
 }
 
+// ListMountPoints returns the paths of all the mounts on the node.
+func (s *Store) ListMountPoints() ([]string, error) {
+	mounts, err := s.NodeStorage.List()
+	if err != nil {
+		return nil, fmt.Errorf("[ListMountPoints] unable to list the mounts: %w", err)
+	}
+
+	paths := make([]string, 0, len(mounts))
+	for _, m := range mounts {
+		paths = append(paths, m.Path)
+	}
+
+	return paths, nil
+}
+
+// FindMountPoint returns a path the device is mounted at or "" if it is not mounted.
+func (s *Store) FindMountPoint(devicePath string) (string, error) {
+	mounts, err := s.NodeStorage.List()
+	if err != nil {
+		return "", fmt.Errorf("[FindMountPoint] unable to list the mounts: %w", err)
+	}
+
+	mapperPath := toMapperPath(devicePath)
+	for _, m := range mounts {
+		if m.Device == devicePath || m.Device == mapperPath {
+			return m.Path, nil
+		}
+	}
+
+	return "", nil
+}
+
+// Freeze suspends the writes to the filesystem mounted at target and flushes it to the device.
+func (s *Store) Freeze(target string) error {
+	s.Log.Debug(fmt.Sprintf("[Freeze] freezing the filesystem mounted at %s", target))
+	out, err := s.NodeStorage.Exec.Command("fsfreeze", "--freeze", target).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("[Freeze] fsfreeze --freeze %s failed: %w, output: %s", target, err, string(out))
+	}
+
+	return nil
+}
+
+// Thaw resumes the writes to the filesystem frozen by Freeze.
+func (s *Store) Thaw(target string) error {
+	s.Log.Debug(fmt.Sprintf("[Thaw] thawing the filesystem mounted at %s", target))
+	out, err := s.NodeStorage.Exec.Command("fsfreeze", "--unfreeze", target).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("[Thaw] fsfreeze --unfreeze %s failed: %w, output: %s", target, err, string(out))
+	}
+
+	return nil
+}
+
 func (s *Store) NeedResize(devicePath string, deviceMountPath string) (bool, error) {
-	return mountutils.NewResizeFs(s.NodeStorage.Exec).NeedResize(devicePath, deviceMountPath)
+	return mountutils.NewResizeFs(resizeToolExec{Interface: s.NodeStorage.Exec, paths: s.ResizeTools}).NeedResize(devicePath, deviceMountPath)
+}
+
+// GetDiskFormat returns the filesystem type found on the device by blkid or an empty string for an unformatted device.
+func (s *Store) GetDiskFormat(devicePath string) (string, error) {
+	return s.NodeStorage.GetDiskFormat(devicePath)
+}
+
+// GetDeviceSize returns the size of the block device in bytes.
+func (s *Store) GetDeviceSize(devicePath string) (int64, error) {
+	out, err := s.NodeStorage.Exec.Command("blockdev", "--getsize64", devicePath).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("[GetDeviceSize] blockdev --getsize64 %s failed: %w, output: %s", devicePath, err, string(out))
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("[GetDeviceSize] unable to parse the size of %s: %w", devicePath, err)
+	}
+
+	return size, nil
+}
+
+// Trim discards the unused blocks of the filesystem mounted at target.
+func (s *Store) Trim(target string) error {
+	s.Log.Debug(fmt.Sprintf("[Trim] running fstrim on %s", target))
+	out, err := s.NodeStorage.Exec.Command("fstrim", target).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("[Trim] fstrim %s failed: %w, output: %s", target, err, string(out))
+	}
+
+	return nil
+}
+
+// Preallocate zero-fills the device, so every block of a thin LV is allocated in the thin pool upfront.
+func (s *Store) Preallocate(devicePath string) error {
+	s.Log.Debug(fmt.Sprintf("[Preallocate] zero-filling %s", devicePath))
+	out, err := s.NodeStorage.Exec.Command("blkdiscard", "--zeroout", devicePath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("[Preallocate] blkdiscard --zeroout %s failed: %w, output: %s", devicePath, err, string(out))
+	}
+
+	return nil
+}
+
+// GetVolumeStats returns the usage of the filesystem mounted at the target.
+func (s *Store) GetVolumeStats(target string) (VolumeStats, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(target, &st); err != nil {
+		return VolumeStats{}, fmt.Errorf("[GetVolumeStats] statfs %s failed: %w", target, err)
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return VolumeStats{}, fmt.Errorf("[GetVolumeStats] stat %s failed: %w", target, err)
+	}
+
+	bsize := int64(st.Bsize)
+	return VolumeStats{
+		TotalBytes:      int64(st.Blocks) * bsize,
+		AvailableBytes:  int64(st.Bavail) * bsize,
+		UsedBytes:       int64(st.Blocks-st.Bfree) * bsize,
+		TotalInodes:     int64(st.Files),
+		AvailableInodes: int64(st.Ffree),
+		UsedInodes:      int64(st.Files - st.Ffree),
+		Block:           info.Mode()&os.ModeDevice != 0,
+		FSType:          fsTypeFromMagic(int64(st.Type)),
+	}, nil
+}
+
+// fsTypeFromMagic returns the type of the filesystem reported by statfs, if it is one the volumes are formatted with.
+func fsTypeFromMagic(magic int64) string {
+	switch magic {
+	case unix.EXT4_SUPER_MAGIC:
+		return internal.FSTypeExt4
+	case unix.XFS_SUPER_MAGIC:
+		return internal.FSTypeXfs
+	default:
+		return ""
+	}
 }
 
 func toMapperPath(devPath string) string {
@@ -288,6 +519,82 @@ func toMapperPath(devPath string) string {
 	return "/dev/mapper/" + mapperPath
 }
 
+const (
+	// mountTargetDirMode and mountTargetFileMode are the permissions of the created mount targets and their parents.
+	mountTargetDirMode  os.FileMode = 0750
+	mountTargetFileMode os.FileMode = 0640
+)
+
+// EnsureMountTarget creates the mount target and its parent directories if they do not exist: a directory
+// for a filesystem or an empty file for a block device. An existing target of the wrong type is an error.
+// A target whose stat fails with a corrupted mount error is left for the unmount to clean up.
+func EnsureMountTarget(target string, block bool) error {
+	info, err := os.Stat(target)
+	switch {
+	case err == nil:
+		if block && info.IsDir() {
+			return fmt.Errorf("target %s of the block volume is a directory", target)
+		}
+		if !block && !info.IsDir() {
+			return fmt.Errorf("target %s of the filesystem volume is not a directory", target)
+		}
+		return nil
+	case mountutils.IsCorruptedMnt(err):
+		return nil
+	case !os.IsNotExist(err):
+		return fmt.Errorf("could not stat target %s: %w", target, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), mountTargetDirMode); err != nil {
+		return fmt.Errorf("could not create parent directory of target %s: %w", target, err)
+	}
+
+	if !block {
+		if err := os.Mkdir(target, mountTargetDirMode); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("could not create target directory %s: %w", target, err)
+		}
+		return nil
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_RDONLY, mountTargetFileMode)
+	if err != nil {
+		return fmt.Errorf("could not create target file %s: %w", target, err)
+	}
+	return f.Close()
+}
+
+// ErrMountNotVerified is returned when the mount reported as successful is not found in the mount table.
+var ErrMountNotVerified = errors.New("mount is not verified")
+
+// ErrForeignMount is returned when the publish target is already mounted from a device other than the volume one.
+var ErrForeignMount = errors.New("target is mounted from a foreign device")
+
+// verifyBlockMount checks the target is a mount point of the source device node. The mount table
+// lists the devtmpfs as the device of the bind mounted device nodes, so the device numbers are compared.
+func verifyBlockMount(s *Store, source, target string) error {
+	mntInfo, err := s.NodeStorage.Interface.List()
+	if err != nil {
+		return fmt.Errorf("[verifyBlockMount] failed to list mounts: %w", err)
+	}
+
+	if !slices.ContainsFunc(mntInfo, func(m mountutils.MountPoint) bool { return m.Path == target }) {
+		return fmt.Errorf("[verifyBlockMount] mount point %q not found in mount info", target)
+	}
+
+	var sourceStat, targetStat unix.Stat_t
+	if err := unix.Stat(source, &sourceStat); err != nil {
+		return fmt.Errorf("[verifyBlockMount] failed to stat %s: %w", source, err)
+	}
+	if err := unix.Stat(target, &targetStat); err != nil {
+		return fmt.Errorf("[verifyBlockMount] failed to stat %s: %w", target, err)
+	}
+	if sourceStat.Rdev != targetStat.Rdev {
+		return fmt.Errorf("[verifyBlockMount] mount point %q has device number %d, expected %d of %s", target, targetStat.Rdev, sourceStat.Rdev, source)
+	}
+
+	return nil
+}
+
 func checkMount(s *Store, devPath, target string, mountOpts []string) error {
 	mntInfo, err := s.NodeStorage.Interface.List()
 	if err != nil {
@@ -316,3 +623,26 @@ func checkMount(s *Store, devPath, target string, mountOpts []string) error {
 
 	return fmt.Errorf("[checkMount] mount point %q not found in mount info", target)
 }
+
+// CSIVolumeData is the part of the vol_data.json the kubelet writes next to the CSI volume mount points.
+type CSIVolumeData struct {
+	DriverName   string `json:"driverName"`
+	VolumeHandle string `json:"volumeHandle"`
+}
+
+// ReadCSIVolumeData reads the kubelet volume data of the CSI volume mounted at the mount path,
+// i.e. the staging globalmount or the publish mount directory.
+func ReadCSIVolumeData(mountPath string) (CSIVolumeData, error) {
+	var data CSIVolumeData
+
+	content, err := os.ReadFile(filepath.Join(filepath.Dir(mountPath), "vol_data.json"))
+	if err != nil {
+		return data, err
+	}
+
+	if err := json.Unmarshal(content, &data); err != nil {
+		return data, fmt.Errorf("unable to parse the volume data of %s: %w", mountPath, err)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"sds-local-volume-csi/internal"
+)
+
+// PlacementDecision is the rationale of placing a volume on an LVMVolumeGroup.
+type PlacementDecision struct {
+	Node     string
+	LVG      string
+	ThinPool string
+	// FreeSpace is the free space of the LVMVolumeGroup, or of the thin pool for the thin volumes, before the volume is created.
+	FreeSpace resource.Quantity
+	Strategy  string
+}
+
+// NewPlacementDecision returns the decision placing a volume of the spec on the LVMVolumeGroup with the strategy.
+func NewPlacementDecision(lvg snc.LVMVolumeGroup, llvSpec snc.LVMLogicalVolumeSpec, strategy string) PlacementDecision {
+	decision := PlacementDecision{
+		Node:      lvg.Spec.Local.NodeName,
+		LVG:       lvg.Name,
+		FreeSpace: GetLVMVolumeGroupFreeSpace(lvg),
+		Strategy:  strategy,
+	}
+
+	if llvSpec.Type == internal.LVMTypeThin && llvSpec.Thin != nil {
+		decision.ThinPool = llvSpec.Thin.PoolName
+		decision.FreeSpace = resource.Quantity{}
+		if free, err := GetLVMThinPoolFreeSpace(lvg, llvSpec.Thin.PoolName); err == nil {
+			decision.FreeSpace = free
+		}
+	}
+
+	return decision
+}
+
+// String renders the decision as the comma-separated key=value pairs in a fixed order,
+// e.g. node=node-1,lvg=lvg-1,free=10Gi,strategy=most-free. The thin pool is rendered for the thin volumes only.
+func (p PlacementDecision) String() string {
+	s := fmt.Sprintf("node=%s,lvg=%s", p.Node, p.LVG)
+	if p.ThinPool != "" {
+		s += ",thinPool=" + p.ThinPool
+	}
+	return s + fmt.Sprintf(",free=%s,strategy=%s", p.FreeSpace.String(), p.Strategy)
+}
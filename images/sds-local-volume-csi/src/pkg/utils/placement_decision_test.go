@@ -0,0 +1,51 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"testing"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"sds-local-volume-csi/internal"
+)
+
+func TestPlacementDecision(t *testing.T) {
+	lvg := snc.LVMVolumeGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: "lvg-1"},
+		Spec:       snc.LVMVolumeGroupSpec{Local: snc.LVMVolumeGroupLocalSpec{NodeName: "node-1"}},
+		Status: snc.LVMVolumeGroupStatus{
+			VGSize:        resource.MustParse("10Gi"),
+			AllocatedSize: resource.MustParse("4Gi"),
+			ThinPools:     []snc.LVMVolumeGroupThinPoolStatus{{Name: "tp-1", AvailableSpace: resource.MustParse("2Gi")}},
+		},
+	}
+
+	t.Run("thick_volume", func(t *testing.T) {
+		decision := NewPlacementDecision(lvg, snc.LVMLogicalVolumeSpec{Type: internal.LVMTypeThick}, NodeSelectorBinPack)
+		assert.Equal(t, "node=node-1,lvg=lvg-1,free=6Gi,strategy=bin-pack", decision.String())
+	})
+
+	t.Run("thin_volume", func(t *testing.T) {
+		spec := snc.LVMLogicalVolumeSpec{Type: internal.LVMTypeThin, Thin: &snc.LVMLogicalVolumeThinSpec{PoolName: "tp-1"}}
+		decision := NewPlacementDecision(lvg, spec, internal.ThinPoolSelectionLowestOvercommit)
+		assert.Equal(t, "node=node-1,lvg=lvg-1,thinPool=tp-1,free=2Gi,strategy="+internal.ThinPoolSelectionLowestOvercommit, decision.String())
+	})
+}
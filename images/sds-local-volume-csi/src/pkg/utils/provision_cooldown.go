@@ -0,0 +1,99 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// ProvisionCooldown tracks the recent provisioning failures per storage class and node,
+// so the same failing placement is not retried until the cooldown window passes.
+// A nil ProvisionCooldown never reports a cooldown.
+type ProvisionCooldown struct {
+	mu       sync.Mutex // protects failures
+	window   time.Duration
+	now      func() time.Time
+	failures map[string]time.Time
+}
+
+// NewProvisionCooldown returns a ProvisionCooldown with the given window. A zero window returns nil.
+func NewProvisionCooldown(window time.Duration) *ProvisionCooldown {
+	if window <= 0 {
+		return nil
+	}
+
+	return &ProvisionCooldown{
+		window:   window,
+		now:      time.Now,
+		failures: make(map[string]time.Time),
+	}
+}
+
+// ProvisionCooldownKey identifies the placement by the storage class LVMVolumeGroups parameter, since
+// the CSI requests do not carry the storage class name, and the node name.
+func ProvisionCooldownKey(storageClassLVGs, nodeName string) string {
+	return storageClassLVGs + "\x00" + nodeName
+}
+
+// RecordFailure starts the cooldown of the key.
+func (c *ProvisionCooldown) RecordFailure(key string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.failures[key] = c.now()
+}
+
+// Reset ends the cooldown of the key, e.g. after a successful provision.
+func (c *ProvisionCooldown) Reset(key string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.failures, key)
+}
+
+// Remaining returns the time left until the cooldown of the key lifts. Zero means there is no cooldown.
+func (c *ProvisionCooldown) Remaining(key string) time.Duration {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for k, failedAt := range c.failures {
+		if now.Sub(failedAt) >= c.window {
+			delete(c.failures, k)
+		}
+	}
+
+	failedAt, ok := c.failures[key]
+	if !ok {
+		return 0
+	}
+
+	return c.window - now.Sub(failedAt)
+}
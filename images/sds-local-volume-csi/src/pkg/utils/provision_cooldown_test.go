@@ -0,0 +1,74 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvisionCooldown(t *testing.T) {
+	newCooldown := func(now *time.Time) *ProvisionCooldown {
+		c := NewProvisionCooldown(time.Minute)
+		require.NotNil(t, c)
+		c.now = func() time.Time { return *now }
+		return c
+	}
+	key := ProvisionCooldownKey("- name: lvg-1\n", "node-1")
+
+	t.Run("cooldown_is_enforced_after_failure", func(t *testing.T) {
+		now := time.Now()
+		c := newCooldown(&now)
+		assert.Zero(t, c.Remaining(key))
+
+		c.RecordFailure(key)
+		now = now.Add(20 * time.Second)
+		assert.Equal(t, 40*time.Second, c.Remaining(key))
+		assert.Zero(t, c.Remaining(ProvisionCooldownKey("- name: lvg-1\n", "node-2")))
+		assert.Zero(t, c.Remaining(ProvisionCooldownKey("- name: lvg-2\n", "node-1")))
+	})
+
+	t.Run("cooldown_lifts_after_window", func(t *testing.T) {
+		now := time.Now()
+		c := newCooldown(&now)
+
+		c.RecordFailure(key)
+		now = now.Add(time.Minute)
+		assert.Zero(t, c.Remaining(key))
+		assert.Empty(t, c.failures)
+	})
+
+	t.Run("reset_lifts_cooldown", func(t *testing.T) {
+		now := time.Now()
+		c := newCooldown(&now)
+
+		c.RecordFailure(key)
+		c.Reset(key)
+		assert.Zero(t, c.Remaining(key))
+	})
+
+	t.Run("zero_window_disables_cooldown", func(t *testing.T) {
+		c := NewProvisionCooldown(0)
+		assert.Nil(t, c)
+
+		c.RecordFailure(key)
+		assert.Zero(t, c.Remaining(key))
+	})
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	storagev1 "k8s.io/api/storage/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"sds-local-volume-csi/pkg/logger"
+)
+
+const (
+	DefaultRegistrationPollInterval = time.Second
+	maxRegistrationPollInterval     = 30 * time.Second
+)
+
+var ErrDriverNotRegistered = errors.New("driver is not registered with the kubelet")
+
+// IsDriverRegistered reports whether the CSINode of the node lists the driver.
+// The CSINode missing means the kubelet has not registered any driver yet.
+func IsDriverRegistered(ctx context.Context, kc client.Client, driverName, nodeName string) (bool, error) {
+	csiNode := &storagev1.CSINode{}
+	if err := kc.Get(ctx, client.ObjectKey{Name: nodeName}, csiNode); err != nil {
+		if kerrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("unable to get CSINode %s: %w", nodeName, err)
+	}
+
+	for _, drv := range csiNode.Spec.Drivers {
+		if drv.Name == driverName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// WaitForDriverRegistration polls the CSINode of the node until it lists the driver or the timeout expires.
+// The poll interval starts at the given one and doubles up to 30s. The lookup errors are logged and retried,
+// as the kubelet and the API server may be restarting along with the node plugin. The wait stops
+// with the lookup error if the plugin is not allowed to get the CSINodes.
+func WaitForDriverRegistration(ctx context.Context, kc client.Client, log *logger.Logger, driverName, nodeName string, timeout, interval time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for attempt := 1; ; attempt++ {
+		registered, err := IsDriverRegistered(ctx, kc, driverName, nodeName)
+		switch {
+		case kerrors.IsForbidden(err):
+			return err
+		case err != nil:
+			log.Warning(fmt.Sprintf("[WaitForDriverRegistration] attempt %d: %v", attempt, err))
+		case registered:
+			log.Info(fmt.Sprintf("[WaitForDriverRegistration] driver %s is registered with the kubelet on node %s after %d attempt(s)", driverName, nodeName, attempt))
+			return nil
+		default:
+			log.Info(fmt.Sprintf("[WaitForDriverRegistration] attempt %d: driver %s is not registered with the kubelet on node %s yet. Retry in %s", attempt, driverName, nodeName, interval))
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: driver %s on node %s in %s", ErrDriverNotRegistered, driverName, nodeName, timeout)
+		case <-time.After(interval):
+		}
+
+		interval = min(2*interval, maxRegistrationPollInterval)
+	}
+}
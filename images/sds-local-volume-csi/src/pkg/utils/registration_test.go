@@ -0,0 +1,107 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	storagev1 "k8s.io/api/storage/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	"sds-local-volume-csi/pkg/logger"
+)
+
+func TestWaitForDriverRegistration(t *testing.T) {
+	const driverName = "local.csi.storage.deckhouse.io"
+	ctx := context.Background()
+
+	s := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(s))
+
+	newCSINode := func(drivers ...string) *storagev1.CSINode {
+		csiNode := &storagev1.CSINode{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}
+		for _, name := range drivers {
+			csiNode.Spec.Drivers = append(csiNode.Spec.Drivers, storagev1.CSINodeDriver{Name: name, NodeID: "node-1"})
+		}
+		return csiNode
+	}
+
+	t.Run("registered_driver_is_found", func(t *testing.T) {
+		cl := fake.NewClientBuilder().WithScheme(s).WithObjects(newCSINode(driverName)).Build()
+
+		err := WaitForDriverRegistration(ctx, cl, &logger.Logger{}, driverName, "node-1", time.Second, time.Millisecond)
+		assert.NoError(t, err)
+	})
+
+	t.Run("delayed_registration_is_awaited", func(t *testing.T) {
+		cl := fake.NewClientBuilder().WithScheme(s).WithObjects(newCSINode("other.csi.example.com")).Build()
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			csiNode := &storagev1.CSINode{}
+			if err := cl.Get(ctx, client.ObjectKey{Name: "node-1"}, csiNode); err != nil {
+				return
+			}
+			csiNode.Spec.Drivers = append(csiNode.Spec.Drivers, storagev1.CSINodeDriver{Name: driverName, NodeID: "node-1"})
+			_ = cl.Update(ctx, csiNode)
+		}()
+
+		err := WaitForDriverRegistration(ctx, cl, &logger.Logger{}, driverName, "node-1", 5*time.Second, 10*time.Millisecond)
+		assert.NoError(t, err)
+	})
+
+	t.Run("delayed_csinode_is_awaited", func(t *testing.T) {
+		cl := fake.NewClientBuilder().WithScheme(s).Build()
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			_ = cl.Create(ctx, newCSINode(driverName))
+		}()
+
+		err := WaitForDriverRegistration(ctx, cl, &logger.Logger{}, driverName, "node-1", 5*time.Second, 10*time.Millisecond)
+		assert.NoError(t, err)
+	})
+
+	t.Run("forbidden_lookup_stops_the_wait", func(t *testing.T) {
+		cl := fake.NewClientBuilder().WithScheme(s).WithInterceptorFuncs(interceptor.Funcs{
+			Get: func(context.Context, client.WithWatch, client.ObjectKey, client.Object, ...client.GetOption) error {
+				return kerrors.NewForbidden(storagev1.Resource("csinodes"), "node-1", errors.New("no RBAC"))
+			},
+		}).Build()
+
+		err := WaitForDriverRegistration(ctx, cl, &logger.Logger{}, driverName, "node-1", 5*time.Second, 10*time.Millisecond)
+		assert.True(t, kerrors.IsForbidden(err))
+	})
+
+	t.Run("missing_registration_times_out", func(t *testing.T) {
+		cl := fake.NewClientBuilder().WithScheme(s).WithObjects(newCSINode()).Build()
+
+		err := WaitForDriverRegistration(ctx, cl, &logger.Logger{}, driverName, "node-1", 50*time.Millisecond, 10*time.Millisecond)
+		assert.ErrorIs(t, err, ErrDriverNotRegistered)
+	})
+}
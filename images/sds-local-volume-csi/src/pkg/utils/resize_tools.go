@@ -0,0 +1,93 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"errors"
+
+	utilexec "k8s.io/utils/exec"
+)
+
+// The names of the tools growing the mounted filesystems.
+const (
+	Resize2fsTool = "resize2fs"
+	XFSGrowfsTool = "xfs_growfs"
+	BtrfsTool     = "btrfs"
+)
+
+// ErrResizeToolMissing is returned when the tool growing the filesystem is not found on the node.
+var ErrResizeToolMissing = errors.New("resize tool is missing")
+
+// ResizeToolPaths maps the names of the resize tools to the paths they are run from.
+// The tools without a path are looked up in PATH.
+type ResizeToolPaths map[string]string
+
+// ResizeTool returns the name of the tool growing the filesystem type.
+func ResizeTool(fsType string) (string, bool) {
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		return Resize2fsTool, true
+	case "xfs":
+		return XFSGrowfsTool, true
+	case "btrfs":
+		return BtrfsTool, true
+	default:
+		return "", false
+	}
+}
+
+// Path returns the path the tool is run from.
+func (p ResizeToolPaths) Path(tool string) string {
+	if path := p[tool]; path != "" {
+		return path
+	}
+	return tool
+}
+
+// Missing returns the configured paths of the tools that are not found by the exec.
+func (p ResizeToolPaths) Missing(e utilexec.Interface) []string {
+	var missing []string
+	for _, tool := range []string{Resize2fsTool, XFSGrowfsTool, BtrfsTool} {
+		if p[tool] == "" {
+			continue
+		}
+		if _, err := e.LookPath(p[tool]); err != nil {
+			missing = append(missing, p[tool])
+		}
+	}
+
+	return missing
+}
+
+// resizeToolExec runs the resize tools from the configured paths and the other commands as is.
+type resizeToolExec struct {
+	utilexec.Interface
+	paths ResizeToolPaths
+}
+
+func (e resizeToolExec) Command(cmd string, args ...string) utilexec.Cmd {
+	return e.Interface.Command(e.paths.Path(cmd), args...)
+}
+
+func (e resizeToolExec) CommandContext(ctx context.Context, cmd string, args ...string) utilexec.Cmd {
+	return e.Interface.CommandContext(ctx, e.paths.Path(cmd), args...)
+}
+
+func (e resizeToolExec) LookPath(file string) (string, error) {
+	return e.Interface.LookPath(e.paths.Path(file))
+}
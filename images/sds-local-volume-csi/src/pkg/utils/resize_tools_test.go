@@ -0,0 +1,111 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	mountutils "k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+	fakeexec "k8s.io/utils/exec/testing"
+
+	"sds-local-volume-csi/pkg/logger"
+)
+
+func TestResizeFS(t *testing.T) {
+	const (
+		devPath = "/dev/vg-1/pvc-1"
+		target  = "/target/pvc-1"
+	)
+
+	// newStore returns a Store with an xfs filesystem mounted at the target and the tools found by lookPath
+	newStore := func(paths ResizeToolPaths, lookPath func(string) (string, error)) (*Store, *[][]string) {
+		var commands [][]string
+		run := func(cmd string, args ...string) utilexec.Cmd {
+			commands = append(commands, append([]string{cmd}, args...))
+			out := ""
+			if cmd == "blkid" {
+				out = "DEVNAME=" + devPath + "\nTYPE=xfs\n"
+			}
+			return &fakeexec.FakeCmd{
+				CombinedOutputScript: []fakeexec.FakeAction{
+					func() ([]byte, []byte, error) { return []byte(out), nil, nil },
+				},
+			}
+		}
+		fake := &fakeexec.FakeExec{
+			CommandScript: []fakeexec.FakeCommandAction{run, run, run},
+			LookPathFunc:  lookPath,
+		}
+
+		return &Store{
+			Log: &logger.Logger{},
+			NodeStorage: mountutils.SafeFormatAndMount{
+				Interface: mountutils.NewFakeMounter([]mountutils.MountPoint{{Device: devPath, Path: target}}),
+				Exec:      fake,
+			},
+			ResizeTools: paths,
+		}, &commands
+	}
+
+	t.Run("configured_path_is_invoked", func(t *testing.T) {
+		var lookedUp []string
+		st, commands := newStore(ResizeToolPaths{XFSGrowfsTool: "/opt/xfs/xfs_growfs"}, func(file string) (string, error) {
+			lookedUp = append(lookedUp, file)
+			return file, nil
+		})
+
+		require.NoError(t, st.ResizeFS(target))
+		assert.Equal(t, []string{"/opt/xfs/xfs_growfs"}, lookedUp)
+		require.Len(t, *commands, 3)
+		assert.Equal(t, []string{"/opt/xfs/xfs_growfs", "-d", target}, (*commands)[2])
+	})
+
+	t.Run("default_path_is_looked_up", func(t *testing.T) {
+		st, commands := newStore(nil, func(file string) (string, error) { return "/usr/sbin/" + file, nil })
+
+		require.NoError(t, st.ResizeFS(target))
+		require.Len(t, *commands, 3)
+		assert.Equal(t, XFSGrowfsTool, (*commands)[2][0])
+	})
+
+	t.Run("missing_tool_is_reported", func(t *testing.T) {
+		st, commands := newStore(ResizeToolPaths{XFSGrowfsTool: "/opt/xfs/xfs_growfs"}, func(string) (string, error) {
+			return "", errors.New("executable file not found")
+		})
+
+		err := st.ResizeFS(target)
+		assert.ErrorIs(t, err, ErrResizeToolMissing)
+		assert.ErrorContains(t, err, "xfs_growfs growing the xfs filesystem on device /dev/vg-1/pvc-1 is not found at /opt/xfs/xfs_growfs")
+		assert.Len(t, *commands, 1)
+	})
+}
+
+func TestResizeToolPathsMissing(t *testing.T) {
+	paths := ResizeToolPaths{Resize2fsTool: "/opt/e2fs/resize2fs", XFSGrowfsTool: "/opt/xfs/xfs_growfs"}
+	fake := &fakeexec.FakeExec{LookPathFunc: func(file string) (string, error) {
+		if file == "/opt/xfs/xfs_growfs" {
+			return "", errors.New("executable file not found")
+		}
+		return file, nil
+	}}
+
+	assert.Equal(t, []string{"/opt/xfs/xfs_growfs"}, paths.Missing(fake))
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"sds-local-volume-csi/internal"
+)
+
+// GetThinPreallocate returns whether the storage class requests the thin volumes to be fully preallocated.
+func GetThinPreallocate(params map[string]string) (bool, error) {
+	val, ok := params[internal.ThinPreallocateKey]
+	if !ok || val == "" {
+		return false, nil
+	}
+
+	preallocate, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("invalid value %q of %s: %w", val, internal.ThinPreallocateKey, err)
+	}
+
+	return preallocate, nil
+}
+
+// ThinAllocationMode returns the allocation mode a new thin LV of the given size gets in the thin pool of the
+// LVMVolumeGroup. The preallocation is only honored if the thin pool has enough physical free space to back the
+// whole LV, otherwise the lazy mode is returned along with the reason of the fallback.
+func ThinAllocationMode(preallocate bool, lvg snc.LVMVolumeGroup, thinPoolName string, size resource.Quantity) (string, string) {
+	if !preallocate {
+		return internal.ThinAllocationLazy, ""
+	}
+
+	tp, err := getLVMThinPoolStatus(lvg, thinPoolName)
+	if err != nil {
+		return internal.ThinAllocationLazy, err.Error()
+	}
+
+	free := tp.ActualSize.DeepCopy()
+	free.Sub(tp.UsedSize)
+	if free.Cmp(size) < 0 {
+		return internal.ThinAllocationLazy, fmt.Sprintf("thin pool %s of LVMVolumeGroup %s has %s of physical free space, but %s is requested", thinPoolName, lvg.Name, free.String(), size.String())
+	}
+
+	return internal.ThinAllocationPreallocated, ""
+}
+
+// GetThinAllocation returns the allocation mode recorded on the thin LVMLogicalVolume or "" for a thick one.
+// The thin LVs created before the mode was recorded are lazily allocated.
+func GetThinAllocation(llv *snc.LVMLogicalVolume) string {
+	if llv.Spec.Type != internal.LVMTypeThin {
+		return ""
+	}
+
+	if mode := llv.Annotations[internal.ThinAllocationAnnotation]; mode != "" {
+		return mode
+	}
+	return internal.ThinAllocationLazy
+}
+
+// SetLLVThinAllocation records the allocation mode of the thin LVMLogicalVolume.
+func SetLLVThinAllocation(ctx context.Context, kc client.Client, llv *snc.LVMLogicalVolume, mode string) error {
+	if llv.Annotations[internal.ThinAllocationAnnotation] == mode {
+		return nil
+	}
+
+	patch := client.MergeFrom(llv.DeepCopy())
+	if llv.Annotations == nil {
+		llv.Annotations = make(map[string]string, 1)
+	}
+	llv.Annotations[internal.ThinAllocationAnnotation] = mode
+
+	return kc.Patch(ctx, llv, patch)
+}
@@ -16,11 +16,33 @@ limitations under the License.
 
 package utils
 
+// VolumeGroup is an entry of the storage class LVMVolumeGroups parameter.
 type VolumeGroup struct {
 	Name string `yaml:"name"`
-	Thin struct {
-		PoolName string `yaml:"poolName"`
-	} `yaml:"thin"`
+	// Thin is nil for the thick volume groups.
+	Thin *VolumeGroupThin `yaml:"thin"`
+	// BytesPerInode overrides the storage class bytes-per-inode ratio of the inode-based node selection.
+	BytesPerInode string `yaml:"bytesPerInode,omitempty"`
+}
+
+type VolumeGroupThin struct {
+	PoolName string `yaml:"poolName"`
+}
+
+// ThinPoolName returns the thin pool name of the entry or an empty string if the entry has no thin spec.
+func (v VolumeGroup) ThinPoolName() string {
+	if v.Thin == nil {
+		return ""
+	}
+
+	return v.Thin.PoolName
 }
 
 type LVMVolumeGroups []VolumeGroup
+
+// LVMVolumeGroupsWithDefaults is the form of the storage class LVMVolumeGroups parameter
+// setting the thin pool of all the entries not specifying their own.
+type LVMVolumeGroupsWithDefaults struct {
+	DefaultThinPoolName string          `yaml:"defaultThinPoolName"`
+	VolumeGroups        LVMVolumeGroups `yaml:"volumeGroups"`
+}
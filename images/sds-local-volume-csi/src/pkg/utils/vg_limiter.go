@@ -0,0 +1,78 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// DefaultVGConcurrency is the default number of concurrent LV operations on the same VG.
+const DefaultVGConcurrency = 1
+
+// DefaultVGSlotHoldTimeout is the default time a creation holds the slot of the VG waiting for the node agent
+// to pick the LVMLogicalVolume up, so an LVMLogicalVolume stuck in Pending does not block the VG.
+const DefaultVGSlotHoldTimeout = time.Minute
+
+// VGLimiter bounds the number of concurrent LV operations per VG, so the LVM commands run by the node agent
+// do not contend on the VG metadata lock. The operations on different VGs are not limited.
+// A nil VGLimiter does not limit anything.
+type VGLimiter struct {
+	mu    sync.Mutex // protects slots
+	limit int64
+	slots map[string]*semaphore.Weighted
+}
+
+// NewVGLimiter returns a VGLimiter allowing limit concurrent operations per VG. A zero limit returns nil.
+func NewVGLimiter(limit int) *VGLimiter {
+	if limit <= 0 {
+		return nil
+	}
+
+	return &VGLimiter{
+		limit: int64(limit),
+		slots: make(map[string]*semaphore.Weighted),
+	}
+}
+
+// Acquire waits for a free slot of the VG identified by the key, e.g. the LVMVolumeGroup name.
+// The returned release func must be called once the operation is done.
+func (l *VGLimiter) Acquire(ctx context.Context, key string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	sem, ok := l.slots[key]
+	if !ok {
+		sem = semaphore.NewWeighted(l.limit)
+		l.slots[key] = sem
+	}
+	l.mu.Unlock()
+
+	if err := sem.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { sem.Release(1) })
+	}, nil
+}
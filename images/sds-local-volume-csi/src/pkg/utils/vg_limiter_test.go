@@ -0,0 +1,85 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVGLimiter(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("same_vg_is_limited", func(t *testing.T) {
+		l := NewVGLimiter(1)
+		release, err := l.Acquire(ctx, "lvg-1")
+		require.NoError(t, err)
+
+		waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		_, err = l.Acquire(waitCtx, "lvg-1")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		release()
+		release()
+		second, err := l.Acquire(ctx, "lvg-1")
+		require.NoError(t, err)
+		second()
+	})
+
+	t.Run("different_vgs_are_not_limited", func(t *testing.T) {
+		l := NewVGLimiter(1)
+		first, err := l.Acquire(ctx, "lvg-1")
+		require.NoError(t, err)
+		defer first()
+
+		waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		second, err := l.Acquire(waitCtx, "lvg-2")
+		require.NoError(t, err)
+		second()
+	})
+
+	t.Run("limit_above_one", func(t *testing.T) {
+		l := NewVGLimiter(2)
+		first, err := l.Acquire(ctx, "lvg-1")
+		require.NoError(t, err)
+		second, err := l.Acquire(ctx, "lvg-1")
+		require.NoError(t, err)
+
+		waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		_, err = l.Acquire(waitCtx, "lvg-1")
+		assert.Error(t, err)
+
+		first()
+		second()
+	})
+
+	t.Run("zero_limit_disables_limiter", func(t *testing.T) {
+		l := NewVGLimiter(0)
+		assert.Nil(t, l)
+
+		release, err := l.Acquire(ctx, "lvg-1")
+		require.NoError(t, err)
+		release()
+	})
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"sds-local-volume-csi/internal"
+)
+
+const (
+	// MinVolumeSizePolicyRoundUp rounds the requests below the minimum volume size up to it.
+	MinVolumeSizePolicyRoundUp = "round-up"
+	// MinVolumeSizePolicyReject rejects the requests below the minimum volume size.
+	MinVolumeSizePolicyReject = "reject"
+)
+
+// DefaultExtentSize is the default LVM physical extent size. LVM rounds the LV sizes up to a multiple of it.
+var DefaultExtentSize = resource.MustParse("4Mi")
+
+// DefaultMinVolumeSize is large enough to create an ext4 filesystem on and is a multiple of the default 4Mi extent size.
+var DefaultMinVolumeSize = resource.MustParse("32Mi")
+
+var (
+	ErrBelowMinVolumeSize = errors.New("requested size is below the minimum volume size")
+	ErrAboveLimitBytes    = errors.New("minimum volume size is above the limit bytes")
+	ErrAboveMaxVolumeSize = errors.New("volume size is above the maximum volume size")
+	ErrDeviceSizeMismatch = errors.New("device size does not match the volume size")
+)
+
+// ValidateMinVolumeSizePolicy checks the policy is one of the supported values.
+func ValidateMinVolumeSizePolicy(policy string) error {
+	switch policy {
+	case MinVolumeSizePolicyRoundUp, MinVolumeSizePolicyReject:
+		return nil
+	default:
+		return fmt.Errorf("unsupported minimum volume size policy %q, expected %q or %q", policy, MinVolumeSizePolicyRoundUp, MinVolumeSizePolicyReject)
+	}
+}
+
+// ApplyMinVolumeSize returns the size to provision for the requested one. The zero size is returned as is,
+// as it means the size is taken from the volume source. A non-zero size below the floor is rounded up
+// to the floor or rejected according to the policy. Rounding up never exceeds the non-zero limit.
+func ApplyMinVolumeSize(size, limit, floor int64, policy string) (int64, error) {
+	if size == 0 || size >= floor {
+		return size, nil
+	}
+
+	if policy == MinVolumeSizePolicyReject {
+		return 0, fmt.Errorf("%w: %s < %s", ErrBelowMinVolumeSize, resource.NewQuantity(size, resource.BinarySI), resource.NewQuantity(floor, resource.BinarySI))
+	}
+
+	if limit > 0 && floor > limit {
+		return 0, fmt.Errorf("%w: %s > %s", ErrAboveLimitBytes, resource.NewQuantity(floor, resource.BinarySI), resource.NewQuantity(limit, resource.BinarySI))
+	}
+
+	return floor, nil
+}
+
+// GetMaxVolumeSize returns the maximum volume size in bytes set by the storage class or the LVMLogicalVolume annotation
+// under the key. Zero means no cap.
+func GetMaxVolumeSize(values map[string]string, key string) (int64, error) {
+	val, ok := values[key]
+	if !ok || val == "" {
+		return 0, nil
+	}
+
+	size, err := resource.ParseQuantity(val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q of %s: %w", val, key, err)
+	}
+	if size.Sign() <= 0 {
+		return 0, fmt.Errorf("invalid value %q of %s: must be positive", val, key)
+	}
+
+	return size.Value(), nil
+}
+
+// CheckMaxVolumeSize returns ErrAboveMaxVolumeSize if the extent aligned size exceeds the non-zero cap.
+func CheckMaxVolumeSize(size, maxSize int64) error {
+	if maxSize > 0 && size > maxSize {
+		return fmt.Errorf("%w: %s > %s", ErrAboveMaxVolumeSize, resource.NewQuantity(size, resource.BinarySI), resource.NewQuantity(maxSize, resource.BinarySI))
+	}
+
+	return nil
+}
+
+// GetExpectedDeviceSize returns the provisioned size of the volume in bytes recorded in the volume context.
+// Zero is returned for the volumes provisioned before the size was recorded.
+func GetExpectedDeviceSize(volumeContext map[string]string) (int64, error) {
+	val, ok := volumeContext[internal.VolumeSizeKey]
+	if !ok || val == "" {
+		return 0, nil
+	}
+
+	size, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q of %s: %w", val, internal.VolumeSizeKey, err)
+	}
+	if size < 0 {
+		return 0, fmt.Errorf("invalid value %q of %s: must not be negative", val, internal.VolumeSizeKey)
+	}
+
+	return size, nil
+}
+
+// CheckDeviceSize returns ErrDeviceSizeMismatch if the device reports zero size or a size smaller than
+// the non-zero expected one by more than the tolerance. The device of an expanded volume is larger
+// than the provisioned size, so only the shortage is checked.
+func CheckDeviceSize(deviceSize, expectedSize, tolerance int64) error {
+	if deviceSize <= 0 {
+		return fmt.Errorf("%w: the device reports zero size", ErrDeviceSizeMismatch)
+	}
+
+	if expectedSize > 0 && deviceSize+tolerance < expectedSize {
+		return fmt.Errorf("%w: the device reports %s, the volume is provisioned with %s", ErrDeviceSizeMismatch,
+			resource.NewQuantity(deviceSize, resource.BinarySI), resource.NewQuantity(expectedSize, resource.BinarySI))
+	}
+
+	return nil
+}
+
+// CapacityBytesToQuantity converts the bytes of a CSI capacity range to the size of an LVMLogicalVolume.
+// It is the only place the conversion happens: the bytes are taken as is and rendered as a BinarySI
+// quantity, so the sizes that are not a multiple of 1Ki are rendered in bytes rather than in decimal units.
+func CapacityBytesToQuantity(bytes int64) *resource.Quantity {
+	return resource.NewQuantity(bytes, resource.BinarySI)
+}
+
+// AlignVolumeSize rounds the size up to a multiple of the alignment. The size is returned as is
+// if the alignment is not positive.
+func AlignVolumeSize(size, alignment int64) int64 {
+	if alignment <= 0 || size%alignment == 0 {
+		return size
+	}
+
+	return (size/alignment + 1) * alignment
+}
+
+// FSOverheadBytes returns how much of a device of the size the filesystem keeps out of the total reported by statfs,
+// so the filesystem grown to the size may report that much less. The ext4 inode tables take 1/64 of the device
+// with the default 16KiB per inode of 256 bytes, and 2% leaves room for the bitmaps and the group descriptors; its
+// journal is sized by mke2fs. The xfs internal log is sized in proportion to the device, and 1% leaves room for
+// the allocation group headers. The other filesystems are allowed 10% of the size.
+func FSOverheadBytes(fsType string, size int64) int64 {
+	switch fsType {
+	case internal.FSTypeExt4:
+		return size/50 + ext4JournalSize(size)
+	case internal.FSTypeXfs:
+		return size/100 + xfsLogSize(size)
+	default:
+		return size / 100 * 10
+	}
+}
+
+// ext4JournalSize returns the default journal size mke2fs picks for a filesystem of the size. The journal is not
+// grown with the filesystem, so the journal of the grown size is the largest one it may have.
+func ext4JournalSize(size int64) int64 {
+	const mi = 1 << 20
+	switch {
+	case size < 8*mi:
+		return 0
+	case size < 128*mi:
+		return 4 * mi
+	case size < 1<<30:
+		return 16 * mi
+	case size < 2<<30:
+		return 32 * mi
+	case size < 16<<30:
+		return 64 * mi
+	case size < 32<<30:
+		return 128 * mi
+	case size < 64<<30:
+		return 256 * mi
+	case size < 128<<30:
+		return 512 * mi
+	default:
+		return 1 << 30
+	}
+}
+
+// xfsLogSize returns the largest default internal log mkfs.xfs creates for a filesystem of the size:
+// 1/2048 of the size, at least 64MiB and at most 2GiB.
+func xfsLogSize(size int64) int64 {
+	return min(max(size/2048, 64<<20), 2<<30)
+}
+
+// NodeLVGCapacity returns the total size of the LVMVolumeGroups located on the node.
+// The sum saturates at math.MaxInt64 instead of overflowing.
+func NodeLVGCapacity(lvgs []snc.LVMVolumeGroup, nodeName string) int64 {
+	var capacity int64
+	for _, lvg := range lvgs {
+		if lvg.Spec.Local.NodeName == nodeName {
+			size := lvg.Status.VGSize.Value()
+			if size > math.MaxInt64-capacity {
+				return math.MaxInt64
+			}
+			capacity += size
+		}
+	}
+
+	return capacity
+}
+
+// MaxVolumesForCapacity returns the number of volumes of the average size fitting the capacity,
+// clamped to the positive ceiling. At least one volume is returned, as zero means no limit in CSI.
+func MaxVolumesForCapacity(capacity, averageSize, ceiling int64) int64 {
+	limit := max(capacity/averageSize, 1)
+	if ceiling > 0 {
+		limit = min(limit, ceiling)
+	}
+
+	return limit
+}
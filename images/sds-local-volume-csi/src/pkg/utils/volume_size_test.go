@@ -0,0 +1,123 @@
+/*
+Copyright 2024 Flant JSC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"sds-local-volume-csi/internal"
+)
+
+func TestAlignVolumeSize(t *testing.T) {
+	const extent = 4 << 20
+
+	for _, tc := range []struct {
+		name      string
+		size      int64
+		alignment int64
+		expected  int64
+	}{
+		{name: "aligned_size", size: 1 << 30, alignment: extent, expected: 1 << 30},
+		{name: "partial_extent", size: 1<<30 + 1, alignment: extent, expected: 1<<30 + extent},
+		{name: "below_one_extent", size: 1 << 20, alignment: extent, expected: extent},
+		{name: "zero_size", size: 0, alignment: extent, expected: 0},
+		{name: "no_alignment", size: 1<<30 + 1, alignment: 0, expected: 1<<30 + 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, AlignVolumeSize(tc.size, tc.alignment))
+		})
+	}
+}
+
+func TestFSOverheadBytes(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		fsType   string
+		size     int64
+		expected int64
+	}{
+		{name: "ext4_small_journal", fsType: internal.FSTypeExt4, size: 2 << 30, expected: (2<<30)/50 + 64<<20},
+		{name: "ext4_largest_journal", fsType: internal.FSTypeExt4, size: 1 << 40, expected: (1<<40)/50 + 1<<30},
+		{name: "xfs_smallest_log", fsType: internal.FSTypeXfs, size: 1 << 30, expected: (1<<30)/100 + 64<<20},
+		{name: "xfs_proportional_log", fsType: internal.FSTypeXfs, size: 1 << 40, expected: (1<<40)/100 + 512<<20},
+		{name: "xfs_largest_log", fsType: internal.FSTypeXfs, size: 16 << 40, expected: (16<<40)/100 + 2<<30},
+		{name: "unknown_filesystem", fsType: "", size: 1 << 30, expected: (1 << 30) / 100 * 10},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, FSOverheadBytes(tc.fsType, tc.size))
+		})
+	}
+}
+
+func TestCapacityBytesToQuantity(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		bytes    int64
+		expected string
+	}{
+		{name: "exactly_1gi", bytes: 1 << 30, expected: "1Gi"},
+		{name: "exactly_1g", bytes: 1000 * 1000 * 1000, expected: "1000000000"},
+		{name: "odd_bytes_above_1gi", bytes: 1<<30 + 1, expected: "1073741825"},
+		{name: "odd_bytes_above_1g", bytes: 1000*1000*1000 + 1, expected: "1000000001"},
+		{name: "one_extent", bytes: 4 << 20, expected: "4Mi"},
+		{name: "below_1ki", bytes: 1023, expected: "1023"},
+		{name: "zero", bytes: 0, expected: "0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := CapacityBytesToQuantity(tc.bytes)
+			assert.Equal(t, tc.expected, q.String())
+			assert.Equal(t, tc.bytes, q.Value())
+
+			parsed, err := resource.ParseQuantity(q.String())
+			require.NoError(t, err)
+			assert.Equal(t, tc.bytes, parsed.Value())
+		})
+	}
+}
+
+func TestCheckDeviceSize(t *testing.T) {
+	const tolerance = 32 << 20
+
+	tests := []struct {
+		name         string
+		deviceSize   int64
+		expectedSize int64
+		err          bool
+	}{
+		{name: "zero_size_device", deviceSize: 0, expectedSize: 1 << 30, err: true},
+		{name: "zero_size_device_without_expected_size", deviceSize: 0, err: true},
+		{name: "matching_size", deviceSize: 1 << 30, expectedSize: 1 << 30},
+		{name: "expanded_device", deviceSize: 2 << 30, expectedSize: 1 << 30},
+		{name: "shortage_within_tolerance", deviceSize: 1<<30 - tolerance, expectedSize: 1 << 30},
+		{name: "implausibly_small_device", deviceSize: 4 << 20, expectedSize: 1 << 30, err: true},
+		{name: "unknown_expected_size", deviceSize: 4 << 20},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := CheckDeviceSize(tc.deviceSize, tc.expectedSize, tolerance)
+			if tc.err {
+				assert.ErrorIs(t, err, ErrDeviceSizeMismatch)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -392,6 +392,7 @@ func filterNodes(
 	thickMapMtx := &sync.RWMutex{}
 	thinMapMtx := &sync.RWMutex{}
 	failedNodesMapMtx := &sync.Mutex{}
+	nodeNamesMtx := &sync.Mutex{}
 
 	wg := &sync.WaitGroup{}
 	wg.Add(len(*nodeNames))
@@ -427,7 +428,7 @@ func filterNodes(
 				// we get the specific LVG which the PVC can use on the node as we support only one specified LVG in the Storage Class on each node
 				commonLVG := findMatchedLVG(lvgsFromNode, lvgsFromSC)
 				if commonLVG == nil {
-					err = fmt.Errorf("unable to match Storage Class's LVMVolumeGroup with the node's one, Storage Class: %s, node: %s", *pvc.Spec.StorageClassName, nodeName)
+					err := fmt.Errorf("unable to match Storage Class's LVMVolumeGroup with the node's one, Storage Class: %s, node: %s", *pvc.Spec.StorageClassName, nodeName)
 					errs <- err
 					return
 				}
@@ -455,7 +456,7 @@ func filterNodes(
 					// we try to find specific ThinPool which the PVC can use in the LVMVolumeGroup
 					targetThinPool := findMatchedThinPool(lvg.Status.ThinPools, commonLVG.Thin.PoolName)
 					if targetThinPool == nil {
-						err = fmt.Errorf("unable to match Storage Class's ThinPools with the node's one, Storage Class: %s; node: %s; lvg Thin pools: %+v; Thin.poolName from StorageClass: %s", *pvc.Spec.StorageClassName, nodeName, lvg.Status.ThinPools, commonLVG.Thin.PoolName)
+						err := fmt.Errorf("unable to match Storage Class's ThinPools with the node's one, Storage Class: %s; node: %s; lvg Thin pools: %+v; Thin.poolName from StorageClass: %s", *pvc.Spec.StorageClassName, nodeName, lvg.Status.ThinPools, commonLVG.Thin.PoolName)
 						errs <- err
 						return
 					}
@@ -489,17 +490,18 @@ func filterNodes(
 				return
 			}
 
+			nodeNamesMtx.Lock()
 			*result.NodeNames = append(*result.NodeNames, nodeName)
+			nodeNamesMtx.Unlock()
 		}(i, nodeName)
 	}
 	wg.Wait()
 	log.Debug("[filterNodes] goroutines work is done")
-	if len(errs) != 0 {
-		for err = range errs {
-			log.Error(err, "[filterNodes] an error occurs while filtering the nodes")
-		}
-	}
 	close(errs)
+	for e := range errs {
+		err = e
+		log.Error(err, "[filterNodes] an error occurs while filtering the nodes")
+	}
 	if err != nil {
 		log.Error(err, fmt.Sprintf("[filterNodes] unable to filter nodes for the Pod %s/%s, last error: %s", pod.Namespace, pod.Name, err.Error()))
 		return nil, err
@@ -647,11 +649,28 @@ type LVMVolumeGroup struct {
 }
 type LVMVolumeGroups []LVMVolumeGroup
 
+// LVMVolumeGroupsWithDefaults is the form of the LVMVolumeGroups parameter setting the thin pool
+// of all the entries not specifying their own.
+type LVMVolumeGroupsWithDefaults struct {
+	DefaultThinPoolName string          `json:"defaultThinPoolName"`
+	VolumeGroups        LVMVolumeGroups `json:"volumeGroups"`
+}
+
 func ExtractLVGsFromSC(sc *v1.StorageClass) (LVMVolumeGroups, error) {
 	var lvmVolumeGroups LVMVolumeGroups
 	err := yaml.Unmarshal([]byte(sc.Parameters[consts.LVMVolumeGroupsParamKey]), &lvmVolumeGroups)
 	if err != nil {
-		return nil, err
+		var withDefaults LVMVolumeGroupsWithDefaults
+		if objErr := yaml.UnmarshalStrict([]byte(sc.Parameters[consts.LVMVolumeGroupsParamKey]), &withDefaults); objErr != nil {
+			return nil, err
+		}
+
+		lvmVolumeGroups = withDefaults.VolumeGroups
+		for i := range lvmVolumeGroups {
+			if lvmVolumeGroups[i].Thin.PoolName == "" {
+				lvmVolumeGroups[i].Thin.PoolName = withDefaults.DefaultThinPoolName
+			}
+		}
 	}
 	return lvmVolumeGroups, nil
 }
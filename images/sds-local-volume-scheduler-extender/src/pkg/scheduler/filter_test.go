@@ -3,11 +3,15 @@ package scheduler
 import (
 	"testing"
 
+	snc "github.com/deckhouse/sds-node-configurator/api/v1alpha1"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	v1 "k8s.io/api/core/v1"
 	v12 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	"sds-local-volume-scheduler-extender/pkg/cache"
 	"sds-local-volume-scheduler-extender/pkg/consts"
 	"sds-local-volume-scheduler-extender/pkg/logger"
 )
@@ -76,3 +80,109 @@ func TestFilter(t *testing.T) {
 		}
 	})
 }
+
+func newTestSchedulerCache(t *testing.T, log logger.Logger) *cache.Cache {
+	t.Helper()
+	c := cache.NewCache(log, 0)
+	for _, n := range []struct {
+		node      string
+		thickFree string
+		thinFree  string
+	}{
+		{node: "node-1", thickFree: "10Gi", thinFree: "10Gi"},
+		{node: "node-2", thickFree: "3Gi", thinFree: "10Gi"},
+		{node: "node-3", thickFree: "10Gi", thinFree: "1Gi"},
+	} {
+		c.AddLVG(&snc.LVMVolumeGroup{
+			ObjectMeta: metav1.ObjectMeta{Name: "thick-" + n.node},
+			Status: snc.LVMVolumeGroupStatus{
+				Nodes:  []snc.LVMVolumeGroupNode{{Name: n.node}},
+				VGFree: resource.MustParse(n.thickFree),
+				VGSize: resource.MustParse("10Gi"),
+			},
+		})
+		c.AddLVG(&snc.LVMVolumeGroup{
+			ObjectMeta: metav1.ObjectMeta{Name: "thin-" + n.node},
+			Status: snc.LVMVolumeGroupStatus{
+				Nodes:     []snc.LVMVolumeGroupNode{{Name: n.node}},
+				VGSize:    resource.MustParse("10Gi"),
+				ThinPools: []snc.LVMVolumeGroupThinPoolStatus{{Name: "pool", AvailableSpace: resource.MustParse(n.thinFree)}},
+			},
+		})
+	}
+	return c
+}
+
+func newTestCapacityRequest() (map[string]*v1.PersistentVolumeClaim, map[string]*v12.StorageClass, map[string]PVCRequest) {
+	thick, thin := "thick", "thin"
+	scs := map[string]*v12.StorageClass{
+		thick: {
+			ObjectMeta:  metav1.ObjectMeta{Name: thick},
+			Provisioner: consts.SdsLocalVolumeProvisioner,
+			Parameters: map[string]string{
+				consts.LvmTypeParamKey:         consts.Thick,
+				consts.LVMVolumeGroupsParamKey: "- name: thick-node-1\n- name: thick-node-2\n- name: thick-node-3\n",
+			},
+		},
+		thin: {
+			ObjectMeta:  metav1.ObjectMeta{Name: thin},
+			Provisioner: consts.SdsLocalVolumeProvisioner,
+			Parameters: map[string]string{
+				consts.LvmTypeParamKey:         consts.Thin,
+				consts.LVMVolumeGroupsParamKey: "- name: thin-node-1\n  thin:\n    poolName: pool\n- name: thin-node-2\n  thin:\n    poolName: pool\n- name: thin-node-3\n  thin:\n    poolName: pool\n",
+			},
+		},
+	}
+	pvcs := map[string]*v1.PersistentVolumeClaim{
+		"data-1": {ObjectMeta: metav1.ObjectMeta{Name: "data-1"}, Spec: v1.PersistentVolumeClaimSpec{StorageClassName: &thick}},
+		"data-2": {ObjectMeta: metav1.ObjectMeta{Name: "data-2"}, Spec: v1.PersistentVolumeClaimSpec{StorageClassName: &thick}},
+		"cache":  {ObjectMeta: metav1.ObjectMeta{Name: "cache"}, Spec: v1.PersistentVolumeClaimSpec{StorageClassName: &thin}},
+	}
+	requests := map[string]PVCRequest{
+		"data-1": {DeviceType: consts.Thick, RequestedSize: 2 << 30},
+		"data-2": {DeviceType: consts.Thick, RequestedSize: 2 << 30},
+		"cache":  {DeviceType: consts.Thin, RequestedSize: 2 << 30},
+	}
+	return pvcs, scs, requests
+}
+
+func TestFilterNodesByCapacity(t *testing.T) {
+	log := logger.Logger{}
+	pvcs, scs, requests := newTestCapacityRequest()
+	nodeNames := []string{"node-1", "node-2", "node-3", "node-4"}
+
+	result, err := filterNodes(log, newTestSchedulerCache(t, log), &nodeNames, &v1.Pod{}, pvcs, scs, requests)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"node-1"}, *result.NodeNames)
+	assert.Equal(t, "not enough space", result.FailedNodes["node-2"])
+	assert.Equal(t, "not enough space", result.FailedNodes["node-3"])
+	assert.Contains(t, result.FailedNodes["node-4"], "is not common")
+}
+
+func TestExtractLVGsFromSC(t *testing.T) {
+	newSC := func(lvgs string) *v12.StorageClass {
+		return &v12.StorageClass{Parameters: map[string]string{consts.LVMVolumeGroupsParamKey: lvgs}}
+	}
+
+	t.Run("list_form", func(t *testing.T) {
+		lvgs, err := ExtractLVGsFromSC(newSC("- name: lvg-1\n  thin:\n    poolName: pool-1\n- name: lvg-2\n"))
+		require.NoError(t, err)
+		require.Len(t, lvgs, 2)
+		assert.Equal(t, "pool-1", lvgs[0].Thin.PoolName)
+		assert.Equal(t, "", lvgs[1].Thin.PoolName)
+	})
+
+	t.Run("default_thin_pool_form", func(t *testing.T) {
+		lvgs, err := ExtractLVGsFromSC(newSC("defaultThinPoolName: pool-1\nvolumeGroups:\n- name: lvg-1\n- name: lvg-2\n  thin:\n    poolName: pool-2\n"))
+		require.NoError(t, err)
+		require.Len(t, lvgs, 2)
+		assert.Equal(t, "pool-1", lvgs[0].Thin.PoolName)
+		assert.Equal(t, "pool-2", lvgs[1].Thin.PoolName)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		_, err := ExtractLVGsFromSC(newSC("name: lvg-1\n"))
+		assert.Error(t, err)
+	})
+}
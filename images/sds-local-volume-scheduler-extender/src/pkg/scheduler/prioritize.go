@@ -174,6 +174,7 @@ func scoreNodes(
 	}
 
 	result := make([]HostPriority, 0, len(*nodeNames))
+	resultMtx := &sync.Mutex{}
 	wg := &sync.WaitGroup{}
 	wg.Add(len(*nodeNames))
 	errs := make(chan error, len(pvcs)*len(*nodeNames))
@@ -193,7 +194,7 @@ func scoreNodes(
 				lvgsFromSC := scLVGs[*pvc.Spec.StorageClassName]
 				commonLVG := findMatchedLVG(lvgsFromNode, lvgsFromSC)
 				if commonLVG == nil {
-					err = fmt.Errorf("unable to match Storage Class's LVMVolumeGroup with the node's one, Storage Class: %s, node: %s", *pvc.Spec.StorageClassName, nodeName)
+					err := fmt.Errorf("unable to match Storage Class's LVMVolumeGroup with the node's one, Storage Class: %s, node: %s", *pvc.Spec.StorageClassName, nodeName)
 					errs <- err
 					return
 				}
@@ -217,7 +218,7 @@ func scoreNodes(
 				case consts.Thin:
 					thinPool := findMatchedThinPool(lvg.Status.ThinPools, commonLVG.Thin.PoolName)
 					if thinPool == nil {
-						err = fmt.Errorf("unable to match Storage Class's ThinPools with the node's one, Storage Class: %s, node: %s", *pvc.Spec.StorageClassName, nodeName)
+						err := fmt.Errorf("unable to match Storage Class's ThinPools with the node's one, Storage Class: %s, node: %s", *pvc.Spec.StorageClassName, nodeName)
 						log.Error(err, "[scoreNodes] an error occurs while searching for target LVMVolumeGroup")
 						errs <- err
 						return
@@ -235,20 +236,21 @@ func scoreNodes(
 			score := getNodeScore(averageFreeSpace, divisor)
 			log.Trace(fmt.Sprintf("[scoreNodes] node %s has score %d with average free space left (after all PVC bounded), percent %d", nodeName, score, averageFreeSpace))
 
+			resultMtx.Lock()
 			result = append(result, HostPriority{
 				Host:  nodeName,
 				Score: score,
 			})
+			resultMtx.Unlock()
 		}(i, nodeName)
 	}
 	wg.Wait()
 
-	if len(errs) != 0 {
-		for err = range errs {
-			log.Error(err, "[scoreNodes] an error occurs while scoring the nodes")
-		}
-	}
 	close(errs)
+	for e := range errs {
+		err = e
+		log.Error(err, "[scoreNodes] an error occurs while scoring the nodes")
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -4,7 +4,11 @@ import (
 	"math"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"k8s.io/apimachinery/pkg/api/resource"
+
+	"sds-local-volume-scheduler-extender/pkg/logger"
 )
 
 func TestPrioritize(t *testing.T) {
@@ -37,3 +41,19 @@ func TestPrioritize(t *testing.T) {
 		t.Logf("rawScore2=%d", rawScore2)
 	})
 }
+
+func TestScoreNodesByCapacity(t *testing.T) {
+	log := logger.Logger{}
+	pvcs, scs, requests := newTestCapacityRequest()
+	nodeNames := []string{"node-1", "node-2"}
+
+	result, err := scoreNodes(log, newTestSchedulerCache(t, log), &nodeNames, pvcs, scs, requests, 1)
+	require.NoError(t, err)
+	require.Len(t, result, 2)
+
+	scores := map[string]int{}
+	for _, p := range result {
+		scores[p.Host] = p.Score
+	}
+	assert.Greater(t, scores["node-1"], scores["node-2"])
+}
@@ -149,6 +149,12 @@ func LSCValidate(ctx context.Context, _ *model.AdmissionReview, obj metav1.Objec
 			nil
 	}
 
+	if err := lsc.Spec.LVM.ValidateLVMType(); err != nil {
+		errMsg = err.Error()
+		klog.Info(errMsg)
+		return &kwhvalidating.ValidatorResult{Valid: false, Message: errMsg}, nil
+	}
+
 	if thickExists && thinExists {
 		errMsg = "There must be only thin or thick pools simultaneously"
 		klog.Info(errMsg)